@@ -0,0 +1,118 @@
+/*
+Cosi is a command-line tool to check collective signatures. A signature is
+the toml-version of a cosi.CollectiveSignature and is checked against the
+group-file of the witnesses, as written by EntityList.Toml:
+
+	cosi verify -group group.toml -sig signature.toml
+
+If a file is given, the signature also has to be on the hash of that file:
+
+	cosi verify -group group.toml -sig signature.toml -file message.txt
+
+By default less than a third of the witnesses may be missing from the
+signature, -threshold gives the number of witnesses that have to sign
+instead:
+
+	cosi verify -group group.toml -sig signature.toml -threshold 2
+*/
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/BurntSushi/toml"
+	"github.com/dedis/cothority/lib/cosi"
+	"github.com/dedis/cothority/lib/dbg"
+	"github.com/dedis/cothority/lib/network"
+	"github.com/dedis/cothority/lib/sda"
+	"github.com/dedis/crypto/abstract"
+)
+
+var groupFile string
+var sigFile string
+var msgFile string
+var threshold int
+var debugVisible int
+
+func init() {
+	flag.StringVar(&groupFile, "group", "group.toml", "the group-file of the witnesses")
+	flag.StringVar(&sigFile, "sig", "signature.toml", "the file holding the signature")
+	flag.StringVar(&msgFile, "file", "", "the signed file, if any")
+	flag.IntVar(&threshold, "threshold", 0, "how many witnesses have to sign, 0 for all but less than a third")
+	flag.IntVar(&debugVisible, "debug", 1, "verbosity: 0-5")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: cosi verify [options]")
+		flag.PrintDefaults()
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] != "verify" {
+		flag.Usage()
+		os.Exit(1)
+	}
+	flag.CommandLine.Parse(os.Args[2:])
+	dbg.SetDebugVisible(debugVisible)
+	cs, err := verify(groupFile, sigFile, msgFile, threshold)
+	if err != nil {
+		dbg.Fatal("Invalid signature:", err)
+	}
+	dbg.Lvl1("Signature OK - signed by", cs.Participants(), "witnesses")
+}
+
+// verify reads the group and the signature and checks that the signature
+// is from at least threshold witnesses of the group, or all but less than
+// a third if threshold is 0. If msgFile is not empty, the hash of the file
+// has to be the hash in the signature.
+func verify(groupFile, sigFile, msgFile string, threshold int) (*cosi.CollectiveSignature, error) {
+	elt := &sda.EntityListToml{}
+	if _, err := toml.DecodeFile(groupFile, elt); err != nil {
+		return nil, err
+	}
+	// the group-file holds the suite of the keys
+	el, err := elt.EntityList(network.Suite)
+	if err != nil {
+		return nil, err
+	}
+	suite := el.Suite()
+	cst := &cosi.CollectiveSignatureToml{}
+	if _, err := toml.DecodeFile(sigFile, cst); err != nil {
+		return nil, err
+	}
+	cs, err := cst.CollectiveSignature(suite)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(cs.Roster, el.Id) {
+		return nil, errors.New("Signature is not from this group")
+	}
+	if msgFile != "" {
+		msg, err := ioutil.ReadFile(msgFile)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(cs.Hash, hashMessage(suite, msg)) {
+			return nil, errors.New("Signature is not on this file")
+		}
+	}
+	publics := make([]abstract.Point, len(el.List))
+	for i, e := range el.List {
+		publics[i] = e.Public
+	}
+	if threshold == 0 {
+		threshold = cosi.Threshold(len(publics))
+	}
+	return cs, cs.VerifyRoster(suite, el.Id, publics, threshold)
+}
+
+// hashMessage returns the hash of msg, which is what gets signed
+func hashMessage(suite abstract.Suite, msg []byte) []byte {
+	h := suite.Hash()
+	h.Write(msg)
+	return h.Sum(nil)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/dedis/cothority/lib/cosi"
+	"github.com/dedis/cothority/lib/dbg"
+	"github.com/dedis/cothority/lib/network"
+	"github.com/dedis/cothority/lib/sda"
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/config"
+)
+
+func TestVerify(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+	suite := network.Suite
+	dir, err := ioutil.TempDir("", "cosi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	msg := []byte("Hello World Cosi")
+	msgFile := path.Join(dir, "message.txt")
+	if err := ioutil.WriteFile(msgFile, msg, 0660); err != nil {
+		t.Fatal(err)
+	}
+	hash := hashMessage(suite, msg)
+
+	// one root and three children, of which the last ones may refuse
+	var entities []*network.Entity
+	var publics []abstract.Point
+	var secrets []abstract.Secret
+	for i := 0; i < 4; i++ {
+		kp := config.NewKeyPair(suite)
+		e := network.NewEntity(kp.Public, "localhost:2000")
+		if err := e.Prove(suite, kp.Secret); err != nil {
+			t.Fatal(err)
+		}
+		entities = append(entities, e)
+		publics = append(publics, kp.Public)
+		secrets = append(secrets, kp.Secret)
+	}
+	el, err := sda.NewEntityList(entities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupFile := path.Join(dir, "group.toml")
+	sigFile := path.Join(dir, "signature.toml")
+	writeToml(t, groupFile, el.Toml(suite))
+	// sign writes the signature of the witnesses that don't refuse
+	sign := func(refusing int) {
+		var cosis []*cosi.Cosi
+		var commitments []*cosi.Commitment
+		var exceptions []cosi.Exception
+		for i, secret := range secrets {
+			c := cosi.NewCosi(suite, secret)
+			cosis = append(cosis, c)
+			if i >= len(secrets)-refusing {
+				c.Refuse()
+				exceptions = append(exceptions, cosi.Exception{
+					Public:     publics[i],
+					Commitment: suite.Point().Null(),
+				})
+			}
+			if i > 0 {
+				commitments = append(commitments, c.CreateCommitment())
+			}
+		}
+		root := cosis[0]
+		root.Commit(commitments)
+		chal, err := root.CreateChallenge(el.Aggregate, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var responses []*cosi.Response
+		for _, c := range cosis[1:] {
+			c.Challenge(chal)
+			r, err := c.CreateResponse()
+			if err != nil {
+				t.Fatal(err)
+			}
+			responses = append(responses, r)
+		}
+		if _, err := root.Response(responses); err != nil {
+			t.Fatal(err)
+		}
+		cs, err := cosi.NewCollectiveSignature(suite, hash, el.Id, publics, root.Signature(), exceptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cst, err := cs.Toml(suite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeToml(t, sigFile, cst)
+	}
+
+	sign(1)
+	cs, err := verify(groupFile, sigFile, msgFile, 0)
+	if err != nil {
+		t.Fatal("Signature should verify:", err)
+	}
+	if cs.Participants() != 3 {
+		t.Fatal("Should have 3 participants, got", cs.Participants())
+	}
+	if _, err := verify(groupFile, sigFile, msgFile, 4); err == nil {
+		t.Fatal("Signature shouldn't verify if all witnesses have to sign")
+	}
+
+	// half of the witnesses are missing
+	sign(2)
+	if _, err := verify(groupFile, sigFile, msgFile, 0); err == nil {
+		t.Fatal("Signature shouldn't verify with too many missing witnesses")
+	}
+	if _, err := verify(groupFile, sigFile, msgFile, 2); err != nil {
+		t.Fatal("Signature should verify with a lower threshold:", err)
+	}
+
+	if err := ioutil.WriteFile(msgFile, []byte("Another message"), 0660); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verify(groupFile, sigFile, msgFile, 2); err == nil {
+		t.Fatal("Signature shouldn't verify on another file")
+	}
+	other, err := sda.NewEntityList(entities[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeToml(t, groupFile, other.Toml(suite))
+	if _, err := verify(groupFile, sigFile, "", 2); err == nil {
+		t.Fatal("Signature shouldn't verify with another group")
+	}
+}
+
+func writeToml(t *testing.T, file string, conf interface{}) {
+	buf := new(bytes.Buffer)
+	if err := toml.NewEncoder(buf).Encode(conf); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, buf.Bytes(), 0660); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -22,6 +22,9 @@ type Cosi struct {
 	timestamp int64
 	// random is our own secret that we wish to commit during the commitment phase.
 	random abstract.Secret
+	// precomputed is the secret given by SetRandom, used by the next
+	// commitment only
+	precomputed abstract.Secret
 	// commitment is our own commitment
 	commitment abstract.Point
 	// V_hat is the aggregated commit (our own + the children's)
@@ -32,6 +35,8 @@ type Cosi struct {
 	response abstract.Secret
 	// aggregateResponses is the aggregated response from the children + our own
 	aggregateResponse abstract.Secret
+	// refused is true if we don't sign but only aggregate the children
+	refused bool
 }
 
 // NewCosi returns a new Cosi struct given the suite + longterm secret.
@@ -53,6 +58,9 @@ type Commitment struct {
 
 type Challenge struct {
 	Challenge abstract.Secret
+	// AggregateCommitment is the commitment the challenge is computed
+	// from, so that every witness can check the challenge
+	AggregateCommitment abstract.Point
 }
 
 type Response struct {
@@ -70,7 +78,10 @@ type Signature struct {
 }
 
 // Exception is what a node that does not want to sign should include when
-// passing up a response
+// passing up its commitment. Only nodes that didn't commit can be
+// exceptions, so the Commitment is always the null point: nobody could
+// check the commitment of a node that fails afterwards, so such a node
+// needs a new challenge without it.
 type Exception struct {
 	Public     abstract.Point
 	Commitment abstract.Point
@@ -106,34 +117,59 @@ func (c *Cosi) Commit(comms []*Commitment) *Commitment {
 	c.genCommit()
 
 	// take the children commitment
-	child_v_hat := c.suite.Point().Null()
+	child_v_hat := AggregateCommitments(c.suite, comms)
+	// add our own commitment to the global V_hat
+	c.aggregateCommitment = c.suite.Point().Add(child_v_hat, c.commitment)
+	return &Commitment{
+		ChildrenCommit: child_v_hat,
+		Commitment:     c.commitment,
+	}
+
+}
+
+// AggregateCommitments returns the sum of the commitments and of the
+// commitments of their children.
+func AggregateCommitments(suite abstract.Suite, comms []*Commitment) abstract.Point {
+	agg := suite.Point().Null()
 	for _, com := range comms {
 		// Add commitment of one child
-		child_v_hat = child_v_hat.Add(child_v_hat, com.Commitment)
+		agg = agg.Add(agg, com.Commitment)
 		// add commitment of it's children if there is one (i.e. if it is not a
 		// leaf)
 		if com.ChildrenCommit != nil {
-			child_v_hat = child_v_hat.Add(child_v_hat, com.ChildrenCommit)
+			agg = agg.Add(agg, com.ChildrenCommit)
 		}
 	}
-	// add our own commitment to the global V_hat
-	c.aggregateCommitment = c.suite.Point().Add(child_v_hat, c.commitment)
-	return &Commitment{
-		ChildrenCommit: child_v_hat,
-		Commitment:     c.commitment,
-	}
+	return agg
+}
 
+// SetRandom makes this cosi use random, generated in advance, as its secret
+// for the next commitment instead of a fresh one. See Precommits.
+func (c *Cosi) SetRandom(random abstract.Secret) {
+	c.precomputed = random
 }
 
-// CreateChallenge creates the challenge out of the message it has been given.
-// This is typically called by Root.
-func (c *Cosi) CreateChallenge(msg []byte) (*Challenge, error) {
-	pb, err := c.aggregateCommitment.MarshalBinary()
-	cipher := c.suite.Cipher(pb)
-	cipher.Message(nil, nil, msg)
-	c.challenge = c.suite.Secret().Pick(cipher)
+// Refuse tells this cosi not to sign: its commitment and response are
+// neutral, so it only aggregates the commitments and responses of its
+// children. The caller has to pass up an Exception with its public key.
+func (c *Cosi) Refuse() {
+	c.refused = true
+}
+
+// Refused returns whether Refuse has been called on this cosi
+func (c *Cosi) Refused() bool {
+	return c.refused
+}
+
+// CreateChallenge creates the challenge out of the message it has been given
+// and the aggregate public key of all witnesses. This is typically called by
+// Root.
+func (c *Cosi) CreateChallenge(public abstract.Point, msg []byte) (*Challenge, error) {
+	var err error
+	c.challenge, err = ComputeChallenge(c.suite, c.aggregateCommitment, public, msg)
 	return &Challenge{
-		Challenge: c.challenge,
+		Challenge:           c.challenge,
+		AggregateCommitment: c.aggregateCommitment,
 	}, err
 }
 
@@ -143,6 +179,43 @@ func (c *Cosi) Challenge(ch *Challenge) *Challenge {
 	return ch
 }
 
+// VerifyChallenge checks that ch is the challenge of msg, the message this
+// witness validated, for the witnesses of the aggregate key public. A
+// witness must not respond to a challenge that doesn't verify.
+func VerifyChallenge(suite abstract.Suite, public abstract.Point, msg []byte, ch *Challenge) error {
+	if ch == nil || ch.Challenge == nil || ch.AggregateCommitment == nil {
+		return errors.New("Incomplete challenge")
+	}
+	challenge, err := ComputeChallenge(suite, ch.AggregateCommitment, public, msg)
+	if err != nil {
+		return err
+	}
+	if !challenge.Equal(ch.Challenge) {
+		return errors.New("Challenge is not the one of the message")
+	}
+	return nil
+}
+
+// ComputeChallenge returns the challenge H(commitment || public || msg). A
+// nil public is left out, which gives the challenge of a Schnorr signature
+// of lib/crypto.
+func ComputeChallenge(suite abstract.Suite, commitment, public abstract.Point, msg []byte) (abstract.Secret, error) {
+	pb, err := commitment.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	if public != nil {
+		xb, err := public.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		pb = append(pb, xb...)
+	}
+	cipher := suite.Cipher(pb)
+	cipher.Message(nil, nil, msg)
+	return suite.Secret().Pick(cipher), nil
+}
+
 // CreateResponse is called by a leaf to create its own response from the
 // challenge + commitment + private key. It returns the response to send up to
 // the tree.
@@ -207,13 +280,22 @@ func (c *Cosi) Signature() *Signature {
 // public key the tree is using.
 // Check that: base**r_hat * X_hat**c == V_hat
 func (c *Cosi) VerifyResponses(aggregatedPublic abstract.Point) error {
+	return c.VerifyResponsesWithException(aggregatedPublic, nil)
+}
+
+// VerifyResponsesWithException verifies the response like VerifyResponses,
+// but removes the public keys of the exceptions from the aggregated public
+// key.
+func (c *Cosi) VerifyResponsesWithException(aggregatedPublic abstract.Point, exceptions []Exception) error {
+	public, err := reduceExceptions(c.suite, aggregatedPublic, exceptions)
+	if err != nil {
+		return err
+	}
 	commitment := c.suite.Point()
-	commitment = commitment.Add(commitment.Mul(nil, c.aggregateResponse), c.suite.Point().Mul(aggregatedPublic, c.challenge))
+	commitment = commitment.Add(commitment.Mul(nil, c.aggregateResponse), c.suite.Point().Mul(public, c.challenge))
 	// T is the recreated V_hat
 	T := c.suite.Point().Null()
 	T = T.Add(T, commitment)
-	// TODO put that into exception mechanism later
-	// T.Add(T, cosi.ExceptionV_hat)
 	if !T.Equal(c.aggregateCommitment) {
 		return errors.New("recreated commitment is not equal to one given")
 	}
@@ -224,6 +306,18 @@ func (c *Cosi) VerifyResponses(aggregatedPublic abstract.Point) error {
 // genCommit generates a random secret vi and computes it's individual commit
 // Vi = G^vi
 func (c *Cosi) genCommit() {
+	if c.refused {
+		c.random = c.suite.Secret().Zero()
+		c.commitment = c.suite.Point().Null()
+		return
+	}
+	if c.precomputed != nil {
+		// given by SetRandom, it is used only once
+		c.random = c.precomputed
+		c.precomputed = nil
+		c.commitment = c.suite.Point().Mul(nil, c.random)
+		return
+	}
 	kp := config.NewKeyPair(c.suite)
 	c.random = kp.Secret
 	c.commitment = kp.Public
@@ -240,10 +334,18 @@ func (c *Cosi) genResponse() error {
 	if c.challenge == nil {
 		return errors.New("No challenge computed in this cosi")
 	}
+	if c.refused {
+		c.response = c.suite.Secret().Zero()
+		c.aggregateResponse = c.response
+		return nil
+	}
 	// resp = random - challenge * privatekey
 	// i.e. ri = vi - c * xi
 	resp := c.suite.Secret().Mul(c.private, c.challenge)
 	c.response = resp.Sub(c.random, resp)
+	// a second response with another challenge would reveal our private
+	// key, so the secret is gone once used
+	c.random = nil
 	// no aggregation here
 	c.aggregateResponse = c.response
 	return nil
@@ -256,19 +358,18 @@ func VerifySignature(suite abstract.Suite, msg []byte, public abstract.Point, ch
 	commitment := suite.Point()
 	commitment = commitment.Add(commitment.Mul(nil, secret), suite.Point().Mul(public, challenge))
 
-	return verifyCommitment(suite, msg, commitment, challenge)
+	return verifyCommitment(suite, public, msg, commitment, challenge)
 
 }
 
-func verifyCommitment(suite abstract.Suite, msg []byte, commitment abstract.Point, challenge abstract.Secret) error {
-	pb, err := commitment.MarshalBinary()
+// verifyCommitment checks that challenge is the one of the commitment, the
+// aggregate key public and msg.
+func verifyCommitment(suite abstract.Suite, public abstract.Point, msg []byte, commitment abstract.Point, challenge abstract.Secret) error {
+	// reconstructed challenge
+	reconstructed, err := ComputeChallenge(suite, commitment, public, msg)
 	if err != nil {
 		return err
 	}
-	cipher := suite.Cipher(pb)
-	cipher.Message(nil, nil, msg)
-	// reconstructed challenge
-	reconstructed := suite.Secret().Pick(cipher)
 	if !reconstructed.Equal(challenge) {
 		return errors.New("Reconstructed challenge not equal to one given")
 	}
@@ -276,27 +377,46 @@ func verifyCommitment(suite abstract.Suite, msg []byte, commitment abstract.Poin
 }
 
 // VerifySignatureWithException will verify the signature taking into account
-// the exceptions given. An exception is the pubilc key + commitment of a peer that did not
-// sign.
-// NOTE: No exception mechanism for "before" commitment has been yet coded.
+// the exceptions given. An exception is the public key of a peer that did
+// not commit. As any signature verifies if everybody is an exception, the
+// caller has to check that the exceptions are witnesses and not too many.
 func VerifySignatureWithException(suite abstract.Suite, public abstract.Point, msg []byte, challenge, secret abstract.Secret, exceptions []Exception) error {
 	// first reduce the aggregate public key
-	subPublic := suite.Point().Add(suite.Point().Null(), public)
-	aggExCommit := suite.Point().Null()
-	for _, ex := range exceptions {
-		subPublic = subPublic.Sub(subPublic, ex.Public)
-		aggExCommit = aggExCommit.Add(aggExCommit, ex.Commitment)
+	subPublic, err := reduceExceptions(suite, public, exceptions)
+	if err != nil {
+		return err
 	}
 
 	// recompute the challenge and check if it is the same
 	commitment := suite.Point()
-	commitment = commitment.Add(commitment.Mul(nil, secret), suite.Point().Mul(public, challenge))
-	// ADD the exceptions commitment here
-	commitment = commitment.Add(commitment, aggExCommit)
+	commitment = commitment.Add(commitment.Mul(nil, secret), suite.Point().Mul(subPublic, challenge))
 	// check if it is ok
-	return verifyCommitment(suite, msg, commitment, challenge)
+	return verifyCommitment(suite, public, msg, commitment, challenge)
 }
 
 func VerifyCosiSignatureWithException(suite abstract.Suite, public abstract.Point, msg []byte, signature *Signature, exceptions []Exception) error {
 	return VerifySignatureWithException(suite, public, msg, signature.Challenge, signature.Response, exceptions)
 }
+
+// reduceExceptions returns the aggregate public key without the public keys
+// of the exceptions. It refuses exceptions holding a commitment, which
+// could be chosen to make any signature verify, and exceptions given twice.
+func reduceExceptions(suite abstract.Suite, public abstract.Point, exceptions []Exception) (abstract.Point, error) {
+	subPublic := suite.Point().Add(suite.Point().Null(), public)
+	null := suite.Point().Null()
+	for i, ex := range exceptions {
+		if ex.Public == nil {
+			return nil, errors.New("Exception without public key")
+		}
+		if ex.Commitment != nil && !ex.Commitment.Equal(null) {
+			return nil, errors.New("Exception with a commitment")
+		}
+		for _, other := range exceptions[:i] {
+			if other.Public.Equal(ex.Public) {
+				return nil, errors.New("Exception given twice")
+			}
+		}
+		subPublic = subPublic.Sub(subPublic, ex.Public)
+	}
+	return subPublic, nil
+}
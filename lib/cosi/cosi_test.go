@@ -2,8 +2,10 @@ package cosi
 
 import (
 	"fmt"
+	"github.com/dedis/crypto/abstract"
 	"github.com/dedis/crypto/config"
 	"github.com/dedis/crypto/edwards"
+	"github.com/dedis/crypto/random"
 	"testing"
 )
 
@@ -32,7 +34,8 @@ func TestCosiCommitment(t *testing.T) {
 func TestCosiChallenge(t *testing.T) {
 	root, children := genPostCommitmentPhaseCosi(5)
 	msg := []byte("Hello World Cosi\n")
-	chal, err := root.CreateChallenge(msg)
+	aggPublic := aggregatePublic(append(children, root)...)
+	chal, err := root.CreateChallenge(aggPublic, msg)
 	if err != nil {
 		t.Fatal("Error during challenge generation")
 	}
@@ -42,6 +45,15 @@ func TestCosiChallenge(t *testing.T) {
 			t.Fatal("Error during challenge on children")
 		}
 	}
+	if err := VerifyChallenge(testSuite, aggPublic, msg, chal); err != nil {
+		t.Fatal("Challenge should verify:", err)
+	}
+	if VerifyChallenge(testSuite, aggPublic, []byte("Other message"), chal) == nil {
+		t.Fatal("Challenge of another message shouldn't verify")
+	}
+	if VerifyChallenge(testSuite, aggregatePublic(children...), msg, chal) == nil {
+		t.Fatal("Challenge for other witnesses shouldn't verify")
+	}
 }
 
 // TestCosiResponse will test wether the response generation is correct or not
@@ -102,14 +114,11 @@ func TestCosiVerifyResponse(t *testing.T) {
 	T := testSuite.Point().Null()
 	T = T.Add(T, commitment)
 
-	pb, err := T.MarshalBinary()
+	// reconstructed challenge
+	challenge, err := ComputeChallenge(testSuite, T, aggregatedPublic, msg)
 	if err != nil {
 		t.Fatal(err)
 	}
-	cipher := testSuite.Cipher(pb)
-	cipher.Message(nil, nil, msg)
-	// reconstructed challenge
-	challenge := testSuite.Secret().Pick(cipher)
 
 	if !challenge.Equal(root.challenge) {
 		t.Fatal("Root challenge != challenge recomputed")
@@ -122,6 +131,266 @@ func TestCosiVerifyResponse(t *testing.T) {
 	}
 }
 
+// TestCosiException checks the signature when one child refuses to sign
+// and another one fails after the commitment, which needs a new challenge
+// without it.
+func TestCosiException(t *testing.T) {
+	msg := []byte("Hello World Cosi")
+	cosis := genCosis(5)
+	cosis[0].Refuse()
+	root := genCosi()
+	aggregatedPublic := aggregatePublic(append(cosis, root)...)
+	publics := make([]abstract.Point, len(cosis))
+	for i, c := range cosis {
+		publics[i] = testSuite.Point().Mul(nil, c.private)
+	}
+	exceptions := []Exception{
+		{Public: publics[0], Commitment: testSuite.Point().Null()},
+	}
+
+	// cosis[1] fails after the commitment
+	sign := func(children []*Cosi) {
+		root.Commit(genCommitments(children))
+		chal, err := root.CreateChallenge(aggregatedPublic, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var responses []*Response
+		for _, c := range children {
+			if c == cosis[1] {
+				continue
+			}
+			c.Challenge(chal)
+			r, err := c.CreateResponse()
+			if err != nil {
+				t.Fatal(err)
+			}
+			responses = append(responses, r)
+		}
+		if _, err := root.Response(responses); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sign(cosis)
+	failed := append(exceptions, Exception{
+		Public:     publics[1],
+		Commitment: cosis[1].GetCommitment(),
+	})
+	if err := root.VerifyResponses(aggregatedPublic); err == nil {
+		t.Fatal("Responses shouldn't verify without exceptions")
+	}
+	if root.VerifyResponsesWithException(aggregatedPublic, failed) == nil {
+		t.Fatal("Responses shouldn't verify with the commitment of an exception")
+	}
+	if VerifyCosiSignatureWithException(testSuite, aggregatedPublic, msg, root.Signature(), failed) == nil {
+		t.Fatal("Signature shouldn't verify with the commitment of an exception")
+	}
+
+	// a new challenge without cosis[1]
+	exceptions = append(exceptions, Exception{
+		Public:     publics[1],
+		Commitment: testSuite.Point().Null(),
+	})
+	sign(append([]*Cosi{cosis[0]}, cosis[2:]...))
+	if err := root.VerifyResponsesWithException(aggregatedPublic, exceptions); err != nil {
+		t.Fatal("Responses should verify with exceptions:", err)
+	}
+	if err := VerifyCosiSignatureWithException(testSuite, aggregatedPublic, msg, root.Signature(), exceptions); err != nil {
+		t.Fatal("Signature should verify with exceptions:", err)
+	}
+	if err := VerifyCosiSignatureWithException(testSuite, aggregatedPublic, msg, root.Signature(), exceptions[:1]); err == nil {
+		t.Fatal("Signature shouldn't verify with missing exception")
+	}
+	if VerifyCosiSignatureWithException(testSuite, aggregatedPublic, msg, root.Signature(),
+		append(exceptions, exceptions[0])) == nil {
+		t.Fatal("Signature shouldn't verify with an exception given twice")
+	}
+}
+
+// TestForgedException checks that nobody can sign by choosing the
+// commitment of an exception.
+func TestForgedException(t *testing.T) {
+	msg := []byte("Hello World Cosi")
+	cosis := genCosis(4)
+	aggregatedPublic := aggregatePublic(cosis...)
+	public := testSuite.Point().Mul(nil, cosis[0].private)
+	sig, exceptions, err := forgeSignature(aggregatedPublic, msg, public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if VerifyCosiSignatureWithException(testSuite, aggregatedPublic, msg, sig, exceptions) == nil {
+		t.Fatal("Forged signature shouldn't verify")
+	}
+}
+
+// forgeSignature returns a signature of msg without any private key, that
+// verifies if the commitment of the exception for public is added to the
+// commitment of the signature.
+func forgeSignature(aggregate abstract.Point, msg []byte, public abstract.Point) (*Signature, []Exception, error) {
+	response := testSuite.Secret().Pick(random.Stream)
+	commitment, _ := testSuite.Point().Pick(nil, random.Stream)
+	challenge, err := ComputeChallenge(testSuite, commitment, aggregate, msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	// commitment = base**response + (aggregate - public)**challenge + exCommit
+	subPublic := testSuite.Point().Sub(aggregate, public)
+	exCommit := testSuite.Point().Sub(commitment, testSuite.Point().Mul(nil, response))
+	exCommit.Sub(exCommit, testSuite.Point().Mul(subPublic, challenge))
+	return &Signature{Challenge: challenge, Response: response},
+		[]Exception{{Public: public, Commitment: exCommit}}, nil
+}
+
+// TestCollectiveSignature checks the self-describing signature with one
+// refusing and one missing witness, also after a round-trip through toml.
+func TestCollectiveSignature(t *testing.T) {
+	msg := []byte("Hello World Cosi")
+	cosis := genCosis(4)
+	cosis[1].Refuse()
+	root := cosis[0]
+	root.Commit(genCommitments([]*Cosi{cosis[1], cosis[3]}))
+	chal, err := root.CreateChallenge(aggregatePublic(cosis...), msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var publics []abstract.Point
+	var responses []*Response
+	for i, c := range cosis {
+		publics = append(publics, testSuite.Point().Mul(nil, c.private))
+		if i == 0 || i == 2 {
+			continue
+		}
+		c.Challenge(chal)
+		r, err := c.CreateResponse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		responses = append(responses, r)
+	}
+	if _, err := root.Response(responses); err != nil {
+		t.Fatal(err)
+	}
+	exceptions := []Exception{
+		{Public: publics[1], Commitment: testSuite.Point().Null()},
+		{Public: publics[2], Commitment: testSuite.Point().Null()},
+	}
+	cs, err := NewCollectiveSignature(testSuite, msg, []byte("roster"), publics,
+		root.Signature(), exceptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an exception with a commitment can't be verified
+	committed := []Exception{exceptions[0], {Public: publics[2], Commitment: cosis[2].CreateCommitment().Commitment}}
+	if _, err := NewCollectiveSignature(testSuite, msg, []byte("roster"), publics,
+		root.Signature(), committed); err == nil {
+		t.Fatal("Exception with a commitment should fail")
+	}
+	if cs.Participants() != 2 || !cs.Participated(0) || cs.Participated(2) {
+		t.Fatal("Wrong participation mask", cs.Mask)
+	}
+	if err := cs.Verify(testSuite, publics); err != nil {
+		t.Fatal("Signature should verify:", err)
+	}
+	if err := cs.VerifyRoster(testSuite, []byte("roster"), publics, 2); err != nil {
+		t.Fatal("Signature should verify with the roster:", err)
+	}
+	if cs.VerifyRoster(testSuite, []byte("other roster"), publics, 2) == nil {
+		t.Fatal("Signature shouldn't verify with another roster")
+	}
+	if cs.VerifyRoster(testSuite, []byte("roster"), publics, Threshold(len(publics))) == nil {
+		t.Fatal("Signature of 2 out of 4 witnesses shouldn't be enough")
+	}
+	cst, err := cs.Toml(testSuite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs2, err := cst.CollectiveSignature(testSuite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cs2.Verify(testSuite, publics); err != nil {
+		t.Fatal("Decoded signature should verify:", err)
+	}
+	if err := cs2.Verify(testSuite, publics[1:]); err == nil {
+		t.Fatal("Signature shouldn't verify with other witnesses")
+	}
+	cs2.Mask[0] |= 1 << 1
+	if err := cs2.Verify(testSuite, publics); err == nil {
+		t.Fatal("Signature shouldn't verify with a wrong mask")
+	}
+	_, err = NewCollectiveSignature(testSuite, msg, nil, publics[2:], root.Signature(), exceptions)
+	if err == nil {
+		t.Fatal("Exception of an unknown witness should fail")
+	}
+}
+
+// TestPrecommits signs with secrets generated in advance and checks that
+// they can't be reused.
+func TestPrecommits(t *testing.T) {
+	msg := []byte("Hello World Cosi")
+	cosis := genCosis(3)
+	precommits := make([]*Precommits, len(cosis))
+	for i := range cosis {
+		precommits[i] = NewPrecommits(testSuite)
+		for round := uint64(1); round <= 2; round++ {
+			if _, err := precommits[i].Generate(round); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := precommits[0].Generate(2); err == nil {
+		t.Fatal("Shouldn't generate a round twice")
+	}
+	if _, err := precommits[0].Generate(1); err == nil {
+		t.Fatal("Shouldn't generate an older round")
+	}
+	aggPublic := testSuite.Point().Null()
+	for i, c := range cosis {
+		aggPublic.Add(aggPublic, testSuite.Point().Mul(nil, c.private))
+		random, err := precommits[i].Take(2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetRandom(random)
+	}
+	root, children := cosis[0], cosis[1:]
+	root.Commit(genCommitments(children))
+	chal, err := root.CreateChallenge(aggPublic, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var responses []*Response
+	for _, c := range children {
+		c.Challenge(chal)
+		r, err := c.CreateResponse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		responses = append(responses, r)
+	}
+	if _, err := root.Response(responses); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyCosiSignatureWithException(testSuite, aggPublic, msg, root.Signature(), nil); err != nil {
+		t.Fatal("Signature with precommits should verify:", err)
+	}
+	if _, err := precommits[0].Take(2); err == nil {
+		t.Fatal("Shouldn't take a secret twice")
+	}
+	if precommits[0].Len() != 1 {
+		t.Fatal("Round 1 should still be there")
+	}
+	c := children[0]
+	if _, err := c.CreateResponse(); err == nil {
+		t.Fatal("Shouldn't respond twice with the same secret")
+	}
+	old := c.GetCommitment()
+	c.CreateCommitment()
+	if c.GetCommitment().Equal(old) {
+		t.Fatal("A new commitment shouldn't reuse the precommitted secret")
+	}
+}
+
 func genKeyPair(nb int) []*config.KeyPair {
 	var kps []*config.KeyPair
 	for i := 0; i < nb; i++ {
@@ -143,6 +412,15 @@ func genCosis(nb int) []*Cosi {
 	return cosis
 }
 
+// aggregatePublic returns the aggregate public key of cosis
+func aggregatePublic(cosis ...*Cosi) abstract.Point {
+	agg := testSuite.Point().Null()
+	for _, c := range cosis {
+		agg.Add(agg, testSuite.Point().Mul(nil, c.private))
+	}
+	return agg
+}
+
 func genCommitments(cosis []*Cosi) []*Commitment {
 	commitments := make([]*Commitment, len(cosis))
 	for i := range cosis {
@@ -163,7 +441,7 @@ func genPostCommitmentPhaseCosi(nb int) (*Cosi, []*Cosi) {
 
 func genPostChallengePhaseCosi(nb int, msg []byte) (*Cosi, []*Cosi) {
 	r, children := genPostCommitmentPhaseCosi(nb)
-	chal, _ := r.CreateChallenge(msg)
+	chal, _ := r.CreateChallenge(aggregatePublic(append(children, r)...), msg)
 	for _, ch := range children {
 		ch.Challenge(chal)
 	}
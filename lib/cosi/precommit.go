@@ -0,0 +1,64 @@
+package cosi
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/config"
+)
+
+// Precommits holds random secrets generated in advance for future rounds,
+// so that a round can skip the commitment phase. As using the same secret
+// with two different challenges reveals the private key, every secret can
+// be taken only once, and rounds have to be generated in increasing order
+// so that a round-number is never reused.
+type Precommits struct {
+	suite abstract.Suite
+	sync.Mutex
+	randoms map[uint64]abstract.Secret
+	// last is the highest round generated so far
+	last uint64
+}
+
+// NewPrecommits returns an empty store of precomputed secrets
+func NewPrecommits(suite abstract.Suite) *Precommits {
+	return &Precommits{
+		suite:   suite,
+		randoms: make(map[uint64]abstract.Secret),
+	}
+}
+
+// Generate creates the secret of round and returns its commitment. Round
+// has to be higher than all rounds generated before.
+func (p *Precommits) Generate(round uint64) (abstract.Point, error) {
+	p.Lock()
+	defer p.Unlock()
+	if round <= p.last {
+		return nil, errors.New("Round has already been generated")
+	}
+	kp := config.NewKeyPair(p.suite)
+	p.randoms[round] = kp.Secret
+	p.last = round
+	return kp.Public, nil
+}
+
+// Take returns the secret of round and removes it from the store, so that
+// it can't be used again.
+func (p *Precommits) Take(round uint64) (abstract.Secret, error) {
+	p.Lock()
+	defer p.Unlock()
+	random, ok := p.randoms[round]
+	if !ok {
+		return nil, errors.New("No precommitment for this round or already used")
+	}
+	delete(p.randoms, round)
+	return random, nil
+}
+
+// Len returns how many secrets are left
+func (p *Precommits) Len() int {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.randoms)
+}
@@ -0,0 +1,197 @@
+package cosi
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/dedis/cothority/lib/cliutils"
+	"github.com/dedis/crypto/abstract"
+)
+
+// CollectiveSignature is a self-describing collective signature: besides
+// the challenge and the response it holds everything a third party needs
+// to verify it given the list of witnesses, which are identified by the
+// Roster-id and their aggregate public key. Every witness has one bit in
+// the Mask, set if it participated in the signature.
+type CollectiveSignature struct {
+	// Hash of the message that has been signed
+	Hash []byte
+	// Roster identifies the list of witnesses, e.g. the id of an EntityList
+	Roster []byte
+	// Aggregate is the aggregate public key of all witnesses
+	Aggregate abstract.Point
+	// Mask holds one bit per witness, in the order of the roster
+	Mask      []byte
+	Challenge abstract.Secret
+	Response  abstract.Secret
+}
+
+// NewCollectiveSignature returns the CollectiveSignature of sig on hash,
+// signed by the witnesses publics, identified by roster. Every exception has
+// to hold the public key of one witness and the null commitment.
+func NewCollectiveSignature(suite abstract.Suite, hash, roster []byte, publics []abstract.Point,
+	sig *Signature, exceptions []Exception) (*CollectiveSignature, error) {
+	if _, err := reduceExceptions(suite, suite.Point().Null(), exceptions); err != nil {
+		return nil, err
+	}
+	cs := &CollectiveSignature{
+		Hash:      hash,
+		Roster:    roster,
+		Aggregate: suite.Point().Null(),
+		Mask:      make([]byte, (len(publics)+7)/8),
+		Challenge: sig.Challenge,
+		Response:  sig.Response,
+	}
+	for i, p := range publics {
+		cs.Aggregate.Add(cs.Aggregate, p)
+		cs.Mask[i/8] |= 1 << uint(i%8)
+	}
+	for _, ex := range exceptions {
+		i := indexOf(publics, ex.Public)
+		if i < 0 {
+			return nil, errors.New("Exception for unknown public key")
+		}
+		cs.Mask[i/8] &^= 1 << uint(i%8)
+	}
+	return cs, nil
+}
+
+// Participated returns whether the witness at index i signed
+func (cs *CollectiveSignature) Participated(i int) bool {
+	if i < 0 || i/8 >= len(cs.Mask) {
+		return false
+	}
+	return cs.Mask[i/8]&(1<<uint(i%8)) != 0
+}
+
+// Participants returns how many witnesses signed
+func (cs *CollectiveSignature) Participants() int {
+	n := 0
+	for i := 0; i < len(cs.Mask)*8; i++ {
+		if cs.Participated(i) {
+			n++
+		}
+	}
+	return n
+}
+
+// Verify checks the signature against the list of witnesses publics. It
+// doesn't check the Roster-id, which is up to the caller.
+func (cs *CollectiveSignature) Verify(suite abstract.Suite, publics []abstract.Point) error {
+	item, err := cs.VerifyItem(NewKeyCache(suite, publics))
+	if err != nil {
+		return err
+	}
+	return item.Verify(suite)
+}
+
+// VerifyRoster checks the signature of the trusted list of witnesses
+// publics, identified by roster, and that at least threshold of them
+// signed.
+func (cs *CollectiveSignature) VerifyRoster(suite abstract.Suite, roster []byte,
+	publics []abstract.Point, threshold int) error {
+	if !bytes.Equal(cs.Roster, roster) {
+		return errors.New("Signature is not from the trusted roster")
+	}
+	if n := cs.Participants(); n < threshold {
+		return fmt.Errorf("Only %d of %d witnesses signed, %d needed",
+			n, len(publics), threshold)
+	}
+	return cs.Verify(suite, publics)
+}
+
+// Threshold returns how many of n witnesses have to sign so that less
+// than a third of them is missing.
+func Threshold(n int) int {
+	return n - (n-1)/3
+}
+
+// VerifyItem checks the aggregate key of the signature against the witnesses
+// of kc and returns the signature as a VerifyItem.
+func (cs *CollectiveSignature) VerifyItem(kc *KeyCache) (*VerifyItem, error) {
+	if len(cs.Mask) != (kc.Len()+7)/8 {
+		return nil, errors.New("Mask doesn't match the number of witnesses")
+	}
+	if cs.Aggregate == nil || !kc.Aggregate().Equal(cs.Aggregate) {
+		return nil, errors.New("Aggregate key doesn't match the witnesses")
+	}
+	signers, err := kc.Participants(cs.Mask)
+	if err != nil {
+		return nil, err
+	}
+	return &VerifyItem{
+		Aggregate: cs.Aggregate,
+		Public:    signers,
+		Message:   cs.Hash,
+		Challenge: cs.Challenge,
+		Response:  cs.Response,
+	}, nil
+}
+
+// indexOf returns the index of p in publics, or -1 if it's not there
+func indexOf(publics []abstract.Point, p abstract.Point) int {
+	for i := range publics {
+		if publics[i].Equal(p) {
+			return i
+		}
+	}
+	return -1
+}
+
+// CollectiveSignatureToml is the toml-writable version of a
+// CollectiveSignature, with all fields hex-encoded.
+type CollectiveSignatureToml struct {
+	Hash      string
+	Roster    string
+	Aggregate string
+	Mask      string
+	Challenge string
+	Response  string
+}
+
+// Toml returns the toml-writable version of this CollectiveSignature
+func (cs *CollectiveSignature) Toml(suite abstract.Suite) (*CollectiveSignatureToml, error) {
+	cst := &CollectiveSignatureToml{
+		Hash:   hex.EncodeToString(cs.Hash),
+		Roster: hex.EncodeToString(cs.Roster),
+		Mask:   hex.EncodeToString(cs.Mask),
+	}
+	var err error
+	if cst.Aggregate, err = cliutils.PubHex(suite, cs.Aggregate); err != nil {
+		return nil, err
+	}
+	if cst.Challenge, err = cliutils.SecretHex(suite, cs.Challenge); err != nil {
+		return nil, err
+	}
+	if cst.Response, err = cliutils.SecretHex(suite, cs.Response); err != nil {
+		return nil, err
+	}
+	return cst, nil
+}
+
+// CollectiveSignature decodes the CollectiveSignature from its toml-version
+func (cst *CollectiveSignatureToml) CollectiveSignature(suite abstract.Suite) (*CollectiveSignature, error) {
+	cs := &CollectiveSignature{}
+	var err error
+	if cs.Hash, err = hex.DecodeString(cst.Hash); err != nil {
+		return nil, err
+	}
+	if cs.Roster, err = hex.DecodeString(cst.Roster); err != nil {
+		return nil, err
+	}
+	if cs.Mask, err = hex.DecodeString(cst.Mask); err != nil {
+		return nil, err
+	}
+	if cs.Aggregate, err = cliutils.ReadPubHex(suite, cst.Aggregate); err != nil {
+		return nil, err
+	}
+	if cs.Challenge, err = cliutils.ReadSecretHex(suite, cst.Challenge); err != nil {
+		return nil, err
+	}
+	if cs.Response, err = cliutils.ReadSecretHex(suite, cst.Response); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
@@ -0,0 +1,181 @@
+package cosi
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+
+	"github.com/dedis/cothority/lib/crypto"
+	"github.com/dedis/crypto/abstract"
+)
+
+// VerifyItem is one signature to verify with ParallelVerify. CoSi and
+// Schnorr signatures of lib/crypto are verified the same way, a Schnorr
+// signature being a CoSi signature of a single witness.
+type VerifyItem struct {
+	// Aggregate is the aggregate key of all witnesses, which is part of
+	// the challenge. It is nil for Schnorr signatures.
+	Aggregate abstract.Point
+	// Public is the aggregate key of the witnesses that signed
+	Public    abstract.Point
+	Message   []byte
+	Challenge abstract.Secret
+	Response  abstract.Secret
+}
+
+// NewVerifyItem returns the VerifyItem of a CoSi signature on msg. The
+// exceptions are removed from public.
+func NewVerifyItem(suite abstract.Suite, public abstract.Point, msg []byte, sig *Signature, exceptions []Exception) (*VerifyItem, error) {
+	subPublic, err := reduceExceptions(suite, public, exceptions)
+	if err != nil {
+		return nil, err
+	}
+	return &VerifyItem{
+		Aggregate: public,
+		Public:    subPublic,
+		Message:   msg,
+		Challenge: sig.Challenge,
+		Response:  sig.Response,
+	}, nil
+}
+
+// SchnorrVerifyItem returns the VerifyItem of a Schnorr signature
+func SchnorrVerifyItem(public abstract.Point, msg []byte, sig crypto.SchnorrSig) *VerifyItem {
+	return &VerifyItem{
+		Public:    public,
+		Message:   msg,
+		Challenge: sig.Challenge,
+		Response:  sig.Response,
+	}
+}
+
+// Verify checks the signature of this item
+func (bi *VerifyItem) Verify(suite abstract.Suite) error {
+	if bi.Public == nil || bi.Challenge == nil || bi.Response == nil {
+		return errors.New("Incomplete signature")
+	}
+	commitment := suite.Point().Mul(nil, bi.Response)
+	commitment.Add(commitment, suite.Point().Mul(bi.Public, bi.Challenge))
+	return verifyCommitment(suite, bi.Aggregate, bi.Message, commitment, bi.Challenge)
+}
+
+// ParallelVerify verifies all items and returns one error per item, which
+// is nil if the signature is valid. As the signatures hold the challenge
+// and not the commitment, they can't be combined into a single check:
+// every signature is verified on its own, spread over all CPUs.
+func ParallelVerify(suite abstract.Suite, items []*VerifyItem) []error {
+	errs := make([]error, len(items))
+	workers := runtime.NumCPU()
+	if workers > len(items) {
+		workers = len(items)
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				errs[i] = items[i].Verify(suite)
+			}
+		}()
+	}
+	for i := range items {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return errs
+}
+
+// ParallelVerifyAll returns nil if all signatures are valid, else the error
+// of the first invalid one.
+func ParallelVerifyAll(suite abstract.Suite, items []*VerifyItem) error {
+	for _, err := range ParallelVerify(suite, items) {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxCachedMasks is how many aggregate keys of subsets a KeyCache keeps
+const maxCachedMasks = 1024
+
+// KeyCache caches the aggregate keys of one list of witnesses, e.g. of an
+// EntityList: the aggregate of all keys and the aggregates of the subsets
+// that signed, given as participation masks like in CollectiveSignature.
+type KeyCache struct {
+	suite     abstract.Suite
+	publics   []abstract.Point
+	aggregate abstract.Point
+	sync.Mutex
+	masks map[string]abstract.Point
+}
+
+// NewKeyCache returns a KeyCache for the witnesses publics
+func NewKeyCache(suite abstract.Suite, publics []abstract.Point) *KeyCache {
+	agg := suite.Point().Null()
+	for _, p := range publics {
+		agg.Add(agg, p)
+	}
+	return &KeyCache{
+		suite:     suite,
+		publics:   publics,
+		aggregate: agg,
+		masks:     make(map[string]abstract.Point),
+	}
+}
+
+// Len returns the number of witnesses
+func (kc *KeyCache) Len() int {
+	return len(kc.publics)
+}
+
+// Aggregate returns the aggregate key of all witnesses
+func (kc *KeyCache) Aggregate() abstract.Point {
+	return kc.aggregate
+}
+
+// Participants returns the aggregate key of the witnesses whose bit is set
+// in mask. It is computed from the aggregate of all witnesses if less than
+// half of them are missing.
+func (kc *KeyCache) Participants(mask []byte) (abstract.Point, error) {
+	if len(mask) != (len(kc.publics)+7)/8 {
+		return nil, errors.New("Mask doesn't match the number of witnesses")
+	}
+	kc.Lock()
+	agg, ok := kc.masks[string(mask)]
+	kc.Unlock()
+	if ok {
+		return agg, nil
+	}
+	missing := 0
+	for i := range kc.publics {
+		if mask[i/8]&(1<<uint(i%8)) == 0 {
+			missing++
+		}
+	}
+	if missing < len(kc.publics)/2 {
+		agg = kc.suite.Point().Add(kc.suite.Point().Null(), kc.aggregate)
+		for i, p := range kc.publics {
+			if mask[i/8]&(1<<uint(i%8)) == 0 {
+				agg.Sub(agg, p)
+			}
+		}
+	} else {
+		agg = kc.suite.Point().Null()
+		for i, p := range kc.publics {
+			if mask[i/8]&(1<<uint(i%8)) != 0 {
+				agg.Add(agg, p)
+			}
+		}
+	}
+	kc.Lock()
+	if len(kc.masks) >= maxCachedMasks {
+		kc.masks = make(map[string]abstract.Point)
+	}
+	kc.masks[string(mask)] = agg
+	kc.Unlock()
+	return agg, nil
+}
@@ -0,0 +1,212 @@
+package cosi
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/dedis/cothority/lib/crypto"
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/config"
+)
+
+// TestParallelVerify verifies CoSi and Schnorr signatures together and
+// checks that only the wrong ones fail.
+func TestParallelVerify(t *testing.T) {
+	items := genVerifyItems(t, 4, 3)
+	kp := config.NewKeyPair(testSuite)
+	msg := []byte("Hello Schnorr")
+	sig, err := crypto.SignSchnorr(testSuite, kp.Secret, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items = append(items, SchnorrVerifyItem(kp.Public, msg, sig))
+	if err := ParallelVerifyAll(testSuite, items); err != nil {
+		t.Fatal("All items should verify:", err)
+	}
+
+	items[1].Message = []byte("Wrong message")
+	items[3].Public = testSuite.Point().Base()
+	errs := ParallelVerify(testSuite, items)
+	for i, err := range errs {
+		wrong := i == 1 || i == 3
+		if wrong && err == nil {
+			t.Fatal("Item", i, "shouldn't verify")
+		}
+		if !wrong && err != nil {
+			t.Fatal("Item", i, "should verify:", err)
+		}
+	}
+	if ParallelVerifyAll(testSuite, items) == nil {
+		t.Fatal("Not all items should verify")
+	}
+}
+
+// TestParallelVerifyForged checks that a signature forged with the
+// commitment of an exception doesn't verify in any form.
+func TestParallelVerifyForged(t *testing.T) {
+	msg := []byte("Hello World Cosi")
+	cosis := genCosis(4)
+	publics := make([]abstract.Point, len(cosis))
+	for i, c := range cosis {
+		publics[i] = testSuite.Point().Mul(nil, c.private)
+	}
+	aggregate := aggregatePublic(cosis...)
+	sig, exceptions, err := forgeSignature(aggregate, msg, publics[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewVerifyItem(testSuite, aggregate, msg, sig, exceptions); err == nil {
+		t.Fatal("Exception with a commitment should be refused")
+	}
+	// without its commitment, the exception is only missing
+	exceptions[0].Commitment = testSuite.Point().Null()
+	item, err := NewVerifyItem(testSuite, aggregate, msg, sig, exceptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := NewCollectiveSignature(testSuite, msg, nil, publics, sig, exceptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csItem, err := cs.VerifyItem(NewKeyCache(testSuite, publics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, err := range ParallelVerify(testSuite, []*VerifyItem{item, csItem}) {
+		if err == nil {
+			t.Fatal("Forged item", i, "shouldn't verify")
+		}
+	}
+}
+
+// TestKeyCache compares the cached aggregate keys of subsets with the
+// aggregate of the keys of the subset.
+func TestKeyCache(t *testing.T) {
+	publics := make([]abstract.Point, 20)
+	for i := range publics {
+		publics[i] = config.NewKeyPair(testSuite).Public
+	}
+	kc := NewKeyCache(testSuite, publics)
+	// few and many missing witnesses are aggregated differently
+	for _, mask := range [][]byte{{0xff, 0xfe, 0x0f}, {0x01, 0x80, 0x00}} {
+		agg := testSuite.Point().Null()
+		for i, p := range publics {
+			if mask[i/8]&(1<<uint(i%8)) != 0 {
+				agg.Add(agg, p)
+			}
+		}
+		for i := 0; i < 2; i++ {
+			sub, err := kc.Participants(mask)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sub.Equal(agg) {
+				t.Fatal("Wrong aggregate for mask", mask)
+			}
+		}
+	}
+	if _, err := kc.Participants([]byte{0xff}); err == nil {
+		t.Fatal("Mask of wrong length should fail")
+	}
+}
+
+func BenchmarkVerifySignature(b *testing.B) {
+	items := genVerifyItems(b, 10, 1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := items[0].Verify(testSuite); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParallelVerify100(b *testing.B) {
+	items := genVerifyItems(b, 10, 100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := ParallelVerifyAll(testSuite, items); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCollectiveSignature1000(b *testing.B) {
+	benchmarkCollectiveSignature(b, false)
+}
+
+func BenchmarkCollectiveSignature1000Cached(b *testing.B) {
+	benchmarkCollectiveSignature(b, true)
+}
+
+// benchmarkCollectiveSignature verifies a signature of 1000 witnesses with
+// one exception, with or without a KeyCache.
+func benchmarkCollectiveSignature(b *testing.B, cached bool) {
+	msg := []byte("Hello World Cosi")
+	cosis := genCosis(1000)
+	cosis[1].Refuse()
+	root := cosis[0]
+	root.Commit(genCommitments(cosis[1:]))
+	chal, err := root.CreateChallenge(aggregatePublic(cosis...), msg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var publics []abstract.Point
+	var responses []*Response
+	for i, c := range cosis {
+		publics = append(publics, testSuite.Point().Mul(nil, c.private))
+		if i == 0 {
+			continue
+		}
+		c.Challenge(chal)
+		r, err := c.CreateResponse()
+		if err != nil {
+			b.Fatal(err)
+		}
+		responses = append(responses, r)
+	}
+	if _, err := root.Response(responses); err != nil {
+		b.Fatal(err)
+	}
+	exceptions := []Exception{{Public: publics[1], Commitment: testSuite.Point().Null()}}
+	cs, err := NewCollectiveSignature(testSuite, msg, []byte("roster"), publics,
+		root.Signature(), exceptions)
+	if err != nil {
+		b.Fatal(err)
+	}
+	kc := NewKeyCache(testSuite, publics)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !cached {
+			err = cs.Verify(testSuite, publics)
+		} else {
+			var item *VerifyItem
+			item, err = cs.VerifyItem(kc)
+			if err == nil {
+				err = item.Verify(testSuite)
+			}
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// genVerifyItems returns nbr VerifyItems, each signed by nbrCosi witnesses
+func genVerifyItems(tb testing.TB, nbrCosi, nbr int) []*VerifyItem {
+	items := make([]*VerifyItem, nbr)
+	for i := range items {
+		msg := []byte("Hello World Cosi " + strconv.Itoa(i))
+		root, children, err := genFinalCosi(nbrCosi, msg)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		aggPublic := testSuite.Point().Mul(nil, root.private)
+		for _, c := range children {
+			aggPublic.Add(aggPublic, testSuite.Point().Mul(nil, c.private))
+		}
+		if items[i], err = NewVerifyItem(testSuite, aggPublic, msg, root.Signature(), nil); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return items
+}
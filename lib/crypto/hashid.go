@@ -2,11 +2,32 @@ package crypto
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 )
 
 type HashId []byte // Cryptographic hash content-IDs
 
+// NewHashId returns the HashId of the concatenation of all data
+func NewHashId(data ...[]byte) HashId {
+	h := sha256.New()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return HashId(h.Sum(nil))
+}
+
+// Equal returns true if both HashIds are the same
+func (id HashId) Equal(id2 HashId) bool {
+	return bytes.Equal(id, id2)
+}
+
+// String returns the HashId in hexadecimal
+func (id HashId) String() string {
+	return hex.EncodeToString(id)
+}
+
 // for sorting arrays of HashIds
 type ByHashId []HashId
 
@@ -8,7 +8,6 @@ package crypto
 import (
 	"errors"
 
-	"github.com/dedis/cothority/lib/network"
 	"github.com/dedis/crypto/abstract"
 	"github.com/dedis/crypto/random"
 )
@@ -28,6 +27,25 @@ func (ss *SchnorrSig) MarshalBinary() ([]byte, error) {
 	return append(cbuf, rbuf...), err
 }
 
+// UnmarshalSchnorr reads a SchnorrSig as written by MarshalBinary
+func UnmarshalSchnorr(suite abstract.Suite, buf []byte) (SchnorrSig, error) {
+	size := suite.Secret().MarshalSize()
+	if len(buf) != 2*size {
+		return SchnorrSig{}, errors.New("Wrong length of signature")
+	}
+	ss := SchnorrSig{
+		Challenge: suite.Secret(),
+		Response:  suite.Secret(),
+	}
+	if err := ss.Challenge.UnmarshalBinary(buf[:size]); err != nil {
+		return SchnorrSig{}, err
+	}
+	if err := ss.Response.UnmarshalBinary(buf[size:]); err != nil {
+		return SchnorrSig{}, err
+	}
+	return ss, nil
+}
+
 // SignSchnorr creates a Schnorr signature from a msg and a private key
 func SignSchnorr(suite abstract.Suite, private abstract.Secret, msg []byte) (SchnorrSig, error) {
 	// using notation from https://en.wikipedia.org/wiki/Schnorr_signature
@@ -36,7 +54,7 @@ func SignSchnorr(suite abstract.Suite, private abstract.Secret, msg []byte) (Sch
 	r := suite.Point().Mul(nil, k)
 
 	// create challenge e based on message and r
-	e, err := hash(r, msg)
+	e, err := hash(suite, r, msg)
 	if err != nil {
 		return SchnorrSig{}, err
 	}
@@ -56,7 +74,7 @@ func VerifySchnorr(suite abstract.Suite, public abstract.Point, msg []byte, sig
 	rv := suite.Point().Add(gs, ye)
 
 	// recompute challenge (e) from rv
-	e, err := hash(rv, msg)
+	e, err := hash(suite, rv, msg)
 	if err != nil {
 		return err
 	}
@@ -68,12 +86,11 @@ func VerifySchnorr(suite abstract.Suite, public abstract.Point, msg []byte, sig
 	return nil
 }
 
-func hash(r abstract.Point, msg []byte) (abstract.Secret, error) {
+func hash(suite abstract.Suite, r abstract.Point, msg []byte) (abstract.Secret, error) {
 	rBuf, err := r.MarshalBinary()
 	if err != nil {
 		return nil, err
 	}
-	suite := network.Suite
 	cipher := suite.Cipher(rBuf)
 	cipher.Message(nil, nil, msg)
 	// (re)compute challenge (e)
@@ -130,6 +130,12 @@ func (m *Measure) Measure() {
 	m.reset()
 }
 
+// MeasureValue sends value as the wall time of a measure called name, for
+// the values that aren't times, like sizes.
+func MeasureValue(name string, value float64) {
+	send(Measure{Name: name, WallTime: value})
+}
+
 // Enables / Disables automatic reset of a measure. If called with true, the
 // measure is reset.
 func (m *Measure) enableAutoReset(b bool) {
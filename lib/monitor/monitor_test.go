@@ -36,6 +36,7 @@ func TestMonitor(t *testing.T) {
 	meas.Measure()
 	time.Sleep(200 * time.Millisecond)
 	meas.Measure()
+	MeasureValue("size", 10)
 	EndAndCleanup()
 	time.Sleep(100 * time.Millisecond)
 	updated := stat.String()
@@ -10,19 +10,27 @@ import (
 	"github.com/dedis/cothority/lib/dbg"
 	"github.com/dedis/crypto/abstract"
 	"github.com/dedis/crypto/edwards"
+	"github.com/dedis/crypto/suites"
 	"github.com/dedis/protobuf"
 	"github.com/satori/go.uuid"
 )
 
 /// Encoding part ///
 
-// Suite used globally by this network library.
-// For the moment, this will stay,as our focus is not on having the possibility
-// to use any suite we want (the decoding stuff is much harder then, because we
-// don't want to send the suite in the wire).
-// It will surely change in futur releases so we can permit this behavior.
+// Suite is the default suite of this network library. As the suite is not
+// sent on the wire, both ends of a connection have to use the same suite,
+// which can be chosen per host with NewTcpHostWithSuite.
 var Suite = edwards.NewAES128SHA256Ed25519(false)
 
+// SuiteByName returns the suite with the given name, as returned by
+// suite.String(). An empty name returns the default Suite.
+func SuiteByName(name string) (abstract.Suite, error) {
+	if name == "" {
+		return Suite, nil
+	}
+	return suites.StringToSuite(name)
+}
+
 // ProtocolMessage is a type for any message that the user wants to send
 type ProtocolMessage interface{}
 
@@ -90,7 +98,8 @@ func DumpTypes() {
 	}
 }
 
-// DefaultConstructors gives a default constructor for protobuf out of the global suite
+// DefaultConstructors gives the protobuf-constructors for the points and
+// secrets of suite
 func DefaultConstructors(suite abstract.Suite) protobuf.Constructors {
 	constructors := make(protobuf.Constructors)
 	var point abstract.Point
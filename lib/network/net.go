@@ -26,18 +26,22 @@ import (
 	"github.com/dedis/cothority/lib/cliutils"
 	"github.com/dedis/cothority/lib/dbg"
 	"github.com/dedis/crypto/abstract"
-	"github.com/satori/go.uuid"
 )
 
 // Network part //
 
-// NewTcpHost returns a Fresh TCP Host
-// If constructors == nil, it will take an empty one.
+// NewTcpHost returns a Fresh TCP Host using the default Suite
 func NewTcpHost() *TcpHost {
+	return NewTcpHostWithSuite(Suite)
+}
+
+// NewTcpHostWithSuite returns a Fresh TCP Host decoding points and secrets
+// of suite
+func NewTcpHostWithSuite(suite abstract.Suite) *TcpHost {
 	return &TcpHost{
 		peers:        make(map[string]Conn),
 		quit:         make(chan bool),
-		constructors: DefaultConstructors(Suite),
+		constructors: DefaultConstructors(suite),
 		quitListener: make(chan bool),
 	}
 }
@@ -302,13 +306,18 @@ func (t *TcpHost) listen(addr string, fn func(*TcpConn)) error {
 	}
 }
 
-// NewSecureTcpHost returns a Secure Tcp Host
+// NewSecureTcpHost returns a Secure Tcp Host using the default Suite
 func NewSecureTcpHost(private abstract.Secret, e *Entity) *SecureTcpHost {
+	return NewSecureTcpHostWithSuite(Suite, private, e)
+}
+
+// NewSecureTcpHostWithSuite returns a Secure Tcp Host using suite
+func NewSecureTcpHostWithSuite(suite abstract.Suite, private abstract.Secret, e *Entity) *SecureTcpHost {
 	return &SecureTcpHost{
 		private:        private,
 		entity:         e,
-		EntityToAddr:   make(map[uuid.UUID]string),
-		TcpHost:        NewTcpHost(),
+		EntityToAddr:   make(map[string]string),
+		TcpHost:        NewTcpHostWithSuite(suite),
 		workingAddress: e.First(),
 	}
 }
@@ -431,7 +440,7 @@ func (sc *SecureTcpConn) negotiateOpen(e *Entity) error {
 	}
 
 	// verify the Entity if its the same we are supposed to connect
-	if sc.Entity().Id != e.Id {
+	if !sc.Entity().Id.Equal(e.Id) {
 		dbg.Lvl3("Wanted to connect to", e, e.Id, "but got", sc.Entity(), sc.Entity().Id)
 		dbg.Lvl4("IDs not the same", dbg.Stack())
 		return errors.New("Warning: Entity received during negotiation is wrong.")
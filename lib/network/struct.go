@@ -2,6 +2,7 @@ package network
 
 import (
 	"bytes"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -11,6 +12,7 @@ import (
 	"time"
 
 	"github.com/dedis/cothority/lib/cliutils"
+	"github.com/dedis/cothority/lib/crypto"
 	"github.com/dedis/crypto/abstract"
 	"github.com/dedis/protobuf"
 	"github.com/satori/go.uuid"
@@ -123,7 +125,7 @@ type SecureTcpHost struct {
 	private abstract.Secret
 	// mapping from the entity to the names used in TcpHost
 	// In TcpHost the names then maps to the actual connection
-	EntityToAddr map[uuid.UUID]string
+	EntityToAddr map[string]string
 	// workingaddress is a private field used mostly for testing
 	// so we know which address this host is listening on
 	workingAddress string
@@ -161,10 +163,14 @@ type NetworkMessage struct {
 type Entity struct {
 	// This is the public key of that Entity
 	Public abstract.Point
-	// The UUID corresponding to that public key
-	Id uuid.UUID
+	// The hash of the public key
+	Id crypto.HashId
 	// A slice of addresses of where that Id might be found
 	Addresses []string
+	// Proof is the proof-of-possession of the private key: a signature on
+	// the public key. Without it, an Entity could choose its public key so
+	// that it cancels out the others in an aggregate key.
+	Proof crypto.SchnorrSig
 	// used to return the next available address
 	iter int
 }
@@ -180,20 +186,85 @@ var EntityType = RegisterMessageType(Entity{})
 type EntityToml struct {
 	Public    string
 	Addresses []string
+	Proof     string `toml:",omitempty"`
 }
 
 // NewEntity creates a new Entity based on a public key and with a slice
-// of IP-addresses where to find that entity. The Id is based on a
-// version5-UUID which can include a URL that is based on it's public key.
+// of IP-addresses where to find that entity. The Id is the hash of the
+// public key.
 func NewEntity(public abstract.Point, addresses ...string) *Entity {
-	url := UuidURL + "id/" + public.String()
+	buf, _ := public.MarshalBinary()
 	return &Entity{
 		Public:    public,
 		Addresses: addresses,
-		Id:        uuid.NewV5(uuid.NamespaceURL, url),
+		Id:        crypto.NewHashId([]byte("entity"), buf),
 	}
 }
 
+// proofMessage returns the message signed by the proof-of-possession
+func proofMessage(public abstract.Point) ([]byte, error) {
+	buf, err := public.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("proof-of-possession"), buf...), nil
+}
+
+// Prove adds the proof-of-possession of private, the private key of the
+// Entity.
+func (e *Entity) Prove(suite abstract.Suite, private abstract.Secret) error {
+	msg, err := proofMessage(e.Public)
+	if err != nil {
+		return err
+	}
+	e.Proof, err = crypto.SignSchnorr(suite, private, msg)
+	return err
+}
+
+// VerifyProof returns an error if the Entity has no valid
+// proof-of-possession of its private key.
+func (e *Entity) VerifyProof(suite abstract.Suite) error {
+	if e.Proof.Challenge == nil || e.Proof.Response == nil {
+		return errors.New("Missing proof-of-possession")
+	}
+	msg, err := proofMessage(e.Public)
+	if err != nil {
+		return err
+	}
+	if err := crypto.VerifySchnorr(suite, e.Public, msg, e.Proof); err != nil {
+		return errors.New("Invalid proof-of-possession")
+	}
+	return nil
+}
+
+// ProofHex returns the proof-of-possession as a hex-string, or an empty
+// string if there is none.
+func (e *Entity) ProofHex() string {
+	if e.Proof.Challenge == nil || e.Proof.Response == nil {
+		return ""
+	}
+	buf, err := e.Proof.MarshalBinary()
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(buf)
+}
+
+// SetProofHex sets the proof-of-possession from a hex-string as returned
+// by ProofHex. An empty string removes the proof.
+func (e *Entity) SetProofHex(suite abstract.Suite, proof string) error {
+	if proof == "" {
+		e.Proof = crypto.SchnorrSig{}
+		return nil
+	}
+	buf, err := hex.DecodeString(proof)
+	if err != nil {
+		return err
+	}
+	e.Proof, err = crypto.UnmarshalSchnorr(suite, buf)
+	return err
+}
+
 // First returns the first address available
 func (e *Entity) First() string {
 	if len(e.Addresses) > 0 {
@@ -223,16 +294,17 @@ func (e *Entity) Toml(suite abstract.Suite) *EntityToml {
 	return &EntityToml{
 		Addresses: e.Addresses,
 		Public:    buf.String(),
+		Proof:     e.ProofHex(),
 	}
 }
 
 // Entity converts an EntityToml structure back to an Entity
 func (e *EntityToml) Entity(suite abstract.Suite) *Entity {
 	pub, _ := cliutils.ReadPub64(suite, strings.NewReader(e.Public))
-	return &Entity{
-		Public:    pub,
-		Addresses: e.Addresses,
-	}
+	entity := NewEntity(pub, e.Addresses...)
+	// a wrong proof is the same as none and fails VerifyProof
+	entity.SetProofHex(suite, e.Proof)
+	return entity
 }
 
 // handleError produces the higher layer error depending on the type
@@ -0,0 +1,55 @@
+package sda
+
+import (
+	"errors"
+	"time"
+
+	"github.com/dedis/cothority/lib/network"
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/config"
+	"golang.org/x/net/context"
+)
+
+// Request sends msg to the Host at dst and returns its reply. It is meant
+// for clients, which don't run a Host: the connection uses a new key that
+// is thrown away afterwards. If timeout is not 0, Request returns an error
+// if the reply doesn't arrive in time.
+func Request(suite abstract.Suite, dst *network.Entity, msg network.ProtocolMessage,
+	timeout time.Duration) (network.ProtocolMessage, error) {
+	// the client only needs a key to connect
+	kp := config.NewKeyPair(suite)
+	host := network.NewSecureTcpHostWithSuite(suite, kp.Secret,
+		network.NewEntity(kp.Public))
+	defer host.Close()
+	conn, err := host.Open(dst)
+	if err != nil {
+		return nil, err
+	}
+	// closing the connection also stops the Receive if we time out
+	defer conn.Close()
+	if err := conn.Send(context.TODO(), msg); err != nil {
+		return nil, err
+	}
+	type reply struct {
+		msg network.NetworkMessage
+		err error
+	}
+	received := make(chan reply, 1)
+	go func() {
+		msg, err := conn.Receive(context.TODO())
+		received <- reply{msg, err}
+	}()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	select {
+	case r := <-received:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return r.msg.Msg, nil
+	case <-expired:
+		return nil, errors.New("Timeout while waiting for the reply")
+	}
+}
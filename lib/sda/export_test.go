@@ -1,6 +1,7 @@
 package sda
 
 import (
+	"github.com/dedis/cothority/lib/crypto"
 	"github.com/dedis/cothority/lib/dbg"
 	"github.com/dedis/cothority/lib/network"
 	"github.com/satori/go.uuid"
@@ -22,12 +23,12 @@ func (h *Host) StartNewNodeName(name string, tree *Tree) (*Node, error) {
 	return h.overlay.StartNewNodeName(name, tree)
 }
 
-func (h *Host) EntityList(id uuid.UUID) (*EntityList, bool) {
+func (h *Host) EntityList(id crypto.HashId) (*EntityList, bool) {
 	el := h.overlay.EntityList(id)
 	return el, el != nil
 }
 
-func (h *Host) GetTree(id uuid.UUID) (*Tree, bool) {
+func (h *Host) GetTree(id crypto.HashId) (*Tree, bool) {
 	t := h.overlay.Tree(id)
 	return t, t != nil
 }
@@ -44,7 +45,20 @@ func (n *Node) Aggregate(sdaMsg *SDAData) (uuid.UUID, []*SDAData, bool) {
 	return n.aggregate(sdaMsg)
 }
 
+// SentSeq returns the sequence-number of the last message sent to tn
+func (n *Node) SentSeq(tn *TreeNode) uint32 {
+	n.seq.Lock()
+	defer n.seq.Unlock()
+	return n.seq.send[string(tn.Id)]
+}
+
 func (o *Overlay) TokenToNode(tok *Token) (*Node, bool) {
-	v, ok := o.nodes[tok.Id()]
+	v, ok := o.nodes[string(tok.Id())]
 	return v, ok
 }
+
+func (o *Overlay) DoneStatsLen() int {
+	o.nodeLock.RLock()
+	defer o.nodeLock.RUnlock()
+	return len(o.doneStats)
+}
@@ -0,0 +1,373 @@
+package sda
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/dedis/cothority/lib/dbg"
+	"github.com/dedis/cothority/lib/network"
+	"github.com/satori/go.uuid"
+)
+
+// This file holds the checks of the channels and handlers given to the
+// Node. All types are verified at registration-time, so that a protocol
+// with a wrong channel or handler fails at startup with a clear error
+// instead of panicking when the first message arrives.
+//
+// Three forms of registration are supported:
+//  - RegisterChannel: a channel of a struct (or slice of structs) holding
+//    a *TreeNode and the message
+//  - RegisterHandler: a function taking such a struct (or slice)
+//  - RegisterTypedHandler: a function taking the *TreeNode and the message
+//    directly, like func(*TreeNode, *Msg) error
+// For the first two, the order of the fields in the struct doesn't matter.
+// A slice in the channel or the arguments means that the messages of all
+// children are aggregated before being dispatched.
+
+// HandlerOption changes how messages are dispatched to a channel or handler
+type HandlerOption func(*msgHandler)
+
+// ChildOrder sorts aggregated messages in the order of the children of the
+// node, instead of the order of arrival.
+func ChildOrder() HandlerOption {
+	return func(h *msgHandler) {
+		h.childOrder = true
+	}
+}
+
+// AggregateTimeout dispatches the aggregated messages received so far if
+// not all children sent their message within d after the first message.
+func AggregateTimeout(d time.Duration) HandlerOption {
+	return func(h *msgHandler) {
+		h.timeout = d
+	}
+}
+
+// msgHandler holds everything needed to dispatch one message-type
+type msgHandler struct {
+	// channel is valid if the messages are sent to a channel
+	channel reflect.Value
+	// function is valid if the messages are given to a function
+	function reflect.Value
+	// wrapper is the struct holding the TreeNode and the message. It is
+	// nil for typed handlers.
+	wrapper       reflect.Type
+	treeNodeField int
+	msgField      int
+	// msgType is the type of the message as expected by the handler,
+	// it can be a pointer
+	msgType reflect.Type
+	// whether the handler of a typed handler returns an error
+	returnsError bool
+	aggregate    bool
+	childOrder   bool
+	timeout      time.Duration
+}
+
+var treeNodeType = reflect.TypeOf(&TreeNode{})
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// newChannelHandler checks the channel c and returns the msgHandler
+func newChannelHandler(c interface{}, opts []HandlerOption) (*msgHandler, error) {
+	cr := reflect.TypeOf(c)
+	if cr == nil || cr.Kind() != reflect.Chan {
+		return nil, fmt.Errorf("Channel %v: input is not a channel", cr)
+	}
+	if reflect.ValueOf(c).IsNil() {
+		return nil, errors.New("Can not Register a (value) channel not initialized")
+	}
+	h := &msgHandler{channel: reflect.ValueOf(c)}
+	if err := h.setWrapper(cr.Elem()); err != nil {
+		return nil, fmt.Errorf("Channel %v: %s", cr, err)
+	}
+	return h, h.setOptions(opts)
+}
+
+// newStructHandler checks the function f which takes a struct (or a slice
+// of structs) holding the TreeNode and the message
+func newStructHandler(f interface{}, opts []HandlerOption) (*msgHandler, error) {
+	ft := reflect.TypeOf(f)
+	if ft == nil || ft.Kind() != reflect.Func {
+		return nil, fmt.Errorf("Handler %v: input is not a function", ft)
+	}
+	if ft.NumIn() != 1 {
+		return nil, fmt.Errorf("Handler %v: needs exactly one argument", ft)
+	}
+	h := &msgHandler{function: reflect.ValueOf(f)}
+	if err := h.setWrapper(ft.In(0)); err != nil {
+		return nil, fmt.Errorf("Handler %v: %s", ft, err)
+	}
+	return h, h.setOptions(opts)
+}
+
+// newTypedHandler checks the function f which takes the TreeNode and the
+// message as separate arguments: func(*TreeNode, Msg) or
+// func([]*TreeNode, []Msg) for aggregation. Msg can be a struct or a
+// pointer to a struct. The function can return an error.
+func newTypedHandler(f interface{}, opts []HandlerOption) (*msgHandler, error) {
+	ft := reflect.TypeOf(f)
+	if ft == nil || ft.Kind() != reflect.Func {
+		return nil, fmt.Errorf("Handler %v: input is not a function", ft)
+	}
+	if ft.NumIn() != 2 {
+		return nil, fmt.Errorf("Handler %v: needs the TreeNode and the message as arguments", ft)
+	}
+	if ft.NumOut() > 1 || (ft.NumOut() == 1 && ft.Out(0) != errorType) {
+		return nil, fmt.Errorf("Handler %v: can only return an error", ft)
+	}
+	h := &msgHandler{
+		function:     reflect.ValueOf(f),
+		returnsError: ft.NumOut() == 1,
+	}
+	tn, msg := ft.In(0), ft.In(1)
+	if tn.Kind() == reflect.Slice {
+		if msg.Kind() != reflect.Slice {
+			return nil, fmt.Errorf("Handler %v: aggregation needs a slice of TreeNodes and a slice of messages", ft)
+		}
+		h.aggregate = true
+		tn, msg = tn.Elem(), msg.Elem()
+	} else if msg.Kind() == reflect.Slice {
+		return nil, fmt.Errorf("Handler %v: aggregation needs a slice of TreeNodes and a slice of messages", ft)
+	}
+	if tn != treeNodeType {
+		return nil, fmt.Errorf("Handler %v: first argument must be *sda.TreeNode", ft)
+	}
+	if !isMessage(msg) {
+		return nil, fmt.Errorf("Handler %v: message must be a struct or a pointer to a struct", ft)
+	}
+	h.msgType = msg
+	return h, h.setOptions(opts)
+}
+
+// setWrapper checks that t is a struct, or a slice of structs, with
+// exactly one *TreeNode and one message-field and stores the index of the
+// two fields.
+func (h *msgHandler) setWrapper(t reflect.Type) error {
+	if t.Kind() == reflect.Slice {
+		h.aggregate = true
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return errors.New("input is not a structure")
+	}
+	if t.NumField() != 2 {
+		return errors.New("structure needs exactly two fields: *sda.TreeNode and the message")
+	}
+	h.treeNodeField, h.msgField = -1, -1
+	for i := 0; i < 2; i++ {
+		ft := t.Field(i).Type
+		switch {
+		case ft == treeNodeType && h.treeNodeField < 0:
+			h.treeNodeField = i
+		case isMessage(ft):
+			h.msgField = i
+		}
+	}
+	if h.treeNodeField < 0 {
+		return errors.New("structure doesn't have *sda.TreeNode as element")
+	}
+	if h.msgField < 0 {
+		return errors.New("structure doesn't have a message-struct as element")
+	}
+	if t.Field(h.msgField).PkgPath != "" {
+		return errors.New("message-field of structure is not exported")
+	}
+	h.wrapper = t
+	h.msgType = t.Field(h.msgField).Type
+	return nil
+}
+
+// setOptions applies the options and checks they make sense
+func (h *msgHandler) setOptions(opts []HandlerOption) error {
+	for _, o := range opts {
+		o(h)
+	}
+	if !h.aggregate && (h.childOrder || h.timeout > 0) {
+		return errors.New("ChildOrder and AggregateTimeout need aggregated messages")
+	}
+	if h.timeout < 0 {
+		return errors.New("AggregateTimeout needs a positive duration")
+	}
+	return nil
+}
+
+// register adds the message-type to the network-library and returns its
+// uuid
+func (h *msgHandler) register() uuid.UUID {
+	t := h.msgType
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return network.RegisterMessageUUID(network.RTypeToUUID(t), t)
+}
+
+// dispatch sends the messages to the channel or handler-function
+func (h *msgHandler) dispatch(n *Node, msgs []*SDAData) error {
+	if h.aggregate && h.childOrder {
+		msgs = n.sortByChildren(msgs)
+	}
+	tns := make([]reflect.Value, len(msgs))
+	vals := make([]reflect.Value, len(msgs))
+	for i, msg := range msgs {
+		var err error
+		tns[i], vals[i], err = h.values(n, msg)
+		if err != nil {
+			return err
+		}
+	}
+	if !h.aggregate {
+		for i := range msgs {
+			if err := h.call(tns[i], vals[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if h.wrapper != nil {
+		out := reflect.MakeSlice(reflect.SliceOf(h.wrapper), len(msgs), len(msgs))
+		for i := range msgs {
+			out.Index(i).Set(vals[i])
+		}
+		return h.call(reflect.Value{}, out)
+	}
+	tnSlice := reflect.MakeSlice(reflect.SliceOf(treeNodeType), len(msgs), len(msgs))
+	msgSlice := reflect.MakeSlice(reflect.SliceOf(h.msgType), len(msgs), len(msgs))
+	for i := range msgs {
+		tnSlice.Index(i).Set(tns[i])
+		msgSlice.Index(i).Set(vals[i])
+	}
+	return h.call(tnSlice, msgSlice)
+}
+
+// values returns the TreeNode of the sender and the message. If the
+// handler uses a wrapper, the message is the filled-in wrapper.
+func (h *msgHandler) values(n *Node, msg *SDAData) (reflect.Value, reflect.Value, error) {
+	tn := n.Tree().GetTreeNode(msg.From.TreeNodeID)
+	if tn == nil {
+		return reflect.Value{}, reflect.Value{},
+			errors.New("Didn't find TreeNode of sender")
+	}
+	m, err := messageValue(h.msgType, msg.Msg)
+	if err != nil {
+		return reflect.Value{}, reflect.Value{}, err
+	}
+	if h.wrapper == nil {
+		return reflect.ValueOf(tn), m, nil
+	}
+	w := reflect.New(h.wrapper).Elem()
+	w.Field(h.treeNodeField).Set(reflect.ValueOf(tn))
+	w.Field(h.msgField).Set(m)
+	return reflect.ValueOf(tn), w, nil
+}
+
+// call sends v to the channel or calls the function with it. For typed
+// handlers the TreeNode tn is given as first argument.
+func (h *msgHandler) call(tn, v reflect.Value) error {
+	if h.channel.IsValid() {
+		h.channel.Send(v)
+		return nil
+	}
+	if h.wrapper != nil {
+		h.function.Call([]reflect.Value{v})
+		return nil
+	}
+	ret := h.function.Call([]reflect.Value{tn, v})
+	if h.returnsError && !ret[0].IsNil() {
+		return ret[0].Interface().(error)
+	}
+	return nil
+}
+
+// messageValue converts msg to the type t, which can be a pointer or a
+// struct
+func messageValue(t reflect.Type, msg interface{}) (reflect.Value, error) {
+	if msg == nil {
+		return reflect.Value{}, errors.New("Can't dispatch empty message")
+	}
+	v := reflect.ValueOf(msg)
+	if t.Kind() == reflect.Ptr && v.Kind() != reflect.Ptr {
+		p := reflect.New(v.Type())
+		p.Elem().Set(v)
+		v = p
+	} else if t.Kind() != reflect.Ptr {
+		v = reflect.Indirect(v)
+	}
+	if !v.Type().AssignableTo(t) {
+		return reflect.Value{}, fmt.Errorf("Message of type %v can't be given to handler of %v",
+			v.Type(), t)
+	}
+	return v, nil
+}
+
+// isMessage returns true if t can hold a message
+func isMessage(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct && t != treeNodeType.Elem()
+}
+
+// sortByChildren returns the messages in the order of the children of the
+// node. Messages not coming from a child are put at the end.
+func (n *Node) sortByChildren(msgs []*SDAData) []*SDAData {
+	sorted := make([]*SDAData, 0, len(msgs))
+	used := make([]bool, len(msgs))
+	for _, c := range n.Children() {
+		for i, msg := range msgs {
+			if !used[i] && msg.From.TreeNodeID.Equal(c.Id) {
+				sorted = append(sorted, msg)
+				used[i] = true
+			}
+		}
+	}
+	for i, msg := range msgs {
+		if !used[i] {
+			sorted = append(sorted, msg)
+		}
+	}
+	return sorted
+}
+
+// aggregateTimer is the timer of one aggregation, gen tells it apart from
+// the timers of earlier aggregations of the same message-type
+type aggregateTimer struct {
+	*time.Timer
+	gen uint64
+}
+
+// aggregateTimeout is called when the children didn't send all messages of
+// type mt in time. It dispatches what has been received so far, in turn
+// with the other messages of the Node.
+func (n *Node) aggregateTimeout(mt uuid.UUID, gen uint64) {
+	n.dispatchLock.Lock()
+	n.deliveries = append(n.deliveries, func() error {
+		return n.dispatchAggregated(mt, gen)
+	})
+	n.dispatchLock.Unlock()
+	if err := n.deliver(); err != nil {
+		dbg.Error(n.Name(), "Couldn't dispatch after timeout:", err)
+	}
+}
+
+// dispatchAggregated dispatches the messages of type mt received so far. A
+// timer that has been stopped or replaced by the messages delivered before
+// does nothing.
+func (n *Node) dispatchAggregated(mt uuid.UUID, gen uint64) error {
+	n.msgQueueLock.Lock()
+	if t, ok := n.msgTimers[mt]; !ok || t.gen != gen {
+		n.msgQueueLock.Unlock()
+		return nil
+	}
+	msgs := n.msgQueue[mt]
+	delete(n.msgQueue, mt)
+	delete(n.msgTimers, mt)
+	n.msgQueueLock.Unlock()
+	if len(msgs) == 0 {
+		return nil
+	}
+	dbg.Lvl3(n.Name(), "timeout while aggregating: got", len(msgs), "of",
+		len(n.Children()), "messages")
+	return n.handlers[mt].dispatch(n, msgs)
+}
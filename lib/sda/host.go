@@ -34,17 +34,19 @@ type Host struct {
 	// It uses tokens to represent an unique ProtocolInstance in the system
 	overlay *Overlay
 	// The open connections
-	connections map[uuid.UUID]network.SecureConn
+	connections map[string]network.SecureConn
+	// The connections being opened, by Entity-id
+	dialing map[string]*dial
 	// chan of received messages - testmode
 	networkChan chan network.NetworkMessage
 	// The database of entities this host knows
-	entities map[uuid.UUID]*network.Entity
+	entities map[string]*network.Entity
 	// lock associated to access entityLists
 	entityListsLock sync.RWMutex
 	// treeMarshal that needs to be converted to Tree but host does not have the
 	// entityList associated yet.
 	// map from EntityList.ID => trees that use this entity list
-	pendingTreeMarshal map[uuid.UUID][]*TreeMarshal
+	pendingTreeMarshal map[string][]*TreeMarshal
 	// pendingSDAData are a list of message we received that does not correspond
 	// to any local tree or/and entitylist. We first request theses so we can
 	// instantiate properly protocolinstance that will use these SDAData msg.
@@ -71,24 +73,51 @@ type Host struct {
 	processMessagesStarted bool
 	// tell processMessages to quit
 	ProcessMessagesQuit chan bool
+	// handlers for the network-messages that are not for the Host itself,
+	// indexed by the message-type
+	networkHandlers     map[uuid.UUID]NetworkHandler
+	networkHandlersLock sync.Mutex
+	// values kept by protocols for this Host, see Value
+	values     map[string]interface{}
+	valuesLock sync.Mutex
 }
 
+// NetworkHandler handles a network-message of a type registered with
+// RegisterNetworkHandler. It is called from the message-loop of the Host,
+// so it must not block.
+type NetworkHandler func(msg *network.NetworkMessage)
+
 // NewHost starts a new Host that will listen on the network for incoming
-// messages. It will store the private-key.
+// messages. It will store the private-key and add the proof-of-possession
+// of it to the Entity if it is missing. It uses the default suite.
 func NewHost(e *network.Entity, pkey abstract.Secret) *Host {
+	return NewHostWithSuite(network.Suite, e, pkey)
+}
+
+// NewHostWithSuite starts a new Host whose keys and protocols use suite. It
+// only accepts EntityLists of the same suite.
+func NewHostWithSuite(suite abstract.Suite, e *network.Entity, pkey abstract.Secret) *Host {
+	if e.VerifyProof(suite) != nil {
+		if err := e.Prove(suite, pkey); err != nil {
+			dbg.Error("Couldn't prove possession of private key:", err)
+		}
+	}
 	h := &Host{
 		Entity:              e,
 		workingAddress:      e.First(),
-		connections:         make(map[uuid.UUID]network.SecureConn),
-		entities:            make(map[uuid.UUID]*network.Entity),
-		pendingTreeMarshal:  make(map[uuid.UUID][]*TreeMarshal),
+		connections:         make(map[string]network.SecureConn),
+		dialing:             make(map[string]*dial),
+		entities:            make(map[string]*network.Entity),
+		pendingTreeMarshal:  make(map[string][]*TreeMarshal),
 		pendingSDAs:         make([]*SDAData, 0),
-		host:                network.NewSecureTcpHost(pkey, e),
+		host:                network.NewSecureTcpHostWithSuite(suite, pkey, e),
 		private:             pkey,
-		suite:               network.Suite,
+		suite:               suite,
 		networkChan:         make(chan network.NetworkMessage, 1),
 		isClosing:           false,
 		ProcessMessagesQuit: make(chan bool),
+		networkHandlers:     make(map[uuid.UUID]NetworkHandler),
+		values:              make(map[string]interface{}),
 	}
 
 	h.overlay = NewOverlay(h)
@@ -99,6 +128,8 @@ type HostConfig struct {
 	Public   string
 	Private  string
 	HostAddr []string
+	// Suite is the name of the suite of the keys, empty for the default
+	Suite string `toml:",omitempty"`
 }
 
 // NewHostFromFile reads the configuration-options from the given file
@@ -109,26 +140,30 @@ func NewHostFromFile(name string) (*Host, error) {
 	if err != nil {
 		return nil, err
 	}
-	private, err := cliutils.ReadSecretHex(network.Suite, hc.Private)
+	suite, err := network.SuiteByName(hc.Suite)
 	if err != nil {
 		return nil, err
 	}
-	public, err := cliutils.ReadPubHex(network.Suite, hc.Public)
+	private, err := cliutils.ReadSecretHex(suite, hc.Private)
+	if err != nil {
+		return nil, err
+	}
+	public, err := cliutils.ReadPubHex(suite, hc.Public)
 	if err != nil {
 		return nil, err
 	}
 	entity := network.NewEntity(public, hc.HostAddr...)
-	host := NewHost(entity, private)
+	host := NewHostWithSuite(suite, entity, private)
 	return host, nil
 }
 
 // SaveToFile puts the private/public key and the hostname into a file
 func (h *Host) SaveToFile(name string) error {
-	public, err := cliutils.PubHex(network.Suite, h.Entity.Public)
+	public, err := cliutils.PubHex(h.suite, h.Entity.Public)
 	if err != nil {
 		return err
 	}
-	private, err := cliutils.SecretHex(network.Suite, h.private)
+	private, err := cliutils.SecretHex(h.suite, h.private)
 	if err != nil {
 		return err
 	}
@@ -136,6 +171,7 @@ func (h *Host) SaveToFile(name string) error {
 		Public:   public,
 		Private:  private,
 		HostAddr: h.Entity.Addresses,
+		Suite:    h.suite.String(),
 	}
 	buf := new(bytes.Buffer)
 	err = toml.NewEncoder(buf).Encode(hc)
@@ -191,22 +227,41 @@ func (h *Host) ListenNoblock() {
 	h.listen(false)
 }
 
-// Connect takes an entity where to connect to
+// Connect takes an entity where to connect to. Concurrent calls for the
+// same entity share one connection.
 func (h *Host) Connect(id *network.Entity) (network.SecureConn, error) {
-	var err error
-	var c network.SecureConn
-	// try to open connection
 	h.networkLock.Lock()
-	c, err = h.host.Open(id)
+	if d, ok := h.dialing[string(id.Id)]; ok {
+		h.networkLock.Unlock()
+		<-d.done
+		return d.conn, d.err
+	}
+	d := &dial{done: make(chan struct{})}
+	h.dialing[string(id.Id)] = d
 	h.networkLock.Unlock()
 
-	if err != nil {
-		return nil, err
+	// try to open connection. This is done without holding the
+	// networkLock, as connecting to a dead host takes a while and would
+	// block all other messages. The lock is only taken to register the
+	// connection.
+	d.conn, d.err = h.host.Open(id)
+	if d.err == nil {
+		dbg.Lvl3("Host", h.workingAddress, "connected to", d.conn.Remote())
+		h.registerConnection(d.conn)
+		go h.handleConn(d.conn)
 	}
-	dbg.Lvl3("Host", h.workingAddress, "connected to", c.Remote())
-	h.registerConnection(c)
-	go h.handleConn(c)
-	return c, nil
+	h.networkLock.Lock()
+	delete(h.dialing, string(id.Id))
+	h.networkLock.Unlock()
+	close(d.done)
+	return d.conn, d.err
+}
+
+// dial is a connection being opened by Connect
+type dial struct {
+	done chan struct{}
+	conn network.SecureConn
+	err  error
 }
 
 // Close shuts down the listener
@@ -236,18 +291,59 @@ func (h *Host) Close() error {
 	}
 	dbg.Lvl3(h.Entity.First(), "Closing tcpHost")
 	err := h.host.Close()
-	h.connections = make(map[uuid.UUID]network.SecureConn)
+	h.connections = make(map[string]network.SecureConn)
 	h.overlay.Close()
+	h.closeValues()
 	return err
 }
 
+// Value returns the value stored under key in this Host, creating it with
+// create if there is none yet. If create is nil, a missing value is
+// returned as nil. Protocols use it for the state that outlives their
+// instances, as it is dropped together with the Host: on Close, every value
+// that has a Close-method is closed.
+func (h *Host) Value(key string, create func() interface{}) interface{} {
+	h.valuesLock.Lock()
+	defer h.valuesLock.Unlock()
+	v, ok := h.values[key]
+	if !ok && create != nil {
+		v = create()
+		h.values[key] = v
+	}
+	return v
+}
+
+// SetValue stores v under key in this Host, replacing the value that might
+// be there. See Value.
+func (h *Host) SetValue(key string, v interface{}) {
+	h.valuesLock.Lock()
+	defer h.valuesLock.Unlock()
+	h.values[key] = v
+}
+
+// closeValues drops all values of the Host
+func (h *Host) closeValues() {
+	h.valuesLock.Lock()
+	defer h.valuesLock.Unlock()
+	for key, v := range h.values {
+		if c, ok := v.(interface {
+			Close() error
+		}); ok {
+			if err := c.Close(); err != nil {
+				dbg.Error(h.Entity.First(), "Couldn't close", key, err)
+			}
+		}
+	}
+	h.values = make(map[string]interface{})
+}
+
 // SendRaw sends to an Entity without wrapping the msg into a SDAMessage
 func (h *Host) SendRaw(e *network.Entity, msg network.ProtocolMessage) error {
 	if msg == nil {
 		return errors.New("Can't send nil-packet")
 	}
 	h.entityListsLock.RLock()
-	if _, ok := h.entities[e.Id]; !ok {
+	if _, ok := h.entities[string(e.Id)]; !ok {
 		dbg.Lvl4(h.Entity.First(), "Connecting to", e.Addresses)
 		h.entityListsLock.RUnlock()
 		// Connect to that entity
@@ -261,7 +357,7 @@ func (h *Host) SendRaw(e *network.Entity, msg network.ProtocolMessage) error {
 	var c network.SecureConn
 	var ok bool
 	h.networkLock.Lock()
-	if c, ok = h.connections[e.Id]; !ok {
+	if c, ok = h.connections[string(e.Id)]; !ok {
 		h.networkLock.Unlock()
 		return errors.New("Got no connection tied to this Entity")
 	}
@@ -324,7 +420,7 @@ func (h *Host) processMessages() {
 		// A Host has replied to our request of a tree
 		case SendTreeMessage:
 			tm := data.Msg.(TreeMarshal)
-			if tm.NodeId == uuid.Nil {
+			if len(tm.NodeId) == 0 {
 				dbg.Error("Received an empty Tree")
 				continue
 			}
@@ -363,16 +459,37 @@ func (h *Host) processMessages() {
 		// Host replied to our request of entitylist
 		case SendEntityListMessage:
 			il := data.Msg.(EntityList)
-			if il.Id == uuid.Nil {
+			if len(il.Id) == 0 {
 				dbg.Lvl2("Received an empty EntityList")
 			} else {
-				h.overlay.RegisterEntityList(&il)
+				if il.SuiteName != h.suite.String() {
+					dbg.Error("Received EntityList with suite", il.SuiteName)
+					continue
+				}
+				// Re-create the EntityList to verify its id and proofs
+				el, err := NewEntityListWithSuite(h.suite, il.List)
+				if err != nil {
+					dbg.Error("Received EntityList with wrong proofs:", err)
+					continue
+				}
+				if !el.Id.Equal(il.Id) {
+					dbg.Error("Received EntityList with wrong id")
+					continue
+				}
+				h.overlay.RegisterEntityList(el)
 				// Check if some trees can be constructed from this entitylist
-				h.checkPendingTreeMarshal(&il)
+				h.checkPendingTreeMarshal(el)
 			}
 			dbg.Lvl4("Received new entityList")
 		default:
-			dbg.Error("Didn't recognize message", data.MsgType)
+			h.networkHandlersLock.Lock()
+			handler, ok := h.networkHandlers[data.MsgType]
+			h.networkHandlersLock.Unlock()
+			if ok {
+				handler(&data)
+			} else {
+				dbg.Error("Didn't recognize message", data.MsgType)
+			}
 		}
 		if err != nil {
 			dbg.Error("Sending error:", err)
@@ -380,6 +497,15 @@ func (h *Host) processMessages() {
 	}
 }
 
+// RegisterNetworkHandler lets services outside of the trees, like clients,
+// send messages of type msgType to this Host: they are passed to fn. The
+// answer can be sent with SendRaw to msg.Entity.
+func (h *Host) RegisterNetworkHandler(msgType uuid.UUID, fn NetworkHandler) {
+	h.networkHandlersLock.Lock()
+	defer h.networkHandlersLock.Unlock()
+	h.networkHandlers[msgType] = fn
+}
+
 // sendSDAData marshals the inner msg and then sends a SDAData msg
 // to the appropriate entity
 func (h *Host) sendSDAData(e *network.Entity, sdaMsg *SDAData) error {
@@ -460,7 +586,7 @@ func (h *Host) checkPendingSDA(t *Tree) {
 		newPending := make([]*SDAData, 0)
 		for _, msg := range h.pendingSDAs {
 			// if this message references t
-			if uuid.Equal(t.Id, msg.To.TreeID) {
+			if t.Id.Equal(msg.To.TreeID) {
 				// instantiate it and go
 				err := h.overlay.TransmitMsg(msg)
 				if err != nil {
@@ -486,8 +612,8 @@ func (h *Host) registerConnection(c network.SecureConn) {
 	defer h.networkLock.Unlock()
 	defer h.entityListsLock.Unlock()
 	id := c.Entity()
-	h.entities[c.Entity().Id] = id
-	h.connections[c.Entity().Id] = c
+	h.entities[string(c.Entity().Id)] = id
+	h.connections[string(c.Entity().Id)] = c
 }
 
 // addPendingTreeMarshal adds a treeMarshal to the list.
@@ -498,11 +624,11 @@ func (h *Host) addPendingTreeMarshal(tm *TreeMarshal) {
 	var sl []*TreeMarshal
 	var ok bool
 	// initiate the slice before adding
-	if sl, ok = h.pendingTreeMarshal[tm.EntityId]; !ok {
+	if sl, ok = h.pendingTreeMarshal[string(tm.EntityId)]; !ok {
 		sl = make([]*TreeMarshal, 0)
 	}
 	sl = append(sl, tm)
-	h.pendingTreeMarshal[tm.EntityId] = sl
+	h.pendingTreeMarshal[string(tm.EntityId)] = sl
 	h.pendingTreeLock.Unlock()
 }
 
@@ -511,7 +637,7 @@ func (h *Host) addPendingTreeMarshal(tm *TreeMarshal) {
 // converted to Tree.
 func (h *Host) checkPendingTreeMarshal(el *EntityList) {
 	h.pendingTreeLock.Lock()
-	sl, ok := h.pendingTreeMarshal[el.Id]
+	sl, ok := h.pendingTreeMarshal[string(el.Id)]
 	if !ok {
 		// no tree for this entitty list
 		return
@@ -548,6 +674,18 @@ func (h *Host) StartNewNode(protoID uuid.UUID, tree *Tree) (*Node, error) {
 	return h.overlay.StartNewNode(protoID, tree)
 }
 
+// CreateNewNode creates a Node with the protocol protoID but doesn't start
+// it, so that it can be set up before calling Start.
+func (h *Host) CreateNewNode(protoID uuid.UUID, tree *Tree) (*Node, error) {
+	return h.overlay.CreateNewNode(protoID, tree)
+}
+
+// CreateNewNodeName creates a Node with the protocol 'name' but doesn't
+// start it, so that it can be set up before calling Start.
+func (h *Host) CreateNewNodeName(name string, tree *Tree) (*Node, error) {
+	return h.overlay.CreateNewNodeName(name, tree)
+}
+
 func SetupHostsMock(s abstract.Suite, addresses ...string) []*Host {
 	var hosts []*Host
 	for _, add := range addresses {
@@ -1,6 +1,7 @@
 package sda
 
 import (
+	"github.com/dedis/cothority/lib/crypto"
 	"github.com/dedis/cothority/lib/network"
 	"github.com/satori/go.uuid"
 )
@@ -27,6 +28,9 @@ type SDAData struct {
 	Msg network.ProtocolMessage
 	// The actual data as binary blob
 	MsgSlice []byte
+	// SeqNo is the sequence-number of the message from the sending TreeNode
+	// to the receiving TreeNode. 0 means the message is not sequenced.
+	SeqNo uint32
 }
 
 // A Token contains all identifiers needed to Uniquely identify one protocol
@@ -35,42 +39,42 @@ type SDAData struct {
 // host knows how to create the SDAData message around the protocol's message
 // with the right fields set.
 type Token struct {
-	EntityListID uuid.UUID
-	TreeID       uuid.UUID
+	EntityListID crypto.HashId
+	TreeID       crypto.HashId
 	ProtocolID   uuid.UUID
 	RoundID      uuid.UUID
-	TreeNodeID   uuid.UUID
-	cacheId      uuid.UUID
+	TreeNodeID   crypto.HashId
+	cacheId      crypto.HashId
 }
 
-// Returns the Id of a token so we can put that in a map easily
-func (t *Token) Id() uuid.UUID {
-	if t.cacheId == uuid.Nil {
-		url := network.UuidURL + "token/" + t.EntityListID.String() +
-			t.RoundID.String() + t.ProtocolID.String() + t.TreeID.String() +
-			t.TreeNodeID.String()
-		t.cacheId = uuid.NewV5(uuid.NamespaceURL, url)
+// Returns the Id of a token so we can put that in a map easily (using
+// string(Id()) as the key)
+func (t *Token) Id() crypto.HashId {
+	if t.cacheId == nil {
+		t.cacheId = crypto.NewHashId([]byte("token"), t.EntityListID,
+			t.RoundID.Bytes(), t.ProtocolID.Bytes(), t.TreeID,
+			t.TreeNodeID)
 	}
 	return t.cacheId
 }
 
 // Return a new Token contianing a reference to the given TreeNode
-func (t *Token) ChangeTreeNodeID(newid uuid.UUID) *Token {
+func (t *Token) ChangeTreeNodeID(newid crypto.HashId) *Token {
 	t_other := *t
 	t_other.TreeNodeID = newid
-	t_other.cacheId = uuid.Nil
+	t_other.cacheId = nil
 	return &t_other
 }
 
 // RequestTree is used to ask the parent for a given Tree
 type RequestTree struct {
 	// The treeID of the tree we want
-	TreeID uuid.UUID
+	TreeID crypto.HashId
 }
 
 // RequestEntityList is used to ask the parent for a given EntityList
 type RequestEntityList struct {
-	EntityListID uuid.UUID
+	EntityListID crypto.HashId
 }
 
 // In case the entity list is unknown
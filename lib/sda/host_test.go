@@ -4,9 +4,11 @@ import (
 	"testing"
 	"time"
 
+	"github.com/dedis/cothority/lib/crypto"
 	"github.com/dedis/cothority/lib/dbg"
 	"github.com/dedis/cothority/lib/network"
 	"github.com/dedis/cothority/lib/sda"
+	"github.com/dedis/crypto/config"
 	"github.com/satori/go.uuid"
 )
 
@@ -60,6 +62,43 @@ func TestHostClose(t *testing.T) {
 	}
 }
 
+// closeValue counts how often it has been closed
+type closeValue struct {
+	closed int
+}
+
+func (c *closeValue) Close() error {
+	c.closed++
+	return nil
+}
+
+// Test that the values of a Host are kept until it closes
+func TestHostValue(t *testing.T) {
+	defer dbg.AfterTest(t)
+	h1 := sda.NewLocalHost(2000)
+	create := func() interface{} { return &closeValue{} }
+	v := h1.Value("test", create).(*closeValue)
+	if h1.Value("test", create) != v {
+		t.Fatal("Value should be created only once")
+	}
+	if h1.Value("other", nil) != nil {
+		t.Fatal("Missing value should be nil")
+	}
+	h1.SetValue("other", &closeValue{})
+	if h1.Value("other", nil) == nil {
+		t.Fatal("Value should be set")
+	}
+	if err := h1.Close(); err != nil {
+		t.Fatal("Couldn't close", err)
+	}
+	if v.closed != 1 {
+		t.Fatal("Value should be closed with the Host")
+	}
+	if h1.Value("test", create) == v {
+		t.Fatal("Value should be dropped with the Host")
+	}
+}
+
 func TestHostClose2(t *testing.T) {
 	defer dbg.AfterTest(t)
 
@@ -181,7 +220,7 @@ func TestPeerListPropagation(t *testing.T) {
 	if msg.MsgType != sda.SendEntityListMessage {
 		t.Fatal("h1 didn't receive EntityList type, but", msg.MsgType)
 	}
-	if msg.Msg.(sda.EntityList).Id != uuid.Nil {
+	if len(msg.Msg.(sda.EntityList).Id) != 0 {
 		t.Fatal("List should be empty")
 	}
 
@@ -195,7 +234,7 @@ func TestPeerListPropagation(t *testing.T) {
 	if msg.MsgType != sda.SendEntityListMessage {
 		t.Fatal("h1 didn't receive EntityList type")
 	}
-	if msg.Msg.(sda.EntityList).Id != el.Id {
+	if !msg.Msg.(sda.EntityList).Id.Equal(el.Id) {
 		t.Fatal("List should be equal to original list")
 	}
 
@@ -210,11 +249,48 @@ func TestPeerListPropagation(t *testing.T) {
 	if !ok {
 		t.Fatal("List-id not found")
 	}
-	if list.Id != el.Id {
+	if !list.Id.Equal(el.Id) {
 		t.Fatal("IDs do not match")
 	}
 }
 
+// Test that an EntityList with a rogue key is not accepted
+func TestPeerListRogueKey(t *testing.T) {
+	defer dbg.AfterTest(t)
+	local := sda.NewLocalTest()
+	hosts, el, _ := local.GenTree(2, true, false, false)
+	defer local.CloseAll()
+	h1 := hosts[0]
+	h2 := hosts[1]
+	h2.StartProcessMessages()
+
+	attacker := config.NewKeyPair(network.Suite)
+	rogue := network.NewEntity(network.Suite.Point().Sub(attacker.Public,
+		el.Aggregate), "localhost:2010")
+	if err := rogue.Prove(network.Suite, attacker.Secret); err != nil {
+		t.Fatal(err)
+	}
+	// NewEntityList refuses the rogue key, so the list is built by hand
+	rogueList := &sda.EntityList{
+		Id:        crypto.NewHashId([]byte("rogue")),
+		List:      append(el.List, rogue),
+		SuiteName: el.SuiteName,
+	}
+	if err := h1.SendRaw(h2.Entity, rogueList); err != nil {
+		t.Fatal("Couldn't send message to h2:", err)
+	}
+	if err := h1.SendRaw(h2.Entity, el); err != nil {
+		t.Fatal("Couldn't send message to h2:", err)
+	}
+	time.Sleep(time.Second)
+	if _, ok := h2.EntityList(el.Id); !ok {
+		t.Fatal("Honest list should be accepted")
+	}
+	if _, ok := h2.EntityList(rogueList.Id); ok {
+		t.Fatal("List with rogue key shouldn't be accepted")
+	}
+}
+
 // Test propagation of tree - both known and unknown
 func TestTreePropagation(t *testing.T) {
 	defer dbg.AfterTest(t)
@@ -238,7 +314,7 @@ func TestTreePropagation(t *testing.T) {
 		network.DumpTypes()
 		t.Fatal("h1 didn't receive SendTree type:", msg.MsgType)
 	}
-	if msg.Msg.(sda.TreeMarshal).EntityId != uuid.Nil {
+	if len(msg.Msg.(sda.TreeMarshal).EntityId) != 0 {
 		t.Fatal("List should be empty")
 	}
 
@@ -252,7 +328,7 @@ func TestTreePropagation(t *testing.T) {
 	if msg.MsgType != sda.SendTreeMessage {
 		t.Fatal("h1 didn't receive Tree-type")
 	}
-	if msg.Msg.(sda.TreeMarshal).NodeId != tree.Id {
+	if !msg.Msg.(sda.TreeMarshal).NodeId.Equal(tree.Id) {
 		t.Fatal("Tree should be equal to original tree")
 	}
 
@@ -322,27 +398,27 @@ func TestListTreePropagation(t *testing.T) {
 
 func TestTokenId(t *testing.T) {
 	t1 := &sda.Token{
-		EntityListID: uuid.NewV1(),
-		TreeID:       uuid.NewV1(),
+		EntityListID: crypto.NewHashId([]byte("entitylist1")),
+		TreeID:       crypto.NewHashId([]byte("tree1")),
 		ProtocolID:   uuid.NewV1(),
 		RoundID:      uuid.NewV1(),
 	}
 	id1 := t1.Id()
 	t2 := &sda.Token{
-		EntityListID: uuid.NewV1(),
-		TreeID:       uuid.NewV1(),
+		EntityListID: crypto.NewHashId([]byte("entitylist2")),
+		TreeID:       crypto.NewHashId([]byte("tree2")),
 		ProtocolID:   uuid.NewV1(),
 		RoundID:      uuid.NewV1(),
 	}
 	id2 := t2.Id()
-	if uuid.Equal(id1, id2) {
+	if id1.Equal(id2) {
 		t.Fatal("Both token are the same")
 	}
-	if !uuid.Equal(id1, t1.Id()) {
+	if !id1.Equal(t1.Id()) {
 		t.Fatal("Twice the Id of the same token should be equal")
 	}
-	t3 := t1.ChangeTreeNodeID(uuid.NewV1())
-	if uuid.Equal(t1.TreeNodeID, t3.TreeNodeID) {
+	t3 := t1.ChangeTreeNodeID(crypto.NewHashId([]byte("treenode")))
+	if t1.TreeNodeID.Equal(t3.TreeNodeID) {
 		t.Fatal("OtherToken should modify copy")
 	}
 }
@@ -370,6 +446,37 @@ func TestAutoConnection(t *testing.T) {
 	}
 }
 
+// Test that a client gets the reply of a Host, or an error if there is none
+func TestRequest(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+	h1 := sda.NewLocalHost(2000)
+	h1.Listen()
+	h1.StartProcessMessages()
+	defer h1.Close()
+	h1.RegisterNetworkHandler(SimpleMessageType, func(msg *network.NetworkMessage) {
+		i := msg.Msg.(SimpleMessage).I
+		if i == 0 {
+			// no reply
+			return
+		}
+		if err := h1.SendRaw(msg.Entity, &SimpleMessage{i + 1}); err != nil {
+			t.Error("Couldn't reply:", err)
+		}
+	})
+
+	reply, err := sda.Request(network.Suite, h1.Entity, &SimpleMessage{12}, time.Second)
+	if err != nil {
+		t.Fatal("Couldn't get reply:", err)
+	}
+	if reply.(SimpleMessage).I != 13 {
+		t.Fatal("Wrong reply", reply)
+	}
+	if _, err := sda.Request(network.Suite, h1.Entity, &SimpleMessage{0}, 100*time.Millisecond); err == nil {
+		t.Fatal("Request without reply should time out")
+	}
+}
+
 func SetupTwoHosts(t *testing.T, h2process bool) (*sda.Host, *sda.Host) {
 	hosts := sda.GenLocalHosts(2, true, false)
 	if h2process {
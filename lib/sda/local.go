@@ -1,11 +1,13 @@
 package sda
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
 	"testing"
 
+	"github.com/dedis/cothority/lib/crypto"
 	"github.com/dedis/cothority/lib/dbg"
 	"github.com/dedis/cothority/lib/network"
 	"github.com/dedis/crypto/abstract"
@@ -16,13 +18,15 @@ import (
 
 type LocalTest struct {
 	// A map of Entity.Id to Hosts
-	Hosts map[uuid.UUID]*Host
+	Hosts map[string]*Host
 	// A map of Entity.Id to Overlays
-	Overlays map[uuid.UUID]*Overlay
+	Overlays map[string]*Overlay
 	// A map of EntityList.Id to EntityLists
-	EntityLists map[uuid.UUID]*EntityList
+	EntityLists map[string]*EntityList
 	// A map of Tree.Id to Trees
-	Trees map[uuid.UUID]*Tree
+	Trees map[string]*Tree
+	// Suite used by the hosts that are generated
+	Suite abstract.Suite
 }
 
 // NewLocalTest creates a new Local handler that can be used to test protocols
@@ -30,10 +34,11 @@ type LocalTest struct {
 func NewLocalTest() *LocalTest {
 	dbg.TestOutput(testing.Verbose(), 3)
 	return &LocalTest{
-		Hosts:       make(map[uuid.UUID]*Host),
-		Overlays:    make(map[uuid.UUID]*Overlay),
-		EntityLists: make(map[uuid.UUID]*EntityList),
-		Trees:       make(map[uuid.UUID]*Tree),
+		Hosts:       make(map[string]*Host),
+		Overlays:    make(map[string]*Overlay),
+		EntityLists: make(map[string]*EntityList),
+		Trees:       make(map[string]*Tree),
+		Suite:       network.Suite,
 	}
 }
 
@@ -42,10 +47,10 @@ func NewLocalTest() *LocalTest {
 func (l *LocalTest) StartNewNodeName(name string, t *Tree) (*Node, error) {
 	rootEntityId := t.Root.Entity.Id
 	for _, h := range l.Hosts {
-		if uuid.Equal(h.Entity.Id, rootEntityId) {
+		if h.Entity.Id.Equal(rootEntityId) {
 			// XXX do we really need multiples overlays ? Can't we just use the
 			// Node, since it is already dispatched as like a TreeNode ?
-			return l.Overlays[h.Entity.Id].StartNewNodeName(name, t)
+			return l.Overlays[string(h.Entity.Id)].StartNewNodeName(name, t)
 		}
 	}
 	return nil, errors.New("Didn't find host for tree-root")
@@ -54,10 +59,10 @@ func (l *LocalTest) StartNewNodeName(name string, t *Tree) (*Node, error) {
 func (l *LocalTest) NewNodeEmptyName(name string, t *Tree) (*Node, error) {
 	rootEntityId := t.Root.Entity.Id
 	for _, h := range l.Hosts {
-		if uuid.Equal(h.Entity.Id, rootEntityId) {
+		if h.Entity.Id.Equal(rootEntityId) {
 			// XXX do we really need multiples overlays ? Can't we just use the
 			// Node, since it is already dispatched as like a TreeNode ?
-			return l.Overlays[h.Entity.Id].NewNodeEmptyName(name, t)
+			return l.Overlays[string(h.Entity.Id)].NewNodeEmptyName(name, t)
 		}
 	}
 	return nil, errors.New("Didn't find host for tree-root")
@@ -67,15 +72,15 @@ func (l *LocalTest) NewNodeEmptyName(name string, t *Tree) (*Node, error) {
 // be connected to the root host. If register is true, the EntityList and Tree
 // will be registered with the overlay.
 func (l *LocalTest) GenTree(n int, connect, processMsg, register bool) ([]*Host, *EntityList, *Tree) {
-	hosts := GenLocalHosts(n, connect, processMsg)
+	hosts := genLocalHosts(l.Suite, n, connect, processMsg)
 	for _, host := range hosts {
-		l.Hosts[host.Entity.Id] = host
-		l.Overlays[host.Entity.Id] = host.overlay
+		l.Hosts[string(host.Entity.Id)] = host
+		l.Overlays[string(host.Entity.Id)] = host.overlay
 	}
 
 	list := l.GenEntityListFromHost(hosts...)
 	tree := list.GenerateBinaryTree()
-	l.Trees[tree.Id] = tree
+	l.Trees[string(tree.Id)] = tree
 	if register {
 		hosts[0].overlay.RegisterEntityList(list)
 		hosts[0].overlay.RegisterTree(tree)
@@ -91,15 +96,15 @@ func (l *LocalTest) GenTree(n int, connect, processMsg, register bool) ([]*Host,
 // nbrHosts can be smaller than nbrTreeNodes, in which case a given host will
 // be used more than once in the tree.
 func (l *LocalTest) GenBigTree(nbrTreeNodes, nbrHosts, bf int, connect bool, register bool) ([]*Host, *EntityList, *Tree) {
-	hosts := GenLocalHosts(nbrHosts, connect, true)
+	hosts := genLocalHosts(l.Suite, nbrHosts, connect, true)
 	for _, host := range hosts {
-		l.Hosts[host.Entity.Id] = host
-		l.Overlays[host.Entity.Id] = host.overlay
+		l.Hosts[string(host.Entity.Id)] = host
+		l.Overlays[string(host.Entity.Id)] = host.overlay
 	}
 
 	list := l.GenEntityListFromHost(hosts...)
 	tree := list.GenerateBigNaryTree(bf, nbrTreeNodes)
-	l.Trees[tree.Id] = tree
+	l.Trees[string(tree.Id)] = tree
 	if register {
 		hosts[0].overlay.RegisterEntityList(list)
 		hosts[0].overlay.RegisterTree(tree)
@@ -107,13 +112,49 @@ func (l *LocalTest) GenBigTree(nbrTreeNodes, nbrHosts, bf int, connect bool, reg
 	return hosts, list, tree
 }
 
+// GenTreeFromJSON replays a tree written by Tree.JSON. As the private keys of
+// the original entities are not known, a new local host is created for each
+// entry of the EntityList and the tree-structure is copied over to the new
+// hosts. If register is true, the EntityList and Tree will be registered with
+// the overlay of the root.
+func (l *LocalTest) GenTreeFromJSON(buf []byte, connect, register bool) ([]*Host, *EntityList, *Tree, error) {
+	tj := &TreeJSON{}
+	if err := json.Unmarshal(buf, tj); err != nil {
+		return nil, nil, nil, err
+	}
+	if tj.EntityList == nil || tj.Root == nil {
+		return nil, nil, nil, errors.New("Missing EntityList or Root in tree")
+	}
+	hosts := genLocalHosts(l.Suite, len(tj.EntityList.List), connect, true)
+	for _, host := range hosts {
+		l.Hosts[string(host.Entity.Id)] = host
+		l.Overlays[string(host.Entity.Id)] = host.overlay
+	}
+
+	list := l.GenEntityListFromHost(hosts...)
+	tree, err := tj.Tree(list)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	l.Trees[string(tree.Id)] = tree
+	if register {
+		root := l.Hosts[string(tree.Root.Entity.Id)]
+		root.overlay.RegisterEntityList(list)
+		root.overlay.RegisterTree(tree)
+	}
+	return hosts, list, tree, nil
+}
+
 func (l *LocalTest) GenEntityListFromHost(hosts ...*Host) *EntityList {
 	var entities []*network.Entity
 	for i := range hosts {
 		entities = append(entities, hosts[i].Entity)
 	}
-	list := NewEntityList(entities)
-	l.EntityLists[list.Id] = list
+	list, err := NewEntityListWithSuite(l.Suite, entities)
+	if err != nil {
+		dbg.Fatal("Couldn't create EntityList:", err)
+	}
+	l.EntityLists[string(list.Id)] = list
 	return list
 }
 
@@ -140,7 +181,7 @@ func (l *LocalTest) GetTree(tn *TreeNode) *Tree {
 
 // NewNode creates a new node on a TreeNode
 func (l *LocalTest) NewNode(tn *TreeNode, protName string) (*Node, error) {
-	o := l.Overlays[tn.Entity.Id]
+	o := l.Overlays[string(tn.Entity.Id)]
 	if o == nil {
 		return nil, errors.New("Didn't find corresponding overlay")
 	}
@@ -165,7 +206,7 @@ func (l *LocalTest) NewNode(tn *TreeNode, protName string) (*Node, error) {
 // GetNodes returns all Nodes that belong to a treeNode
 func (l *LocalTest) GetNodes(tn *TreeNode) []*Node {
 	nodes := make([]*Node, 0)
-	for _, n := range l.Overlays[tn.Entity.Id].nodes {
+	for _, n := range l.Overlays[string(tn.Entity.Id)].nodes {
 		nodes = append(nodes, n)
 	}
 	return nodes
@@ -174,20 +215,22 @@ func (l *LocalTest) GetNodes(tn *TreeNode) []*Node {
 // SendTreeNode injects a message directly in the Overlay-layer, bypassing
 // Host and Network
 func (l *LocalTest) SendTreeNode(proto string, from, to *Node, msg network.ProtocolMessage) error {
-	if from.Tree().Id != to.Tree().Id {
+	if !from.Tree().Id.Equal(to.Tree().Id) {
 		return errors.New("Can't send from one tree to another")
 	}
 	b, err := network.MarshalRegisteredType(msg)
 	if err != nil {
 		return err
 	}
-	sdaMsg := &SDAData{
-		MsgSlice: b,
-		MsgType:  network.TypeToUUID(msg),
-		From:     from.token,
-		To:       to.token,
-	}
-	return to.overlay.TransmitMsg(sdaMsg)
+	return from.sendSequenced(to.TreeNode(), func(seq uint32) error {
+		return to.overlay.TransmitMsg(&SDAData{
+			MsgSlice: b,
+			MsgType:  network.TypeToUUID(msg),
+			From:     from.token,
+			To:       to.token,
+			SeqNo:    seq,
+		})
+	})
 }
 
 func (l *LocalTest) AddPendingTreeMarshal(h *Host, tm *TreeMarshal) {
@@ -198,8 +241,8 @@ func (l *LocalTest) CheckPendingTreeMarshal(h *Host, el *EntityList) {
 	h.checkPendingTreeMarshal(el)
 }
 
-func (l *LocalTest) NodesFromOverlay(entityId uuid.UUID) map[uuid.UUID]*Node {
-	return l.Overlays[entityId].nodes
+func (l *LocalTest) NodesFromOverlay(entityId crypto.HashId) map[string]*Node {
+	return l.Overlays[string(entityId)].nodes
 }
 
 func (l *LocalTest) AllNodes() []*Node {
@@ -216,19 +259,28 @@ func (l *LocalTest) AllNodes() []*Node {
 
 // NewLocalHost creates a new host with the given address and registers it
 func NewLocalHost(port int) *Host {
+	return newLocalHost(network.Suite, port)
+}
+
+// newLocalHost creates a new host using suite
+func newLocalHost(suite abstract.Suite, port int) *Host {
 	address := "localhost:" + strconv.Itoa(port)
-	priv, pub := PrivPub()
-	id := network.NewEntity(pub, address)
-	return NewHost(id, priv)
+	keypair := config.NewKeyPair(suite)
+	id := network.NewEntity(keypair.Public, address)
+	return NewHostWithSuite(suite, id, keypair.Secret)
 }
 
 // GenLocalHosts will create n hosts with the first one being connected to each of
 // the other nodes if connect is true
 func GenLocalHosts(n int, connect bool, processMessages bool) []*Host {
+	return genLocalHosts(network.Suite, n, connect, processMessages)
+}
 
+// genLocalHosts is GenLocalHosts with hosts using suite
+func genLocalHosts(suite abstract.Suite, n int, connect bool, processMessages bool) []*Host {
 	hosts := make([]*Host, n)
 	for i := 0; i < n; i++ {
-		host := NewLocalHost(2000 + i*10)
+		host := newLocalHost(suite, 2000+i*10)
 		hosts[i] = host
 	}
 	root := hosts[0]
@@ -250,7 +302,7 @@ func GenLocalHosts(n int, connect bool, processMessages bool) []*Host {
 				time.Sleep(time.Millisecond * 10)
 				root.entityListsLock.RLock()
 				for id, _ := range root.entities {
-					if uuid.Equal(id, host.Entity.Id) {
+					if id == string(host.Entity.Id) {
 						connected = true
 						break
 					}
@@ -2,10 +2,12 @@ package sda
 
 import (
 	"errors"
-	"reflect"
-
 	"fmt"
+	"reflect"
+	"sync"
+	"time"
 
+	"github.com/dedis/cothority/lib/crypto"
 	"github.com/dedis/cothority/lib/dbg"
 	"github.com/dedis/cothority/lib/network"
 	"github.com/dedis/crypto/abstract"
@@ -22,10 +24,9 @@ type Node struct {
 	token   *Token
 	// cache for the TreeNode this Node is representing
 	treeNode *TreeNode
-	// channels holds all channels available for the different message-types
-	channels map[uuid.UUID]interface{}
-	// registered handler-functions for that protocol
-	handlers map[uuid.UUID]interface{}
+	// registered channels and handler-functions for the different
+	// message-types
+	handlers map[uuid.UUID]*msgHandler
 	// flags for messages - only one channel/handler possible
 	messageTypeFlags map[uuid.UUID]uint32
 	// The protocolInstance belonging to that node
@@ -33,6 +34,19 @@ type Node struct {
 	// aggregate messages in order to dispatch them at once in the protocol
 	// instance
 	msgQueue map[uuid.UUID][]*SDAData
+	// timers for the aggregation-timeouts
+	msgTimers    map[uuid.UUID]*aggregateTimer
+	msgTimerGen  uint64
+	msgQueueLock sync.Mutex
+	// dispatchLock protects the sequencing and the deliveries
+	dispatchLock sync.Mutex
+	// deliveries wait here for the handlers, which see one message at a
+	// time, also when the aggregation-timeout fires
+	deliveries []func() error
+	delivering bool
+	// sequence-numbers for ordered, exactly-once delivery
+	seq   *sequencer
+	stats *nodeStats
 	// done callback
 	onDoneCallback func() bool
 }
@@ -60,9 +74,11 @@ func NewNode(o *Overlay, tok *Token) (*Node, error) {
 func NewNodeEmpty(o *Overlay, tok *Token) (*Node, error) {
 	n := &Node{overlay: o,
 		token:            tok,
-		channels:         make(map[uuid.UUID]interface{}),
-		handlers:         make(map[uuid.UUID]interface{}),
+		handlers:         make(map[uuid.UUID]*msgHandler),
 		msgQueue:         make(map[uuid.UUID][]*SDAData),
+		msgTimers:        make(map[uuid.UUID]*aggregateTimer),
+		seq:              newSequencer(),
+		stats:            &nodeStats{},
 		messageTypeFlags: make(map[uuid.UUID]uint32),
 		treeNode:         nil,
 	}
@@ -110,12 +126,16 @@ func (n *Node) IsLeaf() bool {
 	return len(n.treeNode.Children) == 0
 }
 
-// SendTo sends to a given node
+// SendTo sends to a given node. The messages to a node are delivered in
+// the order they are sent, a message that couldn't be sent doesn't hold
+// back the following ones.
 func (n *Node) SendTo(to *TreeNode, msg interface{}) error {
 	if to == nil {
 		return errors.New("Sent to a nil TreeNode")
 	}
-	return n.overlay.SendToTreeNode(n.token, to, msg)
+	return n.sendSequenced(to, func(seq uint32) error {
+		return n.overlay.sendToTreeNode(n.token, to, msg, seq)
+	})
 }
 
 // Tree returns the tree of that node
@@ -134,84 +154,67 @@ func (n *Node) Suite() abstract.Suite {
 
 // RegisterChannel takes a channel with a struct that contains two
 // elements: a TreeNode and a message. It will send every message that are the
-// same type to this channel.
+// same type to this channel. The order of the two elements doesn't matter.
 // This function handles also
 // - registration of the message-type
 // - aggregation or not of messages: if you give a channel of slices, the
 //   messages will be aggregated, else they will come one-by-one
-func (n *Node) RegisterChannel(c interface{}) error {
-	flags := uint32(0)
+// If c is a pointer to a channel, the channel will be created.
+func (n *Node) RegisterChannel(c interface{}, opts ...HandlerOption) error {
 	cr := reflect.TypeOf(c)
-	if cr.Kind() == reflect.Ptr {
+	if cr != nil && cr.Kind() == reflect.Ptr {
 		val := reflect.ValueOf(c).Elem()
+		if val.Kind() != reflect.Chan {
+			return errors.New("Input is not pointer to channel")
+		}
 		val.Set(reflect.MakeChan(val.Type(), 100))
-		//val.Set(reflect.MakeChan(reflect.Indirect(cr), 1))
-		return n.RegisterChannel(reflect.Indirect(val).Interface())
-	} else if reflect.ValueOf(c).IsNil() {
-		return errors.New("Can not Register a (value) channel not initialized")
-	}
-	// Check we have the correct channel-type
-	if cr.Kind() != reflect.Chan {
-		return errors.New("Input is not channel")
+		return n.RegisterChannel(reflect.Indirect(val).Interface(), opts...)
 	}
-	if cr.Elem().Kind() == reflect.Slice {
-		flags += AggregateMessages
-		cr = cr.Elem()
-	}
-	if cr.Elem().Kind() != reflect.Struct {
-		return errors.New("Input is not channel of structure")
+	h, err := newChannelHandler(c, opts)
+	if err != nil {
+		return err
 	}
-	if cr.Elem().NumField() != 2 {
-		return errors.New("Input is not channel of structure with 2 elements")
+	return n.addHandler(h)
+}
+
+// RegisterHandler takes a function that takes a struct that contains two
+// elements: a TreeNode and a message. The function will be called for every
+// message of that type. Like for RegisterChannel, a function taking a slice
+// of structs will get the aggregated messages of all children.
+func (n *Node) RegisterHandler(f interface{}, opts ...HandlerOption) error {
+	h, err := newStructHandler(f, opts)
+	if err != nil {
+		return err
 	}
-	if cr.Elem().Field(0).Type != reflect.TypeOf(&TreeNode{}) {
-		return errors.New("Input-channel doesn't have TreeNode as element")
+	return n.addHandler(h)
+}
+
+// RegisterTypedHandler takes a function with the sending TreeNode and the
+// message as arguments, like
+//   func(from *sda.TreeNode, msg *Announce) error
+// The message can be a struct or a pointer to a struct, and returning an
+// error is optional. For aggregation, the function takes slices:
+//   func(from []*sda.TreeNode, msgs []*Reply) error
+// Errors returned by the function are passed back to the dispatcher.
+func (n *Node) RegisterTypedHandler(f interface{}, opts ...HandlerOption) error {
+	h, err := newTypedHandler(f, opts)
+	if err != nil {
+		return err
 	}
-	// Automatic registration of the message to the network library.
-	typ := network.RegisterMessageUUID(network.RTypeToUUID(cr.Elem().Field(1).Type),
-		cr.Elem().Field(1).Type)
-	n.channels[typ] = c
-	//typ := network.RTypeToUUID(cr.Elem().Field(1).Type) n.channels[typ] = c
-	n.messageTypeFlags[typ] = flags
-	dbg.Lvl4("Registered channel", typ, "with flags", flags)
-	return nil
+	return n.addHandler(h)
 }
 
-// RegisterChannel takes a channel with a struct that contains two
-// elements: a TreeNode and a message. It will send every message that are the
-// same type to this channel.
-// This function handles also
-// - registration of the message-type
-// - aggregation or not of messages: if you give a channel of slices, the
-//   messages will be aggregated, else they will come one-by-one
-func (n *Node) RegisterHandler(c interface{}) error {
+// addHandler registers the message-type of the handler and stores it. An
+// earlier channel or handler for the same message-type is replaced.
+func (n *Node) addHandler(h *msgHandler) error {
+	typ := h.register()
 	flags := uint32(0)
-	cr := reflect.TypeOf(c)
-	// Check we have the correct channel-type
-	if cr.Kind() != reflect.Func {
-		return errors.New("Input is not function")
-	}
-	cr = cr.In(0)
-	if cr.Kind() == reflect.Slice {
+	if h.aggregate {
 		flags += AggregateMessages
-		cr = cr.Elem()
 	}
-	if cr.Kind() != reflect.Struct {
-		return errors.New("Input is not channel of structure")
-	}
-	if cr.NumField() != 2 {
-		return errors.New("Input is not channel of structure with 2 elements")
-	}
-	if cr.Field(0).Type != reflect.TypeOf(&TreeNode{}) {
-		return errors.New("Input-channel doesn't have TreeNode as element")
-	}
-	// Automatic registration of the message to the network library.
-	typ := network.RegisterMessageUUID(network.RTypeToUUID(cr.Field(1).Type),
-		cr.Field(1).Type)
-	//typ := network.RTypeToUUID(cr.Elem().Field(1).Type)
-	n.handlers[typ] = c
+	n.handlers[typ] = h
 	n.messageTypeFlags[typ] = flags
-	dbg.Lvl3("Registered handler", typ, "with flags", flags)
+	dbg.Lvl4("Registered handler", typ, "with flags", flags)
 	return nil
 }
 
@@ -255,66 +258,68 @@ func (n *Node) Shutdown() error {
 	return nil
 }
 
+// DispatchHandler takes messages of the same type and gives them to the
+// handler-function
 func (n *Node) DispatchHandler(msgSlice []*SDAData) error {
-	mt := msgSlice[0].MsgType
-	to := reflect.TypeOf(n.handlers[mt]).In(0)
-	f := reflect.ValueOf(n.handlers[mt])
-	if n.HasFlag(mt, AggregateMessages) {
-		msgs := reflect.MakeSlice(to, len(msgSlice), len(msgSlice))
-		for i, msg := range msgSlice {
-			msgs.Index(i).Set(n.ReflectCreate(to.Elem(), msg))
-		}
-		dbg.Lvl4("Dispatching aggregation to", n.Entity().Addresses)
-		f.Call([]reflect.Value{msgs})
-	} else {
-		for _, msg := range msgSlice {
-			dbg.Lvl4("Dispatching to", n.Entity().Addresses)
-			m := n.ReflectCreate(to, msg)
-			f.Call([]reflect.Value{m})
-		}
+	h := n.handlers[msgSlice[0].MsgType]
+	if h == nil || !h.function.IsValid() {
+		return errors.New("No handler registered for this message-type")
 	}
-	return nil
+	return h.dispatch(n, msgSlice)
 }
 
-func (n *Node) ReflectCreate(t reflect.Type, msg *SDAData) reflect.Value {
-	m := reflect.Indirect(reflect.New(t))
-	tn := n.Tree().GetTreeNode(msg.From.TreeNodeID)
-	if tn != nil {
-		m.Field(0).Set(reflect.ValueOf(tn))
-		m.Field(1).Set(reflect.Indirect(reflect.ValueOf(msg.Msg)))
+// DispatchChannel takes messages of the same type and sends them to a channel
+func (n *Node) DispatchChannel(msgSlice []*SDAData) error {
+	h := n.handlers[msgSlice[0].MsgType]
+	if h == nil || !h.channel.IsValid() {
+		return errors.New("No channel registered for this message-type")
 	}
-	return m
+	return h.dispatch(n, msgSlice)
 }
 
-// DispatchChannel takes a message and sends it to a channel
-func (n *Node) DispatchChannel(msgSlice []*SDAData) error {
-	mt := msgSlice[0].MsgType
-	to := reflect.TypeOf(n.channels[mt])
-	if n.HasFlag(mt, AggregateMessages) {
-		dbg.Lvl4("Received aggregated message of type:", mt)
-		to = to.Elem()
-		out := reflect.MakeSlice(to, len(msgSlice), len(msgSlice))
-		for i, msg := range msgSlice {
-			dbg.Lvl4("Dispatching aggregated to", to)
-			m := n.ReflectCreate(to.Elem(), msg)
-			dbg.Lvl4("Adding msg", m, "to", n.Entity().Addresses)
-			out.Index(i).Set(m)
-		}
-		reflect.ValueOf(n.channels[mt]).Send(out)
-	} else {
-		for _, msg := range msgSlice {
-			out := n.channels[mt]
-
-			m := n.ReflectCreate(to.Elem(), msg)
-			dbg.Lvl4("Dispatching msg type", mt, " to", to, " :", m.Field(1).Interface())
-			reflect.ValueOf(out).Send(m)
+// DispatchMsg will dispatch this SDAData to the right instance. Messages
+// with a sequence-number are dispatched in order and only once. The
+// handlers are not called if another message is being dispatched, the
+// other dispatch calls them in turn.
+func (n *Node) DispatchMsg(sdaMsg *SDAData) error {
+	n.dispatchLock.Lock()
+	for _, msg := range n.sequence(sdaMsg) {
+		msg := msg
+		n.deliveries = append(n.deliveries, func() error {
+			return n.dispatchMsg(msg)
+		})
+	}
+	n.dispatchLock.Unlock()
+	return n.deliver()
+}
+
+// deliver runs the waiting deliveries one after the other, without holding
+// the dispatchLock, unless somebody else already does. It returns the last
+// error of the deliveries it ran.
+func (n *Node) deliver() error {
+	n.dispatchLock.Lock()
+	if n.delivering {
+		n.dispatchLock.Unlock()
+		return nil
+	}
+	n.delivering = true
+	var err error
+	for len(n.deliveries) > 0 {
+		d := n.deliveries[0]
+		n.deliveries = n.deliveries[1:]
+		n.dispatchLock.Unlock()
+		if e := d(); e != nil {
+			err = e
 		}
+		n.dispatchLock.Lock()
 	}
-	return nil
+	n.delivering = false
+	n.dispatchLock.Unlock()
+	return err
 }
 
-// DispatchMsg will dispatch this SDAData to the right instance
-func (n *Node) DispatchMsg(sdaMsg *SDAData) error {
+// dispatchMsg decodes and dispatches one SDAData
+func (n *Node) dispatchMsg(sdaMsg *SDAData) error {
 	// Decode the inner message here. In older versions, it was decoded before,
 	// but first there is no use to do it before, and then every protocols had
 	// to manually registers their messages. Since it is done automatically by
@@ -339,17 +344,11 @@ func (n *Node) DispatchMsg(sdaMsg *SDAData) error {
 	}
 	dbg.Lvl4("Going to dispatch", sdaMsg)
 
-	switch {
-	case n.channels[msgType] != nil:
-		dbg.Lvl4("Dispatching to channel")
-		err = n.DispatchChannel(msgs)
-	case n.handlers[msgType] != nil:
-		dbg.Lvl4("Dispatching to handler", n.Entity().Addresses)
-		err = n.DispatchHandler(msgs)
-	default:
+	h := n.handlers[msgType]
+	if h == nil {
 		return errors.New("This message-type is not handled by this protocol")
 	}
-	return err
+	return h.dispatch(n, msgs)
 }
 
 // SetFlag makes sure a given flag is set
@@ -373,13 +372,25 @@ func (n *Node) HasFlag(mt uuid.UUID, f uint32) bool {
 // message being analyzed.
 func (n *Node) aggregate(sdaMsg *SDAData) (uuid.UUID, []*SDAData, bool) {
 	mt := sdaMsg.MsgType
-	fromParent := !n.IsRoot() && uuid.Equal(sdaMsg.From.TreeNodeID, n.Parent().Id)
+	fromParent := !n.IsRoot() && sdaMsg.From.TreeNodeID.Equal(n.Parent().Id)
 	if fromParent || !n.HasFlag(mt, AggregateMessages) {
 		return mt, []*SDAData{sdaMsg}, true
 	}
+	n.msgQueueLock.Lock()
+	defer n.msgQueueLock.Unlock()
 	// store the msg according to its type
 	if _, ok := n.msgQueue[mt]; !ok {
 		n.msgQueue[mt] = make([]*SDAData, 0)
+		if h := n.handlers[mt]; h != nil && h.timeout > 0 {
+			n.msgTimerGen++
+			gen := n.msgTimerGen
+			n.msgTimers[mt] = &aggregateTimer{
+				gen: gen,
+				Timer: time.AfterFunc(h.timeout, func() {
+					n.aggregateTimeout(mt, gen)
+				}),
+			}
+		}
 	}
 	msgs := append(n.msgQueue[mt], sdaMsg)
 	n.msgQueue[mt] = msgs
@@ -391,6 +402,10 @@ func (n *Node) aggregate(sdaMsg *SDAData) (uuid.UUID, []*SDAData, bool) {
 	if len(msgs) == len(n.Children()) {
 		// erase
 		delete(n.msgQueue, mt)
+		if t, ok := n.msgTimers[mt]; ok {
+			t.Stop()
+			delete(n.msgTimers, mt)
+		}
 		return mt, msgs, true
 	}
 	// no we still have to wait!
@@ -445,7 +460,7 @@ func (n *Node) Name() string {
 	return n.Entity().First()
 }
 
-func (n *Node) TokenID() uuid.UUID {
+func (n *Node) TokenID() crypto.HashId {
 	return n.token.Id()
 }
 
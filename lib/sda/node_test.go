@@ -125,7 +125,10 @@ func TestNewNode(t *testing.T) {
 
 	h1, h2 := SetupTwoHosts(t, false)
 	// Add tree + entitylist
-	el := sda.NewEntityList([]*network.Entity{h1.Entity, h2.Entity})
+	el, err := sda.NewEntityList([]*network.Entity{h1.Entity, h2.Entity})
+	if err != nil {
+		t.Fatal(err)
+	}
 	h1.AddEntityList(el)
 	tree := el.GenerateBinaryTree()
 	h1.AddTree(tree)
@@ -156,14 +159,17 @@ func TestProtocolChannels(t *testing.T) {
 	defer h1.Close()
 	defer h2.Close()
 	// Add tree + entitylist
-	el := sda.NewEntityList([]*network.Entity{h1.Entity, h2.Entity})
+	el, err := sda.NewEntityList([]*network.Entity{h1.Entity, h2.Entity})
+	if err != nil {
+		t.Fatal(err)
+	}
 	h1.AddEntityList(el)
 	tree := el.GenerateBinaryTree()
 	h1.AddTree(tree)
 	h1.StartProcessMessages()
 
 	// Try directly StartNewProtocol
-	_, err := h1.StartNewNodeName("ProtocolChannels", tree)
+	_, err = h1.StartNewNodeName("ProtocolChannels", tree)
 	if err != nil {
 		t.Fatal("Couldn't start protocol:", err)
 	}
@@ -194,7 +200,7 @@ func TestProtocolHandlers(t *testing.T) {
 	child1 := <-IncomingHandlers
 	child2 := <-IncomingHandlers
 
-	if child1.Entity().Id == child2.Entity().Id {
+	if child1.Entity().Id.Equal(child2.Entity().Id) {
 		t.Fatal("Both entities should be different")
 	}
 
@@ -206,7 +212,7 @@ func TestProtocolHandlers(t *testing.T) {
 	}
 	child2.SendTo(node.TreeNode(), &NodeTestAggMsg{})
 	final := <-IncomingHandlers
-	if final.Entity().Id != node.Entity().Id {
+	if !final.Entity().Id.Equal(node.Entity().Id) {
 		t.Fatal("This should be the same ID")
 	}
 }
@@ -252,6 +258,347 @@ func TestMsgAggregation(t *testing.T) {
 	}
 }
 
+func TestRegisterErrors(t *testing.T) {
+	defer dbg.AfterTest(t)
+
+	local := sda.NewLocalTest()
+	_, _, tree := local.GenTree(2, false, false, true)
+	defer local.CloseAll()
+	n, err := local.NewNode(tree.Root, "ProtocolChannels")
+	if err != nil {
+		t.Fatal("Couldn't create node.")
+	}
+	if n.RegisterChannel(make(chan NodeTestMsg)) == nil {
+		t.Fatal("Should refuse channel without TreeNode")
+	}
+	if n.RegisterHandler(func(a, b int) {}) == nil {
+		t.Fatal("Should refuse handler with two arguments")
+	}
+	if n.RegisterTypedHandler(func(tn *sda.TreeNode, msg int) {}) == nil {
+		t.Fatal("Should refuse non-struct message")
+	}
+	if n.RegisterTypedHandler(func(tn []*sda.TreeNode, msg *NodeTestMsg) {}) == nil {
+		t.Fatal("Should refuse aggregation with only one slice")
+	}
+	if n.RegisterTypedHandler(func(tn *sda.TreeNode, msg *NodeTestMsg) int { return 0 }) == nil {
+		t.Fatal("Should refuse handler returning something else than error")
+	}
+	if n.RegisterTypedHandler(func(tn *sda.TreeNode, msg *NodeTestMsg) {},
+		sda.ChildOrder()) == nil {
+		t.Fatal("Should refuse ChildOrder without aggregation")
+	}
+	// The order of the fields doesn't matter
+	err = n.RegisterHandler(func(msg struct {
+		NodeTestMsg
+		*sda.TreeNode
+	}) {
+	})
+	if err != nil {
+		t.Fatal("Should accept TreeNode as second field:", err)
+	}
+}
+
+func TestTypedHandler(t *testing.T) {
+	defer dbg.AfterTest(t)
+
+	local := sda.NewLocalTest()
+	_, _, tree := local.GenTree(3, false, false, true)
+	defer local.CloseAll()
+	n, err := local.NewNode(tree.Root, "ProtocolChannels")
+	if err != nil {
+		t.Fatal("Couldn't create node.")
+	}
+	var from *sda.TreeNode
+	var got *NodeTestTypedMsg
+	err = n.RegisterTypedHandler(func(tn *sda.TreeNode, msg *NodeTestTypedMsg) error {
+		from, got = tn, msg
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Couldn't register typed handler:", err)
+	}
+	child := tree.Root.Children[0]
+	err = n.DispatchHandler([]*sda.SDAData{&sda.SDAData{
+		Msg:     NodeTestTypedMsg{5},
+		MsgType: network.RegisterMessageType(NodeTestTypedMsg{}),
+		From: &sda.Token{
+			TreeID:     tree.Id,
+			TreeNodeID: child.Id,
+		}},
+	})
+	if err != nil {
+		t.Fatal("Couldn't dispatch:", err)
+	}
+	if got == nil || got.I != 5 || from != child {
+		t.Fatal("Handler didn't get correct message and TreeNode")
+	}
+}
+
+func TestAggregateOptions(t *testing.T) {
+	defer dbg.AfterTest(t)
+
+	local := sda.NewLocalTest()
+	_, _, tree := local.GenTree(3, false, false, true)
+	defer local.CloseAll()
+	n, err := local.NewNode(tree.Root, "ProtocolChannels")
+	if err != nil {
+		t.Fatal("Couldn't create node.")
+	}
+	got := make(chan []int, 1)
+	err = n.RegisterTypedHandler(func(tns []*sda.TreeNode, msgs []NodeTestTypedMsg) {
+		is := make([]int, len(msgs))
+		for i := range msgs {
+			is[i] = msgs[i].I
+		}
+		got <- is
+	}, sda.ChildOrder(), sda.AggregateTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal("Couldn't register typed handler:", err)
+	}
+	send := func(child, i int) {
+		b, err := network.MarshalRegisteredType(&NodeTestTypedMsg{i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = n.DispatchMsg(&sda.SDAData{
+			MsgSlice: b,
+			From: &sda.Token{
+				TreeID:     tree.Id,
+				TreeNodeID: tree.Root.Children[child].Id,
+			},
+		})
+		if err != nil {
+			t.Fatal("Couldn't dispatch:", err)
+		}
+	}
+
+	// Messages arriving in the wrong order are sorted
+	send(1, 2)
+	send(0, 1)
+	if is := <-got; len(is) != 2 || is[0] != 1 || is[1] != 2 {
+		t.Fatal("Messages should be ordered by children:", is)
+	}
+
+	// A missing child triggers the timeout
+	send(1, 2)
+	select {
+	case is := <-got:
+		if len(is) != 1 || is[0] != 2 {
+			t.Fatal("Should get only the message of the second child:", is)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout didn't dispatch the messages")
+	}
+}
+
+func TestMsgSequence(t *testing.T) {
+	defer dbg.AfterTest(t)
+
+	local := sda.NewLocalTest()
+	h, _, tree := local.GenTree(2, false, false, true)
+	defer local.CloseAll()
+	n, err := h[0].Overlay().CreateNewNodeName("ProtocolChannels", tree)
+	if err != nil {
+		t.Fatal("Couldn't create node.")
+	}
+	got := make(chan int, 10)
+	err = n.RegisterTypedHandler(func(tn *sda.TreeNode, msg NodeTestTypedMsg) {
+		got <- msg.I
+	})
+	if err != nil {
+		t.Fatal("Couldn't register typed handler:", err)
+	}
+	newMsg := func(seq uint32) *sda.SDAData {
+		b, err := network.MarshalRegisteredType(&NodeTestTypedMsg{int(seq)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &sda.SDAData{
+			MsgSlice: b,
+			From: &sda.Token{
+				TreeID:     tree.Id,
+				TreeNodeID: tree.Root.Children[0].Id,
+			},
+			To:    n.Token(),
+			SeqNo: seq,
+		}
+	}
+	for _, seq := range []uint32{2, 3, 1, 2, 1, 4} {
+		if err := n.DispatchMsg(newMsg(seq)); err != nil {
+			t.Fatal("Couldn't dispatch:", err)
+		}
+	}
+	for i := 1; i <= 4; i++ {
+		if r := <-got; r != i {
+			t.Fatal("Messages should arrive in order, got", r, "instead of", i)
+		}
+	}
+	if len(got) > 0 {
+		t.Fatal("Duplicates should be dropped")
+	}
+	if n.Duplicates() != 2 {
+		t.Fatal("Should have two duplicates, not", n.Duplicates())
+	}
+
+	// Messages for a done node are counted
+	n.Done()
+	if err := h[0].Overlay().TransmitMsg(newMsg(5)); err != nil {
+		t.Fatal(err)
+	}
+	if n.DroppedLate() != 1 {
+		t.Fatal("Should have one late message, not", n.DroppedLate())
+	}
+}
+
+// TestDispatchBlocked checks that a handler that doesn't return only holds
+// back the messages of its Node, and that they are handled in order once it
+// returns.
+func TestDispatchBlocked(t *testing.T) {
+	defer dbg.AfterTest(t)
+
+	local := sda.NewLocalTest()
+	h, _, tree := local.GenTree(2, false, false, true)
+	defer local.CloseAll()
+	n, err := h[0].Overlay().CreateNewNodeName("ProtocolChannels", tree)
+	if err != nil {
+		t.Fatal("Couldn't create node.")
+	}
+	got := make(chan int, 3)
+	release := make(chan bool)
+	err = n.RegisterTypedHandler(func(tn *sda.TreeNode, msg NodeTestTypedMsg) {
+		got <- msg.I
+		if msg.I == 1 {
+			<-release
+		}
+	})
+	if err != nil {
+		t.Fatal("Couldn't register typed handler:", err)
+	}
+	dispatch := func(seq uint32) error {
+		b, err := network.MarshalRegisteredType(&NodeTestTypedMsg{int(seq)})
+		if err != nil {
+			return err
+		}
+		return n.DispatchMsg(&sda.SDAData{
+			MsgSlice: b,
+			From: &sda.Token{
+				TreeID:     tree.Id,
+				TreeNodeID: tree.Root.Children[0].Id,
+			},
+			To:    n.Token(),
+			SeqNo: seq,
+		})
+	}
+	first := make(chan error, 1)
+	go func() {
+		first <- dispatch(1)
+	}()
+	if r := <-got; r != 1 {
+		t.Fatal("Should get the first message, not", r)
+	}
+	returned := make(chan error, 1)
+	go func() {
+		returned <- dispatch(2)
+	}()
+	select {
+	case err := <-returned:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Dispatching waited for the blocked handler")
+	}
+	if len(got) > 0 {
+		t.Fatal("Second message handled before the first one returned")
+	}
+	release <- true
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	if r := <-got; r != 2 {
+		t.Fatal("Should get the second message, not", r)
+	}
+}
+
+// TestMsgSequencePending checks that a Node holds back at most
+// MaxPendingMessages messages per sender.
+func TestMsgSequencePending(t *testing.T) {
+	defer dbg.AfterTest(t)
+
+	local := sda.NewLocalTest()
+	h, _, tree := local.GenTree(2, false, false, true)
+	defer local.CloseAll()
+	n, err := h[0].Overlay().CreateNewNodeName("ProtocolChannels", tree)
+	if err != nil {
+		t.Fatal("Couldn't create node.")
+	}
+	got := make(chan int, sda.MaxPendingMessages+2)
+	err = n.RegisterTypedHandler(func(tn *sda.TreeNode, msg NodeTestTypedMsg) {
+		got <- msg.I
+	})
+	if err != nil {
+		t.Fatal("Couldn't register typed handler:", err)
+	}
+	dispatch := func(seq uint32) {
+		b, err := network.MarshalRegisteredType(&NodeTestTypedMsg{int(seq)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = n.DispatchMsg(&sda.SDAData{
+			MsgSlice: b,
+			From: &sda.Token{
+				TreeID:     tree.Id,
+				TreeNodeID: tree.Root.Children[0].Id,
+			},
+			To:    n.Token(),
+			SeqNo: seq,
+		})
+		if err != nil {
+			t.Fatal("Couldn't dispatch:", err)
+		}
+	}
+	last := uint32(sda.MaxPendingMessages + 2)
+	for seq := uint32(2); seq <= last; seq++ {
+		dispatch(seq)
+	}
+	dispatch(1)
+	for i := 1; i < int(last); i++ {
+		if r := <-got; r != i {
+			t.Fatal("Messages should arrive in order, got", r, "instead of", i)
+		}
+	}
+	if len(got) > 0 {
+		t.Fatal("The message after MaxPendingMessages should be dropped")
+	}
+	// the dropped message is accepted when it comes again
+	dispatch(last)
+	if r := <-got; r != int(last) {
+		t.Fatal("Should get the dropped message, not", r)
+	}
+}
+
+// TestSendFailed checks that a message that couldn't be sent doesn't use up
+// a sequence-number, so that the receiver doesn't wait for it.
+func TestSendFailed(t *testing.T) {
+	defer dbg.AfterTest(t)
+
+	local := sda.NewLocalTest()
+	h, _, tree := local.GenTree(2, false, false, true)
+	defer local.CloseAll()
+	n, err := h[0].Overlay().CreateNewNodeName("ProtocolChannels", tree)
+	if err != nil {
+		t.Fatal("Couldn't create node.")
+	}
+	child := tree.Root.Children[0]
+	h[1].Close()
+	if n.SendTo(child, &NodeTestMsg{1}) == nil {
+		t.Fatal("Sent to a closed host")
+	}
+	if seq := n.SentSeq(child); seq != 0 {
+		t.Fatal("Failed message used up sequence-number", seq)
+	}
+}
+
 func TestFlags(t *testing.T) {
 	defer dbg.AfterTest(t)
 
@@ -304,6 +651,10 @@ var Incoming chan struct {
 	NodeTestMsg
 }
 
+type NodeTestTypedMsg struct {
+	I int
+}
+
 type NodeTestAggMsg struct {
 	I int
 }
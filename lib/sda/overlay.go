@@ -3,13 +3,19 @@ package sda
 import (
 	"errors"
 	"sync"
+	"sync/atomic"
 
+	"github.com/dedis/cothority/lib/crypto"
 	"github.com/dedis/cothority/lib/dbg"
 	"github.com/dedis/cothority/lib/network"
 	"github.com/dedis/crypto/abstract"
 	"github.com/satori/go.uuid"
 )
 
+// MaxDoneStats is how many nodes that are done keep counting the messages
+// that arrive late.
+const MaxDoneStats = 1000
+
 /*
 Overlay keeps all trees and entity-lists for a given host. It creates
 Nodes and ProtocolInstances upon request and dispatches the messages.
@@ -18,16 +24,20 @@ Nodes and ProtocolInstances upon request and dispatches the messages.
 type Overlay struct {
 	host *Host
 	// mapping from Token.Id() to Node
-	nodes map[uuid.UUID]*Node
+	nodes map[string]*Node
 	// false = NOT DONE
 	// true = DONE
-	nodeInfo map[uuid.UUID]bool
-	nodeLock sync.RWMutex
+	nodeInfo map[string]bool
+	// counters of the last MaxDoneStats nodes that are done, oldest first
+	// in doneOrder
+	doneStats map[string]*nodeStats
+	doneOrder []string
+	nodeLock  sync.RWMutex
 	// mapping from Tree.Id to Tree
-	trees    map[uuid.UUID]*Tree
+	trees    map[string]*Tree
 	treesMut sync.Mutex
 	// mapping from EntityList.id to EntityList
-	entityLists    map[uuid.UUID]*EntityList
+	entityLists    map[string]*EntityList
 	entityListLock sync.Mutex
 	// cache for relating token(~Node) to TreeNode
 	cache TreeNodeCache
@@ -37,10 +47,11 @@ type Overlay struct {
 func NewOverlay(h *Host) *Overlay {
 	return &Overlay{
 		host:        h,
-		nodes:       make(map[uuid.UUID]*Node),
-		nodeInfo:    make(map[uuid.UUID]bool),
-		trees:       make(map[uuid.UUID]*Tree),
-		entityLists: make(map[uuid.UUID]*EntityList),
+		nodes:       make(map[string]*Node),
+		nodeInfo:    make(map[string]bool),
+		doneStats:   make(map[string]*nodeStats),
+		trees:       make(map[string]*Tree),
+		entityLists: make(map[string]*EntityList),
 		cache:       NewTreeNodeCache(),
 	}
 }
@@ -64,23 +75,27 @@ func (o *Overlay) TransmitMsg(sdaMsg *SDAData) error {
 	}
 	// If node does not exists, then create it
 	o.nodeLock.Lock()
-	node := o.nodes[sdaMsg.To.Id()]
-	isDone := o.nodeInfo[sdaMsg.To.Id()]
+	tokId := string(sdaMsg.To.Id())
+	node := o.nodes[tokId]
+	isDone := o.nodeInfo[tokId]
 	// If we never have seen this token before, then we create it
 	if node == nil && !isDone {
 		dbg.Lvl3(o.host.Entity.First(), "creating new node for token:", sdaMsg.To.Id())
 		var err error
-		o.nodes[sdaMsg.To.Id()], err = NewNode(o, sdaMsg.To)
-		o.nodeInfo[sdaMsg.To.Id()] = false
+		o.nodes[tokId], err = NewNode(o, sdaMsg.To)
+		o.nodeInfo[tokId] = false
 		if err != nil {
 			o.nodeLock.Unlock()
 			return err
 		}
-		node = o.nodes[sdaMsg.To.Id()]
+		node = o.nodes[tokId]
 	}
 	// If node is ALREADY DONE => drop packet
 	if isDone {
 		dbg.Lvl2("Dropped message given to node that is done.")
+		if stats := o.doneStats[tokId]; stats != nil {
+			atomic.AddUint64(&stats.droppedLate, 1)
+		}
 		o.nodeLock.Unlock()
 		return nil
 	}
@@ -95,40 +110,41 @@ func (o *Overlay) TransmitMsg(sdaMsg *SDAData) error {
 // RegisterTree takes a tree and puts it in the map
 func (o *Overlay) RegisterTree(t *Tree) {
 	o.treesMut.Lock()
-	o.trees[t.Id] = t
+	o.trees[string(t.Id)] = t
+	o.cache.CacheTree(t)
 	o.treesMut.Unlock()
 	o.host.checkPendingSDA(t)
 }
 
 // TreeFromToken searches for the tree corresponding to a token.
 func (o *Overlay) TreeFromToken(tok *Token) *Tree {
-	return o.trees[tok.TreeID]
+	return o.trees[string(tok.TreeID)]
 }
 
 // Tree returns the tree given by treeId or nil if not found
-func (o *Overlay) Tree(tid uuid.UUID) *Tree {
+func (o *Overlay) Tree(tid crypto.HashId) *Tree {
 	o.treesMut.Lock()
 	defer o.treesMut.Unlock()
-	return o.trees[tid]
+	return o.trees[string(tid)]
 }
 
 // RegisterEntityList puts an entityList in the map
 func (o *Overlay) RegisterEntityList(el *EntityList) {
 	o.entityListLock.Lock()
 	defer o.entityListLock.Unlock()
-	o.entityLists[el.Id] = el
+	o.entityLists[string(el.Id)] = el
 }
 
 // EntityListFromToken returns the entitylist corresponding to a token
 func (o *Overlay) EntityListFromToken(tok *Token) *EntityList {
-	return o.entityLists[tok.EntityListID]
+	return o.entityLists[string(tok.EntityListID)]
 }
 
 // EntityList returns the entityList given by EntityListID
-func (o *Overlay) EntityList(elid uuid.UUID) *EntityList {
+func (o *Overlay) EntityList(elid crypto.HashId) *EntityList {
 	o.entityListLock.Lock()
 	defer o.entityListLock.Unlock()
-	return o.entityLists[elid]
+	return o.entityLists[string(elid)]
 }
 
 // StartNewNode starts a new node which will in turn instantiate the desired
@@ -159,8 +175,8 @@ func (o *Overlay) CreateNewNode(protocolID uuid.UUID, tree *Tree) (*Node, error)
 	}
 	o.nodeLock.Lock()
 	defer o.nodeLock.Unlock()
-	o.nodes[node.token.Id()] = node
-	o.nodeInfo[node.token.Id()] = false
+	o.nodes[string(node.token.Id())] = node
+	o.nodeInfo[string(node.token.Id())] = false
 	return node, node.protocolInstantiate()
 }
 
@@ -201,8 +217,8 @@ func (o *Overlay) NewNodeEmpty(protocolID uuid.UUID, tree *Tree) (*Node, error)
 	o.nodeLock.Lock()
 	defer o.nodeLock.Unlock()
 	node, err := NewNodeEmpty(o, token)
-	o.nodes[node.token.Id()] = node
-	o.nodeInfo[node.token.Id()] = false
+	o.nodes[string(node.token.Id())] = node
+	o.nodeInfo[string(node.token.Id())] = false
 	return node, err
 }
 
@@ -211,30 +227,30 @@ func (o *Overlay) TreeNodeFromToken(t *Token) (*TreeNode, error) {
 	if t == nil {
 		return nil, errors.New("Didn't find tree-node: No token given.")
 	}
-	// First, check the cache
+	o.treesMut.Lock()
+	defer o.treesMut.Unlock()
+	// All registered trees are in the cache
 	if tn := o.cache.GetFromToken(t); tn != nil {
 		return tn, nil
 	}
-	// If cache has not, then search the tree
-	tree := o.Tree(t.TreeID)
-	if tree == nil {
+	if o.trees[string(t.TreeID)] == nil {
 		return nil, errors.New("Didn't find tree")
 	}
-	tn := tree.GetTreeNode(t.TreeNodeID)
-	if tn == nil {
-		return nil, errors.New("Didn't find treenode")
-	}
-	// Since we found treeNode, cache it so later reuse
-	o.cache.Cache(tree, tn)
-	return tn, nil
+	return nil, errors.New("Didn't find treenode")
 }
 
 // SendToTreeNode sends a message to a treeNode
 func (o *Overlay) SendToTreeNode(from *Token, to *TreeNode, msg network.ProtocolMessage) error {
+	return o.sendToTreeNode(from, to, msg, 0)
+}
+
+// sendToTreeNode sends a message with the sequence-number seq to a treeNode
+func (o *Overlay) sendToTreeNode(from *Token, to *TreeNode, msg network.ProtocolMessage, seq uint32) error {
 	sda := &SDAData{
-		Msg:  msg,
-		From: from,
-		To:   from.ChangeTreeNodeID(to.Id),
+		Msg:   msg,
+		From:  from,
+		To:    from.ChangeTreeNodeID(to.Id),
+		SeqNo: seq,
 	}
 	dbg.Lvl4("Sending to entity", to.Entity.Addresses)
 	return o.host.sendSDAData(to.Entity, sda)
@@ -250,7 +266,7 @@ func (o *Overlay) SendToToken(from, to *Token, msg network.ProtocolMessage) erro
 		return errors.New("To-token is nil")
 	}
 	o.nodeLock.RLock()
-	if o.nodes[from.Id()] == nil {
+	if o.nodes[string(from.Id())] == nil {
 		o.nodeLock.RUnlock()
 		return errors.New("No protocol instance registered with this token.")
 	}
@@ -267,9 +283,17 @@ func (o *Overlay) SendToToken(from, to *Token, msg network.ProtocolMessage) erro
 func (o *Overlay) nodeDone(tok *Token) {
 	o.nodeLock.Lock()
 	defer o.nodeLock.Unlock()
-	delete(o.nodes, tok.Id())
+	if n := o.nodes[string(tok.Id())]; n != nil {
+		o.doneStats[string(tok.Id())] = n.stats
+		o.doneOrder = append(o.doneOrder, string(tok.Id()))
+		for len(o.doneOrder) > MaxDoneStats {
+			delete(o.doneStats, o.doneOrder[0])
+			o.doneOrder = o.doneOrder[1:]
+		}
+	}
+	delete(o.nodes, string(tok.Id()))
 	// mark it done !
-	o.nodeInfo[tok.Id()] = true
+	o.nodeInfo[string(tok.Id())] = true
 }
 
 func (o *Overlay) Private() abstract.Secret {
@@ -293,55 +317,37 @@ func (o *Overlay) Close() {
 // is not 1-1 (many Token can point to one TreeNode, but one token leads to one
 // TreeNode), we have to do certain
 // lookup, but that's better than searching the tree each time.
-type TreeNodeCache map[uuid.UUID]map[uuid.UUID]*TreeNode
+// As the ids of the TreeNodes only depend on the structure of the tree, the
+// whole tree is cached at once and every TreeNode can be found without
+// searching the tree or fetching it from another host.
+type TreeNodeCache map[string]map[string]*TreeNode
 
 // Returns a new TreeNodeCache
 func NewTreeNodeCache() TreeNodeCache {
-	m := make(map[uuid.UUID]map[uuid.UUID]*TreeNode)
+	m := make(map[string]map[string]*TreeNode)
 	return m
 }
 
-// Cache a TreeNode that relates to the Tree
-// It will also cache the parent and children of the treenode since that's most
-// likely what we are going to query.
-func (tnc TreeNodeCache) Cache(tree *Tree, treeNode *TreeNode) {
-	var mm map[uuid.UUID]*TreeNode
-	var ok bool
-	if mm, ok = tnc[tree.Id]; !ok {
-		mm = make(map[uuid.UUID]*TreeNode)
-	}
-	// add treenode
-	mm[treeNode.Id] = treeNode
-	// add parent if not root
-	if treeNode.Parent != nil {
-		mm[treeNode.Parent.Id] = treeNode.Parent
-	}
-	// add children
-	for _, c := range treeNode.Children {
-		mm[c.Id] = c
-	}
-	// add cache
-	tnc[tree.Id] = mm
+// CacheTree adds all TreeNodes of the tree to the cache
+func (tnc TreeNodeCache) CacheTree(tree *Tree) {
+	mm := make(map[string]*TreeNode)
+	tree.Root.Visit(0, func(d int, tn *TreeNode) {
+		mm[string(tn.Id)] = tn
+	})
+	tnc[string(tree.Id)] = mm
 }
 
 // GetFromToken returns the TreeNode that the token is pointing at, or
 // nil if there is none for this token.
 func (tnc TreeNodeCache) GetFromToken(tok *Token) *TreeNode {
-	var mm map[uuid.UUID]*TreeNode
+	var mm map[string]*TreeNode
 	var ok bool
 	if tok == nil {
 		return nil
 	}
-	if mm, ok = tnc[tok.TreeID]; !ok {
+	if mm, ok = tnc[string(tok.TreeID)]; !ok {
 		// no tree cached for this token :...
 		return nil
 	}
-	var tn *TreeNode
-	if tn, ok = mm[tok.TreeNodeID]; !ok {
-		// no treeNode cached for this token...
-		// XXX Should we search the tree ? Then we need to keep reference to the
-		// tree ...
-		return nil
-	}
-	return tn
+	return mm[string(tok.TreeNodeID)]
 }
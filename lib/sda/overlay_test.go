@@ -40,7 +40,10 @@ func TestOverlayDone(t *testing.T) {
 		}
 		return &ps, nil
 	}
-	el := sda.NewEntityList([]*network.Entity{h1.Entity})
+	el, err := sda.NewEntityList([]*network.Entity{h1.Entity})
+	if err != nil {
+		t.Fatal(err)
+	}
 	h1.AddEntityList(el)
 	tree := el.GenerateBinaryTree()
 	h1.AddTree(tree)
@@ -69,3 +72,32 @@ func TestOverlayDone(t *testing.T) {
 		t.Fatal("Node should  NOT exists after call Done()")
 	}
 }
+
+func TestOverlayDoneStats(t *testing.T) {
+	defer dbg.AfterTest(t)
+
+	dbg.TestOutput(testing.Verbose(), 4)
+	h1 := sda.NewLocalHost(2000)
+	defer h1.Close()
+	el, err := sda.NewEntityList([]*network.Entity{h1.Entity})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h1.AddEntityList(el)
+	tree := el.GenerateBinaryTree()
+	h1.AddTree(tree)
+	sda.ProtocolRegisterName("ProtocolOverlay", func(n *sda.Node) (sda.ProtocolInstance, error) {
+		return &ProtocolOverlay{Node: n}, nil
+	})
+	overlay := h1.Overlay()
+	for i := 0; i < sda.MaxDoneStats+10; i++ {
+		node, err := overlay.CreateNewNodeName("ProtocolOverlay", tree)
+		if err != nil {
+			t.Fatal("error creating new node", err)
+		}
+		node.Done()
+	}
+	if n := overlay.DoneStatsLen(); n != sda.MaxDoneStats {
+		t.Fatal("Should keep", sda.MaxDoneStats, "counters, not", n)
+	}
+}
@@ -115,7 +115,10 @@ func TestProtocolAutomaticInstantiation(t *testing.T) {
 	defer h2.Close()
 	h1.StartProcessMessages()
 	// create small Tree
-	el := sda.NewEntityList([]*network.Entity{h1.Entity, h2.Entity})
+	el, err := sda.NewEntityList([]*network.Entity{h1.Entity, h2.Entity})
+	if err != nil {
+		t.Fatal(err)
+	}
 	h1.AddEntityList(el)
 	tree := el.GenerateBinaryTree()
 	h1.AddTree(tree)
@@ -0,0 +1,142 @@
+package sda
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/dedis/cothority/lib/dbg"
+)
+
+// Every message sent by a Node gets a sequence-number that is counted
+// separately for every destination TreeNode, starting at 1. The receiving
+// Node keeps track of the next expected sequence-number per sending
+// TreeNode, drops duplicates and holds back messages that arrive too
+// early, so that the channels and handlers see the messages of a sender
+// exactly once and in the order they were sent.
+// Messages with sequence-number 0 are not sequenced and dispatched as they
+// arrive.
+// A sequence-number is only used up once its message is sent, so that the
+// receiver doesn't wait for a message that never left. At most
+// MaxPendingMessages messages are held back per sender, the others are
+// dropped.
+
+// MaxPendingMessages is how many messages a Node holds back per sending
+// TreeNode while waiting for a missing one.
+const MaxPendingMessages = 1000
+
+// sequencer holds the sequence-numbers of a Node
+type sequencer struct {
+	sync.Mutex
+	// last sequence-number sent, per destination TreeNode
+	send map[string]uint32
+	// sending serializes the messages to every destination TreeNode
+	sending map[string]*sync.Mutex
+	// next sequence-number expected, per sending TreeNode
+	recv map[string]uint32
+	// messages that arrived before their turn, per sending TreeNode
+	pending map[string]map[uint32]*SDAData
+}
+
+// nodeStats holds the counters of a Node. They are kept by the Overlay
+// once the Node is done, so that late messages can still be counted.
+type nodeStats struct {
+	droppedLate uint64
+	duplicates  uint64
+}
+
+func newSequencer() *sequencer {
+	return &sequencer{
+		send:    make(map[string]uint32),
+		sending: make(map[string]*sync.Mutex),
+		recv:    make(map[string]uint32),
+		pending: make(map[string]map[uint32]*SDAData),
+	}
+}
+
+// sendSequenced calls send with the sequence-number of the next message
+// to 'to'. The sequence-number is only used up if send succeeds. The
+// messages to one destination are sent one after the other.
+func (n *Node) sendSequenced(to *TreeNode, send func(seq uint32) error) error {
+	id := string(to.Id)
+	n.seq.Lock()
+	sending, ok := n.seq.sending[id]
+	if !ok {
+		sending = &sync.Mutex{}
+		n.seq.sending[id] = sending
+	}
+	n.seq.Unlock()
+	sending.Lock()
+	defer sending.Unlock()
+	n.seq.Lock()
+	seq := n.seq.send[id] + 1
+	n.seq.Unlock()
+	if err := send(seq); err != nil {
+		return err
+	}
+	n.seq.Lock()
+	n.seq.send[id] = seq
+	n.seq.Unlock()
+	return nil
+}
+
+// sequence returns the messages that can be dispatched in order after the
+// reception of sdaMsg. Duplicates are dropped and messages that come too
+// early are stored until the missing messages arrive.
+func (n *Node) sequence(sdaMsg *SDAData) []*SDAData {
+	if sdaMsg.SeqNo == 0 || sdaMsg.From == nil {
+		return []*SDAData{sdaMsg}
+	}
+	n.seq.Lock()
+	defer n.seq.Unlock()
+	from := string(sdaMsg.From.TreeNodeID)
+	next, ok := n.seq.recv[from]
+	if !ok {
+		next = 1
+	}
+	pending := n.seq.pending[from]
+	_, isPending := pending[sdaMsg.SeqNo]
+	if sdaMsg.SeqNo < next || isPending {
+		atomic.AddUint64(&n.stats.duplicates, 1)
+		dbg.Lvl3(n.Name(), "dropped duplicate message", sdaMsg.SeqNo)
+		return nil
+	}
+	if sdaMsg.SeqNo > next {
+		if pending == nil {
+			pending = make(map[uint32]*SDAData)
+			n.seq.pending[from] = pending
+		}
+		if len(pending) >= MaxPendingMessages {
+			dbg.Lvl2(n.Name(), "dropped message", sdaMsg.SeqNo,
+				"as too many are waiting for", next)
+			return nil
+		}
+		dbg.Lvl4(n.Name(), "holding back message", sdaMsg.SeqNo, "waiting for", next)
+		pending[sdaMsg.SeqNo] = sdaMsg
+		return nil
+	}
+	msgs := []*SDAData{sdaMsg}
+	next++
+	for {
+		msg, ok := pending[next]
+		if !ok {
+			break
+		}
+		delete(pending, next)
+		msgs = append(msgs, msg)
+		next++
+	}
+	n.seq.recv[from] = next
+	return msgs
+}
+
+// DroppedLate returns how many messages arrived for this Node after it was
+// done and have been dropped.
+func (n *Node) DroppedLate() uint64 {
+	return atomic.LoadUint64(&n.stats.droppedLate)
+}
+
+// Duplicates returns how many messages have been received twice and
+// have been dropped.
+func (n *Node) Duplicates() uint64 {
+	return atomic.LoadUint64(&n.stats.duplicates)
+}
@@ -72,10 +72,18 @@ type SimulationConfigFile struct {
 	Config      string
 }
 
+// simulationSuiteFile holds an encoded SimulationConfigFile together with
+// the name of the suite needed to decode it.
+type simulationSuiteFile struct {
+	Suite  string
+	Config []byte
+}
+
 // Load gets all configuration from dir + SimulationFileName and instantiates the
 // corresponding host 'ha'.
 func LoadSimulationConfig(dir, ha string) ([]*SimulationConfig, error) {
 	network.RegisterMessageType(SimulationConfigFile{})
+	network.RegisterMessageType(simulationSuiteFile{})
 	bin, err := ioutil.ReadFile(dir + "/" + SimulationFileName)
 	if err != nil {
 		return nil, err
@@ -85,9 +93,27 @@ func LoadSimulationConfig(dir, ha string) ([]*SimulationConfig, error) {
 	if err != nil {
 		return nil, err
 	}
+	ssf := msg.(simulationSuiteFile)
+	suite, err := network.SuiteByName(ssf.Suite)
+	if err != nil {
+		return nil, err
+	}
+	_, msg, err = network.UnmarshalRegisteredType(ssf.Config,
+		network.DefaultConstructors(suite))
+	if err != nil {
+		return nil, err
+	}
 	scf := msg.(SimulationConfigFile)
+	// re-create the EntityList to verify the proofs-of-possession
+	el, err := NewEntityListWithSuite(suite, scf.EntityList.List)
+	if err != nil {
+		return nil, err
+	}
+	if !el.Id.Equal(scf.EntityList.Id) {
+		return nil, errors.New("EntityList of the simulation has wrong id")
+	}
 	sc := &SimulationConfig{
-		EntityList:  scf.EntityList,
+		EntityList:  el,
 		PrivateKeys: scf.PrivateKeys,
 		Config:      scf.Config,
 	}
@@ -113,7 +139,7 @@ func LoadSimulationConfig(dir, ha string) ([]*SimulationConfig, error) {
 				// footprint
 				if strings.Contains(a, ha) {
 					dbg.Lvl3("Found host", a, "to match", ha)
-					host := NewHost(e, scf.PrivateKeys[a])
+					host := NewHostWithSuite(suite, e, scf.PrivateKeys[a])
 					scNew := *sc
 					scNew.Host = host
 					scNew.Overlay = host.overlay
@@ -142,13 +168,21 @@ func LoadSimulationConfig(dir, ha string) ([]*SimulationConfig, error) {
 // dir + SimulationFileName
 func (sc *SimulationConfig) Save(dir string) error {
 	network.RegisterMessageType(&SimulationConfigFile{})
+	network.RegisterMessageType(&simulationSuiteFile{})
 	scf := &SimulationConfigFile{
 		TreeMarshal: sc.Tree.MakeTreeMarshal(),
 		EntityList:  sc.EntityList,
 		PrivateKeys: sc.PrivateKeys,
 		Config:      sc.Config,
 	}
-	buf, err := network.MarshalRegisteredType(scf)
+	conf, err := network.MarshalRegisteredType(scf)
+	if err != nil {
+		dbg.Fatal(err)
+	}
+	buf, err := network.MarshalRegisteredType(&simulationSuiteFile{
+		Suite:  sc.EntityList.SuiteName,
+		Config: conf,
+	})
 	if err != nil {
 		dbg.Fatal(err)
 	}
@@ -191,6 +225,8 @@ type SimulationBFTree struct {
 	Hosts      int
 	SingleHost bool
 	Depth      int
+	// Suite is the name of the suite to use, empty for the default
+	Suite string
 }
 
 // CreateEntityLists creates an EntityList with the host-names in 'addresses'.
@@ -219,7 +255,11 @@ func (s *SimulationBFTree) CreateEntityList(sc *SimulationConfig, addresses []st
 	}
 	entities := make([]*network.Entity, hosts)
 	dbg.Lvl3("Doing", hosts, "hosts")
-	key := config.NewKeyPair(network.Suite)
+	suite, err := network.SuiteByName(s.Suite)
+	if err != nil {
+		dbg.Fatal(err)
+	}
+	key := config.NewKeyPair(suite)
 	for c := 0; c < hosts; c++ {
 		key.Secret.Add(key.Secret,
 			key.Suite.Secret().One())
@@ -239,8 +279,14 @@ func (s *SimulationBFTree) CreateEntityList(sc *SimulationConfig, addresses []st
 		} else {
 			address += strconv.Itoa(port + c/nbrAddr)
 		}
-		entities[c] = network.NewEntity(key.Public, address)
-		sc.PrivateKeys[entities[c].Addresses[0]] = key.Secret
+		// key is changed in every round, so every entity gets a copy
+		public := suite.Point().Add(suite.Point().Null(), key.Public)
+		secret := suite.Secret().Add(suite.Secret().Zero(), key.Secret)
+		entities[c] = network.NewEntity(public, address)
+		if err := entities[c].Prove(suite, secret); err != nil {
+			dbg.Fatal("Couldn't prove possession of key:", err)
+		}
+		sc.PrivateKeys[entities[c].Addresses[0]] = secret
 	}
 	// And close all our listeners
 	if localhosts {
@@ -252,7 +298,10 @@ func (s *SimulationBFTree) CreateEntityList(sc *SimulationConfig, addresses []st
 		}
 	}
 
-	sc.EntityList = NewEntityList(entities)
+	sc.EntityList, err = NewEntityListWithSuite(suite, entities)
+	if err != nil {
+		dbg.Fatal("Couldn't create EntityList:", err)
+	}
 	dbg.Lvl3("Creating entity List took: " + time.Now().Sub(start).String())
 }
 
@@ -66,7 +66,7 @@ func TestLoadSave(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if sc2[0].Tree.Id != sc.Tree.Id {
+	if !sc2[0].Tree.Id.Equal(sc.Tree.Id) {
 		t.Fatal("Tree-id is not correct")
 	}
 }
@@ -87,7 +87,7 @@ func TestMultipleInstances(t *testing.T) {
 	if len(sc2) != 4 {
 		t.Fatal("We should have 4 local1-hosts but have", len(sc2))
 	}
-	if sc2[0].Host.Entity.Id == sc2[1].Host.Entity.Id {
+	if sc2[0].Host.Entity.Id.Equal(sc2[1].Host.Entity.Id) {
 		t.Fatal("Hosts are not copies")
 	}
 }
@@ -5,11 +5,12 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"github.com/dedis/cothority/lib/crypto"
 	"github.com/dedis/cothority/lib/dbg"
 	"github.com/dedis/cothority/lib/network"
 	"github.com/dedis/crypto/abstract"
-	"github.com/satori/go.uuid"
 	"net"
+	"strconv"
 )
 
 // In this file we define the main structures used for a running protocol
@@ -26,7 +27,7 @@ import (
 // Tree is a topology to be used by any network layer/host layer
 // It contains the peer list we use, and the tree we use
 type Tree struct {
-	Id         uuid.UUID
+	Id         crypto.HashId
 	EntityList *EntityList
 	Root       *TreeNode
 }
@@ -34,17 +35,16 @@ type Tree struct {
 var TreeType = network.RegisterMessageType(Tree{})
 
 // NewTree creates a new tree using the entityList and the root-node. It
-// also generates the id.
+// also generates the ids of the tree and all TreeNodes, which only depend on
+// the structure of the tree and the Entities, so that two hosts creating the
+// same tree get the same ids.
 func NewTree(il *EntityList, r *TreeNode) *Tree {
-	url := network.UuidURL + "tree/" + il.Id.String() + r.Id.String()
 	t := &Tree{
 		EntityList: il,
 		Root:       r,
-		Id:         uuid.NewV5(uuid.NamespaceURL, url),
 	}
-	// network.Suite used for the moment => explicit mark that something is
-	// wrong and that needs to be changed !
-	t.computeSubtreeAggregate(network.Suite, r)
+	t.computeIds()
+	t.computeSubtreeAggregate(il.Suite(), r)
 	return t
 }
 
@@ -52,16 +52,14 @@ func NewTree(il *EntityList, r *TreeNode) *Tree {
 // the original tree
 func NewTreeFromMarshal(buf []byte, il *EntityList) (*Tree, error) {
 	tp, pm, err := network.UnmarshalRegisteredType(buf,
-		network.DefaultConstructors(network.Suite))
+		network.DefaultConstructors(il.Suite()))
 	if err != nil {
 		return nil, err
 	}
 	if tp != TreeMarshalType {
 		return nil, errors.New("Didn't receive TreeMarshal-struct")
 	}
-	t, err := pm.(TreeMarshal).MakeTree(il)
-	t.computeSubtreeAggregate(network.Suite, t.Root)
-	return t, err
+	return pm.(TreeMarshal).MakeTree(il)
 }
 
 // MakeTreeMarshal creates a replacement-tree that is safe to send: no
@@ -88,7 +86,7 @@ func (t *Tree) Marshal() ([]byte, error) {
 
 // Equal verifies if the given tree is equal
 func (t *Tree) Equal(t2 *Tree) bool {
-	if t.Id != t2.Id || t.EntityList.Id != t2.EntityList.Id {
+	if !t.Id.Equal(t2.Id) || !t.EntityList.Id.Equal(t2.EntityList.Id) {
 		dbg.Lvl4("Ids of trees don't match")
 		return false
 	}
@@ -117,9 +115,9 @@ func (t *Tree) Dump() string {
 }
 
 // GetTreeNode searches the tree for the given TreeNodeId
-func (t *Tree) GetTreeNode(tn uuid.UUID) (ret *TreeNode) {
+func (t *Tree) GetTreeNode(tn crypto.HashId) (ret *TreeNode) {
 	found := func(d int, tns *TreeNode) {
-		if tns.Id == tn {
+		if tns.Id.Equal(tn) {
 			ret = tns
 		}
 	}
@@ -173,7 +171,7 @@ func (t *Tree) UsesList() bool {
 	for _, p := range t.EntityList.List {
 		found := false
 		for _, n := range nodes {
-			if n.Entity.Id == p.Id {
+			if n.Entity.Id.Equal(p.Id) {
 				found = true
 				break
 			}
@@ -203,15 +201,39 @@ func (t *Tree) computeSubtreeAggregate(suite abstract.Suite, root *TreeNode) abs
 	return aggregate
 }
 
+// computeIds sets the ids of all TreeNodes and of the tree. The id of a
+// TreeNode is the hash of the id of its parent, its position amongst the
+// children of the parent and the id of its Entity. The id of the tree is
+// the hash of the EntityList-id and the ids of all TreeNodes.
+func (t *Tree) computeIds() {
+	ids := [][]byte{[]byte("tree"), t.EntityList.Id}
+	t.Root.Visit(0, func(d int, tn *TreeNode) {
+		var parent []byte
+		if tn.Parent != nil {
+			idx := 0
+			for i, c := range tn.Parent.Children {
+				if c == tn {
+					idx = i
+					break
+				}
+			}
+			parent = append([]byte(tn.Parent.Id), strconv.Itoa(idx)...)
+		}
+		tn.Id = crypto.NewHashId([]byte("treenode"), parent, tn.Entity.Id)
+		ids = append(ids, tn.Id)
+	})
+	t.Id = crypto.NewHashId(ids...)
+}
+
 // TreeMarshal is used to send and receive a tree-structure without having
 // to copy the whole nodelist
 type TreeMarshal struct {
-	// This is the UUID of the corresponding TreeNode, or the Tree-Id for the
+	// This is the id of the corresponding TreeNode, or the Tree-Id for the
 	// top-node
-	NodeId uuid.UUID
-	// This is the UUID of the Entity, except for the top-node, where this
+	NodeId crypto.HashId
+	// This is the id of the Entity, except for the top-node, where this
 	// is the EntityList-Id
-	EntityId uuid.UUID
+	EntityId crypto.HashId
 	// All children from this tree. The top-node only has one child, which is
 	// the root
 	Children []*TreeMarshal
@@ -244,64 +266,125 @@ func TreeMarshalCopyTree(tr *TreeNode) *TreeMarshal {
 
 // MakeTree creates a tree given an EntityList
 func (tm TreeMarshal) MakeTree(il *EntityList) (*Tree, error) {
-	if il.Id != tm.EntityId {
+	if !il.Id.Equal(tm.EntityId) {
 		return nil, errors.New("Not correct EntityList-Id")
 	}
-	tree := &Tree{
-		Id:         tm.NodeId,
-		EntityList: il,
+	if len(tm.Children) != 1 {
+		return nil, errors.New("TreeMarshal needs exactly one root")
+	}
+	root, err := tm.Children[0].MakeTreeFromList(nil, il)
+	if err != nil {
+		return nil, err
+	}
+	tree := NewTree(il, root)
+	if !tree.Id.Equal(tm.NodeId) {
+		return nil, errors.New("Tree-Id doesn't match the tree")
 	}
-	tree.Root = tm.Children[0].MakeTreeFromList(nil, il)
-	tree.computeSubtreeAggregate(network.Suite, tree.Root)
 	return tree, nil
 }
 
 // MakeTreeFromList creates a sub-tree given an EntityList
-func (tm *TreeMarshal) MakeTreeFromList(parent *TreeNode, il *EntityList) *TreeNode {
+func (tm *TreeMarshal) MakeTreeFromList(parent *TreeNode, il *EntityList) (*TreeNode, error) {
 	tn := &TreeNode{
 		Parent: parent,
 		Id:     tm.NodeId,
 		Entity: il.Search(tm.EntityId),
 	}
+	if tn.Entity == nil {
+		return nil, errors.New("Entity " + tm.EntityId.String() +
+			" is not in EntityList")
+	}
 	for _, c := range tm.Children {
-		tn.Children = append(tn.Children, c.MakeTreeFromList(tn, il))
+		child, err := c.MakeTreeFromList(tn, il)
+		if err != nil {
+			return nil, err
+		}
+		tn.Children = append(tn.Children, child)
 	}
-	return tn
+	return tn, nil
 }
 
 // An EntityList is a list of Entity we choose to run  some tree on it ( and
 // therefor some protocols)
 type EntityList struct {
-	Id uuid.UUID
-	// TODO make that a map so search is O(1)
+	Id   crypto.HashId
 	List []*network.Entity
 	// Aggregate public key
 	Aggregate abstract.Point
+	// SuiteName is the name of the suite of the public keys
+	SuiteName string
+	// maps the Entity-ids to the Entities, so search is O(1)
+	search map[string]*network.Entity
 }
 
 var EntityListType = network.RegisterMessageType(EntityList{})
 
 var NilEntityList = EntityList{}
 
-// NewEntityList creates a new Entity from a list of entities. It also
-// adds a UUID which is randomly chosen.
-func NewEntityList(ids []*network.Entity) *EntityList {
+// NewEntityList creates a new Entity from a list of entities using the
+// default suite. It also adds an id which is the hash of the ids of the
+// entities. It returns an error if an entity has no valid
+// proof-of-possession, see VerifyProofs.
+func NewEntityList(ids []*network.Entity) (*EntityList, error) {
+	return NewEntityListWithSuite(network.Suite, ids)
+}
+
+// NewEntityListWithSuite creates a new EntityList whose entities use suite.
+// The name of the suite is part of the id.
+func NewEntityListWithSuite(suite abstract.Suite, ids []*network.Entity) (*EntityList, error) {
 	// compute the aggregate key already
-	agg := network.Suite.Point().Null()
+	agg := suite.Point().Null()
+	hashes := [][]byte{[]byte("entitylist"), []byte(suite.String())}
+	search := make(map[string]*network.Entity)
 	for _, e := range ids {
 		agg = agg.Add(agg, e.Public)
+		hashes = append(hashes, e.Id)
+		search[string(e.Id)] = e
 	}
-	return &EntityList{
+	el := &EntityList{
 		List:      ids,
 		Aggregate: agg,
-		Id:        uuid.NewV4(),
+		SuiteName: suite.String(),
+		Id:        crypto.NewHashId(hashes...),
+		search:    search,
+	}
+	if err := el.VerifyProofs(suite); err != nil {
+		return nil, err
 	}
+	return el, nil
 }
 
-// Search looks for a corresponding UUID and returns that entity
-func (il *EntityList) Search(uuid uuid.UUID) *network.Entity {
+// Suite returns the suite of the public keys of the entities, or the
+// default suite if it is unknown.
+func (el *EntityList) Suite() abstract.Suite {
+	suite, err := network.SuiteByName(el.SuiteName)
+	if err != nil {
+		dbg.Error("Unknown suite", el.SuiteName, "- using default suite")
+		return network.Suite
+	}
+	return suite
+}
+
+// VerifyProofs checks the proof-of-possession of every Entity. As the
+// Aggregate is the sum of the public keys, an Entity choosing its key after
+// the others could otherwise cancel them out and sign alone.
+func (el *EntityList) VerifyProofs(suite abstract.Suite) error {
+	for i, e := range el.List {
+		if err := e.VerifyProof(suite); err != nil {
+			return fmt.Errorf("Entity %d: %s", i, err)
+		}
+	}
+	return nil
+}
+
+// Search looks for a corresponding id and returns that entity
+func (il *EntityList) Search(id crypto.HashId) *network.Entity {
+	if il.search != nil {
+		return il.search[string(id)]
+	}
+	// EntityList has not been created by NewEntityList
 	for _, i := range il.List {
-		if i.Id == uuid {
+		if i.Id.Equal(id) {
 			return i
 		}
 	}
@@ -311,12 +394,23 @@ func (il *EntityList) Search(uuid uuid.UUID) *network.Entity {
 // Get simply returns the entity that is stored at that index in the entitylist
 // returns nil if index error
 func (en *EntityList) Get(idx int) *network.Entity {
-	if idx < 0 || idx > len(en.List) {
+	if idx < 0 || idx >= len(en.List) {
 		return nil
 	}
 	return en.List[idx]
 }
 
+// Index returns the position of the entity in the entitylist or -1 if it
+// is not found
+func (en *EntityList) Index(e *network.Entity) int {
+	for i, entity := range en.List {
+		if entity.Equal(e) {
+			return i
+		}
+	}
+	return -1
+}
+
 // GenerateBigNaryTree creates a tree where each node has N children.
 // It will make a tree with exactly 'nodes' elements, regardless of the
 // size of the EntityList. If 'nodes' is bigger than the number of elements
@@ -425,7 +519,7 @@ func (il *EntityList) GenerateBinaryTree() *Tree {
 // TreeNode is one node in the tree
 type TreeNode struct {
 	// The Id represents that node of the tree
-	Id uuid.UUID
+	Id crypto.HashId
 	// The Entity points to the corresponding host. One given host
 	// can be used more than once in a tree.
 	Entity *network.Entity
@@ -444,13 +538,13 @@ func (t *TreeNode) Name() string {
 
 var TreeNodeType = network.RegisterMessageType(TreeNode{})
 
-// NewTreeNode creates a new TreeNode with the proper Id
+// NewTreeNode creates a new TreeNode. The Id is set once the TreeNode is
+// part of a tree created with NewTree.
 func NewTreeNode(ni *network.Entity) *TreeNode {
 	tn := &TreeNode{
 		Entity:   ni,
 		Parent:   nil,
 		Children: make([]*TreeNode, 0),
-		Id:       uuid.NewV4(),
 	}
 	return tn
 }
@@ -485,7 +579,7 @@ func (t *TreeNode) IsInTree(tree *Tree) bool {
 	for root.Parent != nil {
 		root = *root.Parent
 	}
-	return tree.Root.Id == root.Id
+	return tree.Root.Id.Equal(root.Id)
 }
 
 // AddChild adds a child to this tree-node.
@@ -496,7 +590,7 @@ func (t *TreeNode) AddChild(c *TreeNode) {
 
 // Equal tests if that node is equal to the given node
 func (t *TreeNode) Equal(t2 *TreeNode) bool {
-	if t.Id != t2.Id || t.Entity.Id != t2.Entity.Id {
+	if !t.Id.Equal(t2.Id) || !t.Entity.Id.Equal(t2.Entity.Id) {
 		dbg.Lvl4("TreeNode: ids are not equal")
 		return false
 	}
@@ -515,7 +609,7 @@ func (t *TreeNode) Equal(t2 *TreeNode) bool {
 
 // String returns the current treenode's Id as a string.
 func (t *TreeNode) String() string {
-	return string(t.Id.String())
+	return t.Id.String()
 }
 
 // Stringify returns a string containing the whole tree.
@@ -543,10 +637,10 @@ func (t *TreeNode) Visit(firstDepth int, fn func(depth int, n *TreeNode)) {
 }
 
 // EntityListToml is the struct can can embedded EntityToml to be written in a
-// toml file
+// toml file. The id is not stored, as it is derived from the entities.
 type EntityListToml struct {
-	Id   uuid.UUID
-	List []*network.EntityToml
+	List  []*network.EntityToml
+	Suite string `toml:",omitempty"`
 }
 
 // Toml returns the toml-writable version of this entityList
@@ -556,19 +650,25 @@ func (el *EntityList) Toml(suite abstract.Suite) *EntityListToml {
 		ids[i] = el.List[i].Toml(suite)
 	}
 	return &EntityListToml{
-		Id:   el.Id,
-		List: ids,
+		List:  ids,
+		Suite: suite.String(),
 	}
 }
 
-// EntityList returns the Id list from this toml read struct
-func (elt *EntityListToml) EntityList(suite abstract.Suite) *EntityList {
+// EntityList returns the Id list from this toml read struct. If the toml
+// holds the name of a suite, it is used instead of suite. Every entity
+// needs its proof-of-possession.
+func (elt *EntityListToml) EntityList(suite abstract.Suite) (*EntityList, error) {
+	if elt.Suite != "" {
+		if s, err := network.SuiteByName(elt.Suite); err == nil {
+			suite = s
+		} else {
+			dbg.Error("Unknown suite", elt.Suite)
+		}
+	}
 	ids := make([]*network.Entity, len(elt.List))
 	for i := range elt.List {
 		ids[i] = elt.List[i].Entity(suite)
 	}
-	return &EntityList{
-		Id:   elt.Id,
-		List: ids,
-	}
+	return NewEntityListWithSuite(suite, ids)
 }
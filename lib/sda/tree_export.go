@@ -0,0 +1,279 @@
+package sda
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/dedis/cothority/lib/cliutils"
+	"github.com/dedis/cothority/lib/crypto"
+	"github.com/dedis/cothority/lib/network"
+	"github.com/dedis/crypto/abstract"
+)
+
+// This file holds the export of Trees and EntityLists to the Graphviz
+// DOT-format and to a stable JSON-schema. The JSON-schema can be read back,
+// so that trees can be edited by hand and replayed using
+// LocalTest.GenTreeFromJSON. As all ids are derived from the content, they
+// are optional when reading. If they are present, they are verified. The
+// proofs-of-possession are required.
+
+// EntityJSON is the JSON-representation of an Entity. The public key and
+// the proof-of-possession are stored as hex-strings.
+type EntityJSON struct {
+	Id        string   `json:"id,omitempty"`
+	Public    string   `json:"public"`
+	Addresses []string `json:"addresses"`
+	Proof     string   `json:"proof,omitempty"`
+}
+
+// EntityListJSON is the JSON-representation of an EntityList
+type EntityListJSON struct {
+	Id    string        `json:"id,omitempty"`
+	List  []*EntityJSON `json:"list"`
+	Suite string        `json:"suite,omitempty"`
+}
+
+// TreeNodeJSON is the JSON-representation of a TreeNode. Instead of copying
+// the Entity, it only holds the index of the Entity in the EntityList.
+type TreeNodeJSON struct {
+	Id       string          `json:"id,omitempty"`
+	Entity   int             `json:"entity"`
+	Children []*TreeNodeJSON `json:"children,omitempty"`
+}
+
+// TreeJSON is the JSON-representation of a Tree including its EntityList
+type TreeJSON struct {
+	Id         string          `json:"id,omitempty"`
+	EntityList *EntityListJSON `json:"entitylist"`
+	Root       *TreeNodeJSON   `json:"root"`
+}
+
+// JSON returns the JSON-representation of the EntityList
+func (el *EntityList) JSON(suite abstract.Suite) ([]byte, error) {
+	elj, err := el.toJSON(suite)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(elj, "", "  ")
+}
+
+// toJSON converts the EntityList to an EntityListJSON
+func (el *EntityList) toJSON(suite abstract.Suite) (*EntityListJSON, error) {
+	elj := &EntityListJSON{
+		Id:    el.Id.String(),
+		List:  make([]*EntityJSON, len(el.List)),
+		Suite: el.SuiteName,
+	}
+	for i, e := range el.List {
+		pub, err := cliutils.PubHex(suite, e.Public)
+		if err != nil {
+			return nil, err
+		}
+		elj.List[i] = &EntityJSON{
+			Id:        e.Id.String(),
+			Public:    pub,
+			Addresses: e.Addresses,
+			Proof:     e.ProofHex(),
+		}
+	}
+	return elj, nil
+}
+
+// NewEntityListFromJSON reads an EntityList as written by EntityList.JSON
+func NewEntityListFromJSON(suite abstract.Suite, buf []byte) (*EntityList, error) {
+	elj := &EntityListJSON{}
+	if err := json.Unmarshal(buf, elj); err != nil {
+		return nil, err
+	}
+	return elj.EntityList(suite)
+}
+
+// EntityList converts the JSON-representation back to an EntityList. The
+// ids of the Entities and the EntityList are re-calculated and compared to
+// the given ids. If the JSON holds the name of a suite, it is used instead
+// of suite.
+func (elj *EntityListJSON) EntityList(suite abstract.Suite) (*EntityList, error) {
+	if elj.Suite != "" {
+		var err error
+		suite, err = network.SuiteByName(elj.Suite)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ids := make([]*network.Entity, len(elj.List))
+	for i, ej := range elj.List {
+		pub, err := cliutils.ReadPubHex(suite, ej.Public)
+		if err != nil {
+			return nil, fmt.Errorf("Wrong public key for entity %d: %s",
+				i, err)
+		}
+		ids[i] = network.NewEntity(pub, ej.Addresses...)
+		if err := checkJSONId(ej.Id, ids[i].Id); err != nil {
+			return nil, fmt.Errorf("Entity %d: %s", i, err)
+		}
+		if err := ids[i].SetProofHex(suite, ej.Proof); err != nil {
+			return nil, fmt.Errorf("Entity %d: %s", i, err)
+		}
+	}
+	// this also verifies the proofs-of-possession
+	el, err := NewEntityListWithSuite(suite, ids)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkJSONId(elj.Id, el.Id); err != nil {
+		return nil, fmt.Errorf("EntityList: %s", err)
+	}
+	return el, nil
+}
+
+// JSON returns the JSON-representation of the tree, including the
+// EntityList.
+func (t *Tree) JSON(suite abstract.Suite) ([]byte, error) {
+	elj, err := t.EntityList.toJSON(suite)
+	if err != nil {
+		return nil, err
+	}
+	root, err := t.Root.toJSON(t.EntityList)
+	if err != nil {
+		return nil, err
+	}
+	tj := &TreeJSON{
+		Id:         t.Id.String(),
+		EntityList: elj,
+		Root:       root,
+	}
+	return json.MarshalIndent(tj, "", "  ")
+}
+
+// toJSON converts the sub-tree to a TreeNodeJSON
+func (t *TreeNode) toJSON(el *EntityList) (*TreeNodeJSON, error) {
+	idx := el.Index(t.Entity)
+	if idx < 0 {
+		return nil, errors.New("Entity of TreeNode " + t.Id.String() +
+			" is not in EntityList")
+	}
+	tnj := &TreeNodeJSON{
+		Id:     t.Id.String(),
+		Entity: idx,
+	}
+	for _, c := range t.Children {
+		cj, err := c.toJSON(el)
+		if err != nil {
+			return nil, err
+		}
+		tnj.Children = append(tnj.Children, cj)
+	}
+	return tnj, nil
+}
+
+// NewTreeFromJSON reads a tree as written by Tree.JSON
+func NewTreeFromJSON(suite abstract.Suite, buf []byte) (*Tree, error) {
+	tj := &TreeJSON{}
+	if err := json.Unmarshal(buf, tj); err != nil {
+		return nil, err
+	}
+	if tj.EntityList == nil || tj.Root == nil {
+		return nil, errors.New("Missing EntityList or Root in tree")
+	}
+	el, err := tj.EntityList.EntityList(suite)
+	if err != nil {
+		return nil, err
+	}
+	t, err := tj.Tree(el)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkJSONId(tj.Id, t.Id); err != nil {
+		return nil, fmt.Errorf("Tree: %s", err)
+	}
+	tjNodes := tj.Root.list()
+	for i, tn := range t.ListNodes() {
+		if err := checkJSONId(tjNodes[i].Id, tn.Id); err != nil {
+			return nil, fmt.Errorf("TreeNode %d: %s", i, err)
+		}
+	}
+	return t, nil
+}
+
+// Tree creates the tree described by the TreeJSON using the Entities from
+// el. This is also used to replay the structure of a tree on another
+// EntityList of the same size, so the ids of the TreeJSON are not verified.
+func (tj *TreeJSON) Tree(el *EntityList) (*Tree, error) {
+	root, err := tj.Root.TreeNode(nil, el)
+	if err != nil {
+		return nil, err
+	}
+	return NewTree(el, root), nil
+}
+
+// TreeNode creates the sub-tree described by the TreeNodeJSON
+func (tnj *TreeNodeJSON) TreeNode(parent *TreeNode, el *EntityList) (*TreeNode, error) {
+	e := el.Get(tnj.Entity)
+	if e == nil {
+		return nil, fmt.Errorf("Entity-index %d out of range", tnj.Entity)
+	}
+	tn := NewTreeNode(e)
+	tn.Parent = parent
+	for _, c := range tnj.Children {
+		child, err := c.TreeNode(tn, el)
+		if err != nil {
+			return nil, err
+		}
+		tn.Children = append(tn.Children, child)
+	}
+	return tn, nil
+}
+
+// list returns all TreeNodeJSONs in the same depth-first order as
+// TreeNode.Visit
+func (tnj *TreeNodeJSON) list() []*TreeNodeJSON {
+	ret := []*TreeNodeJSON{tnj}
+	for _, c := range tnj.Children {
+		ret = append(ret, c.list()...)
+	}
+	return ret
+}
+
+// checkJSONId returns an error if the id read from JSON is given and
+// doesn't match the calculated id
+func checkJSONId(jsonId string, id crypto.HashId) error {
+	if jsonId == "" {
+		return nil
+	}
+	if jsonId != id.String() {
+		return errors.New("Id " + jsonId + " doesn't match content")
+	}
+	return nil
+}
+
+// Dot returns the tree in the Graphviz DOT-format. Every TreeNode is labeled
+// with the address of its Entity, so a host used more than once in the
+// tree shows up more than once.
+func (t *Tree) Dot() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "digraph \"%s\" {\n", t.Id)
+	t.Root.Visit(0, func(d int, tn *TreeNode) {
+		fmt.Fprintf(&buf, "  \"%s\" [label=\"%s\"];\n", tn.Id,
+			tn.Entity.First())
+		if tn.Parent != nil {
+			fmt.Fprintf(&buf, "  \"%s\" -> \"%s\";\n", tn.Parent.Id,
+				tn.Id)
+		}
+	})
+	buf.WriteString("}\n")
+	return buf.String()
+}
+
+// Dot returns the EntityList in the Graphviz DOT-format. As the EntityList
+// has no structure, this is a graph without edges.
+func (el *EntityList) Dot() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "graph \"%s\" {\n", el.Id)
+	for _, e := range el.List {
+		fmt.Fprintf(&buf, "  \"%s\" [label=\"%s\"];\n", e.Id, e.First())
+	}
+	buf.WriteString("}\n")
+	return buf.String()
+}
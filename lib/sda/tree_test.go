@@ -1,14 +1,17 @@
 package sda_test
 
 import (
+	"github.com/dedis/cothority/lib/cosi"
+	"github.com/dedis/cothority/lib/crypto"
 	"github.com/dedis/cothority/lib/dbg"
 	"github.com/dedis/cothority/lib/network"
 	"github.com/dedis/cothority/lib/sda"
 	"github.com/dedis/crypto/abstract"
 	"github.com/dedis/crypto/config"
-	"github.com/satori/go.uuid"
+	"github.com/dedis/crypto/nist"
 	"net"
 	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -35,11 +38,52 @@ func TestTreeId(t *testing.T) {
 				t.Fatal("Id generated is wrong")
 			}
 	*/
-	if len(tree.Id.String()) != 36 {
+	if len(tree.Id) != 32 {
 		t.Fatal("Id generated is wrong")
 	}
 }
 
+// Test that independently created trees with the same structure get the
+// same ids
+func TestTreeIdDeterministic(t *testing.T) {
+	defer dbg.AfterTest(t)
+
+	names := genLocalhostPeerNames(7, 2000)
+	el := genEntityList(tSuite, names)
+	el2, err := sda.NewEntityList(el.List)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !el.Id.Equal(el2.Id) {
+		t.Fatal("Same entities should give same EntityList-id")
+	}
+	tree := el.GenerateBinaryTree()
+	tree2 := el2.GenerateBinaryTree()
+	if !tree.Equal(tree2) {
+		t.Fatal("Same structure should give same tree")
+	}
+	nodes := tree.ListNodes()
+	for i, tn := range tree2.ListNodes() {
+		if !tn.Id.Equal(nodes[i].Id) {
+			t.Fatal("TreeNode", i, "has different ids")
+		}
+	}
+	tree3 := el.GenerateNaryTree(3)
+	if tree3.Id.Equal(tree.Id) {
+		t.Fatal("Different structure should give different tree-ids")
+	}
+
+	// The same entity used twice in a tree needs different ids
+	tree4 := el.GenerateBigNaryTree(2, 15)
+	ids := make(map[string]bool)
+	for _, tn := range tree4.ListNodes() {
+		if ids[string(tn.Id)] {
+			t.Fatal("Found TreeNode-id twice")
+		}
+		ids[string(tn.Id)] = true
+	}
+}
+
 // Test if topology correctly handles the "virtual" connections in the topology
 func TestTreeConnectedTo(t *testing.T) {
 	defer dbg.AfterTest(t)
@@ -66,11 +110,27 @@ func TestEntityListNew(t *testing.T) {
 	if len(pl.List) != 2 {
 		t.Fatalf("Expected two peers in PeerList. Instead got %d", len(pl.List))
 	}
-	if pl.Id == uuid.Nil {
+	if len(pl.Id) == 0 {
 		t.Fatal("PeerList without ID is not allowed")
 	}
-	if len(pl.Id.String()) != 36 {
-		t.Fatal("PeerList ID does not seem to be a UUID.")
+	if len(pl.Id) != 32 {
+		t.Fatal("PeerList ID does not seem to be a sha256-hash.")
+	}
+}
+
+// Test the lookup of entities in an EntityList
+func TestEntityListSearch(t *testing.T) {
+	defer dbg.AfterTest(t)
+
+	names := genLocalhostPeerNames(5, 2000)
+	el := genEntityList(tSuite, names)
+	for _, e := range el.List {
+		if el.Search(e.Id) != e {
+			t.Fatal("Didn't find entity", e.First())
+		}
+	}
+	if el.Search(crypto.NewHashId([]byte("unknown"))) != nil {
+		t.Fatal("Shouldn't find unknown entity")
 	}
 }
 
@@ -87,15 +147,18 @@ func TestInitPeerListFromConfigFile(t *testing.T) {
 	if err := sda.ReadTomlConfig(&decoded, "identities.toml", "testdata"); err != nil {
 		t.Fatal("COuld not read from file the entityList")
 	}
-	decodedList := decoded.EntityList(tSuite)
+	decodedList, err := decoded.EntityList(tSuite)
+	if err != nil {
+		t.Fatal("Decoded EntityList should keep the proofs:", err)
+	}
 	if len(decodedList.List) != 3 {
 		t.Fatalf("Expected two identities in EntityList. Instead got %d", len(decodedList.List))
 	}
-	if decodedList.Id == uuid.Nil {
+	if len(decodedList.Id) == 0 {
 		t.Fatal("PeerList without ID is not allowed")
 	}
-	if len(decodedList.Id.String()) != 36 {
-		t.Fatal("PeerList ID does not seem to be a UUID hash.")
+	if !decodedList.Id.Equal(idsList.Id) {
+		t.Fatal("Decoded EntityList should have the same ID")
 	}
 }
 
@@ -118,7 +181,7 @@ func TestTreeParent(t *testing.T) {
 	// Generate two example topology
 	tree := peerList.GenerateBinaryTree()
 	child := tree.Root.Children[0]
-	if child.Parent.Id != tree.Root.Id {
+	if !child.Parent.Id.Equal(tree.Root.Id) {
 		t.Fatal("Parent of child of root is not the root...")
 	}
 }
@@ -132,7 +195,7 @@ func TestTreeChildren(t *testing.T) {
 	// Generate two example topology
 	tree := peerList.GenerateBinaryTree()
 	child := tree.Root.Children[0]
-	if child.Entity.Id != peerList.List[1].Id {
+	if !child.Entity.Id.Equal(peerList.List[1].Id) {
 		t.Fatal("Parent of child of root is not the root...")
 	}
 }
@@ -163,6 +226,13 @@ func TestUnMarshalTree(t *testing.T) {
 		dbg.Lvl3(tree, "\n", tree2)
 		t.Fatal("Tree and Tree2 are not identical")
 	}
+
+	// A tree with a wrong id must be refused
+	tm := tree.MakeTreeMarshal()
+	tm.NodeId = crypto.NewHashId([]byte("wrong"))
+	if _, err := tm.MakeTree(peerList); err == nil {
+		t.Fatal("Shouldn't accept tree with wrong id")
+	}
 }
 
 func TestGetNode(t *testing.T) {
@@ -252,11 +322,11 @@ func TestBigNaryTree(t *testing.T) {
 		t.Fatal("Tree should be 3-ary")
 	}
 	for _, child := range root.Children {
-		if child.Entity.Id == root.Entity.Id {
+		if child.Entity.Id.Equal(root.Entity.Id) {
 			t.Fatal("Child should not have same identity as parent")
 		}
 		for _, c := range child.Children {
-			if c.Entity.Id == child.Entity.Id {
+			if c.Entity.Id.Equal(child.Entity.Id) {
 				t.Fatal("Child should not have same identity as parent")
 			}
 		}
@@ -356,6 +426,188 @@ func TestTreeComputeSubtreeAggregate(t *testing.T) {
 
 }
 
+// TestEntityListRogueKey forges a signature for an EntityList using a
+// rogue key and checks that the proofs-of-possession reject it.
+func TestEntityListRogueKey(t *testing.T) {
+	defer dbg.AfterTest(t)
+
+	el := genEntityList(tSuite, genLocalhostPeerNames(3, 2000))
+	if err := el.VerifyProofs(tSuite); err != nil {
+		t.Fatal("Honest list should verify:", err)
+	}
+	// the attacker chooses its key so that the aggregate is its own key
+	attacker := config.NewKeyPair(tSuite)
+	rogue := tSuite.Point().Sub(attacker.Public, el.Aggregate)
+	rogueEntity := network.NewEntity(rogue, "localhost:2010")
+	// the attacker doesn't know the private key of rogue
+	if err := rogueEntity.Prove(tSuite, attacker.Secret); err != nil {
+		t.Fatal(err)
+	}
+	rogueAggregate := tSuite.Point().Add(el.Aggregate, rogue)
+	if !rogueAggregate.Equal(attacker.Public) {
+		t.Fatal("Rogue key should cancel out the other keys")
+	}
+	msg := []byte("Forged message")
+	forger := cosi.NewCosi(tSuite, attacker.Secret)
+	forger.Commit(nil)
+	chal, err := forger.CreateChallenge(rogueAggregate, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forger.Challenge(chal)
+	if _, err := forger.Response(nil); err != nil {
+		t.Fatal(err)
+	}
+	sig := forger.Signature()
+	err = cosi.VerifySignature(tSuite, msg, rogueAggregate, sig.Challenge, sig.Response)
+	if err != nil {
+		t.Fatal("Forged signature should verify against the aggregate:", err)
+	}
+	if _, err := sda.NewEntityList(append(el.List, rogueEntity)); err == nil {
+		t.Fatal("List with rogue key should be rejected")
+	}
+	// an entity without proof is rejected, too
+	kp := config.NewKeyPair(tSuite)
+	if _, err := sda.NewEntityList([]*network.Entity{network.NewEntity(kp.Public, "localhost:2011")}); err == nil {
+		t.Fatal("List without proofs should be rejected")
+	}
+}
+
+// TestEntityListSuite checks that the suite of an EntityList survives the
+// export to toml and JSON.
+func TestEntityListSuite(t *testing.T) {
+	defer dbg.AfterTest(t)
+
+	suite := nist.NewAES128SHA256P256()
+	var ids []*network.Entity
+	for _, n := range genLocalhostPeerNames(3, 2000) {
+		kp := config.NewKeyPair(suite)
+		e := network.NewEntity(kp.Public, n)
+		if err := e.Prove(suite, kp.Secret); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, e)
+	}
+	el, err := sda.NewEntityListWithSuite(suite, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if el.Suite().String() != suite.String() {
+		t.Fatal("Wrong suite", el.SuiteName)
+	}
+	tree := el.GenerateBinaryTree()
+	if !tree.Root.PublicAggregateSubTree.Equal(el.Aggregate) {
+		t.Fatal("Wrong aggregate of the tree")
+	}
+
+	// the suite of the files is used instead of the default suite
+	elToml, err := el.Toml(suite).EntityList(tSuite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := el.JSON(suite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	elJSON, err := sda.NewEntityListFromJSON(tSuite, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, decoded := range []*sda.EntityList{elToml, elJSON} {
+		if !decoded.Id.Equal(el.Id) {
+			t.Fatal("Decoded EntityList should have the same id")
+		}
+		if err := decoded.VerifyProofs(decoded.Suite()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Test the export to JSON and back
+func TestTreeJSON(t *testing.T) {
+	defer dbg.AfterTest(t)
+
+	tree, el := genLocalTree(7, 2000)
+	buf, err := tree.JSON(tSuite)
+	if err != nil {
+		t.Fatal("Couldn't export tree:", err)
+	}
+	tree2, err := sda.NewTreeFromJSON(tSuite, buf)
+	if err != nil {
+		t.Fatal("Couldn't import tree:", err)
+	}
+	if !tree.Equal(tree2) {
+		t.Fatal("Imported tree is not the same")
+	}
+	if !tree.Root.PublicAggregateSubTree.Equal(tree2.Root.PublicAggregateSubTree) {
+		t.Fatal("Aggregate of imported tree is not the same")
+	}
+
+	buf, err = el.JSON(tSuite)
+	if err != nil {
+		t.Fatal("Couldn't export EntityList:", err)
+	}
+	el2, err := sda.NewEntityListFromJSON(tSuite, buf)
+	if err != nil {
+		t.Fatal("Couldn't import EntityList:", err)
+	}
+	if !el.Id.Equal(el2.Id) || len(el2.List) != len(el.List) {
+		t.Fatal("Imported EntityList is not the same")
+	}
+	for i, e := range el.List {
+		if !e.Id.Equal(el2.List[i].Id) || !e.Equal(el2.List[i]) {
+			t.Fatal("Entity", i, "is not the same")
+		}
+	}
+}
+
+// Test the export to DOT
+func TestTreeDot(t *testing.T) {
+	defer dbg.AfterTest(t)
+
+	tree, el := genLocalTree(3, 2000)
+	dot := tree.Dot()
+	for _, tn := range tree.ListNodes() {
+		if !strings.Contains(dot, tn.Id.String()) {
+			t.Fatal("TreeNode", tn.Id, "missing in DOT-output")
+		}
+	}
+	edge := "\"" + tree.Root.Id.String() + "\" -> \"" +
+		tree.Root.Children[0].Id.String() + "\""
+	if !strings.Contains(dot, edge) {
+		t.Fatal("Missing edge from root in DOT-output")
+	}
+	dot = el.Dot()
+	for _, e := range el.List {
+		if !strings.Contains(dot, e.First()) {
+			t.Fatal("Entity", e.First(), "missing in DOT-output")
+		}
+	}
+}
+
+// Test replaying a tree from JSON in LocalTest
+func TestLocalTreeFromJSON(t *testing.T) {
+	defer dbg.AfterTest(t)
+
+	tree, _ := genLocalTree(7, 2000)
+	buf, err := tree.JSON(tSuite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := sda.NewLocalTest()
+	defer local.CloseAll()
+	_, _, tree2, err := local.GenTreeFromJSON(buf, false, true)
+	if err != nil {
+		t.Fatal("Couldn't replay tree:", err)
+	}
+	if tree2.Size() != tree.Size() {
+		t.Fatal("Replayed tree has not the same structure")
+	}
+	if !tree2.IsBinary(tree2.Root) {
+		t.Fatal("Replayed tree should be binary")
+	}
+}
+
 // - public keys
 // - corner-case: accessing parent/children with multiple instances of the same peer
 // in the graph
@@ -383,9 +635,17 @@ func genEntityList(suite abstract.Suite, names []string) *sda.EntityList {
 	var ids []*network.Entity
 	for _, n := range names {
 		kp := config.NewKeyPair(suite)
-		ids = append(ids, network.NewEntity(kp.Public, n))
+		e := network.NewEntity(kp.Public, n)
+		if err := e.Prove(suite, kp.Secret); err != nil {
+			dbg.Fatal(err)
+		}
+		ids = append(ids, e)
+	}
+	el, err := sda.NewEntityList(ids)
+	if err != nil {
+		dbg.Fatal(err)
 	}
-	return sda.NewEntityList(ids)
+	return el
 }
 
 func genLocalTree(count, port int) (*sda.Tree, *sda.EntityList) {
@@ -0,0 +1,313 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math"
+
+	"github.com/dedis/cothority/protocols/byzcoin/blockchain/blkparser"
+)
+
+// The binary encoding of blocks is canonical: a block has exactly one
+// encoding, so that it can be hashed and signed. Integers are uvarints and
+// byte slices are preceded by their length. Hashes and keys are sent as the
+// bytes their lowercase hex strings stand for, other strings as they are.
+
+// MarshalBinary returns the binary encoding of the block.
+func (tr *TrBlock) MarshalBinary() ([]byte, error) {
+	if tr.Header == nil {
+		return nil, errors.New("Block without header")
+	}
+	var e encoder
+	e.Write(tr.Magic[:])
+	e.uvarint(uint64(tr.BlockSize))
+	e.hexString(tr.HeaderHash)
+	tr.Header.encode(&e)
+	tr.TransactionList.encode(&e)
+	return e.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a block encoded by MarshalBinary.
+func (tr *TrBlock) UnmarshalBinary(data []byte) error {
+	d := &decoder{buf: data}
+	*tr = TrBlock{}
+	copy(tr.Magic[:], d.bytes(len(tr.Magic)))
+	tr.BlockSize = d.uint32()
+	tr.HeaderHash = d.hexString()
+	tr.Header = &Header{}
+	tr.Header.decode(d)
+	tr.TransactionList.decode(d)
+	return d.finish()
+}
+
+// MarshalBinary returns the binary encoding of the header.
+func (h *Header) MarshalBinary() ([]byte, error) {
+	var e encoder
+	h.encode(&e)
+	return e.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a header encoded by MarshalBinary.
+func (h *Header) UnmarshalBinary(data []byte) error {
+	d := &decoder{buf: data}
+	*h = Header{}
+	h.decode(d)
+	return d.finish()
+}
+
+// MarshalBinary returns the binary encoding of the transactions.
+func (tl *TransactionList) MarshalBinary() ([]byte, error) {
+	var e encoder
+	tl.encode(&e)
+	return e.Bytes(), nil
+}
+
+// UnmarshalBinary decodes transactions encoded by MarshalBinary.
+func (tl *TransactionList) UnmarshalBinary(data []byte) error {
+	d := &decoder{buf: data}
+	*tl = TransactionList{}
+	tl.decode(d)
+	return d.finish()
+}
+
+func (h *Header) encode(e *encoder) {
+	e.hexString(h.MerkleRoot)
+	e.hexString(h.Parent)
+	e.hexString(h.ParentKey)
+	e.hexString(h.PublicKey)
+	e.bytes(h.LeaderId)
+}
+
+func (h *Header) decode(d *decoder) {
+	h.MerkleRoot = d.hexString()
+	h.Parent = d.hexString()
+	h.ParentKey = d.hexString()
+	h.PublicKey = d.hexString()
+	if ip := d.lenBytes(); len(ip) > 0 {
+		h.LeaderId = ip
+	}
+}
+
+func (tl *TransactionList) encode(e *encoder) {
+	e.uvarint(uint64(tl.TxCnt))
+	e.uint64(math.Float64bits(tl.Fees))
+	e.uvarint(uint64(len(tl.Txs)))
+	for i := range tl.Txs {
+		encodeTx(e, &tl.Txs[i])
+	}
+}
+
+func (tl *TransactionList) decode(d *decoder) {
+	tl.TxCnt = d.uint32()
+	tl.Fees = math.Float64frombits(d.uint64())
+	n := d.count()
+	tl.Txs = make([]blkparser.Tx, n)
+	for i := range tl.Txs {
+		decodeTx(d, &tl.Txs[i])
+	}
+}
+
+// TxId returns the id of tx: the hex-encoded hash of its binary encoding
+// without the Hash, which is the id itself.
+func TxId(tx *blkparser.Tx) string {
+	unhashed := *tx
+	unhashed.Hash = ""
+	return hashTx(&unhashed)
+}
+
+// IsStripped returns true if tx is only the hash of a transaction, like in
+// a compact block.
+func IsStripped(tx *blkparser.Tx) bool {
+	return len(tx.TxIns) == 0 && len(tx.TxOuts) == 0
+}
+
+// compactTxId returns the TxId of tx, or the Hash of a stripped transaction,
+// which stands for the transaction with this TxId.
+func compactTxId(tx *blkparser.Tx) string {
+	if IsStripped(tx) {
+		return tx.Hash
+	}
+	return TxId(tx)
+}
+
+// SigHash returns what the inputs of tx sign: the hex-encoded hash of its
+// binary encoding without the Hash and the ScriptSigs of the inputs.
+func SigHash(tx *blkparser.Tx) string {
+	unsigned := *tx
+	unsigned.Hash = ""
+	unsigned.TxIns = make([]*blkparser.TxIn, len(tx.TxIns))
+	for i, in := range tx.TxIns {
+		txin := *in
+		txin.ScriptSig = nil
+		unsigned.TxIns[i] = &txin
+	}
+	return hashTx(&unsigned)
+}
+
+func hashTx(tx *blkparser.Tx) string {
+	var e encoder
+	encodeTx(&e, tx)
+	h := sha256.Sum256(e.Bytes())
+	return hex.EncodeToString(h[:])
+}
+
+func encodeTx(e *encoder, tx *blkparser.Tx) {
+	e.hexString(tx.Hash)
+	for _, v := range []uint32{tx.Size, tx.LockTime, tx.Version, tx.TxInCnt, tx.TxOutCnt} {
+		e.uvarint(uint64(v))
+	}
+	e.uvarint(uint64(len(tx.TxIns)))
+	for _, in := range tx.TxIns {
+		e.hexString(in.InputHash)
+		e.uvarint(uint64(in.InputVout))
+		e.bytes(in.ScriptSig)
+		e.uvarint(uint64(in.Sequence))
+	}
+	e.uvarint(uint64(len(tx.TxOuts)))
+	for _, out := range tx.TxOuts {
+		e.bytes([]byte(out.Addr))
+		e.uvarint(out.Value)
+		e.bytes(out.Pkscript)
+	}
+}
+
+func decodeTx(d *decoder, tx *blkparser.Tx) {
+	tx.Hash = d.hexString()
+	for _, v := range []*uint32{&tx.Size, &tx.LockTime, &tx.Version, &tx.TxInCnt, &tx.TxOutCnt} {
+		*v = d.uint32()
+	}
+	tx.TxIns = make([]*blkparser.TxIn, d.count())
+	for i := range tx.TxIns {
+		tx.TxIns[i] = &blkparser.TxIn{
+			InputHash: d.hexString(),
+			InputVout: d.uint32(),
+			ScriptSig: d.lenBytes(),
+			Sequence:  d.uint32(),
+		}
+	}
+	tx.TxOuts = make([]*blkparser.TxOut, d.count())
+	for i := range tx.TxOuts {
+		tx.TxOuts[i] = &blkparser.TxOut{
+			Addr:     string(d.lenBytes()),
+			Value:    d.uvarint(),
+			Pkscript: d.lenBytes(),
+		}
+	}
+}
+
+// encoder writes the binary encoding of a block
+type encoder struct {
+	bytes.Buffer
+}
+
+func (e *encoder) uvarint(v uint64) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	e.Write(buf[:binary.PutUvarint(buf, v)])
+}
+
+func (e *encoder) uint64(v uint64) {
+	binary.Write(e, binary.BigEndian, v)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.uvarint(uint64(len(b)))
+	e.Write(b)
+}
+
+// hexString writes s as the bytes it stands for if it is a lowercase hex
+// string, else as it is, preceded by a flag.
+func (e *encoder) hexString(s string) {
+	if b, err := hex.DecodeString(s); err == nil && hex.EncodeToString(b) == s {
+		e.WriteByte(1)
+		e.bytes(b)
+		return
+	}
+	e.WriteByte(0)
+	e.bytes([]byte(s))
+}
+
+// decoder reads a binary encoding, keeping the first error
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) fail(msg string) {
+	if d.err == nil {
+		d.err = errors.New(msg)
+	}
+	d.buf = nil
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if n > len(d.buf) {
+		d.fail("Encoding is too short")
+		return make([]byte, n)
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.fail("Wrong integer in encoding")
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) uint32() uint32 {
+	v := d.uvarint()
+	if v > math.MaxUint32 {
+		d.fail("Integer too big in encoding")
+	}
+	return uint32(v)
+}
+
+func (d *decoder) uint64() uint64 {
+	return binary.BigEndian.Uint64(d.bytes(8))
+}
+
+// count returns the length of a list or slice, which can't be bigger than
+// the rest of the encoding.
+func (d *decoder) count() int {
+	n := d.uvarint()
+	if n > uint64(len(d.buf)) {
+		d.fail("Wrong length in encoding")
+		return 0
+	}
+	return int(n)
+}
+
+// lenBytes returns a copy of a byte slice preceded by its length. It is
+// never nil.
+func (d *decoder) lenBytes() []byte {
+	return append([]byte{}, d.bytes(d.count())...)
+}
+
+func (d *decoder) hexString() string {
+	flag := d.bytes(1)[0]
+	b := d.lenBytes()
+	switch flag {
+	case 0:
+		return string(b)
+	case 1:
+		return hex.EncodeToString(b)
+	}
+	d.fail("Wrong string flag in encoding")
+	return ""
+}
+
+// finish returns the first error, or an error if data is left
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.buf) > 0 {
+		return errors.New("Data left after encoding")
+	}
+	return d.err
+}
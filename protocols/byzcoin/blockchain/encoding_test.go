@@ -0,0 +1,112 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/dedis/cothority/lib/dbg"
+	"github.com/dedis/cothority/protocols/byzcoin/blockchain/blkparser"
+)
+
+func TestBinaryEncoding(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	txs := NewGenerator(&TxConfig{TxSize: 250, TxInputs: 2, TxOutputs: 2}).Generate(20)
+	trlist := NewTransactionList(txs, len(txs))
+	header := NewHeader(trlist, "not hex", HashHeader(&Header{}))
+	header.LeaderId = net.ParseIP("10.0.0.1")
+	block := NewTrBlock(trlist, header)
+
+	buf, err := block.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &TrBlock{}
+	if err := decoded.UnmarshalBinary(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(block, decoded) {
+		t.Fatal("Decoded block differs")
+	}
+	again, _ := decoded.MarshalBinary()
+	if !bytes.Equal(buf, again) {
+		t.Fatal("Encoding is not canonical")
+	}
+	if !bytes.Equal(block.HashSum(), decoded.HashSum()) {
+		t.Fatal("HashSum changed")
+	}
+	js, _ := json.Marshal(block)
+	if len(buf) >= len(js)/2 {
+		t.Fatal("Binary encoding isn't compact:", len(buf), "JSON:", len(js))
+	}
+
+	// the HashSum covers the encoding of the transactions, which their
+	// ids stand for
+	stripped := *block
+	stripped.Txs = nil
+	for i := range txs {
+		stripped.Txs = append(stripped.Txs, blkparser.Tx{Hash: TxId(&txs[i])})
+	}
+	if !bytes.Equal(block.HashSum(), stripped.HashSum()) {
+		t.Fatal("HashSum of the stripped block changed")
+	}
+	changed := *block
+	changed.Txs = append([]blkparser.Tx{}, txs...)
+	changed.Txs[0].LockTime++
+	if bytes.Equal(block.HashSum(), changed.HashSum()) {
+		t.Fatal("HashSum doesn't cover the transactions")
+	}
+	header.Parent = "other"
+	if bytes.Equal(block.HashSum(), decoded.HashSum()) {
+		t.Fatal("HashSum doesn't cover the header")
+	}
+
+	if decoded.UnmarshalBinary(buf[:len(buf)-1]) == nil {
+		t.Fatal("Decoded a truncated block")
+	}
+	if decoded.UnmarshalBinary(append(buf, 0)) == nil {
+		t.Fatal("Decoded a block with trailing data")
+	}
+}
+
+func TestTxId(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	txs := NewGenerator(&TxConfig{TxSize: 250, TxInputs: 2, TxOutputs: 2}).Generate(3)
+	tx := txs[2]
+	if TxId(&tx) != tx.Hash {
+		t.Fatal("Generator doesn't use the TxId as hash")
+	}
+	signed := tx
+	signed.Hash = "claimed"
+	if TxId(&signed) != tx.Hash {
+		t.Fatal("TxId depends on the hash")
+	}
+	signed.TxIns = []*blkparser.TxIn{{}, {}}
+	for i, in := range tx.TxIns {
+		*signed.TxIns[i] = *in
+		signed.TxIns[i].ScriptSig = []byte("signature")
+	}
+	if TxId(&signed) == tx.Hash {
+		t.Fatal("TxId doesn't cover the signatures")
+	}
+	if SigHash(&signed) != SigHash(&tx) {
+		t.Fatal("SigHash depends on the hash or the signatures")
+	}
+	signed.TxIns[1].InputVout++
+	if SigHash(&signed) == SigHash(&tx) {
+		t.Fatal("SigHash doesn't cover the inputs")
+	}
+	stripped := blkparser.Tx{Hash: tx.Hash}
+	if TxId(&stripped) == tx.Hash {
+		t.Fatal("TxId of a stripped transaction is its hash")
+	}
+	if compactTxId(&stripped) != tx.Hash {
+		t.Fatal("Stripped transaction doesn't keep its hash in a compact block")
+	}
+}
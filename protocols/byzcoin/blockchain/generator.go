@@ -0,0 +1,166 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"math/rand"
+
+	"github.com/dedis/cothority/protocols/byzcoin/blockchain/blkparser"
+)
+
+// TxConfig selects the transactions of a simulation. It is embedded in the
+// simulation configs, so its fields can be set in the runfile.
+type TxConfig struct {
+	// Synthetic generates the transactions instead of reading them from
+	// Bitcoin blocks, so no block-file is needed
+	Synthetic bool
+	// TxSize is the approximate size in bytes of a synthetic transaction
+	TxSize int
+	// TxInputs and TxOutputs are the number of inputs and outputs of a
+	// synthetic transaction, one if unset
+	TxInputs  int
+	TxOutputs int
+	// ConflictRate is the fraction of synthetic transactions spending an
+	// output already spent by an earlier one. Only the ByzCoin simulation
+	// checks the transactions and drops the conflicting ones.
+	ConflictRate float64
+	// Seed of the generator: the same seed gives the same transactions
+	Seed int64
+}
+
+// Prepare makes sure the transactions are available: for Bitcoin blocks it
+// downloads the block-file to dir if needed.
+func (c *TxConfig) Prepare(dir string) error {
+	if c.Synthetic {
+		return nil
+	}
+	return EnsureBlockIsAvailable(dir)
+}
+
+// Generator creates deterministic synthetic transactions. The first ones
+// are coinbases, the following ones spend their outputs, so that the
+// transactions pass a UTXOSet unless they are conflicting, or unless a
+// block gets more than one coinbase because there are more TxInputs than
+// TxOutputs.
+type Generator struct {
+	config  TxConfig
+	rand    *rand.Rand
+	count   uint64
+	unspent []Outpoint
+	spent   []Outpoint
+	values  map[Outpoint]uint64
+}
+
+// NewGenerator returns a generator following config.
+func NewGenerator(config *TxConfig) *Generator {
+	c := *config
+	if c.TxInputs < 1 {
+		c.TxInputs = 1
+	}
+	if c.TxOutputs < 1 {
+		c.TxOutputs = 1
+	}
+	return &Generator{
+		config: c,
+		rand:   rand.New(rand.NewSource(c.Seed)),
+		values: make(map[Outpoint]uint64),
+	}
+}
+
+// Generate returns the n next transactions.
+func (g *Generator) Generate(n int) []blkparser.Tx {
+	txs := make([]blkparser.Tx, n)
+	for i := range txs {
+		txs[i] = g.next()
+	}
+	return txs
+}
+
+// next returns a coinbase if there are not enough outputs to spend, else a
+// transaction spending TxInputs of them.
+func (g *Generator) next() blkparser.Tx {
+	g.count++
+	var ins []*blkparser.TxIn
+	var value uint64
+	conflict := false
+	if len(g.unspent) < g.config.TxInputs {
+		ins = []*blkparser.TxIn{{InputHash: g.coinbaseInput(), InputVout: 0xffffffff}}
+		value = MaxCoinbaseValue
+	} else {
+		// a conflicting transaction spends a spent output and leaves the
+		// other ones unspent
+		conflict = len(g.spent) > 0 && g.rand.Float64() < g.config.ConflictRate
+		for i := 0; i < g.config.TxInputs; i++ {
+			var op Outpoint
+			if conflict && i == 0 {
+				op = g.spent[g.rand.Intn(len(g.spent))]
+			} else if conflict {
+				op = g.unspent[g.rand.Intn(len(g.unspent))]
+			} else {
+				j := g.rand.Intn(len(g.unspent))
+				op = g.unspent[j]
+				g.unspent[j] = g.unspent[len(g.unspent)-1]
+				g.unspent = g.unspent[:len(g.unspent)-1]
+				g.spent = append(g.spent, op)
+			}
+			ins = append(ins, &blkparser.TxIn{InputHash: op.Hash, InputVout: op.Index})
+			value += g.values[op]
+		}
+	}
+
+	// pad the scripts of the inputs up to TxSize, the outputs stay
+	// spendable by anybody
+	pad := g.config.TxSize - g.baseSize(len(ins))
+	if pad < 0 {
+		pad = 0
+	}
+	for i, in := range ins {
+		in.ScriptSig = make([]byte, pad/len(ins))
+		if i == 0 {
+			in.ScriptSig = make([]byte, pad/len(ins)+pad%len(ins))
+		}
+		g.rand.Read(in.ScriptSig)
+		in.Sequence = 0xffffffff
+	}
+
+	// the LockTime numbers the transactions, so that a conflicting one
+	// doesn't get the id of the one it conflicts with
+	tx := blkparser.Tx{
+		Size:     uint32(g.baseSize(len(ins)) + pad),
+		LockTime: uint32(g.count),
+		Version:  1,
+		TxInCnt:  uint32(len(ins)),
+		TxOutCnt: uint32(g.config.TxOutputs),
+		TxIns:    ins,
+	}
+	for i := 0; i < g.config.TxOutputs; i++ {
+		tx.TxOuts = append(tx.TxOuts, &blkparser.TxOut{
+			Value:    value / uint64(g.config.TxOutputs),
+			Pkscript: []byte{},
+		})
+	}
+	tx.Hash = TxId(&tx)
+	if !conflict {
+		for i, out := range tx.TxOuts {
+			op := Outpoint{tx.Hash, uint32(i)}
+			g.unspent = append(g.unspent, op)
+			g.values[op] = out.Value
+		}
+	}
+	return tx
+}
+
+// baseSize returns the size of a transaction with ins inputs and empty
+// scripts, as serialized by Bitcoin.
+func (g *Generator) baseSize(ins int) int {
+	return 10 + 41*ins + 9*g.config.TxOutputs
+}
+
+// coinbaseInput returns a unique input hash for the next coinbase
+func (g *Generator) coinbaseInput() string {
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, g.config.Seed)
+	binary.Write(h, binary.BigEndian, g.count)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,54 @@
+package blockchain
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dedis/cothority/lib/dbg"
+	"github.com/dedis/cothority/lib/network"
+	"github.com/dedis/protobuf"
+)
+
+func TestGenerator(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	config := &TxConfig{
+		Synthetic: true,
+		TxSize:    300,
+		TxInputs:  2,
+		TxOutputs: 3,
+		Seed:      1,
+	}
+	txs := NewGenerator(config).Generate(50)
+	if !reflect.DeepEqual(txs, NewGenerator(config).Generate(50)) {
+		t.Fatal("The same seed gave different transactions")
+	}
+	for _, tx := range txs[1:] {
+		if tx.Size != 300 {
+			t.Fatal("Wrong size", tx.Size)
+		}
+		if len(tx.TxOuts) != 3 {
+			t.Fatal("Wrong number of outputs")
+		}
+	}
+	if len(txs[1].TxIns) != 2 {
+		t.Fatal("Wrong number of inputs")
+	}
+	u := NewUTXOSet(network.Suite)
+	if err := u.Check(txs); err != nil {
+		t.Fatal("Transactions without conflicts are invalid:", err)
+	}
+
+	config.ConflictRate = 0.5
+	txs = NewGenerator(config).Generate(50)
+	valid, _ := u.Filter(txs)
+	if len(valid) == len(txs) || len(valid) < len(txs)/4 {
+		t.Fatal("Wrong number of conflicts:", len(txs)-len(valid))
+	}
+	trlist := NewTransactionList(txs, len(txs))
+	block := NewTrBlock(trlist, NewHeader(trlist, "", ""))
+	if _, err := protobuf.Encode(block); err != nil {
+		t.Fatal("Couldn't marshal the transactions:", err)
+	}
+}
@@ -1,12 +1,42 @@
 package blockchain
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"net"
+
+	"github.com/dedis/cothority/lib/cliutils"
+	"github.com/dedis/cothority/lib/crypto"
+	"github.com/dedis/crypto/abstract"
 )
 
 type KeyBlock struct {
 	Block
+	// Nonce is set by the LeaderRule that sealed the block
+	Nonce uint64
+	// Signature of the miner, whose key is Header.PublicKey, on HeaderHash
+	Signature []byte
+	// Acceptances of the consensus group preceding the key block
+	Acceptances []Acceptance
+}
+
+// Acceptance is the signature of the holder of PublicKey accepting a key
+// block.
+type Acceptance struct {
+	PublicKey string
+	Signature []byte
+}
+
+// NewLeaderKeyBlock returns an unsealed key block following the key block
+// parentKey, that makes the holder of publicKey the leader.
+func NewLeaderKeyBlock(parentKey string, leader net.IP, publicKey string) *KeyBlock {
+	kb := new(KeyBlock)
+	header := kb.NewHeader(TransactionList{}, parentKey, leader, publicKey)
+	*kb = kb.NewKeyBlock(TransactionList{}, &header)
+	// until it is signed, the network-encoding needs a Signature
+	kb.Signature = []byte{}
+	return kb
 }
 
 func (*KeyBlock) NewKeyBlock(transactions TransactionList, header *Header) (tr KeyBlock) {
@@ -28,6 +58,90 @@ func (t *KeyBlock) NewHeader(transactions TransactionList, parent string, IP net
 	return *hdr
 }
 
+// Sign sets the signature of the miner, who has to hold the private key of
+// Header.PublicKey.
+func (kb *KeyBlock) Sign(suite abstract.Suite, private abstract.Secret) error {
+	sig, err := signSchnorr(suite, private, []byte(kb.HeaderHash))
+	if err != nil {
+		return err
+	}
+	kb.Signature = sig
+	return nil
+}
+
+// VerifySignature checks the signature of the miner.
+func (kb *KeyBlock) VerifySignature(suite abstract.Suite) error {
+	if kb.Header == nil {
+		return errors.New("Key block has no header")
+	}
+	if err := verifySchnorr(suite, kb.PublicKey, []byte(kb.HeaderHash), kb.Signature); err != nil {
+		return fmt.Errorf("Wrong signature of the miner: %s", err)
+	}
+	return nil
+}
+
+// Accept returns the acceptance of kb by the holder of private, whose
+// public key is publicKey.
+func (kb *KeyBlock) Accept(suite abstract.Suite, private abstract.Secret, publicKey string) (*Acceptance, error) {
+	sig, err := signSchnorr(suite, private, kb.acceptMessage())
+	if err != nil {
+		return nil, err
+	}
+	return &Acceptance{PublicKey: publicKey, Signature: sig}, nil
+}
+
+// VerifyAcceptances checks that at least threshold of the public keys in
+// group accepted kb. Acceptances from outside of group are ignored.
+func (kb *KeyBlock) VerifyAcceptances(suite abstract.Suite, group []string, threshold int) error {
+	members := make(map[string]bool)
+	for _, pub := range group {
+		members[pub] = true
+	}
+	accepted := make(map[string]bool)
+	for _, a := range kb.Acceptances {
+		if !members[a.PublicKey] || accepted[a.PublicKey] {
+			continue
+		}
+		if err := verifySchnorr(suite, a.PublicKey, kb.acceptMessage(), a.Signature); err != nil {
+			return fmt.Errorf("Wrong acceptance of %s: %s", a.PublicKey, err)
+		}
+		accepted[a.PublicKey] = true
+	}
+	if len(accepted) < threshold {
+		return fmt.Errorf("Only %d of %d accepted the key block, %d needed",
+			len(accepted), len(group), threshold)
+	}
+	return nil
+}
+
+// acceptMessage is what the acceptances sign, so that they can't be
+// mistaken for the signature of the miner.
+func (kb *KeyBlock) acceptMessage() []byte {
+	return []byte("accept" + kb.HeaderHash)
+}
+
+func signSchnorr(suite abstract.Suite, private abstract.Secret, msg []byte) ([]byte, error) {
+	sig, err := crypto.SignSchnorr(suite, private, msg)
+	if err != nil {
+		return nil, err
+	}
+	return sig.MarshalBinary()
+}
+
+// verifySchnorr checks the signature buf of msg by the hex-encoded public key
+// pub.
+func verifySchnorr(suite abstract.Suite, pub string, msg, buf []byte) error {
+	public, err := cliutils.ReadPubHex(suite, pub)
+	if err != nil {
+		return err
+	}
+	sig, err := crypto.UnmarshalSchnorr(suite, buf)
+	if err != nil {
+		return err
+	}
+	return crypto.VerifySchnorr(suite, public, msg, sig)
+}
+
 func (trb *KeyBlock) Print() {
 	log.Println("Header:")
 	log.Printf("Leader %v", trb.LeaderId)
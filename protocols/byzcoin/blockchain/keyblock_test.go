@@ -0,0 +1,78 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/dedis/cothority/lib/cliutils"
+	"github.com/dedis/cothority/lib/dbg"
+	"github.com/dedis/cothority/lib/network"
+	"github.com/dedis/crypto/config"
+)
+
+func TestKeyBlockSignatures(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	suite := network.Suite
+	keys := make([]*config.KeyPair, 5)
+	pubs := make([]string, len(keys))
+	for i := range keys {
+		keys[i] = config.NewKeyPair(suite)
+		var err error
+		if pubs[i], err = cliutils.PubHex(suite, keys[i].Public); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	kb := NewLeaderKeyBlock("", nil, pubs[0])
+	if kb.VerifySignature(suite) == nil {
+		t.Fatal("Verified an unsigned key block")
+	}
+	if err := kb.Sign(suite, keys[1].Secret); err != nil {
+		t.Fatal(err)
+	}
+	if kb.VerifySignature(suite) == nil {
+		t.Fatal("Verified a key block signed by somebody else than the miner")
+	}
+	if err := kb.Sign(suite, keys[0].Secret); err != nil {
+		t.Fatal(err)
+	}
+	if err := kb.VerifySignature(suite); err != nil {
+		t.Fatal(err)
+	}
+
+	// the last key is not in the group, and the first one accepts twice
+	group := pubs[:4]
+	for _, i := range []int{0, 0, 1, 4} {
+		acc, err := kb.Accept(suite, keys[i].Secret, pubs[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		kb.Acceptances = append(kb.Acceptances, *acc)
+	}
+	if kb.VerifyAcceptances(suite, group, 3) == nil {
+		t.Fatal("Counted acceptances twice or from outside the group")
+	}
+	acc, err := kb.Accept(suite, keys[2].Secret, pubs[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb.Acceptances = append(kb.Acceptances, *acc)
+	if err := kb.VerifyAcceptances(suite, group, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	// an acceptance is no signature of the miner and vice versa
+	forged := *kb
+	header := *kb.Header
+	header.PublicKey = pubs[2]
+	forged.Header = &header
+	forged.Signature = acc.Signature
+	if forged.VerifySignature(suite) == nil {
+		t.Fatal("Took an acceptance for the signature of the miner")
+	}
+	kb.Acceptances[len(kb.Acceptances)-1].Signature = kb.Signature
+	if kb.VerifyAcceptances(suite, group, 3) == nil {
+		t.Fatal("Took the signature of the miner for an acceptance")
+	}
+}
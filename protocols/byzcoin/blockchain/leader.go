@@ -0,0 +1,56 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// LeaderRule decides who may produce the next key block, and thus lead the
+// consensus group.
+type LeaderRule interface {
+	// Seal makes kb acceptable to Verify, or returns an error.
+	Seal(kb *KeyBlock) error
+	// Verify returns an error if kb hasn't been sealed under the rule.
+	Verify(kb *KeyBlock) error
+}
+
+// ProofOfWork is a simulated proof of work: a key block is sealed if the
+// hash of its header and nonce starts with Difficulty zero bits.
+type ProofOfWork struct {
+	Difficulty uint
+}
+
+// Seal searches the nonce of kb.
+func (pow *ProofOfWork) Seal(kb *KeyBlock) error {
+	if pow.Difficulty > sha256.Size*8 {
+		return errors.New("Difficulty too high")
+	}
+	for nonce := uint64(0); ; nonce++ {
+		if pow.check(kb.HeaderHash, nonce) {
+			kb.Nonce = nonce
+			return nil
+		}
+	}
+}
+
+// Verify checks the nonce of kb.
+func (pow *ProofOfWork) Verify(kb *KeyBlock) error {
+	if !pow.check(kb.HeaderHash, kb.Nonce) {
+		return errors.New("Key block has no proof of work")
+	}
+	return nil
+}
+
+func (pow *ProofOfWork) check(hash string, nonce uint64) bool {
+	h := sha256.New()
+	h.Write([]byte(hash))
+	binary.Write(h, binary.BigEndian, nonce)
+	sum := h.Sum(nil)
+	for i := uint(0); i < pow.Difficulty; i++ {
+		if sum[i/8]&(0x80>>(i%8)) != 0 {
+			return false
+		}
+	}
+	return true
+}
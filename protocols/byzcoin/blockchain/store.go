@@ -0,0 +1,292 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/dedis/cothority/lib/cosi"
+	"github.com/dedis/cothority/lib/network"
+	"github.com/dedis/crypto/abstract"
+)
+
+func init() {
+	network.RegisterMessageType(SignedBlock{})
+	network.RegisterMessageType(KeyBlock{})
+}
+
+// SignedBlock is a block with the collective signature of the witnesses and
+// the exceptions of those who didn't sign.
+type SignedBlock struct {
+	Block      *TrBlock
+	Signature  *cosi.Signature
+	Exceptions []cosi.Exception
+}
+
+// Store is a chain of signed blocks next to a chain of key blocks. Every
+// block has to point to the last block with Header.Parent and to the last
+// key block with Header.ParentKey, and every key block to the last key block.
+// If it is opened from a file, every block is appended to the file, so that
+// the chains survive restarts.
+type Store struct {
+	suite abstract.Suite
+	file  *os.File
+	sync.Mutex
+	blocks []*SignedBlock
+	// heights maps the hash of a block to its height
+	heights   map[string]int
+	keyBlocks []*KeyBlock
+	// keyHeights maps the hash of a key block to its height
+	keyHeights map[string]int
+}
+
+// NewStore returns an empty chain that is only kept in memory.
+func NewStore(suite abstract.Suite) *Store {
+	return &Store{
+		suite:      suite,
+		heights:    make(map[string]int),
+		keyHeights: make(map[string]int),
+	}
+}
+
+// OpenStore reads the chain from filename, creating it if it doesn't exist.
+// The blocks appended afterwards are written to filename.
+func OpenStore(suite abstract.Suite, filename string) (*Store, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		return nil, err
+	}
+	s := NewStore(suite)
+	for {
+		msg, err := s.readBlock(file)
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			switch b := msg.(type) {
+			case SignedBlock:
+				err = s.add(&b)
+			case KeyBlock:
+				err = s.addKey(&b)
+			default:
+				err = errors.New("Not a block")
+			}
+		}
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("Record %d of %s: %s",
+				len(s.blocks)+len(s.keyBlocks), filename, err)
+		}
+	}
+	s.file = file
+	return s, nil
+}
+
+// Close closes the file of the chain, if any.
+func (s *Store) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// Append adds sb on top of the chain. The signature has to be verified by
+// the caller. Appending the last block again does nothing, so that a
+// host present more than once in a tree can append each block it signs.
+func (s *Store) Append(sb *SignedBlock) error {
+	if sb.Block == nil || sb.Signature == nil {
+		return errors.New("Empty signed block")
+	}
+	s.Lock()
+	defer s.Unlock()
+	if h, ok := s.heights[sb.Block.HeaderHash]; ok && h == len(s.blocks)-1 {
+		return nil
+	}
+	if err := s.add(sb); err != nil {
+		return err
+	}
+	if s.file != nil {
+		return s.writeBlock(sb)
+	}
+	return nil
+}
+
+// AppendKey adds kb on top of the key chain. The caller has to check it
+// against the LeaderRule. Appending the last key block again does nothing.
+func (s *Store) AppendKey(kb *KeyBlock) error {
+	s.Lock()
+	defer s.Unlock()
+	if h, ok := s.keyHeights[kb.HeaderHash]; ok && h == len(s.keyBlocks)-1 {
+		return nil
+	}
+	if err := s.addKey(kb); err != nil {
+		return err
+	}
+	if s.file != nil {
+		return s.writeBlock(kb)
+	}
+	return nil
+}
+
+// Height returns the number of blocks in the chain.
+func (s *Store) Height() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.blocks)
+}
+
+// Last returns the hash of the last block and of the last key block, which
+// are the parents of the next block. Both are empty for an empty chain.
+func (s *Store) Last() (string, string) {
+	s.Lock()
+	defer s.Unlock()
+	return s.lastHash(), s.lastKeyHash()
+}
+
+// KeyHeight returns the number of key blocks in the chain.
+func (s *Store) KeyHeight() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.keyBlocks)
+}
+
+// KeyByHeight returns the key block at height, starting at 0.
+func (s *Store) KeyByHeight(height int) (*KeyBlock, error) {
+	s.Lock()
+	defer s.Unlock()
+	if height < 0 || height >= len(s.keyBlocks) {
+		return nil, fmt.Errorf("No key block at height %d", height)
+	}
+	return s.keyBlocks[height], nil
+}
+
+// KeyByHash returns the key block whose header hashes to hash.
+func (s *Store) KeyByHash(hash string) (*KeyBlock, error) {
+	s.Lock()
+	defer s.Unlock()
+	h, ok := s.keyHeights[hash]
+	if !ok {
+		return nil, errors.New("Unknown key block " + hash)
+	}
+	return s.keyBlocks[h], nil
+}
+
+// Miners returns the distinct public keys of the leaders of the last window
+// key blocks, the most recent first.
+func (s *Store) Miners(window int) []string {
+	s.Lock()
+	defer s.Unlock()
+	var miners []string
+	seen := make(map[string]bool)
+	for i := len(s.keyBlocks) - 1; i >= 0 && i >= len(s.keyBlocks)-window; i-- {
+		pub := s.keyBlocks[i].PublicKey
+		if !seen[pub] {
+			seen[pub] = true
+			miners = append(miners, pub)
+		}
+	}
+	return miners
+}
+
+// ByHeight returns the block at height, starting at 0.
+func (s *Store) ByHeight(height int) (*SignedBlock, error) {
+	s.Lock()
+	defer s.Unlock()
+	if height < 0 || height >= len(s.blocks) {
+		return nil, fmt.Errorf("No block at height %d", height)
+	}
+	return s.blocks[height], nil
+}
+
+// ByHash returns the block whose header hashes to hash.
+func (s *Store) ByHash(hash string) (*SignedBlock, error) {
+	s.Lock()
+	defer s.Unlock()
+	h, ok := s.heights[hash]
+	if !ok {
+		return nil, errors.New("Unknown block " + hash)
+	}
+	return s.blocks[h], nil
+}
+
+// add checks that sb follows the last block and key block and adds it to
+// the chain.
+func (s *Store) add(sb *SignedBlock) error {
+	block := sb.Block
+	if block.Header == nil || block.HeaderHash != HashHeader(block.Header) {
+		return errors.New("Wrong hash of header")
+	}
+	if parent := s.lastHash(); block.Parent != parent {
+		return fmt.Errorf("Block %s doesn't follow %s", block.HeaderHash, parent)
+	}
+	if key := s.lastKeyHash(); block.ParentKey != key {
+		return fmt.Errorf("Block %s doesn't follow key block %s", block.HeaderHash, key)
+	}
+	s.heights[block.HeaderHash] = len(s.blocks)
+	s.blocks = append(s.blocks, sb)
+	return nil
+}
+
+// addKey checks that kb follows the last key block and adds it to the chain.
+func (s *Store) addKey(kb *KeyBlock) error {
+	if kb.Header == nil || kb.HeaderHash != HashHeader(kb.Header) {
+		return errors.New("Wrong hash of header")
+	}
+	if parent := s.lastKeyHash(); kb.ParentKey != parent {
+		return fmt.Errorf("Key block %s doesn't follow %s", kb.HeaderHash, parent)
+	}
+	s.keyHeights[kb.HeaderHash] = len(s.keyBlocks)
+	s.keyBlocks = append(s.keyBlocks, kb)
+	return nil
+}
+
+func (s *Store) lastHash() string {
+	if len(s.blocks) == 0 {
+		return ""
+	}
+	return s.blocks[len(s.blocks)-1].Block.HeaderHash
+}
+
+func (s *Store) lastKeyHash() string {
+	if len(s.keyBlocks) == 0 {
+		return ""
+	}
+	return s.keyBlocks[len(s.keyBlocks)-1].HeaderHash
+}
+
+// writeBlock appends a block or key block to the file, preceded by its
+// length.
+func (s *Store) writeBlock(block network.ProtocolMessage) error {
+	buf, err := network.MarshalRegisteredType(block)
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(s.file, binary.BigEndian, uint32(len(buf))); err != nil {
+		return err
+	}
+	if _, err := s.file.Write(buf); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// readBlock reads the next record written by writeBlock from r.
+func (s *Store) readBlock(r io.Reader) (network.ProtocolMessage, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	_, msg, err := network.UnmarshalRegisteredType(buf, network.DefaultConstructors(s.suite))
+	return msg, err
+}
@@ -0,0 +1,161 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/dedis/cothority/lib/cosi"
+	"github.com/dedis/cothority/lib/dbg"
+	"github.com/dedis/cothority/lib/network"
+	"github.com/dedis/cothority/protocols/byzcoin/blockchain/blkparser"
+	"github.com/dedis/crypto/random"
+)
+
+func TestStore(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "chain")
+	suite := network.Suite
+
+	s, err := OpenStore(suite, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blocks []*SignedBlock
+	var keyBlock *KeyBlock
+	for i := 0; i < 3; i++ {
+		if i == 1 {
+			_, parentKey := s.Last()
+			keyBlock = NewLeaderKeyBlock(parentKey, net.IPv4(127, 0, 0, 1), "miner")
+			if err := s.AppendKey(keyBlock); err != nil {
+				t.Fatal(err)
+			}
+		}
+		parent, parentKey := s.Last()
+		sb := signedBlock(i, parent, parentKey)
+		if err := s.Append(sb); err != nil {
+			t.Fatal(err)
+		}
+		// appending twice does nothing
+		if err := s.Append(sb); err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, sb)
+	}
+	if err := s.Append(signedBlock(3, "", "")); err == nil {
+		t.Fatal("Appended a block not following the last one")
+	}
+	parent, _ := s.Last()
+	if err := s.Append(signedBlock(3, parent, "")); err == nil {
+		t.Fatal("Appended a block not following the last key block")
+	}
+	if err := s.AppendKey(NewLeaderKeyBlock("", nil, "other")); err == nil {
+		t.Fatal("Appended a key block not following the last one")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// restart
+	s, err = OpenStore(suite, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Height() != 3 || s.KeyHeight() != 1 {
+		t.Fatal("Expected 3 blocks and 1 key block, got", s.Height(), s.KeyHeight())
+	}
+	if kb, err := s.KeyByHeight(0); err != nil || kb.HeaderHash != keyBlock.HeaderHash {
+		t.Fatal("Got wrong key block", err)
+	}
+	if kb, err := s.KeyByHash(keyBlock.HeaderHash); err != nil || kb.HeaderHash != keyBlock.HeaderHash {
+		t.Fatal("Got wrong key block by hash", err)
+	}
+	if blocks[2].Block.ParentKey != keyBlock.HeaderHash {
+		t.Fatal("Last block doesn't point to the key block")
+	}
+	for i, sb := range blocks {
+		byHeight, err := s.ByHeight(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		byHash, err := s.ByHash(sb.Block.HeaderHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if byHeight != byHash || byHash.Block.HeaderHash != sb.Block.HeaderHash {
+			t.Fatal("Got wrong block for height", i)
+		}
+		if !byHash.Signature.Challenge.Equal(sb.Signature.Challenge) {
+			t.Fatal("Signature of block", i, "changed")
+		}
+	}
+	if _, err := s.ByHeight(3); err == nil {
+		t.Fatal("Got a block above the chain")
+	}
+	if _, err := s.ByHash("unknown"); err == nil {
+		t.Fatal("Got an unknown block")
+	}
+}
+
+func TestProofOfWork(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	rule := &ProofOfWork{Difficulty: 8}
+	kb := NewLeaderKeyBlock("", net.IPv4(127, 0, 0, 1), "miner")
+	if err := rule.Seal(kb); err != nil {
+		t.Fatal(err)
+	}
+	if err := rule.Verify(kb); err != nil {
+		t.Fatal(err)
+	}
+	kb.Nonce++
+	if rule.Verify(kb) == nil {
+		t.Fatal("Accepted a wrong nonce")
+	}
+}
+
+func TestMiners(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	s := NewStore(network.Suite)
+	for _, miner := range []string{"a", "b", "a", "c"} {
+		_, parentKey := s.Last()
+		if err := s.AppendKey(NewLeaderKeyBlock(parentKey, nil, miner)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	miners := s.Miners(3)
+	if len(miners) != 3 || miners[0] != "c" || miners[1] != "a" || miners[2] != "b" {
+		t.Fatal("Wrong miners in window:", miners)
+	}
+}
+
+// signedBlock returns a block following parent with a random signature
+func signedBlock(i int, parent, parentKey string) *SignedBlock {
+	h := sha256.Sum256([]byte(strconv.Itoa(i)))
+	txs := []blkparser.Tx{{Hash: hex.EncodeToString(h[:])}}
+	list := NewTransactionList(txs, len(txs))
+	block := NewTrBlock(list, NewHeader(list, parent, parentKey))
+	return &SignedBlock{
+		Block: block,
+		Signature: &cosi.Signature{
+			Challenge: network.Suite.Secret().Pick(random.Stream),
+			Response:  network.Suite.Secret().Pick(random.Stream),
+		},
+	}
+}
@@ -2,8 +2,8 @@ package blockchain
 
 import (
 	"crypto/sha256"
-	"encoding/binary"
 	"log"
+	"math"
 
 	"github.com/dedis/cothority/protocols/byzcoin/blockchain/blkparser"
 )
@@ -14,14 +14,19 @@ type TransactionList struct {
 	Fees  float64        `json:"-"`
 }
 
+// HashSum returns the hash of the binary encoding of the list with the
+// transactions replaced by their TxId, the hash of their encoding. A block
+// stripped down to these ids, like a compact block, keeps its HashSum.
 func (tl *TransactionList) HashSum() []byte {
-	h := sha256.New()
-	for _, tx := range tl.Txs {
-		h.Write([]byte(tx.Hash))
+	var e encoder
+	e.uvarint(uint64(tl.TxCnt))
+	e.uint64(math.Float64bits(tl.Fees))
+	e.uvarint(uint64(len(tl.Txs)))
+	for i := range tl.Txs {
+		e.hexString(compactTxId(&tl.Txs[i]))
 	}
-	binary.Write(h, binary.LittleEndian, tl.TxCnt)
-	binary.Write(h, binary.LittleEndian, tl.Fees)
-	return h.Sum(nil)
+	h := sha256.Sum256(e.Bytes())
+	return h[:]
 }
 
 func NewTransactionList(transactions []blkparser.Tx, n int) (tr TransactionList) {
@@ -3,10 +3,8 @@ package blockchain
 
 import (
 	"crypto/sha256"
-	"encoding/binary"
 	"encoding/hex"
-	"encoding/json"
-	"fmt"
+	"errors"
 	"net"
 
 	"github.com/dedis/cothority/lib/crypto"
@@ -24,19 +22,17 @@ type TrBlock struct {
 	Block
 }
 
-func (tr *TrBlock) MarshalBinary() ([]byte, error) {
-	return json.Marshal(tr)
-}
-
-// Hash returns a hash representation of the block
+// HashSum returns the hash of the binary encoding of the block, with the
+// transactions replaced by their HashSum.
 func (tr *TrBlock) HashSum() []byte {
-	h := sha256.New()
-	h.Write(tr.Magic[:])
-	binary.Write(h, binary.LittleEndian, tr.BlockSize)
-	h.Write([]byte(tr.HeaderHash))
-	h.Write(tr.Header.HashSum())
-	h.Write(tr.TransactionList.HashSum())
-	return h.Sum(nil)
+	var e encoder
+	e.Write(tr.Magic[:])
+	e.uvarint(uint64(tr.BlockSize))
+	e.hexString(tr.HeaderHash)
+	tr.Header.encode(&e)
+	e.Write(tr.TransactionList.HashSum())
+	h := sha256.Sum256(e.Bytes())
+	return h[:]
 }
 
 type Header struct {
@@ -47,14 +43,11 @@ type Header struct {
 	LeaderId   net.IP
 }
 
-// Hash returns a hash representation of the header
+// HashSum returns the hash of the binary encoding of the header.
 func (h *Header) HashSum() []byte {
-	ha := sha256.New()
-	ha.Write([]byte(h.MerkleRoot))
-	ha.Write([]byte(h.Parent))
-	ha.Write([]byte(h.ParentKey))
-	ha.Write([]byte(h.PublicKey))
-	return ha.Sum(nil)
+	buf, _ := h.MarshalBinary()
+	hash := sha256.Sum256(buf)
+	return hash[:]
 }
 
 func (trb *TrBlock) NewTrBlock(transactions TransactionList, header *Header) *TrBlock {
@@ -87,27 +80,64 @@ func NewHeader(transactions TransactionList, parent, parentKey string) *Header {
 	hdr.MerkleRoot = HashRootTransactions(transactions)
 	return hdr
 }
+
+// HashRootTransactions returns the root of the Merkle tree over the TxIds
+// of transactions.
 func HashRootTransactions(transactions TransactionList) string {
 	var hashes []crypto.HashId
 
-	for _, t := range transactions.Txs {
-		temp, _ := hex.DecodeString(t.Hash)
+	for i := range transactions.Txs {
+		temp, _ := hex.DecodeString(TxId(&transactions.Txs[i]))
 		hashes = append(hashes, temp)
 	}
 	out, _ := crypto.ProofTree(sha256.New, hashes)
 	return hex.EncodeToString(out)
 }
 
+// MerkleProof returns the proof that the transaction with TxId hash is part
+// of the MerkleRoot of transactions.
+func MerkleProof(transactions TransactionList, hash string) (crypto.Proof, error) {
+	var hashes []crypto.HashId
+	index := -1
+	for i := range transactions.Txs {
+		id := TxId(&transactions.Txs[i])
+		if id == hash {
+			index = i
+		}
+		temp, _ := hex.DecodeString(id)
+		hashes = append(hashes, temp)
+	}
+	if index < 0 {
+		return nil, errors.New("Unknown transaction " + hash)
+	}
+	_, proofs := crypto.ProofTree(sha256.New, hashes)
+	return proofs[index], nil
+}
+
+// CheckMerkleProof returns an error if proof doesn't show that the
+// transaction with TxId hash is part of the MerkleRoot of h.
+func (h *Header) CheckMerkleProof(hash string, proof crypto.Proof) error {
+	root, err := hex.DecodeString(h.MerkleRoot)
+	if err != nil {
+		return err
+	}
+	leaf, err := hex.DecodeString(hash)
+	if err != nil {
+		return err
+	}
+	if !proof.Check(sha256.New, root, leaf) {
+		return errors.New("Transaction " + hash + " is not in the block")
+	}
+	return nil
+}
+
 func (trb *Block) Hash(h *Header) (res string) {
 	//change it to be more portable
 	return HashHeader(h)
 
 }
 
+// HashHeader returns the hex-encoded HashSum of h.
 func HashHeader(h *Header) string {
-	data := fmt.Sprintf("%v", h)
-	sha := sha256.New()
-	sha.Write([]byte(data))
-	hash := sha.Sum(nil)
-	return hex.EncodeToString(hash)
+	return hex.EncodeToString(h.HashSum())
 }
@@ -0,0 +1,35 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/dedis/cothority/lib/dbg"
+)
+
+func TestMerkleProof(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	for _, n := range []int{1, 2, 5, 8} {
+		txs := NewGenerator(&TxConfig{Seed: int64(n)}).Generate(n)
+		trlist := NewTransactionList(txs, n)
+		header := NewHeader(trlist, "", "")
+		for _, tx := range txs {
+			proof, err := MerkleProof(trlist, tx.Hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := header.CheckMerkleProof(tx.Hash, proof); err != nil {
+				t.Fatal("Proof of", n, "transactions failed:", err)
+			}
+		}
+		other := NewGenerator(&TxConfig{Seed: -1}).Generate(1)[0]
+		proof, _ := MerkleProof(trlist, txs[0].Hash)
+		if header.CheckMerkleProof(other.Hash, proof) == nil {
+			t.Fatal("Accepted a transaction not in the block")
+		}
+	}
+	if _, err := MerkleProof(TransactionList{}, "00"); err == nil {
+		t.Fatal("Got a proof for an unknown transaction")
+	}
+}
@@ -0,0 +1,219 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/dedis/cothority/lib/crypto"
+	"github.com/dedis/cothority/protocols/byzcoin/blockchain/blkparser"
+	"github.com/dedis/crypto/abstract"
+)
+
+// MaxCoinbaseValue is the most a coinbase may create.
+const MaxCoinbaseValue = 50 * 100000000
+
+// Outpoint designates the Index'th output of the transaction Hash.
+type Outpoint struct {
+	Hash  string
+	Index uint32
+}
+
+// UTXOSet holds the unspent transaction outputs of the chain.
+//
+// The Hash of every transaction has to be its TxId, and it needs inputs or
+// outputs. Transactions without inputs, or with the single input of a
+// coinbase, create coins: there may be one of them per block, creating at
+// most MaxCoinbaseValue. The Pkscript of an output holds the public key of
+// its owner, and the input spending it holds in ScriptSig the Schnorr
+// signature of the SigHash of the spending transaction. Anybody can spend
+// outputs with an empty Pkscript.
+type UTXOSet struct {
+	suite abstract.Suite
+	sync.Mutex
+	outputs map[Outpoint]*blkparser.TxOut
+	// last is the hash of the last block applied
+	last string
+}
+
+// NewUTXOSet returns an empty set.
+func NewUTXOSet(suite abstract.Suite) *UTXOSet {
+	return &UTXOSet{
+		suite:   suite,
+		outputs: make(map[Outpoint]*blkparser.TxOut),
+	}
+}
+
+// Check returns an error if txs, in this order, can't be added to the chain
+// in one block.
+func (u *UTXOSet) Check(txs []blkparser.Tx) error {
+	u.Lock()
+	defer u.Unlock()
+	v := u.newView()
+	for i := range txs {
+		if err := v.add(&txs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Filter returns the transactions of txs that can be added to the chain in
+// one block, in the same order, and the errors of the others by TxId.
+func (u *UTXOSet) Filter(txs []blkparser.Tx) ([]blkparser.Tx, map[string]error) {
+	u.Lock()
+	defer u.Unlock()
+	v := u.newView()
+	var valid []blkparser.Tx
+	refused := make(map[string]error)
+	for i := range txs {
+		if err := v.add(&txs[i]); err != nil {
+			refused[TxId(&txs[i])] = err
+			continue
+		}
+		valid = append(valid, txs[i])
+	}
+	return valid, refused
+}
+
+// Apply spends the inputs and adds the outputs of the transactions of the
+// block blockHash. Nothing changes if one of them is invalid. Applying the
+// last block again does nothing.
+func (u *UTXOSet) Apply(blockHash string, txs []blkparser.Tx) error {
+	u.Lock()
+	defer u.Unlock()
+	if blockHash == u.last {
+		return nil
+	}
+	v := u.newView()
+	for i := range txs {
+		if err := v.add(&txs[i]); err != nil {
+			return err
+		}
+	}
+	for op := range v.spent {
+		delete(u.outputs, op)
+	}
+	for op, out := range v.added {
+		u.outputs[op] = out
+	}
+	u.last = blockHash
+	return nil
+}
+
+// Output returns the unspent output op, or nil if there is none.
+func (u *UTXOSet) Output(op Outpoint) *blkparser.TxOut {
+	u.Lock()
+	defer u.Unlock()
+	return u.outputs[op]
+}
+
+// utxoView holds the changes of the transactions of a block on top of a set
+type utxoView struct {
+	*UTXOSet
+	added map[Outpoint]*blkparser.TxOut
+	spent map[Outpoint]bool
+	// coinbase is set once the block has its coinbase
+	coinbase bool
+}
+
+func (u *UTXOSet) newView() *utxoView {
+	return &utxoView{
+		UTXOSet: u,
+		added:   make(map[Outpoint]*blkparser.TxOut),
+		spent:   make(map[Outpoint]bool),
+	}
+}
+
+func (v *utxoView) get(op Outpoint) *blkparser.TxOut {
+	if v.spent[op] {
+		return nil
+	}
+	if out, ok := v.added[op]; ok {
+		return out
+	}
+	return v.outputs[op]
+}
+
+// add checks tx and applies it to the view
+func (v *utxoView) add(tx *blkparser.Tx) error {
+	if IsStripped(tx) {
+		return fmt.Errorf("Transaction %s has neither inputs nor outputs", tx.Hash)
+	}
+	if id := TxId(tx); tx.Hash != id {
+		return fmt.Errorf("Transaction %s has id %s", tx.Hash, id)
+	}
+	if len(tx.TxOuts) > 0 && v.get(Outpoint{tx.Hash, 0}) != nil {
+		return fmt.Errorf("Transaction %s already exists", tx.Hash)
+	}
+	spent := make(map[Outpoint]bool)
+	if isCoinbase(tx) {
+		if v.coinbase {
+			return fmt.Errorf("Transaction %s is a second coinbase", tx.Hash)
+		}
+		var out uint64
+		for _, txout := range tx.TxOuts {
+			out += txout.Value
+			if out > MaxCoinbaseValue {
+				return fmt.Errorf("Coinbase %s creates more than %d", tx.Hash, MaxCoinbaseValue)
+			}
+		}
+		v.coinbase = true
+	} else {
+		var in, out uint64
+		for _, txin := range tx.TxIns {
+			op := Outpoint{txin.InputHash, txin.InputVout}
+			prev := v.get(op)
+			if prev == nil || spent[op] {
+				return fmt.Errorf("Transaction %s spends unknown or spent output %s:%d",
+					tx.Hash, op.Hash, op.Index)
+			}
+			if err := v.verifyScript(prev.Pkscript, txin.ScriptSig, SigHash(tx)); err != nil {
+				return fmt.Errorf("Transaction %s can't spend %s:%d: %s",
+					tx.Hash, op.Hash, op.Index, err)
+			}
+			spent[op] = true
+			in += prev.Value
+		}
+		for _, txout := range tx.TxOuts {
+			out += txout.Value
+		}
+		if out > in {
+			return fmt.Errorf("Transaction %s spends more than its inputs", tx.Hash)
+		}
+	}
+	for op := range spent {
+		if _, ok := v.added[op]; ok {
+			delete(v.added, op)
+		} else {
+			v.spent[op] = true
+		}
+	}
+	for i, txout := range tx.TxOuts {
+		v.added[Outpoint{tx.Hash, uint32(i)}] = txout
+	}
+	return nil
+}
+
+// verifyScript checks that sig is the signature of sigHash by the public key
+// in pkscript.
+func (u *UTXOSet) verifyScript(pkscript, sig []byte, sigHash string) error {
+	if len(pkscript) == 0 {
+		return nil
+	}
+	pub := u.suite.Point()
+	if err := pub.UnmarshalBinary(pkscript); err != nil {
+		return errors.New("Unsupported script")
+	}
+	schnorr, err := crypto.UnmarshalSchnorr(u.suite, sig)
+	if err != nil {
+		return err
+	}
+	return crypto.VerifySchnorr(u.suite, pub, []byte(sigHash), schnorr)
+}
+
+// isCoinbase returns true if tx creates coins
+func isCoinbase(tx *blkparser.Tx) bool {
+	return len(tx.TxIns) == 0 ||
+		len(tx.TxIns) == 1 && tx.TxIns[0].InputVout == 0xffffffff
+}
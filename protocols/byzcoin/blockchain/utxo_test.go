@@ -0,0 +1,123 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/dedis/cothority/lib/crypto"
+	"github.com/dedis/cothority/lib/dbg"
+	"github.com/dedis/cothority/lib/network"
+	"github.com/dedis/cothority/protocols/byzcoin/blockchain/blkparser"
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/config"
+)
+
+func TestUTXOSet(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	suite := network.Suite
+	alice := config.NewKeyPair(suite)
+	bob := config.NewKeyPair(suite)
+	u := NewUTXOSet(suite)
+
+	mint := mintTx(alice.Public, 10)
+	if err := u.Apply("block0", []blkparser.Tx{mint}); err != nil {
+		t.Fatal(err)
+	}
+	coin := Outpoint{mint.Hash, 0}
+	if out := u.Output(coin); out == nil || out.Value != 10 {
+		t.Fatal("Minted coin is missing")
+	}
+
+	pay := spendTx(coin, alice.Secret, bob.Public, 10)
+	if err := u.Check([]blkparser.Tx{pay}); err != nil {
+		t.Fatal(err)
+	}
+	if u.Check([]blkparser.Tx{spendTx(coin, bob.Secret, bob.Public, 10)}) == nil {
+		t.Fatal("Accepted a wrong signature")
+	}
+	if u.Check([]blkparser.Tx{spendTx(coin, alice.Secret, bob.Public, 11)}) == nil {
+		t.Fatal("Accepted to spend more than the input")
+	}
+	renamed := pay
+	renamed.Hash = TxId(&mint)
+	if u.Check([]blkparser.Tx{renamed}) == nil {
+		t.Fatal("Accepted a transaction with the wrong hash")
+	}
+	double := spendTx(coin, alice.Secret, alice.Public, 10)
+	if u.Check([]blkparser.Tx{pay, double}) == nil {
+		t.Fatal("Accepted a double spend in a block")
+	}
+	valid, refused := u.Filter([]blkparser.Tx{pay, double})
+	if len(valid) != 1 || valid[0].Hash != pay.Hash {
+		t.Fatal("Filter kept the wrong transactions")
+	}
+	if len(refused) != 1 || refused[double.Hash] == nil {
+		t.Fatal("Filter didn't return the error of the double spend")
+	}
+
+	// an output can be spent in the block creating it
+	change := spendTx(Outpoint{pay.Hash, 0}, bob.Secret, alice.Public, 4)
+	if err := u.Apply("block1", []blkparser.Tx{pay, change}); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Apply("block1", []blkparser.Tx{pay, change}); err != nil {
+		t.Fatal("Applying the last block again failed:", err)
+	}
+	if u.Output(coin) != nil || u.Output(Outpoint{pay.Hash, 0}) != nil {
+		t.Fatal("Spent outputs are still there")
+	}
+	if u.Output(Outpoint{change.Hash, 0}) == nil {
+		t.Fatal("New output is missing")
+	}
+	if u.Apply("block2", []blkparser.Tx{double}) == nil {
+		t.Fatal("Applied a double spend")
+	}
+
+	// a block has at most one coinbase, which creates at most
+	// MaxCoinbaseValue
+	if u.Check([]blkparser.Tx{mintTx(bob.Public, 1), mintTx(bob.Public, 2)}) == nil {
+		t.Fatal("Accepted two coinbases in a block")
+	}
+	if u.Check([]blkparser.Tx{mintTx(bob.Public, MaxCoinbaseValue+1)}) == nil {
+		t.Fatal("Accepted a coinbase creating too much")
+	}
+	if err := u.Check([]blkparser.Tx{mintTx(bob.Public, MaxCoinbaseValue)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a transaction without inputs and outputs only stands for another
+	// one in a compact block
+	empty := blkparser.Tx{}
+	empty.Hash = TxId(&empty)
+	if u.Check([]blkparser.Tx{empty}) == nil {
+		t.Fatal("Accepted a transaction without inputs and outputs")
+	}
+}
+
+// mintTx returns a coinbase paying value to pub
+func mintTx(pub abstract.Point, value uint64) blkparser.Tx {
+	pk, _ := pub.MarshalBinary()
+	tx := blkparser.Tx{
+		TxOuts: []*blkparser.TxOut{{Value: value, Pkscript: pk}},
+	}
+	tx.Hash = TxId(&tx)
+	return tx
+}
+
+// spendTx returns a transaction spending from with priv and paying value
+// to pub
+func spendTx(from Outpoint, priv abstract.Secret, pub abstract.Point, value uint64) blkparser.Tx {
+	pk, _ := pub.MarshalBinary()
+	tx := blkparser.Tx{
+		TxIns: []*blkparser.TxIn{{
+			InputHash: from.Hash,
+			InputVout: from.Index,
+		}},
+		TxOuts: []*blkparser.TxOut{{Value: value, Pkscript: pk}},
+	}
+	sig, _ := crypto.SignSchnorr(network.Suite, priv, []byte(SigHash(&tx)))
+	tx.TxIns[0].ScriptSig, _ = sig.MarshalBinary()
+	tx.Hash = TxId(&tx)
+	return tx
+}
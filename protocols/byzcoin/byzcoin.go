@@ -3,23 +3,30 @@
 package byzcoin
 
 import (
-	"crypto/sha256"
-	"encoding/json"
+	"bytes"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"math"
 	"sync"
 	"time"
 
 	"github.com/dedis/cothority/lib/cosi"
+	"github.com/dedis/cothority/lib/crypto"
 	"github.com/dedis/cothority/lib/dbg"
 	"github.com/dedis/cothority/lib/monitor"
+	"github.com/dedis/cothority/lib/network"
 	"github.com/dedis/cothority/lib/sda"
 	"github.com/dedis/cothority/protocols/byzcoin/blockchain"
 	"github.com/dedis/cothority/protocols/byzcoin/blockchain/blkparser"
 	"github.com/dedis/crypto/abstract"
-	"github.com/satori/go.uuid"
 )
 
+// CommittedTimeout is how long a witness waits for the final signature of
+// the root after sending its response, before it ends the round without
+// committing the block.
+var CommittedTimeout = 10 * time.Second
+
 type ByzCoin struct {
 	// the node we are represented-in
 	*sda.Node
@@ -53,32 +60,51 @@ type ByzCoin struct {
 
 	//  block to pass up between the two rounds (prepare + commits)
 	tempBlock *blockchain.TrBlock
-	// exceptions given during the rounds that is used in the signature
-	tempExceptions []cosi.Exception
+	// compact sends only the hashes of the transactions down the tree, the
+	// witnesses fetch the ones they don't know from their parent
+	compact bool
+	// pendingChallenge and pendingBlock wait for the missingTxs of the
+	// compact block, which map to their indexes in the block
+	pendingChallenge *ByzCoinChallengePrepare
+	pendingBlock     *blockchain.TrBlock
+	missingTxs       map[string][]int
+	// channels for the missing transactions of compact blocks
+	transactionRequestChan chan transactionRequestChan
+	transactionReplyChan   chan transactionReplyChan
 
 	// transactions is the slice of transactions that contains transactions
 	// coming from clients
 	transactions []blkparser.Tx
+	// chain of the host, where the signed blocks are appended
+	chain *blockchain.Store
+	// utxo checks the transactions of the blocks, if the host has a set
+	utxo *blockchain.UTXOSet
+	// channel for the final signature sent down the tree by the root
+	committedChan chan committedChan
+	// committedTimer gives up waiting for the final signature after
+	// CommittedTimeout, committedTimeout is where it fires
+	committedTimer   *time.Timer
+	committedTimeout chan bool
 	// last block computed
 	lastBlock string
 	// last key block computed
 	lastKeyBlock string
-	// temporary buffer of "prepare" commitments
-	tempPrepareCommit []*cosi.Commitment
-	tpcMut            sync.Mutex
-	// temporary buffer of "commit" commitments
-	tempCommitCommit []*cosi.Commitment
-	tccMut           sync.Mutex
-	// temporary buffer of "prepare" responses
-	tempPrepareResponse []*cosi.Response
-	tprMut              sync.Mutex
-	// temporary buffer of "commit" responses
-	tempCommitResponse []*cosi.Response
-	tcrMut             sync.Mutex
-
-	// refusal to sign for the commit phase or not. This flag is set during the
-	// Challenge of the commit phase and will be used during the response of the
-	// commit phase to put an exception or to sign.
+	// commitments, responses and exceptions of the "prepare" and "commit"
+	// rounds, indexed by RoundType
+	rounds [2]*roundState
+	// childTimeout is how many milliseconds we wait for the commitments of
+	// each level of our subtree, 0 waits for all of them
+	childTimeout      uint64
+	commitTimeoutChan chan commitTimeout
+	// attempt is the number of times the root restarted the rounds,
+	// excluded are the witnesses that refused in the earlier attempts
+	attempt  uint32
+	excluded []abstract.Point
+
+	// refusal to sign for the commit phase or not. This flag is set if the
+	// block can't be verified or during the Challenge of the commit phase and
+	// will be used during the response of the commit phase to put an
+	// exception or to sign.
 	signRefusal bool
 
 	// onDoneCallback is the callback that will be called at the end of the
@@ -86,9 +112,9 @@ type ByzCoin struct {
 	// phase of the commit round or at the end of a view change.
 	onDoneCallback func()
 
-	// onSignatureDone is the callback that will be called when a signature has
+	// onSignatureDone are the callbacks that will be called when a signature has
 	// been generated ( at the end of the response phase of the commit round)
-	onSignatureDone func(*BlockSignature)
+	onSignatureDone []func(*BlockSignature)
 
 	// rootTimeout is the timeout given to the root. It will be passed down the
 	// tree so every nodes knows how much time to wait. This root is a very nice
@@ -103,7 +129,13 @@ type ByzCoin struct {
 	// measurements. Hence functions will not be called in go routines
 
 	// root fails:
+	// 0 do not fail
+	// 1 propose the block, then stay silent
+	// 2 propose a wrong block, then stay silent
 	rootFailMode uint
+	// faults are injected by the nodes of the simulation, fault is ours
+	faults *FaultPlan
+	fault  Fault
 	// Call back when we start the announcement of the prepare phase
 	onAnnouncementPrepare func()
 	// callback when we finished the response of the prepare phase
@@ -113,11 +145,19 @@ type ByzCoin struct {
 
 	onResponseCommitDone func()
 	// view change setup and measurement
-	viewchangeChan chan struct {
-		*sda.TreeNode
-		viewChange
-	}
-	vcMeasure *monitor.Measure
+	viewchangeChan chan viewChangeChan
+	// channel for the signature of the round that replaced this one
+	newViewChan chan newViewChan
+	vcMeasure   *monitor.Measure
+	// view is the number of view changes since the first leader. The leader
+	// of view v+i is the i'th entity of the EntityList.
+	view uint32
+	// vcSent is true once we asked for the next view
+	vcSent bool
+	// vcVotes are the tree nodes that asked for the next view
+	vcVotes map[string]bool
+	// lock associated
+	vcLock sync.Mutex
 	// bool set to true when the final signature is produced
 	doneSigning chan bool
 	// lock associated
@@ -127,8 +167,6 @@ type ByzCoin struct {
 	// threshold for how much view change acceptance we need
 	// basically n - threshold
 	viewChangeThreshold int
-	// how many view change request have we received
-	vcCounter int
 	// done processing is used to stop the processing of the channels
 	doneProcessing chan bool
 
@@ -143,10 +181,20 @@ func NewByzCoinProtocol(n *sda.Node) (*ByzCoin, error) {
 	bz.suite = n.Suite()
 	bz.prepare = cosi.NewCosi(n.Suite(), n.Private())
 	bz.commit = cosi.NewCosi(n.Suite(), n.Private())
-	bz.verifyBlockChan = make(chan bool)
+	// buffered so that a silent root doesn't block the verification
+	bz.verifyBlockChan = make(chan bool, 1)
 	bz.doneProcessing = make(chan bool, 2)
 	bz.doneSigning = make(chan bool, 1)
 	bz.timeoutChan = make(chan uint64, 1)
+	bz.commitTimeoutChan = make(chan commitTimeout, 2)
+	bz.committedTimeout = make(chan bool, 1)
+	bz.rounds = [2]*roundState{{}, {}}
+	bz.vcVotes = make(map[string]bool)
+	bz.chain = chainOf(n.Host())
+	bz.lastBlock, bz.lastKeyBlock = bz.chain.Last()
+	bz.utxo = UTXOSetOf(n.Host())
+	bz.faults = FaultsOf(n.Host())
+	bz.fault = bz.faults.FaultOf(n.TreeNode().Entity)
 
 	//bz.endProto, _ = end.NewEndProtocol(n)
 	bz.aggregatedPublic = n.EntityList().Aggregate
@@ -160,6 +208,10 @@ func NewByzCoinProtocol(n *sda.Node) (*ByzCoin, error) {
 	n.RegisterChannel(&bz.challengeCommitChan)
 	n.RegisterChannel(&bz.responseChan)
 	n.RegisterChannel(&bz.viewchangeChan)
+	n.RegisterChannel(&bz.newViewChan)
+	n.RegisterChannel(&bz.committedChan)
+	n.RegisterChannel(&bz.transactionRequestChan)
+	n.RegisterChannel(&bz.transactionReplyChan)
 
 	n.OnDoneCallback(bz.nodeDone)
 
@@ -172,7 +224,7 @@ func NewByzCoinRootProtocol(n *sda.Node, transactions []blkparser.Tx, timeOutMs
 	if err != nil {
 		return nil, err
 	}
-	bz.tempBlock, err = getBlock(transactions, bz.lastBlock, bz.lastKeyBlock)
+	bz.tempBlock, err = getBlock(bz.validTransactions(transactions), bz.lastBlock, bz.lastKeyBlock)
 	bz.rootFailMode = failMode
 	bz.rootTimeout = timeOutMs
 	return bz, err
@@ -192,8 +244,18 @@ func (bz *ByzCoin) Start() error {
 func (bz *ByzCoin) Dispatch() error {
 	return nil
 }
+
+// Shutdown stops the processing of the messages, as the round of a crashed
+// witness never ends.
+func (bz *ByzCoin) Shutdown() error {
+	select {
+	case bz.doneProcessing <- true:
+	default:
+	}
+	return nil
+}
 func (bz *ByzCoin) listen() {
-	// FIXME handle different failure modes
+	// a failing root proposes its block but never collects the responses
 	fail := (bz.rootFailMode != 0) && bz.IsRoot()
 	var timeoutStarted bool
 	for {
@@ -204,18 +266,14 @@ func (bz *ByzCoin) listen() {
 			err = bz.handleAnnouncement(msg.ByzCoinAnnounce)
 		case msg := <-bz.commitChan:
 			// Commitment
-			if !fail {
-				err = bz.handleCommit(msg.ByzCoinCommitment)
-			}
+			err = bz.handleCommit(msg.TreeNode, msg.ByzCoinCommitment)
+		case timeout := <-bz.commitTimeoutChan:
+			err = bz.handleCommitTimeout(timeout)
 		case msg := <-bz.challengePrepareChan:
 			// Challenge
-			if !fail {
-				err = bz.handleChallengePrepare(&msg.ByzCoinChallengePrepare)
-			}
+			err = bz.handleChallengePrepare(&msg.ByzCoinChallengePrepare)
 		case msg := <-bz.challengeCommitChan:
-			if !fail {
-				err = bz.handleChallengeCommit(&msg.ByzCoinChallengeCommit)
-			}
+			err = bz.handleChallengeCommit(&msg.ByzCoinChallengeCommit)
 		case msg := <-bz.responseChan:
 			// Response
 			if !fail {
@@ -235,7 +293,17 @@ func (bz *ByzCoin) listen() {
 			go bz.startTimer(timeout)
 		case msg := <-bz.viewchangeChan:
 			// receive view change
-			err = bz.handleViewChange(msg.TreeNode, &msg.viewChange)
+			err = bz.handleViewChange(msg.TreeNode, &msg.ViewChange)
+		case msg := <-bz.newViewChan:
+			err = bz.handleNewViewSignature(&msg.NewViewSignature)
+		case msg := <-bz.committedChan:
+			err = bz.handleCommitted(&msg.BlockSignature)
+		case <-bz.committedTimeout:
+			err = bz.handleCommittedTimeout()
+		case msg := <-bz.transactionRequestChan:
+			err = bz.handleTransactionRequest(msg.TreeNode, &msg.TransactionRequest)
+		case msg := <-bz.transactionReplyChan:
+			err = bz.handleTransactionReply(&msg.TransactionReply)
 		case <-bz.doneProcessing:
 			// we are done
 			dbg.Lvl2(bz.Name(), "ByzCoin Dispatches stop.")
@@ -251,7 +319,7 @@ func (bz *ByzCoin) listen() {
 // startAnnouncementPrepare create its announcement for the prepare round and
 // sends it down the tree.
 func (bz *ByzCoin) startAnnouncementPrepare() error {
-	if bz.onAnnouncementPrepare != nil {
+	if bz.onAnnouncementPrepare != nil && bz.attempt == 0 {
 		go bz.onAnnouncementPrepare()
 	}
 
@@ -260,6 +328,7 @@ func (bz *ByzCoin) startAnnouncementPrepare() error {
 		TYPE:         ROUND_PREPARE,
 		Announcement: ann,
 		Timeout:      bz.rootTimeout,
+		View:         bz.view,
 	}
 	dbg.Lvl3("ByzCoin Start Announcement (PREPARE)")
 	return bz.sendAnnouncement(bza)
@@ -277,7 +346,13 @@ func (bz *ByzCoin) startAnnouncementCommit() error {
 	return bz.sendAnnouncement(bza)
 }
 
+// sendAnnouncement sends the announcement of the root down the tree, with
+// the child timeout and the attempt.
 func (bz *ByzCoin) sendAnnouncement(bza *ByzCoinAnnounce) error {
+	bza.ChildTimeout = bz.childTimeout
+	bza.Attempt = bz.attempt
+	bza.Excluded = bz.excluded
+	bz.startCommitTimer(bza.TYPE)
 	var err error
 	for _, tn := range bz.Children() {
 		err = bz.SendTo(tn, bza)
@@ -285,19 +360,39 @@ func (bz *ByzCoin) sendAnnouncement(bza *ByzCoinAnnounce) error {
 	return err
 }
 
-// handleAnnouncement pass the announcement to the right CoSi struct.
+// handleAnnouncement pass the announcement to the right CoSi struct. The
+// first announcement of a new attempt drops the earlier one.
 func (bz *ByzCoin) handleAnnouncement(ann ByzCoinAnnounce) error {
 	var announcement = new(ByzCoinAnnounce)
 
+	if bz.fault == FaultCrashed {
+		dbg.Lvl2(bz.Name(), "Crashed, not answering")
+		return nil
+	}
+	switch {
+	case ann.Attempt < bz.attempt:
+		dbg.Lvl2(bz.Name(), "Ignoring announcement of attempt", ann.Attempt)
+		return nil
+	case ann.Attempt > bz.attempt:
+		bz.newAttempt(ann.Attempt, ann.Excluded)
+	}
+	bz.childTimeout = ann.ChildTimeout
 	switch ann.TYPE {
 	case ROUND_PREPARE:
 		announcement = &ByzCoinAnnounce{
 			TYPE:         ROUND_PREPARE,
 			Announcement: bz.prepare.Announce(ann.Announcement),
 			Timeout:      ann.Timeout,
+			View:         ann.View,
 		}
 
-		bz.timeoutChan <- ann.Timeout
+		bz.vcLock.Lock()
+		bz.view = ann.View
+		bz.vcLock.Unlock()
+		bz.rootTimeout = ann.Timeout
+		if ann.Timeout > 0 {
+			bz.timeoutChan <- ann.Timeout
+		}
 		// give the timeout
 		dbg.Lvl3(bz.Name(), "ByzCoin Handle Announcement PREPARE")
 
@@ -315,6 +410,10 @@ func (bz *ByzCoin) handleAnnouncement(ann ByzCoinAnnounce) error {
 			return bz.startCommitmentCommit()
 		}
 	}
+	announcement.ChildTimeout = ann.ChildTimeout
+	announcement.Attempt = ann.Attempt
+	announcement.Excluded = ann.Excluded
+	bz.startCommitTimer(ann.TYPE)
 
 	var err error
 	for _, tn := range bz.Children() {
@@ -327,7 +426,12 @@ func (bz *ByzCoin) handleAnnouncement(ann ByzCoinAnnounce) error {
 // round.
 func (bz *ByzCoin) startCommitmentPrepare() error {
 	cm := bz.prepare.CreateCommitment()
-	err := bz.SendTo(bz.Parent(), &ByzCoinCommitment{TYPE: ROUND_PREPARE, Commitment: cm})
+	err := bz.sendToParent(&ByzCoinCommitment{
+		TYPE:       ROUND_PREPARE,
+		Commitment: cm,
+		Exceptions: bz.exceptions(ROUND_PREPARE),
+		Attempt:    bz.attempt,
+	})
 	dbg.Lvl3(bz.Name(), "ByzCoin Start Commitment PREPARE")
 	return err
 }
@@ -337,86 +441,101 @@ func (bz *ByzCoin) startCommitmentPrepare() error {
 func (bz *ByzCoin) startCommitmentCommit() error {
 	cm := bz.commit.CreateCommitment()
 
-	err := bz.SendTo(bz.Parent(), &ByzCoinCommitment{TYPE: ROUND_COMMIT, Commitment: cm})
+	err := bz.sendToParent(&ByzCoinCommitment{
+		TYPE:       ROUND_COMMIT,
+		Commitment: cm,
+		Exceptions: bz.exceptions(ROUND_COMMIT),
+		Attempt:    bz.attempt,
+	})
 	dbg.Lvl3(bz.Name(), "ByzCoin Start Commitment COMMIT", err)
 	return err
 }
 
-// handle the arrival of a commitment
-func (bz *ByzCoin) handleCommit(ann ByzCoinCommitment) error {
-	var commitment *ByzCoinCommitment
-	// store it and check if we have enough commitments
-	switch ann.TYPE {
-	case ROUND_PREPARE:
-		bz.tpcMut.Lock()
-		bz.tempPrepareCommit = append(bz.tempPrepareCommit, ann.Commitment)
-		if len(bz.tempPrepareCommit) < len(bz.Children()) {
-			bz.tpcMut.Unlock()
-			return nil
-		}
-		commit := bz.prepare.Commit(bz.tempPrepareCommit)
-		bz.tpcMut.Unlock()
-		if bz.IsRoot() {
-			return bz.startChallengePrepare()
-		}
-		commitment = &ByzCoinCommitment{
-			TYPE:       ROUND_PREPARE,
-			Commitment: commit,
-		}
-		dbg.Lvl3(bz.Name(), "ByzCoin handle Commit PREPARE")
-	case ROUND_COMMIT:
-		bz.tccMut.Lock()
-		bz.tempCommitCommit = append(bz.tempCommitCommit, ann.Commitment)
-		if len(bz.tempCommitCommit) < len(bz.Children()) {
-			bz.tccMut.Unlock()
-			return nil
-		}
-		commit := bz.commit.Commit(bz.tempCommitCommit)
-		bz.tccMut.Unlock()
-		if bz.IsRoot() {
-			// do nothing
-			//	bz.startChallengeCommit()
-			// stop the processing of the round, wait the end of the "prepare"
-			// round. startChallengeCOmmit will be called then.
-			return nil
-		}
-		commitment = &ByzCoinCommitment{
-			TYPE:       ROUND_COMMIT,
-			Commitment: commit,
-		}
-		dbg.Lvl3(bz.Name(), "ByzCoin handle Commit COMMIT")
+// handleCommit stores the commitment of a child and goes on once all
+// children committed. Commitments coming after the child timeout or of
+// another attempt are ignored.
+func (bz *ByzCoin) handleCommit(tn *sda.TreeNode, bzc ByzCoinCommitment) error {
+	if bzc.Attempt != bz.attempt {
+		dbg.Lvl2(bz.Name(), "Ignoring commitment of attempt", bzc.Attempt)
+		return nil
 	}
-	err := bz.SendTo(bz.Parent(), commitment)
-	return err
+	r := bz.rounds[bzc.TYPE]
+	r.Lock()
+	if r.closed {
+		r.Unlock()
+		dbg.Lvl2(bz.Name(), "Ignoring late commitment of", tn.Name())
+		return nil
+	}
+	r.commits = append(r.commits, bzc.Commitment)
+	r.committed = append(r.committed, tn)
+	r.exceptions = append(r.exceptions, bzc.Exceptions...)
+	complete := len(r.committed) == len(bz.Children())
+	r.Unlock()
+	if !complete {
+		return nil
+	}
+	return bz.sendCommitment(bzc.TYPE)
 }
 
 // startPrepareChallenge create the challenge and send its down the tree
 func (bz *ByzCoin) startChallengePrepare() error {
 	// make the challenge out of it
 	trblock := bz.tempBlock
-	marshalled, err := json.Marshal(trblock)
+	if bz.rootFailMode == 2 {
+		trblock = wrongBlock(trblock)
+	}
+	marshalled, err := trblock.MarshalBinary()
 	if err != nil {
 		return err
 	}
-	ch, err := bz.prepare.CreateChallenge(marshalled)
+	ch, err := bz.prepare.CreateChallenge(bz.aggregatedPublic, marshalled)
 	if err != nil {
 		return err
 	}
-	bizChal := &ByzCoinChallengePrepare{
-		TYPE:      ROUND_PREPARE,
-		Challenge: ch,
-		TrBlock:   trblock,
+	bizChal, err := bz.challengeMessage(ch, trblock)
+	if err != nil {
+		return err
+	}
+	// an equivocating root sends another block with the same challenge
+	other := bizChal
+	if bz.faults.Equivocates(bz.Entity()) {
+		if other, err = bz.challengeMessage(ch, EquivocatingBlock(trblock)); err != nil {
+			return err
+		}
 	}
 
-	go verifyBlock(bz.tempBlock, bz.lastBlock, bz.lastKeyBlock, bz.verifyBlockChan)
+	go verifyBlock(bz.tempBlock, bz.lastBlock, bz.lastKeyBlock, bz.utxo, bz.verifyBlockChan)
 	dbg.Lvl3(bz.Name(), "ByzCoin Start Challenge PREPARE")
 	// send to children
-	for _, tn := range bz.Children() {
-		err = bz.SendTo(tn, bizChal)
+	for _, tn := range bz.participants(ROUND_PREPARE) {
+		if bz.faults.Equivocated(tn) {
+			err = bz.SendTo(tn, other)
+		} else {
+			err = bz.SendTo(tn, bizChal)
+		}
 	}
 	return err
 }
 
+// challengeMessage returns the challenge of the "prepare" round for block,
+// compact if asked to.
+func (bz *ByzCoin) challengeMessage(ch *cosi.Challenge, block *blockchain.TrBlock) (*ByzCoinChallengePrepare, error) {
+	if bz.compact {
+		block = compactBlock(block)
+	}
+	marshalled, err := block.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return &ByzCoinChallengePrepare{
+		TYPE:      ROUND_PREPARE,
+		Challenge: ch,
+		Block:     marshalled,
+		Compact:   bz.compact,
+		Attempt:   bz.attempt,
+	}, nil
+}
+
 // startCommitChallenge waits the end of the "prepare" round.
 // Then it creates the challenge and sends it along with the
 // "prepare" signature down the tree.
@@ -426,30 +545,69 @@ func (bz *ByzCoin) startChallengeCommit() error {
 	}
 	// create the challenge out of it
 	marshalled := bz.tempBlock.HashSum()
-	chal, err := bz.commit.CreateChallenge(marshalled)
+	chal, err := bz.commit.CreateChallenge(bz.aggregatedPublic, marshalled)
 	if err != nil {
 		return err
 	}
 
-	// send challenge + signature
+	// send challenge + signature, with the exceptions to verify it
 	bzc := &ByzCoinChallengeCommit{
-		TYPE:      ROUND_COMMIT,
-		Challenge: chal,
-		Signature: bz.prepare.Signature(),
+		TYPE:       ROUND_COMMIT,
+		Challenge:  chal,
+		Signature:  bz.prepare.Signature(),
+		Exceptions: bz.exceptions(ROUND_PREPARE),
+		Attempt:    bz.attempt,
 	}
 	dbg.Lvl3("ByzCoin Start Challenge COMMIT")
-	for _, tn := range bz.Children() {
+	for _, tn := range bz.participants(ROUND_COMMIT) {
 		err = bz.SendTo(tn, bzc)
 	}
 	return err
 }
 
 // handlePrepareChallenge receive the challenge messages for the "prepare"
-// round.
+// round. The transactions of a compact block that we don't know are asked
+// to the parent first.
 func (bz *ByzCoin) handleChallengePrepare(ch *ByzCoinChallengePrepare) error {
-	bz.tempBlock = ch.TrBlock
+	if ch.Attempt != bz.attempt {
+		dbg.Lvl2(bz.Name(), "Ignoring challenge of attempt", ch.Attempt)
+		return nil
+	}
+	block := &blockchain.TrBlock{}
+	if err := block.UnmarshalBinary(ch.Block); err != nil {
+		return err
+	}
+	bz.compact = ch.Compact
+	if ch.Compact {
+		bz.fillCompactBlock(block)
+		if len(bz.missingTxs) > 0 {
+			bz.pendingChallenge, bz.pendingBlock = ch, block
+			req := &TransactionRequest{}
+			for h := range bz.missingTxs {
+				req.Hashes = append(req.Hashes, h)
+			}
+			dbg.Lvl3(bz.Name(), "Asking parent for", len(req.Hashes), "transactions")
+			return bz.SendTo(bz.Parent(), req)
+		}
+	}
+	return bz.challengePrepare(ch, block, nil)
+}
+
+// challengePrepare verifies the complete block and sends the challenge
+// down. We refuse to sign if refusal isn't nil or if the challenge is not
+// the one of the block.
+func (bz *ByzCoin) challengePrepare(ch *ByzCoinChallengePrepare, block *blockchain.TrBlock, refusal error) error {
+	bz.tempBlock = block
+	marshalled, err := block.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	challengeErr := refusal
+	if challengeErr == nil {
+		challengeErr = cosi.VerifyChallenge(bz.suite, bz.aggregatedPublic, marshalled, ch.Challenge)
+	}
 	// start the verification of the block
-	go verifyBlock(bz.tempBlock, bz.lastBlock, bz.lastKeyBlock, bz.verifyBlockChan)
+	go bz.verifyProposal(bz.tempBlock, challengeErr)
 	// acknoledge the challenge and send its down
 	chal := bz.prepare.Challenge(ch.Challenge)
 	ch.Challenge = chal
@@ -459,8 +617,7 @@ func (bz *ByzCoin) handleChallengePrepare(ch *ByzCoinChallengePrepare) error {
 	if bz.IsLeaf() {
 		return bz.startResponsePrepare()
 	}
-	var err error
-	for _, tn := range bz.Children() {
+	for _, tn := range bz.participants(ROUND_PREPARE) {
 		err = bz.SendTo(tn, ch)
 	}
 	return err
@@ -469,11 +626,19 @@ func (bz *ByzCoin) handleChallengePrepare(ch *ByzCoinChallengePrepare) error {
 // handleCommitChallenge will verify the signature + check if no more than 1/3
 // of participants refused to sign.
 func (bz *ByzCoin) handleChallengeCommit(ch *ByzCoinChallengeCommit) error {
+	if ch.Attempt != bz.attempt {
+		dbg.Lvl2(bz.Name(), "Ignoring challenge of attempt", ch.Attempt)
+		return nil
+	}
 	// marshal the block
-	marshalled, err := json.Marshal(bz.tempBlock)
+	marshalled, err := bz.tempBlock.MarshalBinary()
 	if err != nil {
 		return err
 	}
+	if err := cosi.VerifyChallenge(bz.suite, bz.aggregatedPublic, bz.tempBlock.HashSum(), ch.Challenge); err != nil {
+		dbg.Error(bz.Name(), "Refusing the challenge:", err)
+		bz.signRefusal = true
+	}
 	ch.Challenge = bz.commit.Challenge(ch.Challenge)
 
 	// verify if the signature is correct
@@ -482,192 +647,234 @@ func (bz *ByzCoin) handleChallengeCommit(ch *ByzCoinChallengeCommit) error {
 		bz.signRefusal = true
 	}
 
-	// Verify if we have no more than 1/3 failed nodes
-
-	if len(ch.Exceptions) > int(bz.threshold) {
-		dbg.Errorf("More than 1/3 (%d/%d) refused to sign ! ABORT", len(ch.Exceptions), len(bz.EntityList().List))
+	// Verify if we have no more than 1/3 failed nodes, all distinct
+	// members
+	if err := CheckExceptions(bz.EntityList(), ch.Exceptions); err != nil {
+		dbg.Error(bz.Name(), "Wrong exceptions:", err)
 		bz.signRefusal = true
 	}
 
-	// store the exceptions for later usage
-	bz.tempExceptions = ch.Exceptions
 	dbg.Lvl3("ByzCoin handle Challenge COMMIT")
 	if bz.IsLeaf() {
 		return bz.startResponseCommit()
 	}
 
 	// send it down
-	for _, tn := range bz.Children() {
+	for _, tn := range bz.participants(ROUND_COMMIT) {
 		err = bz.SendTo(tn, ch)
 	}
 	return nil
 }
 
-// startPrepareResponse wait the verification of the block and then start the
-// challenge process
+// startPrepareResponse wait the verification of the block and then sends
+// the response up, refusing to sign if the block is wrong.
 func (bz *ByzCoin) startResponsePrepare() error {
-	// create response
-	resp, err := bz.prepare.CreateResponse()
+	// wait the verification
+	ok := <-bz.verifyBlockChan
+	bzr, err := bz.response(ROUND_PREPARE, !ok)
 	if err != nil {
 		return err
 	}
-	// wait the verification
-	bzr, ok := bz.waitResponseVerification()
-	if ok {
-		// apend response only if OK
-		bzr.Response = resp
+	dbg.Lvl3(bz.Name(), "ByzCoin Start Response PREPARE (refusal=", !ok, ")")
+	// if I'm root, we are finished, let's notify the "commit" round
+	if bz.IsRoot() {
+		if len(bzr.Refusals) > 0 {
+			return bz.restartOrFail(ROUND_PREPARE)
+		}
+		// notify listeners (simulation) we finished
+		if bz.onResponsePrepareDone != nil {
+			bz.onResponsePrepareDone()
+		}
+		return bz.startChallengeCommit()
 	}
-	dbg.Lvl3(bz.Name(), "ByzCoin Start Response PREPARE")
 	// send to parent
-	return bz.SendTo(bz.Parent(), bzr)
+	return bz.sendToParent(bzr)
 }
 
 // startCommitResponse will create the response for the commit phase and send it
-// up. It will not create the response if it decided the signature is wrong from
-// the prepare phase.
+// up. It will not sign if it decided the signature is wrong from the prepare
+// phase.
 func (bz *ByzCoin) startResponseCommit() error {
-	bzr := &ByzCoinResponse{
-		TYPE: ROUND_COMMIT,
-	}
-	// if i dont want to sign
-	if bz.signRefusal {
-		bzr.Exceptions = append(bzr.Exceptions, cosi.Exception{
-			Public:     bz.Public(),
-			Commitment: bz.commit.GetCommitment(),
-		})
-	} else {
-		// otherwise i create the response
-		resp, err := bz.commit.CreateResponse()
-		if err != nil {
-			return err
-		}
-		bzr.Response = resp
-	}
-	dbg.Lvl3(bz.Name(), "ByzCoin Start Response COMMIT")
-	// send to parent
-	err := bz.SendTo(bz.Parent(), bzr)
-	bz.Done()
-	return err
-}
-
-// handleResponseCommit handles the responses for the commit round during the
-// response phase.
-func (bz *ByzCoin) handleResponseCommit(bzr *ByzCoinResponse) error {
-	// check if we have enough
-	// FIXME possible data race
-	bz.tcrMut.Lock()
-	bz.tempCommitResponse = append(bz.tempCommitResponse, bzr.Response)
-
-	if len(bz.tempCommitResponse) < len(bz.Children()) {
-		bz.tcrMut.Unlock()
-		return nil
+	bzr, err := bz.response(ROUND_COMMIT, bz.signRefusal)
+	if err != nil {
+		return err
 	}
-
-	if bz.signRefusal {
-		bzr.Exceptions = append(bzr.Exceptions, cosi.Exception{
-			Public:     bz.Public(),
-			Commitment: bz.commit.GetCommitment(),
-		})
-		bz.tcrMut.Unlock()
-	} else {
-		resp, err := bz.commit.Response(bz.tempCommitResponse)
-		bz.tcrMut.Unlock()
-		if err != nil {
-			return err
-		}
-		bzr.Response = resp
+	// notify we have finished to participate in this signature, unless
+	// the timer is already stopped by an earlier attempt
+	select {
+	case bz.doneSigning <- true:
+	default:
 	}
-
-	// notify we have finished to participate in this signature
-	bz.doneSigning <- true
-	dbg.Lvl3(bz.Name(), "ByzCoin handle Response COMMIT (refusal=", bz.signRefusal, ")")
+	dbg.Lvl3(bz.Name(), "ByzCoin Start Response COMMIT (refusal=", bz.signRefusal, ")")
 	// if root we have finished
 	if bz.IsRoot() {
+		if len(bzr.Refusals) > 0 {
+			return bz.restartOrFail(ROUND_COMMIT)
+		}
 		sig := bz.Signature()
+		if len(sig.Exceptions) > bz.threshold {
+			bz.Done()
+			return fmt.Errorf("More than 1/3 (%d/%d) refused to sign",
+				len(sig.Exceptions), len(bz.Tree().ListNodes()))
+		}
 		if bz.onResponseCommitDone != nil {
 			bz.onResponseCommitDone()
 		}
-		if bz.onSignatureDone != nil {
-			bz.onSignatureDone(sig)
+		err := bz.commitBlock(sig)
+		for _, fn := range bz.onSignatureDone {
+			fn(sig)
 		}
 		bz.Done()
+		return err
+	}
+	// send to parent, we are done once the block is committed, or if the
+	// root doesn't send it in time
+	bz.committedTimer = time.AfterFunc(CommittedTimeout, func() {
+		select {
+		case bz.committedTimeout <- true:
+		default:
+		}
+	})
+	return bz.sendToParent(bzr)
+}
+
+// restartOrFail restarts the rounds without the witnesses that refused in
+// round rt. If that's not possible, the block can't be signed in this view
+// and we ask for the next one.
+func (bz *ByzCoin) restartOrFail(rt RoundType) error {
+	err := bz.restart(rt)
+	if err != nil {
+		go bz.sendAndMeasureViewchange()
+	}
+	return err
+}
+
+// handleResponseCommit handles the responses for the commit round during the
+// response phase.
+func (bz *ByzCoin) handleResponseCommit(bzr *ByzCoinResponse) error {
+	if bzr.Attempt != bz.attempt {
+		dbg.Lvl2(bz.Name(), "Ignoring response of attempt", bzr.Attempt)
+		return nil
+	}
+	if !bz.addResponse(bzr) {
 		return nil
 	}
+	return bz.startResponseCommit()
+}
 
-	// otherwise , send the response up
-	err := bz.SendTo(bz.Parent(), bzr)
+// handleCommitted receives the final signature from the root and commits
+// the block.
+func (bz *ByzCoin) handleCommitted(sig *BlockSignature) error {
+	if bz.committedTimer != nil {
+		bz.committedTimer.Stop()
+		bz.committedTimer = nil
+	}
+	// a compact block is the one we completed if it has the same HashSum
+	if bz.tempBlock != nil && sig.Block != nil &&
+		bytes.Equal(bz.tempBlock.HashSum(), sig.Block.HashSum()) {
+		sig.Block = bz.tempBlock
+	}
+	err := bz.commitBlock(sig)
 	bz.Done()
 	return err
 }
 
-func (bz *ByzCoin) handleResponsePrepare(bzr *ByzCoinResponse) error {
-	// check if we have enough
-	bz.tprMut.Lock()
-	bz.tempPrepareResponse = append(bz.tempPrepareResponse, bzr.Response)
-	if len(bz.tempPrepareResponse) < len(bz.Children()) {
-		bz.tprMut.Unlock()
+// handleCommittedTimeout ends the round if the root didn't send the final
+// signature, e.g. because it crashed. The block is not committed.
+func (bz *ByzCoin) handleCommittedTimeout() error {
+	if bz.committedTimer == nil {
+		// the signature arrived in the meantime
 		return nil
 	}
+	bz.committedTimer = nil
+	dbg.Lvl2(bz.Name(), "No final signature from the root - giving up")
+	bz.Done()
+	return nil
+}
 
-	// wait for verification
-	bzrReturn, ok := bz.waitResponseVerification()
-	if ok {
-		// append response
-		resp, err := bz.prepare.Response(bz.tempPrepareResponse)
-		bz.tprMut.Unlock()
-		if err != nil {
-			return err
+// commitBlock appends the block to the chain if sig verifies, and sends sig
+// down the tree so that the children do the same. In compact mode, the
+// children get the block they completed during the challenge back in its
+// compact form.
+func (bz *ByzCoin) commitBlock(sig *BlockSignature) error {
+	err := verifyBlockSignature(bz.suite, bz.EntityList(), sig)
+	if err == nil {
+		err = bz.chain.Append(&blockchain.SignedBlock{
+			Block:      sig.Block,
+			Signature:  sig.Sig,
+			Exceptions: sig.Exceptions,
+		})
+	}
+	if err == nil && bz.utxo != nil {
+		err = bz.utxo.Apply(sig.Block.HeaderHash, sig.Block.Txs)
+	}
+	down := sig
+	if bz.compact && bz.tempBlock != nil && sig.Block.HeaderHash == bz.tempBlock.HeaderHash {
+		down = &BlockSignature{
+			Sig:        sig.Sig,
+			Block:      compactBlock(sig.Block),
+			Exceptions: sig.Exceptions,
 		}
-		bzrReturn.Response = resp
-	} else {
-		bz.tprMut.Unlock()
 	}
-
-	dbg.Lvl3("ByzCoin Handle Response PREPARE")
-	// if I'm root, we are finished, let's notify the "commit" round
-	if bz.IsRoot() {
-		// notify listeners (simulation) we finished
-		if bz.onResponsePrepareDone != nil {
-			bz.onResponsePrepareDone()
+	for _, tn := range bz.participants(ROUND_COMMIT) {
+		msg := down
+		if bz.faults.Equivocated(tn) {
+			// they didn't complete this block
+			msg = sig
 		}
-		bz.startChallengeCommit()
+		if e := bz.SendTo(tn, msg); e != nil {
+			err = e
+		}
+	}
+	if err == nil {
+		dbg.Lvl3(bz.Name(), "Committed block", sig.Block.HeaderHash)
+	}
+	return err
+}
 
+func (bz *ByzCoin) handleResponsePrepare(bzr *ByzCoinResponse) error {
+	if bzr.Attempt != bz.attempt {
+		dbg.Lvl2(bz.Name(), "Ignoring response of attempt", bzr.Attempt)
 		return nil
 	}
-	// send up
-	return bz.SendTo(bz.Parent(), bzrReturn)
+	if !bz.addResponse(bzr) {
+		return nil
+	}
+	return bz.startResponsePrepare()
 }
 
-// computePrepareResponse wait the end of the verification and returns the
-// ByzCoinResponse along with the flag:
-// true => no exception, the verification is correct
-// false => exception, the verification is NOT correct
-func (bz *ByzCoin) waitResponseVerification() (*ByzCoinResponse, bool) {
-	bzr := &ByzCoinResponse{
-		TYPE: ROUND_PREPARE,
-	}
-	// wait the verification
-	verified := <-bz.verifyBlockChan
-	if !verified {
-		// append our exception
-		bzr.Exceptions = append(bzr.Exceptions, cosi.Exception{
-			Public:     bz.Public(),
-			Commitment: bz.prepare.GetCommitment(),
-		})
+// verifyProposal verifies the block proposed by the root and asks right away
+// for a view change if it is wrong, without waiting for the children. A
+// refusing witness refuses any block, but doesn't ask for a view change,
+// and so does a witness that got a challenge for another block.
+func (bz *ByzCoin) verifyProposal(block *blockchain.TrBlock, challengeErr error) {
+	verified := make(chan bool, 1)
+	verifyBlock(block, bz.lastBlock, bz.lastKeyBlock, bz.utxo, verified)
+	ok := <-verified
+	switch {
+	case bz.fault == FaultRefusing:
+		dbg.Lvl2(bz.Name(), "Refusing to sign")
+		bz.signRefusal = true
+		ok = false
+	case challengeErr != nil:
+		dbg.Error(bz.Name(), "Refusing the challenge:", challengeErr)
+		bz.signRefusal = true
+		ok = false
+	case !ok:
+		bz.signRefusal = true
 		bz.sendAndMeasureViewchange()
-		return bzr, false
 	}
-
-	return bzr, true
+	bz.verifyBlockChan <- ok
 }
 
-// verifyBlock is a simulation of a real verification block algorithm
-func verifyBlock(block *blockchain.TrBlock, lastBlock, lastKeyBlock string, done chan bool) {
+// verifyBlock simulates the cost of verifying the block, and checks its
+// header and, if utxo isn't nil, its transactions.
+func verifyBlock(block *blockchain.TrBlock, lastBlock, lastKeyBlock string, utxo *blockchain.UTXOSet, done chan bool) {
 	//We measure the average block verification delays is 174ms for an average
 	//block of 500kB.
 	//To simulate the verification cost of bigger blocks we multiply 174ms
 	//times the size/500*1024
-	b, _ := json.Marshal(block)
+	b, _ := block.MarshalBinary()
 	s := len(b)
 	var n time.Duration
 	n = time.Duration(s / (500 * 1024))
@@ -676,11 +883,38 @@ func verifyBlock(block *blockchain.TrBlock, lastBlock, lastKeyBlock string, done
 	verified := block.Header.Parent == lastBlock && block.Header.ParentKey == lastKeyBlock
 	verified = verified && block.Header.MerkleRoot == blockchain.HashRootTransactions(block.TransactionList)
 	verified = verified && block.HeaderHash == blockchain.HashHeader(block.Header)
+	if verified && utxo != nil {
+		if err := utxo.Check(block.Txs); err != nil {
+			dbg.Lvl2("Refusing block:", err)
+			verified = false
+		}
+	}
 	// notify it
 	dbg.Lvl3("Verification of the block done =", verified)
 	done <- verified
 }
 
+// validTransactions drops the transactions that the UTXO set of the host
+// refuses.
+func (bz *ByzCoin) validTransactions(txs []blkparser.Tx) []blkparser.Tx {
+	if bz.utxo == nil {
+		return txs
+	}
+	valid, refused := bz.utxo.Filter(txs)
+	if len(refused) > 0 {
+		dbg.Lvl2(bz.Name(), "Dropped", len(refused), "invalid transactions")
+	}
+	return valid
+}
+
+// wrongBlock returns a copy of block with a header pointing to an unknown
+// parent. It is used by a root failing in mode 2.
+func wrongBlock(block *blockchain.TrBlock) *blockchain.TrBlock {
+	header := *block.Header
+	header.Parent = "wrong parent"
+	return blockchain.NewTrBlock(block.TransactionList, &header)
+}
+
 // getblock returns the next block available from the transaction pool.
 func getBlock(transactions []blkparser.Tx, lastBlock, lastKeyBlock string) (*blockchain.TrBlock, error) {
 	if len(transactions) < 1 {
@@ -699,7 +933,7 @@ func (bz *ByzCoin) Signature() *BlockSignature {
 	return &BlockSignature{
 		Sig:        bz.commit.Signature(),
 		Block:      bz.tempBlock,
-		Exceptions: bz.tempExceptions,
+		Exceptions: bz.exceptions(ROUND_COMMIT),
 	}
 }
 
@@ -707,35 +941,50 @@ func (bz *ByzCoin) RegisterOnDone(fn func()) {
 	bz.onDoneCallback = fn
 }
 
+// RegisterOnSignatureDone adds fn to the callbacks called with the final
+// signature.
 func (bz *ByzCoin) RegisterOnSignatureDone(fn func(*BlockSignature)) {
-	bz.onSignatureDone = fn
+	bz.onSignatureDone = append(bz.onSignatureDone, fn)
 }
 
 // startTimer starts the timer to decide whether we should request a view change
 // after a certain timeout or not. If the signature is done, we don't. otherwise
 // we start the view change protocol.
 func (bz *ByzCoin) startTimer(millis uint64) {
-	if bz.rootFailMode != 0 {
-		dbg.Lvl3(bz.Name(), "Started timer (", millis, ")...")
-		select {
-		case <-bz.doneSigning:
-			return
-		case <-time.After(time.Millisecond * time.Duration(millis)):
-			bz.sendAndMeasureViewchange()
-		}
+	dbg.Lvl3(bz.Name(), "Started timer (", millis, ")...")
+	select {
+	case <-bz.doneSigning:
+		return
+	case <-time.After(time.Millisecond * time.Duration(millis)):
+		bz.sendAndMeasureViewchange()
 	}
 }
 
 // sendAndMeasureViewChange is a method that creates the viewchange request,
-// broadcast it and measures the time it takes to accept it.
+// broadcast it and measures the time it takes to accept it. It asks only
+// once for the next view.
 func (bz *ByzCoin) sendAndMeasureViewchange() {
+	bz.vcLock.Lock()
+	if bz.vcSent {
+		bz.vcLock.Unlock()
+		return
+	}
+	bz.vcSent = true
+	view := bz.view + 1
+	bz.vcLock.Unlock()
+
 	dbg.Lvl3(bz.Name(), "Created viewchange measure")
 	bz.vcMeasure = monitor.NewMeasure("viewchange")
-	vc := newViewChange()
-	var err error
+	vc, err := newViewChange(bz.suite, bz.Private(), bz.Tree().Id, view)
+	if err != nil {
+		dbg.Error(bz.Name(), "Couldn't sign view change", err)
+		return
+	}
+	// our own request counts, too
+	bz.viewchangeChan <- viewChangeChan{bz.TreeNode(), *vc}
 	for _, n := range bz.Tree().ListNodes() {
 		// don't send to ourself
-		if uuid.Equal(n.Id, bz.TreeNode().Id) {
+		if n.Id.Equal(bz.TreeNode().Id) {
 			continue
 		}
 		err = bz.SendTo(n, vc)
@@ -745,36 +994,162 @@ func (bz *ByzCoin) sendAndMeasureViewchange() {
 	}
 }
 
-// viewChange is simply the last hash / id of the previous leader.
-type viewChange struct {
-	LastBlock [sha256.Size]byte
+// newViewChange creates a new view change for the round on tree treeID.
+func newViewChange(suite abstract.Suite, private abstract.Secret, treeID crypto.HashId, view uint32) (*ViewChange, error) {
+	sig, err := crypto.SignSchnorr(suite, private, viewChangeMessage(treeID, view))
+	if err != nil {
+		return nil, err
+	}
+	return &ViewChange{View: view, Signature: sig}, nil
 }
 
-// newViewChange creates a new view change.
-func newViewChange() *viewChange {
-	res := &viewChange{}
-	for i := 0; i < sha256.Size; i++ {
-		res.LastBlock[i] = 0
-	}
-	return res
+// viewChangeMessage returns what is signed in a view change: the id of the
+// tree, so that the request can't be replayed in another round, and the view.
+func viewChangeMessage(treeID crypto.HashId, view uint32) []byte {
+	msg := make([]byte, len(treeID)+4)
+	copy(msg, treeID)
+	binary.BigEndian.PutUint32(msg[len(treeID):], view)
+	return msg
 }
 
 // handleViewChange receives a view change request and if received more than
 // 2/3, accept the view change.
-func (bz *ByzCoin) handleViewChange(tn *sda.TreeNode, vc *viewChange) error {
-	bz.vcCounter++
+func (bz *ByzCoin) handleViewChange(tn *sda.TreeNode, vc *ViewChange) error {
+	if bz.fault == FaultCrashed {
+		return nil
+	}
+	msg := viewChangeMessage(bz.Tree().Id, vc.View)
+	if err := crypto.VerifySchnorr(bz.suite, tn.Entity.Public, msg, vc.Signature); err != nil {
+		return fmt.Errorf("Wrong signature on view change from %s: %s", tn.Name(), err)
+	}
+	bz.vcLock.Lock()
+	if vc.View != bz.view+1 {
+		bz.vcLock.Unlock()
+		dbg.Lvl3(bz.Name(), "Ignoring view change to", vc.View, "in view", bz.view)
+		return nil
+	}
+	bz.vcVotes[string(tn.Id)] = true
 	// only do it once
-	if bz.vcCounter == bz.viewChangeThreshold {
-		if bz.vcMeasure != nil {
-			bz.vcMeasure.Measure()
+	if len(bz.vcVotes) != bz.viewChangeThreshold {
+		bz.vcLock.Unlock()
+		return nil
+	}
+	bz.vcLock.Unlock()
+
+	if bz.vcMeasure != nil {
+		bz.vcMeasure.Measure()
+	}
+	leader := bz.leader(vc.View)
+	dbg.Lvl3(bz.Name(), "Viewchange threshold reached (2/3) of all nodes - new leader is", leader.Entity)
+	switch {
+	case leader.Id.Equal(bz.TreeNode().Id):
+		go func() {
+			if err := bz.startNewView(vc.View); err != nil {
+				dbg.Error(bz.Name(), "Couldn't start view", vc.View, ":", err)
+				bz.Done()
+			}
+		}()
+	case bz.IsRoot():
+		// wait for the signature of the new leader
+	default:
+		go bz.Done()
+	}
+	return nil
+}
+
+// leader returns the tree node of the leader of view: the first tree node of
+// the entity in the EntityList that follows the current leader by
+// view - bz.view positions.
+func (bz *ByzCoin) leader(view uint32) *sda.TreeNode {
+	el := bz.EntityList()
+	entity := el.List[int(view-bz.view)%len(el.List)]
+	for _, tn := range bz.Tree().ListNodes() {
+		if tn.Entity.Equal(entity) {
+			return tn
 		}
+	}
+	// an entity that is not in the tree can't lead, so stay with the root
+	return bz.Root()
+}
+
+// startNewView is called by the leader of view. It signs the block again in
+// a new round, on a tree rooted at itself, and sends the signature to the
+// root of this round.
+func (bz *ByzCoin) startNewView(view uint32) error {
+	if bz.tempBlock == nil {
+		return errors.New("No block proposed in this round")
+	}
+	// the block of the failed leader might be wrong, so build it again
+	// without the invalid transactions
+	block, err := getBlock(bz.validTransactions(bz.tempBlock.Txs), bz.lastBlock, bz.lastKeyBlock)
+	if err != nil {
+		return err
+	}
+	el, err := rotateEntityList(bz.EntityList(), int(view-bz.view))
+	if err != nil {
+		return err
+	}
+	bf := len(bz.Root().Children)
+	if bf < 1 {
+		bf = 1
+	}
+	tree := el.GenerateBigNaryTree(bf, bz.Tree().Size())
+	host := bz.Host()
+	host.AddEntityList(el)
+	host.AddTree(tree)
+	node, err := host.CreateNewNodeName("ByzCoin", tree)
+	if err != nil {
+		return err
+	}
+	next := node.ProtocolInstance().(*ByzCoin)
+	next.tempBlock = block
+	next.compact = bz.compact
+	next.rootTimeout = bz.rootTimeout
+	next.childTimeout = bz.childTimeout
+	next.view = view
+	next.RegisterOnSignatureDone(func(sig *BlockSignature) {
+		nvs := &NewViewSignature{View: view, BlockSignature: *sig}
 		if bz.IsRoot() {
-			dbg.Lvl3(bz.Name(), "Viewchange threshold reached (2/3) of all nodes")
-			go bz.Done()
-			//	bz.endProto.Start()
+			bz.handleNewViewSignature(nvs)
+			return
 		}
-		return nil
+		if err := bz.SendTo(bz.Root(), nvs); err != nil {
+			dbg.Error(bz.Name(), "Couldn't send signature of view", view, ":", err)
+		}
+		bz.Done()
+	})
+	dbg.Lvl2(bz.Name(), "Starting view", view)
+	return next.Start()
+}
+
+// rotateEntityList returns the EntityList starting with the index'th entity
+// of el, followed by the others in the same order.
+func rotateEntityList(el *sda.EntityList, index int) (*sda.EntityList, error) {
+	n := len(el.List)
+	list := make([]*network.Entity, n)
+	for i := range list {
+		list[i] = el.List[(index+i)%n]
+	}
+	return sda.NewEntityListWithSuite(el.Suite(), list)
+}
+
+// handleNewViewSignature passes the signature of the new view to the
+// callbacks of the root, which is done afterwards.
+func (bz *ByzCoin) handleNewViewSignature(nvs *NewViewSignature) error {
+	sig := &nvs.BlockSignature
+	if err := verifyBlockSignature(bz.suite, bz.EntityList(), sig); err != nil {
+		return fmt.Errorf("Wrong signature for view %d: %s", nvs.View, err)
+	}
+	dbg.Lvl3(bz.Name(), "Got signature of view", nvs.View)
+	bz.vcLock.Lock()
+	bz.view = nvs.View
+	bz.vcLock.Unlock()
+	bz.tempBlock = sig.Block
+	bz.finalSignature = sig
+	for _, fn := range bz.onSignatureDone {
+		fn(sig)
 	}
+	go bz.Done()
 	return nil
 }
 
@@ -783,6 +1158,11 @@ func (bz *ByzCoin) handleViewChange(tn *sda.TreeNode, vc *viewChange) error {
 func (bz *ByzCoin) nodeDone() bool {
 	dbg.Lvl3(bz.Name(), "nodeDone()      ----- ")
 	bz.doneProcessing <- true
+	// stop the timer
+	select {
+	case bz.doneSigning <- true:
+	default:
+	}
 	dbg.Lvl3(bz.Name(), "nodeDone()      +++++  ", bz.onDoneCallback)
 	if bz.onDoneCallback != nil {
 		bz.onDoneCallback()
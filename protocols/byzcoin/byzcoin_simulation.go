@@ -1,7 +1,10 @@
 package byzcoin
 
 import (
+	"encoding/json"
 	"errors"
+	"path/filepath"
+	"strings"
 	"sync"
 
 	"github.com/BurntSushi/toml"
@@ -36,9 +39,23 @@ type SimulationConfig struct {
 	TimeoutMs uint64
 	// Fail:
 	// 0  do not fail
-	// 1 fail by doing nothing
+	// 1 fail by doing nothing after proposing the block
 	// 2 fail by sending wrong blocks
 	Fail uint
+	// Compact sends only the hashes of the transactions down the tree
+	Compact bool
+	// ChildTimeoutMs is how long the nodes wait for each level of their
+	// subtree to commit, so that crashed witnesses become exceptions
+	ChildTimeoutMs uint64
+	// Crashed, Refusing, Delayed and Equivocate inject faults
+	Faults
+	// Synthetic and the Tx-fields select generated transactions instead
+	// of Bitcoin blocks. Synthetic transactions are checked against a UTXO
+	// set on every host, so that the conflicting ones are dropped.
+	blockchain.TxConfig
+	// ChainDir is where every host keeps its chain in a file, named after
+	// its address. The chains are kept in memory if it is empty.
+	ChainDir string
 }
 
 func NewSimulation(config string) (sda.Simulation, error) {
@@ -50,11 +67,12 @@ func NewSimulation(config string) (sda.Simulation, error) {
 	return es, nil
 }
 
-// Setup implements sda.Simulation interface. It checks on the availability
-// of the block-file and downloads it if missing. Then the block-file will be
-// copied to the simulation-directory
+// Setup implements sda.Simulation interface. Unless the transactions are
+// synthetic, it checks on the availability of the block-file and downloads
+// it if missing. Then the block-file will be copied to the
+// simulation-directory
 func (e *Simulation) Setup(dir string, hosts []string) (*sda.SimulationConfig, error) {
-	err := blockchain.EnsureBlockIsAvailable(dir)
+	err := e.Prepare(dir)
 	if err != nil {
 		dbg.Fatal("Couldn't get block:", err)
 	}
@@ -83,10 +101,50 @@ func (m *monitorMut) MeasureAndReset() {
 	m.Measure = nil
 }
 
+// Node implements sda.Simulation interface. It gives the host its faults
+// and a UTXO set for synthetic transactions, and opens its chain if the
+// chains are kept in files. With compact blocks, the host knows the
+// transactions of all rounds beforehand, like if the clients had sent them
+// to everybody.
+func (e *Simulation) Node(sc *sda.SimulationConfig) error {
+	if err := e.SimulationBFTree.Node(sc); err != nil {
+		return err
+	}
+	plan, err := e.Plan(sc.Tree)
+	if err != nil {
+		return err
+	}
+	RegisterFaults(sc.Host, plan)
+	if e.Synthetic {
+		RegisterUTXOSet(sc.Host, blockchain.NewUTXOSet(sc.Host.Suite()))
+	}
+	if e.Compact {
+		// the Bitcoin blocks give the same transactions every round
+		rounds := 1
+		if e.Synthetic {
+			rounds = e.Rounds
+		}
+		for round := 0; round < rounds; round++ {
+			txs, err := SimulatedTransactions(&e.TxConfig, round, e.Blocksize)
+			if err != nil {
+				return err
+			}
+			AddKnownTransactions(sc.Host, txs...)
+		}
+	}
+	if e.ChainDir == "" {
+		return nil
+	}
+	name := strings.Replace(sc.Host.Entity.First(), ":", "_", -1) + ".chain"
+	return OpenChain(sc.Host, filepath.Join(e.ChainDir, name))
+}
+
 // Run implements sda.Simulation interface
 func (e *Simulation) Run(sdaConf *sda.SimulationConfig) error {
 	dbg.Lvl1("Simulation starting with:  Rounds=", e.Rounds)
 	server := NewByzCoinServer(e.Blocksize, e.TimeoutMs, e.Fail)
+	server.Compact = e.Compact
+	server.ChildTimeoutMs = e.ChildTimeoutMs
 
 	node, _ := sdaConf.Overlay.NewNodeEmptyName("Broadcast", sdaConf.Tree)
 	proto, _ := manage.NewBroadcastRootProtocol(node)
@@ -102,7 +160,7 @@ func (e *Simulation) Run(sdaConf *sda.SimulationConfig) error {
 
 	for round := 0; round < e.Rounds; round++ {
 		client := NewClient(server)
-		err := client.StartClientSimulation(blockchain.GetBlockDir(), e.Blocksize)
+		err := client.StartClientSimulationConfig(&e.TxConfig, round, e.Blocksize)
 		if err != nil {
 			dbg.Error("Error in ClientSimulation:", err)
 			return err
@@ -122,39 +180,65 @@ func (e *Simulation) Run(sdaConf *sda.SimulationConfig) error {
 		}
 
 		bz := pi.(*ByzCoin)
+		logBlockSize(bz.tempBlock)
 		// Register callback for the generation of the signature !
 		bz.RegisterOnSignatureDone(func(sig *BlockSignature) {
 			rComplete.Measure()
-			if err := verifyBlockSignature(node.Suite(), node.EntityList().Aggregate, sig); err != nil {
+			if err := verifyBlockSignature(node.Suite(), node.EntityList(), sig); err != nil {
 				dbg.Error("Round", round, "failed:", err)
 			} else {
-				dbg.Lvl1("Round", round, "success")
+				dbg.Lvl1("Round", round, "success with", len(sig.Exceptions), "exceptions")
 			}
 		})
 
 		// Register when the protocol is finished (all the nodes have finished)
-		done := make(chan bool)
+		done := make(chan bool, 1)
 		bz.RegisterOnDone(func() {
 			done <- true
 		})
-		if e.Fail > 0 {
-			go bz.startAnnouncementPrepare()
-			// do not run bz.startAnnouncementCommit()
-		} else {
-			go bz.Start()
-		}
+		// if the root fails, a view change elects a new leader who signs
+		// the block
+		go bz.Start()
 		// wait for the end
-		<-done
+		if !e.WaitRound(done, "round_failed") {
+			dbg.Error("Round", round, "gave up after", e.GiveUpMs, "ms")
+			continue
+		}
 		dbg.Lvl3("Round", round, "finished")
 
 	}
 	return nil
 }
 
-func verifyBlockSignature(suite abstract.Suite, aggregate abstract.Point, sig *BlockSignature) error {
+// logBlockSize measures the percentage of bandwidth saved by sending block
+// in its binary encoding instead of JSON as "block_saving", and by sending
+// it compact as "compact_block_saving".
+func logBlockSize(block *blockchain.TrBlock) {
+	bin, err := block.MarshalBinary()
+	if err != nil {
+		dbg.Error("Couldn't encode block:", err)
+		return
+	}
+	js, _ := json.Marshal(block)
+	compact, _ := compactBlock(block).MarshalBinary()
+	saving := 100 - 100*float64(len(bin))/float64(len(js))
+	compactSaving := 100 - 100*float64(len(compact))/float64(len(js))
+	monitor.MeasureValue("block_saving", saving)
+	monitor.MeasureValue("compact_block_saving", compactSaving)
+	dbg.Lvl1("Block of", len(block.Txs), "transactions takes", len(bin),
+		"bytes instead of", len(js), "in JSON, saving", int(saving),
+		"%, and", len(compact), "bytes compact")
+}
+
+// verifyBlockSignature checks that sig signs its block by the members of el,
+// with exceptions that are distinct members of el and at most a third.
+func verifyBlockSignature(suite abstract.Suite, el *sda.EntityList, sig *BlockSignature) error {
 	if sig == nil || sig.Sig == nil || sig.Block == nil {
 		return errors.New("Empty block signature")
 	}
+	if err := CheckExceptions(el, sig.Exceptions); err != nil {
+		return err
+	}
 	marshalled := sig.Block.HashSum()
-	return cosi.VerifySignatureWithException(suite, aggregate, marshalled, sig.Sig.Challenge, sig.Sig.Response, sig.Exceptions)
+	return cosi.VerifySignatureWithException(suite, el.Aggregate, marshalled, sig.Sig.Challenge, sig.Sig.Response, sig.Exceptions)
 }
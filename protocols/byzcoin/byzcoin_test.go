@@ -0,0 +1,904 @@
+package byzcoin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dedis/cothority/lib/cosi"
+	"github.com/dedis/cothority/lib/dbg"
+	"github.com/dedis/cothority/lib/monitor"
+	"github.com/dedis/cothority/lib/network"
+	"github.com/dedis/cothority/lib/sda"
+	"github.com/dedis/cothority/protocols/byzcoin/blockchain"
+	"github.com/dedis/cothority/protocols/byzcoin/blockchain/blkparser"
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/random"
+)
+
+func TestByzCoin(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	startMonitor(t)
+	defer monitor.EndAndCleanup()
+
+	for _, fail := range []uint{0, 1, 2} {
+		dbg.Lvl2("Running ByzCoin with root failing in mode", fail)
+		local := sda.NewLocalTest()
+		hosts, _, tree := local.GenTree(5, true, true, true)
+		runByzCoin(t, local, hosts, tree, fail)
+		local.CloseAll()
+	}
+}
+
+func TestChain(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	local := sda.NewLocalTest()
+	hosts, el, tree := local.GenTree(5, true, true, true)
+	defer local.CloseAll()
+	first := runByzCoin(t, local, hosts, tree, 0)
+	second := runByzCoin(t, local, hosts, tree, 0)
+	if second.Block.Parent != first.Block.HeaderHash {
+		t.Fatal("Second block doesn't point to the first")
+	}
+	for _, h := range hosts {
+		if chainOf(h).Height() != 2 {
+			t.Fatal(h.Entity, "has", chainOf(h).Height(), "blocks")
+		}
+	}
+
+	// any host serves the blocks
+	sig, err := FetchBlock(el.Suite(), hosts[4].Entity, &BlockRequest{Height: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig.Block.HeaderHash != second.Block.HeaderHash {
+		t.Fatal("Got wrong block at height 1")
+	}
+	if err := verifyBlockSignature(el.Suite(), el, sig); err != nil {
+		t.Fatal(err)
+	}
+	sig, err = FetchBlock(el.Suite(), hosts[2].Entity, &BlockRequest{Hash: first.Block.HeaderHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig.Block.Parent != "" {
+		t.Fatal("Got wrong block for hash")
+	}
+	if _, err := FetchBlock(el.Suite(), hosts[2].Entity, &BlockRequest{Height: 2}); err == nil {
+		t.Fatal("Got a block above the chain")
+	}
+}
+
+// TestOpenChain keeps the chains in files and checks that they survive the
+// hosts.
+func TestOpenChain(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	dir, err := ioutil.TempDir("", "byzcoin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	local := sda.NewLocalTest()
+	hosts, el, tree := local.GenTree(3, true, true, true)
+	for i, h := range hosts {
+		if err := OpenChain(h, filepath.Join(dir, strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sig := runByzCoin(t, local, hosts, tree, 0)
+	local.CloseAll()
+
+	store, err := blockchain.OpenStore(el.Suite(), filepath.Join(dir, "2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if sb, err := store.ByHeight(0); err != nil || sb.Block.HeaderHash != sig.Block.HeaderHash {
+		t.Fatal("Block should be in the file of the chain:", err)
+	}
+}
+
+func TestTransactionValidation(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+	startMonitor(t)
+	defer monitor.EndAndCleanup()
+
+	local := sda.NewLocalTest()
+	hosts, el, tree := local.GenTree(5, true, true, true)
+	defer local.CloseAll()
+	// the root doesn't check transactions
+	for _, h := range hosts[1:] {
+		RegisterUTXOSet(h, blockchain.NewUTXOSet(el.Suite()))
+	}
+	mint := blkparser.Tx{
+		TxOuts: []*blkparser.TxOut{{Value: 10, Pkscript: []byte{}}},
+	}
+	mint.Hash = blockchain.TxId(&mint)
+	runTransactions(t, local, hosts, tree, 0, []blkparser.Tx{mint}, 0)
+	coin := blockchain.Outpoint{Hash: mint.Hash}
+	for _, h := range hosts[1:] {
+		if UTXOSetOf(h).Output(coin) == nil {
+			t.Fatal(h.Entity, "didn't apply the block")
+		}
+	}
+
+	// the witnesses refuse the double spend and the next leader drops it.
+	// Anybody can spend outputs with an empty script.
+	pay := blkparser.Tx{
+		TxIns:  []*blkparser.TxIn{{InputHash: coin.Hash, ScriptSig: []byte{}}},
+		TxOuts: []*blkparser.TxOut{{Value: 10, Pkscript: []byte{}}},
+	}
+	pay.Hash = blockchain.TxId(&pay)
+	double := pay
+	double.TxOuts = []*blkparser.TxOut{{Value: 9, Pkscript: []byte{}}}
+	double.Hash = blockchain.TxId(&double)
+	sig := runTransactions(t, local, hosts, tree, 0, []blkparser.Tx{pay, double}, 1)
+	if len(sig.Block.Txs) != 1 || sig.Block.Txs[0].Hash != pay.Hash {
+		t.Fatal("Signed block with wrong transactions")
+	}
+	if UTXOSetOf(hosts[2]).Output(coin) != nil {
+		t.Fatal("Spent coin is still there")
+	}
+}
+
+func TestKeyBlock(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	local := sda.NewLocalTest()
+	hosts, el, tree := local.GenTree(5, true, true, true)
+	defer local.CloseAll()
+	runByzCoin(t, local, hosts, tree, 0)
+
+	miner := hosts[2]
+	kb, err := MineKeyBlock(miner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := PublishKeyBlock(miner, el, kb); err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range hosts {
+		for i := 0; chainOf(h).KeyHeight() == 0; i++ {
+			if i == 100 {
+				t.Fatal(h.Entity, "didn't append the key block")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// the miner leads the next microblocks
+	group, err := ConsensusGroup(el, chainOf(miner), len(el.List))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(group.List) != len(el.List) || !group.List[0].Equal(miner.Entity) {
+		t.Fatal("Miner doesn't lead the consensus group")
+	}
+	tree = group.GenerateBigNaryTree(2, len(group.List))
+	miner.AddEntityList(group)
+	miner.AddTree(tree)
+	sig := runByzCoin(t, local, hosts, tree, 0)
+	if sig.Block.ParentKey != kb.HeaderHash {
+		t.Fatal("Microblock doesn't point to the key block")
+	}
+
+	// only the miners of the window are left
+	group, err = ConsensusGroup(el, chainOf(miner), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(group.List) != 1 || !group.List[0].Equal(miner.Entity) {
+		t.Fatal("Wrong consensus group for a window of 1")
+	}
+}
+
+func TestKeyBlockRefused(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	local := sda.NewLocalTest()
+	hosts, el, _ := local.GenTree(5, true, true, true)
+	defer local.CloseAll()
+
+	// a key block signed by somebody else than the miner is not announced
+	miner := hosts[1]
+	kb, err := MineKeyBlock(miner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kb.Sign(miner.Suite(), hosts[0].Private()); err != nil {
+		t.Fatal(err)
+	}
+	if PublishKeyBlock(miner, el, kb) == nil {
+		t.Fatal("Published a key block with a wrong signature")
+	}
+
+	// the others don't know the parent of the key block and refuse it
+	if err := chainOf(miner).AppendKey(blockchain.NewLeaderKeyBlock("", nil, "other")); err != nil {
+		t.Fatal(err)
+	}
+	kb, err = MineKeyBlock(miner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if PublishKeyBlock(miner, el, kb) == nil {
+		t.Fatal("Published a key block the consensus group refused")
+	}
+	if time.Since(start) >= KeyBlockTimeout {
+		t.Fatal("Miner waited for the timeout instead of the refusals")
+	}
+	if chainOf(miner).KeyHeight() != 1 {
+		t.Fatal("Miner appended the refused key block")
+	}
+	for _, h := range hosts {
+		if h != miner && chainOf(h).KeyHeight() != 0 {
+			t.Fatal(h.Entity, "appended a key block")
+		}
+	}
+}
+
+func TestSubmitTransaction(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	local := sda.NewLocalTest()
+	hosts, el, tree := local.GenTree(5, true, true, true)
+	defer local.CloseAll()
+	servers := make([]*ByzCoinServer, len(hosts))
+	for i, h := range hosts {
+		servers[i] = NewByzCoinServer(2, 500, 0)
+		servers[i].ListenClientTransactions(h, el)
+	}
+
+	// the first transaction is forwarded to the leader, the second is sent
+	// twice
+	txs := fakeTransactions(2)
+	submitters := []int{3, 0, 4}
+	replies := make(chan string, len(submitters))
+	for i, s := range submitters {
+		go func(tx blkparser.Tx, server *sda.Host) {
+			block, err := SubmitTransaction(el.Suite(), server.Entity, tx, 10*time.Second)
+			if err != nil {
+				dbg.Error(err)
+			}
+			replies <- block
+		}(txs[i%2], hosts[s])
+	}
+
+	node, err := local.NewNodeEmptyName("ByzCoin", tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi, err := servers[0].Instantiate(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bz := pi.(*ByzCoin)
+	if len(bz.tempBlock.Txs) != 2 {
+		t.Fatal("Block should hold both transactions")
+	}
+	hash := bz.tempBlock.HeaderHash
+	done := make(chan bool, 1)
+	bz.RegisterOnDone(func() {
+		done <- true
+	})
+	go bz.Start()
+	<-done
+	for range submitters {
+		select {
+		case block := <-replies:
+			if block != hash {
+				t.Fatal("Client got wrong block", block)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Client didn't get an acknowledgement")
+		}
+	}
+	for _, h := range hosts {
+		for i := 0; chainOf(h).Height() == 0; i++ {
+			if i == 100 {
+				t.Fatal(h.Entity, "didn't commit the block")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestSubmitTransactionRefused(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	local := sda.NewLocalTest()
+	hosts, el, tree := local.GenTree(5, true, true, true)
+	defer local.CloseAll()
+	server := NewByzCoinServer(2, 500, 0)
+	server.ListenClientTransactions(hosts[0], el)
+	RegisterUTXOSet(hosts[0], blockchain.NewUTXOSet(el.Suite()))
+
+	// the second transaction spends an unknown output
+	mint := blkparser.Tx{TxOuts: []*blkparser.TxOut{{Value: 10, Pkscript: []byte{}}}}
+	mint.Hash = blockchain.TxId(&mint)
+	spend := blkparser.Tx{
+		TxIns:  []*blkparser.TxIn{{InputHash: txHash("unknown"), ScriptSig: []byte{}}},
+		TxOuts: []*blkparser.TxOut{{Value: 10, Pkscript: []byte{}}},
+	}
+	spend.Hash = blockchain.TxId(&spend)
+	errs := make(chan error, 2)
+	for _, tx := range []blkparser.Tx{mint, spend} {
+		go func(tx blkparser.Tx) {
+			_, err := SubmitTransaction(el.Suite(), hosts[0].Entity, tx, 10*time.Second)
+			errs <- err
+		}(tx)
+	}
+
+	node, err := local.NewNodeEmptyName("ByzCoin", tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi, err := server.Instantiate(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bz := pi.(*ByzCoin)
+	if len(bz.tempBlock.Txs) != 1 || bz.tempBlock.Txs[0].Hash != mint.Hash {
+		t.Fatal("Block should hold only the valid transaction")
+	}
+	go bz.Start()
+	refused := 0
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err != nil {
+				refused++
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Client didn't get an acknowledgement")
+		}
+	}
+	if refused != 1 {
+		t.Fatal("Expected one refused transaction, got", refused)
+	}
+	server.pendingLock.Lock()
+	defer server.pendingLock.Unlock()
+	if len(server.pending) != 0 {
+		t.Fatal("Server still waits to acknowledge transactions")
+	}
+}
+
+func TestSubmitTimeout(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	local := sda.NewLocalTest()
+	hosts, el, _ := local.GenTree(2, true, true, true)
+	defer local.CloseAll()
+	NewByzCoinServer(2, 500, 0).ListenClientTransactions(hosts[0], el)
+
+	// the block never fills up
+	tx := fakeTransactions(1)[0]
+	if _, err := SubmitTransaction(el.Suite(), hosts[0].Entity, tx, 100*time.Millisecond); err == nil {
+		t.Fatal("Submission didn't time out")
+	}
+}
+
+// TestForwardedAck checks that the acknowledgement of a forwarded
+// transaction is only taken from the leader it was forwarded to.
+func TestForwardedAck(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	local := sda.NewLocalTest()
+	hosts, el, _ := local.GenTree(3, true, true, true)
+	defer local.CloseAll()
+	server := NewByzCoinServer(2, 500, 0)
+	server.ListenClientTransactions(hosts[1], el)
+
+	tx := fakeTransactions(1)[0]
+	replies := make(chan string, 1)
+	go func() {
+		block, err := SubmitTransaction(el.Suite(), hosts[1].Entity, tx, 5*time.Second)
+		if err != nil {
+			dbg.Error(err)
+		}
+		replies <- block
+	}()
+	for i := 0; ; i++ {
+		server.pendingLock.Lock()
+		p := server.pending[tx.Hash]
+		forwarded := p != nil && p.forwardedTo != nil
+		server.pendingLock.Unlock()
+		if forwarded {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Transaction hasn't been forwarded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := hosts[2].SendRaw(hosts[1].Entity, &TransactionAck{Hash: tx.Hash, Block: "forged"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case block := <-replies:
+		t.Fatal("Client got an acknowledgement from another conode:", block)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if err := hosts[0].SendRaw(hosts[1].Entity, &TransactionAck{Hash: tx.Hash, Block: "signed"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case block := <-replies:
+		if block != "signed" {
+			t.Fatal("Client got wrong block", block)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client didn't get the acknowledgement of the leader")
+	}
+}
+
+// TestPendingLimit checks that a server refuses transactions while as many
+// transactions as the mempool holds wait for their acknowledgement, and
+// that the expired ones are dropped.
+func TestPendingLimit(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	local := sda.NewLocalTest()
+	hosts, el, _ := local.GenTree(2, true, true, true)
+	defer local.CloseAll()
+	server := NewByzCoinServer(1, 500, 0)
+	server.ListenClientTransactions(hosts[0], el)
+
+	server.pendingLock.Lock()
+	for i := 0; i < MempoolBlocks; i++ {
+		server.pending[txHash(strconv.Itoa(i))] = &pendingTx{expires: time.Now().Add(time.Hour)}
+	}
+	server.pendingLock.Unlock()
+	tx := fakeTransactions(1)[0]
+	if _, err := SubmitTransaction(el.Suite(), hosts[0].Entity, tx, 5*time.Second); err == nil {
+		t.Fatal("Accepted a transaction with too many pending ones")
+	}
+
+	server.pendingLock.Lock()
+	for _, p := range server.pending {
+		p.expires = time.Now()
+	}
+	server.pendingLock.Unlock()
+	// the block never fills up
+	if _, err := SubmitTransaction(el.Suite(), hosts[0].Entity, tx, 100*time.Millisecond); err == nil {
+		t.Fatal("Submission didn't time out")
+	}
+	server.pendingLock.Lock()
+	defer server.pendingLock.Unlock()
+	if len(server.pending) != 1 || server.pending[tx.Hash] == nil {
+		t.Fatal("Expired transactions should be dropped, got", len(server.pending))
+	}
+}
+
+func TestClientSimulationConfig(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	local := sda.NewLocalTest()
+	hosts, el, tree := local.GenTree(2, true, true, true)
+	defer local.CloseAll()
+	RegisterUTXOSet(hosts[0], blockchain.NewUTXOSet(el.Suite()))
+
+	// every round gets new transactions
+	server := NewByzCoinServer(20, 500, 0)
+	config := &blockchain.TxConfig{Synthetic: true, ConflictRate: 0.5, Seed: 1}
+	for round := 0; round < 2; round++ {
+		if err := NewClient(server).StartClientSimulationConfig(config, round, 20); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(server.pool.txs) != 40 {
+		t.Fatal("Rounds got the same transactions")
+	}
+
+	// the conflicting transactions are dropped
+	node, err := local.NewNodeEmptyName("ByzCoin", tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi, err := server.Instantiate(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(pi.(*ByzCoin).tempBlock.Txs); n == 20 || n == 0 {
+		t.Fatal("Wrong number of valid transactions:", n)
+	}
+}
+
+func TestMempool(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	pool := newMempool(2)
+	txs := fakeTransactions(3)
+	if err := pool.add(txs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if pool.add(txs[0]) == nil {
+		t.Fatal("Added a transaction twice")
+	}
+	if err := pool.add(txs[1]); err != nil {
+		t.Fatal(err)
+	}
+	if pool.add(txs[2]) == nil {
+		t.Fatal("Added a transaction to a full mempool")
+	}
+	if taken := pool.take(1); taken[0].Hash != txs[0].Hash {
+		t.Fatal("Took the wrong transaction")
+	}
+	if err := pool.add(txs[0]); err != nil {
+		t.Fatal("Couldn't add a transaction taken out:", err)
+	}
+}
+
+func TestCompactBlock(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	local := sda.NewLocalTest()
+	hosts, _, tree := local.GenTree(5, true, true, true)
+	defer local.CloseAll()
+	txs := blockchain.NewGenerator(&blockchain.TxConfig{TxSize: 200}).Generate(10)
+	// hosts[2] knows all transactions and hosts[1] half of them, the
+	// others fetch them from their parent
+	AddKnownTransactions(hosts[2], txs...)
+	AddKnownTransactions(hosts[1], txs[:5]...)
+
+	server := NewByzCoinServer(len(txs), 500, 0)
+	server.Compact = true
+	for _, tx := range txs {
+		server.AddTransaction(tx)
+	}
+	node, err := local.NewNodeEmptyName("ByzCoin", tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi, err := server.Instantiate(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bz := pi.(*ByzCoin)
+	done := make(chan bool, 1)
+	bz.RegisterOnDone(func() {
+		done <- true
+	})
+	go bz.Start()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Compact block wasn't signed")
+	}
+
+	for _, h := range hosts {
+		for i := 0; chainOf(h).Height() == 0; i++ {
+			if i == 100 {
+				t.Fatal(h.Entity, "didn't commit the block")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		sb, _ := chainOf(h).ByHeight(0)
+		if !reflect.DeepEqual(sb.Block.Txs, txs) {
+			t.Fatal(h.Entity, "didn't complete the compact block")
+		}
+		if _, ok := knownTransaction(h, txs[9].Hash); !ok && h != hosts[0] {
+			t.Fatal(h.Entity, "didn't remember the transactions")
+		}
+	}
+}
+
+func TestCompactBlockMissingTransactions(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	local := sda.NewLocalTest()
+	_, _, tree := local.GenTree(1, true, true, true)
+	defer local.CloseAll()
+	node, err := local.NewNodeEmptyName("ByzCoin", tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bz, err := NewByzCoinProtocol(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.SetProtocolInstance(bz)
+	defer bz.Done()
+	bz.prepare.Commit(nil)
+	bz.commit.Commit(nil)
+	txs := blockchain.NewGenerator(&blockchain.TxConfig{TxSize: 200}).Generate(2)
+	block, err := getBlock(txs, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := bz.prepare.CreateChallenge(bz.aggregatedPublic, block.HashSum())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the parent sends only one of the missing transactions: we refuse
+	// the block instead of waiting for the other one
+	bz.pendingChallenge = &ByzCoinChallengePrepare{TYPE: ROUND_PREPARE, Challenge: ch, Compact: true}
+	bz.pendingBlock = compactBlock(block)
+	bz.fillCompactBlock(bz.pendingBlock)
+	if len(bz.missingTxs) != 2 {
+		t.Fatal("Expected 2 missing transactions, got", len(bz.missingTxs))
+	}
+	if err := bz.handleTransactionReply(&TransactionReply{Txs: txs[:1]}); err != nil {
+		t.Fatal(err)
+	}
+	if len(bz.exceptions(ROUND_PREPARE)) != 1 {
+		t.Fatal("Didn't refuse the incomplete block")
+	}
+	if _, ok := knownTransaction(node.Host(), txs[0].Hash); ok {
+		t.Fatal("Remembered the transactions of a refused block")
+	}
+}
+
+func TestFaults(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	for _, test := range []struct {
+		n      int
+		faults Faults
+	}{
+		{10, Faults{Crashed: 1, CrashDepth: 2, Refusing: 1, Delayed: 1, DelayMs: 50}},
+		{5, Faults{Equivocate: true}},
+	} {
+		dbg.Lvl2("Running ByzCoin with faults", test.faults)
+		local := sda.NewLocalTest()
+		hosts, _, tree := local.GenTree(test.n, true, true, true)
+		runFaults(t, local, hosts, tree, test.faults)
+		local.CloseAll()
+	}
+}
+
+func TestRotateEntityList(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	local := sda.NewLocalTest()
+	_, el, _ := local.GenTree(4, false, false, false)
+	defer local.CloseAll()
+	rot, err := rotateEntityList(el, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range el.List {
+		if !rot.List[i].Equal(el.List[(i+1)%4]) {
+			t.Fatal("Wrong entity at position", i)
+		}
+	}
+	if !rot.Aggregate.Equal(el.Aggregate) {
+		t.Fatal("Rotation changed the aggregate key")
+	}
+}
+
+func TestCheckExceptions(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	local := sda.NewLocalTest()
+	_, el, _ := local.GenTree(7, false, false, false)
+	defer local.CloseAll()
+	suite := el.Suite()
+	exception := func(public abstract.Point) cosi.Exception {
+		return cosi.Exception{Public: public, Commitment: suite.Point().Null()}
+	}
+	ok := []cosi.Exception{exception(el.List[1].Public), exception(el.List[2].Public)}
+	if err := CheckExceptions(el, ok); err != nil {
+		t.Fatal("Refused valid exceptions:", err)
+	}
+	outsider, _ := suite.Point().Pick(nil, random.Stream)
+	for i, exs := range [][]cosi.Exception{
+		// twice the same witness
+		{exception(el.List[1].Public), exception(el.List[1].Public)},
+		// somebody outside of the EntityList
+		{exception(outsider)},
+		// more than a third
+		{exception(el.List[1].Public), exception(el.List[2].Public),
+			exception(el.List[3].Public), exception(el.List[4].Public)},
+	} {
+		if CheckExceptions(el, exs) == nil {
+			t.Fatal("Accepted wrong exceptions", i)
+		}
+	}
+}
+
+// runByzCoin signs a block on the hosts of tree with the root failing in
+// mode fail, and checks that the next leader signed it if the root failed.
+func runByzCoin(t *testing.T, local *sda.LocalTest, hosts []*sda.Host, tree *sda.Tree, fail uint) *BlockSignature {
+	view := uint32(0)
+	if fail != 0 {
+		view = 1
+	}
+	return runTransactions(t, local, hosts, tree, fail, fakeTransactions(10), view)
+}
+
+// runTransactions signs a block of txs on the hosts of tree with the root
+// failing in mode fail, and checks the signature. The view of the root
+// shows which leader signed the block. It waits for all hosts to commit the
+// block.
+func runTransactions(t *testing.T, local *sda.LocalTest, hosts []*sda.Host, tree *sda.Tree, fail uint, txs []blkparser.Tx, view uint32) *BlockSignature {
+	node, err := local.NewNodeEmptyName("ByzCoin", tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bz, err := NewByzCoinRootProtocol(node, txs, 500, fail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.SetProtocolInstance(bz)
+	sigChan := make(chan *BlockSignature, 1)
+	bz.RegisterOnSignatureDone(func(sig *BlockSignature) {
+		sigChan <- sig
+	})
+	done := make(chan bool, 1)
+	bz.RegisterOnDone(func() {
+		done <- true
+	})
+	height := chainOf(hosts[0]).Height()
+	go bz.Start()
+
+	var sig *BlockSignature
+	select {
+	case sig = <-sigChan:
+		if err := verifyBlockSignature(node.Suite(), tree.EntityList, sig); err != nil {
+			t.Fatal("Wrong signature in mode", fail, ":", err)
+		}
+		if sig.Block.Header.Parent != bz.lastBlock {
+			t.Fatal("Signed a wrong block in mode", fail)
+		}
+		if len(sig.Exceptions) > 0 {
+			t.Fatal("Got exceptions in mode", fail)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No signature in mode", fail)
+	}
+	<-done
+	if bz.view != view {
+		t.Fatal("Expected view", view, "got", bz.view)
+	}
+	for _, h := range hosts {
+		for i := 0; chainOf(h).Height() == height; i++ {
+			if i == 100 {
+				t.Fatal(h.Entity, "didn't commit the block")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return sig
+}
+
+// runFaults signs a block on the hosts of tree with faults, and checks that
+// the crashed and refusing witnesses and those getting another block from
+// the equivocating root are exceptions. It waits for the hosts that are not
+// cut off by a crash to commit the block.
+func runFaults(t *testing.T, local *sda.LocalTest, hosts []*sda.Host, tree *sda.Tree, faults Faults) {
+	txs := fakeTransactions(10)
+	server := NewByzCoinServer(len(txs), 0, 0)
+	server.ChildTimeoutMs = 200
+	plan, err := faults.Plan(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range hosts {
+		RegisterFaults(h, plan)
+	}
+	for _, tx := range txs {
+		server.AddTransaction(tx)
+	}
+	node, err := local.NewNodeEmptyName("ByzCoin", tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi, err := server.Instantiate(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bz := pi.(*ByzCoin)
+	sigChan := make(chan *BlockSignature, 1)
+	bz.RegisterOnSignatureDone(func(sig *BlockSignature) {
+		sigChan <- sig
+	})
+	go bz.Start()
+
+	var sig *BlockSignature
+	select {
+	case sig = <-sigChan:
+		if err := verifyBlockSignature(node.Suite(), tree.EntityList, sig); err != nil {
+			t.Fatal("Wrong signature with faults", faults, ":", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No signature with faults", faults)
+	}
+
+	cut := make(map[string]bool)
+	exceptions := 0
+	tree.Root.Visit(0, func(d int, tn *sda.TreeNode) {
+		fault := plan.FaultOf(tn.Entity)
+		if fault == FaultCrashed || tn.Parent != nil && cut[string(tn.Parent.Id)] {
+			cut[string(tn.Id)] = true
+		}
+		if cut[string(tn.Id)] || fault == FaultRefusing || plan.Equivocated(tn) {
+			exceptions++
+		}
+	})
+	if len(sig.Exceptions) != exceptions {
+		t.Fatal("Expected", exceptions, "exceptions, got", len(sig.Exceptions))
+	}
+	for _, tn := range tree.ListNodes() {
+		if cut[string(tn.Id)] {
+			continue
+		}
+		h := hostOf(hosts, tn.Entity)
+		for i := 0; chainOf(h).Height() == 0; i++ {
+			if i == 100 {
+				t.Fatal(h.Entity, "didn't commit the block")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// hostOf returns the host of e
+func hostOf(hosts []*sda.Host, e *network.Entity) *sda.Host {
+	for _, h := range hosts {
+		if h.Entity.Equal(e) {
+			return h
+		}
+	}
+	return nil
+}
+
+// fakeTransactions returns n transactions with distinct hashes
+func fakeTransactions(n int) []blkparser.Tx {
+	txs := make([]blkparser.Tx, n)
+	for i := range txs {
+		txs[i] = blkparser.Tx{TxOuts: []*blkparser.TxOut{{Value: uint64(i), Pkscript: []byte{}}}}
+		txs[i].Hash = blockchain.TxId(&txs[i])
+	}
+	return txs
+}
+
+// txHash returns the hex-encoded hash of name
+func txHash(name string) string {
+	h := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(h[:])
+}
+
+// startMonitor starts a monitor and connects to it, so that the view
+// changes can be measured.
+func startMonitor(t *testing.T) {
+	mon := monitor.NewMonitor(monitor.NewStats(map[string]string{
+		"servers": "1",
+		"hosts":   "1",
+	}))
+	go mon.Listen()
+	time.Sleep(100 * time.Millisecond)
+	err := monitor.ConnectSink("localhost:" + strconv.Itoa(monitor.DefaultSinkPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,261 @@
+package byzcoin
+
+import (
+	"errors"
+
+	"github.com/dedis/cothority/lib/crypto"
+	"github.com/dedis/cothority/lib/dbg"
+	"github.com/dedis/cothority/lib/network"
+	"github.com/dedis/cothority/lib/sda"
+	"github.com/dedis/cothority/protocols/byzcoin/blockchain"
+	"github.com/dedis/crypto/abstract"
+)
+
+func init() {
+	network.RegisterMessageType(BlockRequest{})
+	network.RegisterMessageType(BlockSignature{})
+	network.RegisterMessageType(BlockError{})
+	network.RegisterMessageType(StatusRequest{})
+	network.RegisterMessageType(ChainStatus{})
+	network.RegisterMessageType(ProofRequest{})
+	network.RegisterMessageType(TransactionProof{})
+}
+
+// BlockRequest asks a host for a block of its chain, by Hash if it is
+// given, else by Height.
+type BlockRequest struct {
+	Hash   string
+	Height int64
+	// Key asks for a key block instead of a block
+	Key bool
+	// HashesOnly strips the transactions of the block down to their hash,
+	// which is all its signature covers
+	HashesOnly bool
+}
+
+// StatusRequest asks a host for the ChainStatus of its chain.
+type StatusRequest struct{}
+
+// ChainStatus holds the number of blocks and key blocks of a chain.
+type ChainStatus struct {
+	Height    int64
+	KeyHeight int64
+}
+
+// ProofRequest asks a host for the Merkle proof of the transaction Tx in
+// the block Block.
+type ProofRequest struct {
+	Block string
+	Tx    string
+}
+
+// TransactionProof links a transaction to the MerkleRoot of its block.
+type TransactionProof struct {
+	Proof [][]byte
+}
+
+// BlockError is sent instead of the BlockSignature if the block is unknown.
+type BlockError struct {
+	Error string
+}
+
+// chainKey and utxoKey store the chain and the UTXO set of a host with
+// sda.Host.SetValue, so that they are dropped when the host closes.
+const (
+	chainKey = "byzcoin.chain"
+	utxoKey  = "byzcoin.utxo"
+)
+
+// RegisterChain makes host append the blocks it signs to store, and serve
+// them to BlockRequests. Hosts without a registered chain keep it in memory.
+// The store is closed together with host.
+func RegisterChain(host *sda.Host, store *blockchain.Store) {
+	host.SetValue(chainKey, store)
+	registerChainHandlers(host, store)
+}
+
+// OpenChain makes host keep its chain in filename, reading the blocks
+// already in there, see RegisterChain.
+func OpenChain(host *sda.Host, filename string) error {
+	store, err := blockchain.OpenStore(host.Suite(), filename)
+	if err != nil {
+		return err
+	}
+	RegisterChain(host, store)
+	return nil
+}
+
+// registerChainHandlers answers the requests for the blocks of store
+func registerChainHandlers(host *sda.Host, store *blockchain.Store) {
+	host.RegisterNetworkHandler(network.TypeFromData(BlockRequest{}), func(msg *network.NetworkMessage) {
+		reply, err := findBlock(store, msg.Msg.(BlockRequest))
+		sendReply(host, msg.Entity, reply, err)
+	})
+	host.RegisterNetworkHandler(network.TypeFromData(StatusRequest{}), func(msg *network.NetworkMessage) {
+		reply := &ChainStatus{
+			Height:    int64(store.Height()),
+			KeyHeight: int64(store.KeyHeight()),
+		}
+		sendReply(host, msg.Entity, reply, nil)
+	})
+	host.RegisterNetworkHandler(network.TypeFromData(ProofRequest{}), func(msg *network.NetworkMessage) {
+		reply, err := findProof(store, msg.Msg.(ProofRequest))
+		sendReply(host, msg.Entity, reply, err)
+	})
+}
+
+// sendReply sends reply to e, or a BlockError if err is not nil
+func sendReply(host *sda.Host, e *network.Entity, reply network.ProtocolMessage, err error) {
+	if err != nil {
+		reply = &BlockError{Error: err.Error()}
+	}
+	if err := host.SendRaw(e, reply); err != nil {
+		dbg.Error("Couldn't send reply:", err)
+	}
+}
+
+// chainOf returns the chain of host, registering an in-memory one if needed.
+func chainOf(host *sda.Host) *blockchain.Store {
+	created := false
+	store := host.Value(chainKey, func() interface{} {
+		created = true
+		return blockchain.NewStore(host.Suite())
+	}).(*blockchain.Store)
+	if created {
+		registerChainHandlers(host, store)
+	}
+	return store
+}
+
+// RegisterUTXOSet makes host refuse to sign blocks with transactions that
+// set doesn't accept, and apply the blocks it commits to set. Hosts without
+// a set, like in the simulations replaying Bitcoin blocks, don't check
+// transactions.
+func RegisterUTXOSet(host *sda.Host, set *blockchain.UTXOSet) {
+	host.SetValue(utxoKey, set)
+}
+
+// UTXOSetOf returns the UTXO set of host, or nil if it has none.
+func UTXOSetOf(host *sda.Host) *blockchain.UTXOSet {
+	set, _ := host.Value(utxoKey, nil).(*blockchain.UTXOSet)
+	return set
+}
+
+func findBlock(store *blockchain.Store, req BlockRequest) (network.ProtocolMessage, error) {
+	if req.Key {
+		if req.Hash != "" {
+			return store.KeyByHash(req.Hash)
+		}
+		return store.KeyByHeight(int(req.Height))
+	}
+	var sb *blockchain.SignedBlock
+	var err error
+	if req.Hash != "" {
+		sb, err = store.ByHash(req.Hash)
+	} else {
+		sb, err = store.ByHeight(int(req.Height))
+	}
+	if err != nil {
+		return nil, err
+	}
+	block := sb.Block
+	if req.HashesOnly {
+		block = compactBlock(block)
+	}
+	return &BlockSignature{
+		Sig:        sb.Signature,
+		Block:      block,
+		Exceptions: sb.Exceptions,
+	}, nil
+}
+
+func findProof(store *blockchain.Store, req ProofRequest) (*TransactionProof, error) {
+	sb, err := store.ByHash(req.Block)
+	if err != nil {
+		return nil, err
+	}
+	proof, err := blockchain.MerkleProof(sb.Block.TransactionList, req.Tx)
+	if err != nil {
+		return nil, err
+	}
+	reply := &TransactionProof{}
+	for _, h := range proof {
+		reply.Proof = append(reply.Proof, h)
+	}
+	return reply, nil
+}
+
+// FetchBlock asks server for a block of its chain. The signature of the
+// block is not verified.
+func FetchBlock(suite abstract.Suite, server *network.Entity, req *BlockRequest) (*BlockSignature, error) {
+	if req.Key {
+		return nil, errors.New("Use FetchKeyBlock for key blocks")
+	}
+	reply, err := request(suite, server, req)
+	if err != nil {
+		return nil, err
+	}
+	sig, ok := reply.(BlockSignature)
+	if !ok {
+		return nil, errors.New("Unexpected reply from server")
+	}
+	return &sig, nil
+}
+
+// FetchKeyBlock asks server for the key block at height of its chain. The
+// key block is not verified.
+func FetchKeyBlock(suite abstract.Suite, server *network.Entity, height int) (*blockchain.KeyBlock, error) {
+	reply, err := request(suite, server, &BlockRequest{Height: int64(height), Key: true})
+	if err != nil {
+		return nil, err
+	}
+	kb, ok := reply.(blockchain.KeyBlock)
+	if !ok {
+		return nil, errors.New("Unexpected reply from server")
+	}
+	return &kb, nil
+}
+
+// FetchStatus asks server for the status of its chain.
+func FetchStatus(suite abstract.Suite, server *network.Entity) (*ChainStatus, error) {
+	reply, err := request(suite, server, &StatusRequest{})
+	if err != nil {
+		return nil, err
+	}
+	status, ok := reply.(ChainStatus)
+	if !ok {
+		return nil, errors.New("Unexpected reply from server")
+	}
+	return &status, nil
+}
+
+// FetchProof asks server for the Merkle proof of the transaction tx in the
+// block with hash block. The proof is not verified.
+func FetchProof(suite abstract.Suite, server *network.Entity, block, tx string) (crypto.Proof, error) {
+	reply, err := request(suite, server, &ProofRequest{Block: block, Tx: tx})
+	if err != nil {
+		return nil, err
+	}
+	tp, ok := reply.(TransactionProof)
+	if !ok {
+		return nil, errors.New("Unexpected reply from server")
+	}
+	var proof crypto.Proof
+	for _, h := range tp.Proof {
+		proof = append(proof, h)
+	}
+	return proof, nil
+}
+
+// request sends req to server and returns its reply, or the error of a
+// BlockError.
+func request(suite abstract.Suite, server *network.Entity, req network.ProtocolMessage) (network.ProtocolMessage, error) {
+	msg, err := sda.Request(suite, server, req, 0)
+	if err != nil {
+		return nil, err
+	}
+	if reply, ok := msg.(BlockError); ok {
+		return nil, errors.New(reply.Error)
+	}
+	return msg, nil
+}
@@ -3,9 +3,14 @@ package byzcoin
 import (
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/dedis/cothority/lib/dbg"
+	"github.com/dedis/cothority/lib/network"
+	"github.com/dedis/cothority/lib/sda"
 	"github.com/dedis/cothority/protocols/byzcoin/blockchain"
+	"github.com/dedis/cothority/protocols/byzcoin/blockchain/blkparser"
+	"github.com/dedis/crypto/abstract"
 )
 
 var magicNum = [4]byte{0xF9, 0xBE, 0xB4, 0xD9}
@@ -34,33 +39,94 @@ func (c *Client) StartClientSimulation(blocksDir string, numTxs int) error {
 	return c.triggerTransactions(blocksDir, numTxs)
 }
 
+// StartClientSimulationConfig simulates a client sending numTxs
+// transactions for round, selected by config: generated ones if
+// config.Synthetic, else the ones of the Bitcoin blocks in GetBlockDir.
+// The seed of the generated transactions is derived from round, so that
+// every round gets new ones.
+func (c *Client) StartClientSimulationConfig(config *blockchain.TxConfig, round, numTxs int) error {
+	if !config.Synthetic {
+		return c.StartClientSimulation(blockchain.GetBlockDir(), numTxs)
+	}
+	dbg.Lvl1("ByzCoin Client will trigger", numTxs, "synthetic transactions")
+	txs, err := SimulatedTransactions(config, round, numTxs)
+	if err != nil {
+		return err
+	}
+	for _, tr := range txs {
+		c.srv.AddTransaction(tr)
+	}
+	return nil
+}
+
+// SimulatedTransactions returns the transactions StartClientSimulationConfig
+// sends for round, so that the other hosts of a simulation can know them.
+func SimulatedTransactions(config *blockchain.TxConfig, round, numTxs int) ([]blkparser.Tx, error) {
+	if !config.Synthetic {
+		return readTransactions(blockchain.GetBlockDir(), numTxs)
+	}
+	roundConfig := *config
+	roundConfig.Seed += int64(round)
+	return blockchain.NewGenerator(&roundConfig).Generate(numTxs), nil
+}
+
 func (c *Client) triggerTransactions(blocksPath string, nTxs int) error {
 	dbg.Lvl1("ByzCoin Client will trigger up to", nTxs, " transactions")
+	transactions, err := readTransactions(blocksPath, nTxs)
+	if err != nil {
+		return err
+	}
+	consumed := nTxs
+	for consumed > 0 {
+		for _, tr := range transactions {
+			// "send" transaction to server (we skip tcp connection on purpose here)
+			c.srv.AddTransaction(tr)
+		}
+		consumed--
+	}
+	return nil
+}
+
+// readTransactions returns the transactions of the first ReadFirstNBlocks
+// Bitcoin blocks in blocksPath, of which there must be at least nTxs.
+func readTransactions(blocksPath string, nTxs int) ([]blkparser.Tx, error) {
 	parser, err := blockchain.NewParser(blocksPath, magicNum)
 	if err != nil {
 		dbg.Error("Error: Couldn't parse blocks in", blocksPath,
 			".\nPlease download bitcoin blocks as .dat files first and place them in",
 			blocksPath, "Either run a bitcoin node (recommended) or using a torrent.")
-		return err
+		return nil, err
 	}
 
 	transactions, err := parser.Parse(0, ReadFirstNBlocks)
 	if err != nil {
-		return fmt.Errorf("Error while parsing transactions %v", err)
+		return nil, fmt.Errorf("Error while parsing transactions %v", err)
 	}
 	if len(transactions) == 0 {
-		return errors.New("Couldn't read any transactions.")
+		return nil, errors.New("Couldn't read any transactions.")
 	}
 	if len(transactions) < nTxs {
-		return fmt.Errorf("Read only %v but caller wanted %v", len(transactions), nTxs)
+		return nil, fmt.Errorf("Read only %v but caller wanted %v", len(transactions), nTxs)
 	}
-	consumed := nTxs
-	for consumed > 0 {
-		for _, tr := range transactions {
-			// "send" transaction to server (we skip tcp connection on purpose here)
-			c.srv.AddTransaction(tr)
-		}
-		consumed--
+	return transactions, nil
+}
+
+// SubmitTransaction sends tx to server, which forwards it to the leader,
+// and waits until tx is in a signed block. It returns the hash of the block,
+// or an error if tx has been refused or, if timeout is not 0, if the block
+// isn't signed in time.
+func SubmitTransaction(suite abstract.Suite, server *network.Entity, tx blkparser.Tx,
+	timeout time.Duration) (string, error) {
+	msg, err := sda.Request(suite, server, &TransactionSubmit{Tx: tx}, timeout)
+	if err != nil {
+		return "", err
 	}
-	return nil
+	ack, ok := msg.(TransactionAck)
+	if !ok {
+		return "", errors.New("Unexpected reply from server")
+	}
+	if ack.Error != "" {
+		return "", errors.New(ack.Error)
+	}
+	return ack.Block, nil
 }
@@ -0,0 +1,163 @@
+package byzcoin
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/dedis/cothority/lib/dbg"
+	"github.com/dedis/cothority/lib/sda"
+	"github.com/dedis/cothority/protocols/byzcoin/blockchain"
+	"github.com/dedis/cothority/protocols/byzcoin/blockchain/blkparser"
+)
+
+// MaxKnownTransactions is how many transactions a host remembers to rebuild
+// compact blocks.
+const MaxKnownTransactions = 100000
+
+// TransactionRequest asks the parent for the transactions of the proposed
+// block that a witness doesn't know.
+type TransactionRequest struct {
+	Hashes []string
+}
+
+// TransactionReply holds the transactions asked for by a
+// TransactionRequest.
+type TransactionReply struct {
+	Txs []blkparser.Tx
+}
+
+type transactionRequestChan struct {
+	*sda.TreeNode
+	TransactionRequest
+}
+
+type transactionReplyChan struct {
+	*sda.TreeNode
+	TransactionReply
+}
+
+// knownTxsKey stores the transactions a host has seen in its values
+const knownTxsKey = "byzcoin.knownTxs"
+
+// txCache holds the last MaxKnownTransactions transactions, by TxId
+type txCache struct {
+	sync.Mutex
+	txs   map[string]blkparser.Tx
+	order []string
+}
+
+// knownTxsOf returns the transactions host has seen.
+func knownTxsOf(host *sda.Host) *txCache {
+	return host.Value(knownTxsKey, func() interface{} {
+		return &txCache{txs: make(map[string]blkparser.Tx)}
+	}).(*txCache)
+}
+
+// AddKnownTransactions remembers txs on host, so that it doesn't have to
+// fetch them when they are in a compact block.
+func AddKnownTransactions(host *sda.Host, txs ...blkparser.Tx) {
+	c := knownTxsOf(host)
+	c.Lock()
+	defer c.Unlock()
+	for i := range txs {
+		id := blockchain.TxId(&txs[i])
+		if _, ok := c.txs[id]; ok {
+			continue
+		}
+		c.txs[id] = txs[i]
+		c.order = append(c.order, id)
+	}
+	for len(c.order) > MaxKnownTransactions {
+		delete(c.txs, c.order[0])
+		c.order = c.order[1:]
+	}
+}
+
+// knownTransaction returns the transaction with TxId id if host knows it.
+func knownTransaction(host *sda.Host, id string) (blkparser.Tx, bool) {
+	c := knownTxsOf(host)
+	c.Lock()
+	defer c.Unlock()
+	tx, ok := c.txs[id]
+	return tx, ok
+}
+
+// compactBlock returns a copy of block with the transactions stripped down
+// to their TxId, which keeps its HashSum.
+func compactBlock(block *blockchain.TrBlock) *blockchain.TrBlock {
+	compact := *block
+	compact.Txs = make([]blkparser.Tx, len(block.Txs))
+	for i := range block.Txs {
+		compact.Txs[i] = blkparser.Tx{Hash: blockchain.TxId(&block.Txs[i])}
+	}
+	return &compact
+}
+
+// fillCompactBlock puts the transactions known to the host in the compact
+// block and remembers which ones are missing. The transactions are looked
+// up by their TxId, which is the Hash of the stripped ones.
+func (bz *ByzCoin) fillCompactBlock(block *blockchain.TrBlock) {
+	bz.missingTxs = make(map[string][]int)
+	for i := range block.Txs {
+		if !blockchain.IsStripped(&block.Txs[i]) {
+			continue
+		}
+		id := block.Txs[i].Hash
+		if known, ok := knownTransaction(bz.Host(), id); ok {
+			block.Txs[i] = known
+		} else {
+			bz.missingTxs[id] = append(bz.missingTxs[id], i)
+		}
+	}
+}
+
+// handleTransactionRequest sends the asked transactions of the proposed
+// block to the child, leaving out the ones we are missing ourselves.
+func (bz *ByzCoin) handleTransactionRequest(tn *sda.TreeNode, req *TransactionRequest) error {
+	if bz.tempBlock == nil {
+		return errors.New("No block to take the transactions from")
+	}
+	byHash := make(map[string]blkparser.Tx)
+	for i, tx := range bz.tempBlock.Txs {
+		if !blockchain.IsStripped(&tx) {
+			byHash[blockchain.TxId(&bz.tempBlock.Txs[i])] = tx
+		}
+	}
+	reply := &TransactionReply{}
+	for _, h := range req.Hashes {
+		if tx, ok := byHash[h]; ok {
+			reply.Txs = append(reply.Txs, tx)
+		}
+	}
+	return bz.SendTo(tn, reply)
+}
+
+// handleTransactionReply completes the compact block with the transactions
+// of the parent, and goes on with the challenge. If the parent didn't send
+// all missing transactions, we refuse the block, which we can't verify.
+func (bz *ByzCoin) handleTransactionReply(reply *TransactionReply) error {
+	if bz.pendingChallenge == nil {
+		return errors.New("Got transactions without a compact block")
+	}
+	for i, tx := range reply.Txs {
+		if blockchain.IsStripped(&reply.Txs[i]) {
+			continue
+		}
+		id := blockchain.TxId(&reply.Txs[i])
+		for _, j := range bz.missingTxs[id] {
+			bz.pendingBlock.Txs[j] = tx
+		}
+		delete(bz.missingTxs, id)
+	}
+	ch, block := bz.pendingChallenge, bz.pendingBlock
+	bz.pendingChallenge, bz.pendingBlock = nil, nil
+	var refusal error
+	if len(bz.missingTxs) > 0 {
+		refusal = fmt.Errorf("Parent didn't send %d missing transactions", len(bz.missingTxs))
+	} else {
+		AddKnownTransactions(bz.Host(), block.Txs...)
+		dbg.Lvl3(bz.Name(), "Completed compact block with", len(reply.Txs), "transactions")
+	}
+	return bz.challengePrepare(ch, block, refusal)
+}
@@ -0,0 +1,308 @@
+package byzcoin
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/dedis/cothority/lib/cosi"
+	"github.com/dedis/cothority/lib/dbg"
+	"github.com/dedis/cothority/lib/sda"
+	pcosi "github.com/dedis/cothority/protocols/cosi"
+	"github.com/dedis/crypto/abstract"
+)
+
+// This file holds the exceptions of ByzCoin, which are collected in each
+// round and sent up the tree with the commitments, all with the null
+// commitment:
+//  - if a child doesn't send its commitment within the child timeout,
+//    every node of its subtree is an exception, and the child is left out
+//    of the rest of the round
+//  - a witness excluded from the attempt passes up its own exception, but
+//    still aggregates its children
+// A witness refusing to sign once its commitment is aggregated passes up a
+// refusal with its response. The root then restarts both rounds in a new
+// attempt that excludes the witnesses that refused, as an exception
+// holding a commitment couldn't be verified.
+// The root uses the exceptions of the "prepare" round in the challenge of
+// the "commit" round, and those of the "commit" round in the signature.
+
+// CheckExceptions returns an error if the exceptions are not distinct
+// members of el, or if they are more than a third of el.
+func CheckExceptions(el *sda.EntityList, exceptions []cosi.Exception) error {
+	threshold := int(math.Ceil(float64(len(el.List)) / 3.0))
+	if len(exceptions) > threshold {
+		return fmt.Errorf("More than 1/3 (%d/%d) refused to sign",
+			len(exceptions), len(el.List))
+	}
+	seen := make(map[int]bool)
+	for _, ex := range exceptions {
+		if ex.Public == nil {
+			return errors.New("Exception without public key")
+		}
+		i := -1
+		for j, e := range el.List {
+			if e.Public.Equal(ex.Public) {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			return errors.New("Exception from outside the EntityList")
+		}
+		if seen[i] {
+			return errors.New("Exception given twice")
+		}
+		seen[i] = true
+	}
+	return nil
+}
+
+// roundState collects what the children send in one round
+type roundState struct {
+	sync.Mutex
+	// commitments of the children in committed
+	commits   []*cosi.Commitment
+	committed []*sda.TreeNode
+	// closed is set once our commitment is sent, later ones are ignored
+	closed    bool
+	responses []*cosi.Response
+	// exceptions of our subtree, sent with the commitment
+	exceptions []cosi.Exception
+	// refusals of our subtree, sent with the response
+	refusals []abstract.Point
+	// timer of the child timeout
+	timer *time.Timer
+}
+
+// commitTimeout is the round of an attempt whose child timeout fired
+type commitTimeout struct {
+	rt      RoundType
+	attempt uint32
+}
+
+// hasCommitted returns whether tn sent its commitment
+func (r *roundState) hasCommitted(tn *sda.TreeNode) bool {
+	for _, c := range r.committed {
+		if c.Id.Equal(tn.Id) {
+			return true
+		}
+	}
+	return false
+}
+
+// participants returns the children that committed in round rt
+func (bz *ByzCoin) participants(rt RoundType) []*sda.TreeNode {
+	r := bz.rounds[rt]
+	r.Lock()
+	defer r.Unlock()
+	return r.committed
+}
+
+// exceptions returns the exceptions of our subtree in round rt
+func (bz *ByzCoin) exceptions(rt RoundType) []cosi.Exception {
+	r := bz.rounds[rt]
+	r.Lock()
+	defer r.Unlock()
+	return r.exceptions
+}
+
+// sendCommitment aggregates the commitments of the children that committed
+// in round rt and sends it up, together with the exceptions.
+func (bz *ByzCoin) sendCommitment(rt RoundType) error {
+	r := bz.rounds[rt]
+	r.Lock()
+	r.closed = true
+	commits, exceptions := r.commits, r.exceptions
+	r.Unlock()
+	c := bz.prepare
+	if rt == ROUND_COMMIT {
+		c = bz.commit
+	}
+	commit := c.Commit(commits)
+	bz.stopCommitTimer(rt)
+	if bz.IsRoot() {
+		if rt == ROUND_PREPARE {
+			return bz.startChallengePrepare()
+		}
+		// the "commit" round waits for the end of the "prepare" round,
+		// which calls startChallengeCommit.
+		return nil
+	}
+	dbg.Lvl3(bz.Name(), "ByzCoin handle Commit", rt)
+	return bz.sendToParent(&ByzCoinCommitment{
+		TYPE:       rt,
+		Commitment: commit,
+		Exceptions: exceptions,
+		Attempt:    bz.attempt,
+	})
+}
+
+// startCommitTimer gives the children childTimeout per level below us to
+// send their commitments of round rt, if it is set.
+func (bz *ByzCoin) startCommitTimer(rt RoundType) {
+	if bz.childTimeout == 0 || bz.IsLeaf() {
+		return
+	}
+	wait := pcosi.WaitTime(bz.TreeNode(), time.Duration(bz.childTimeout)*time.Millisecond)
+	timeout := commitTimeout{rt, bz.attempt}
+	r := bz.rounds[rt]
+	r.Lock()
+	r.timer = time.AfterFunc(wait, func() {
+		bz.commitTimeoutChan <- timeout
+	})
+	r.Unlock()
+}
+
+// stopCommitTimer stops the child timeout of round rt
+func (bz *ByzCoin) stopCommitTimer(rt RoundType) {
+	r := bz.rounds[rt]
+	r.Lock()
+	defer r.Unlock()
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+}
+
+// handleCommitTimeout counts the children that didn't commit in round rt as
+// exceptions, together with their subtrees, and goes on without them.
+func (bz *ByzCoin) handleCommitTimeout(timeout commitTimeout) error {
+	if timeout.attempt != bz.attempt {
+		return nil
+	}
+	rt := timeout.rt
+	r := bz.rounds[rt]
+	r.Lock()
+	if r.closed {
+		r.Unlock()
+		return nil
+	}
+	for _, tn := range bz.Children() {
+		if !r.hasCommitted(tn) {
+			dbg.Lvl2(bz.Name(), "No commitment from", tn.Name())
+			r.exceptions = append(r.exceptions, pcosi.SubtreeExceptions(bz.suite, tn)...)
+		}
+	}
+	r.Unlock()
+	return bz.sendCommitment(rt)
+}
+
+// response creates our response of round rt out of the responses of the
+// children. If we refuse to sign, our response is neutral and we add our
+// refusal, unless we are excluded and our commitment is already null.
+func (bz *ByzCoin) response(rt RoundType, refuse bool) (*ByzCoinResponse, error) {
+	c := bz.prepare
+	if rt == ROUND_COMMIT {
+		c = bz.commit
+	}
+	r := bz.rounds[rt]
+	r.Lock()
+	defer r.Unlock()
+	if refuse && !c.Refused() {
+		c.Refuse()
+		r.refusals = append(r.refusals, bz.Public())
+	}
+	resp, err := c.Response(r.responses)
+	if err != nil {
+		return nil, err
+	}
+	return &ByzCoinResponse{
+		TYPE:     rt,
+		Response: resp,
+		Refusals: r.refusals,
+		Attempt:  bz.attempt,
+	}, nil
+}
+
+// refusals returns the refusals of our subtree in round rt
+func (bz *ByzCoin) refusals(rt RoundType) []abstract.Point {
+	r := bz.rounds[rt]
+	r.Lock()
+	defer r.Unlock()
+	return r.refusals
+}
+
+// addResponse stores the response of a child and returns true once all
+// children that committed in the round responded.
+func (bz *ByzCoin) addResponse(bzr *ByzCoinResponse) bool {
+	r := bz.rounds[bzr.TYPE]
+	r.Lock()
+	defer r.Unlock()
+	r.responses = append(r.responses, bzr.Response)
+	r.refusals = append(r.refusals, bzr.Refusals...)
+	return len(r.responses) == len(r.committed)
+}
+
+// isExcluded returns whether public is in excluded
+func isExcluded(excluded []abstract.Point, public abstract.Point) bool {
+	for _, p := range excluded {
+		if p.Equal(public) {
+			return true
+		}
+	}
+	return false
+}
+
+// newAttempt drops the state of both rounds for attempt, where the
+// witnesses in excluded refuse to sign. If we are excluded, we refuse
+// before committing and are an exception.
+func (bz *ByzCoin) newAttempt(attempt uint32, excluded []abstract.Point) {
+	bz.stopCommitTimer(ROUND_PREPARE)
+	bz.stopCommitTimer(ROUND_COMMIT)
+	if bz.committedTimer != nil {
+		bz.committedTimer.Stop()
+		bz.committedTimer = nil
+	}
+	bz.attempt = attempt
+	bz.excluded = excluded
+	bz.rounds = [2]*roundState{{}, {}}
+	bz.prepare = cosi.NewCosi(bz.suite, bz.Private())
+	bz.commit = cosi.NewCosi(bz.suite, bz.Private())
+	bz.pendingChallenge, bz.pendingBlock, bz.missingTxs = nil, nil, nil
+	bz.signRefusal = isExcluded(excluded, bz.Public())
+	if !bz.signRefusal {
+		return
+	}
+	dbg.Lvl2(bz.Name(), "is excluded from attempt", attempt)
+	bz.prepare.Refuse()
+	bz.commit.Refuse()
+	for _, r := range bz.rounds {
+		r.exceptions = []cosi.Exception{{
+			Public:     bz.Public(),
+			Commitment: bz.suite.Point().Null(),
+		}}
+	}
+}
+
+// restart is called by the root if witnesses refused after committing in
+// round rt. It starts both rounds again in a new attempt that excludes
+// them. It fails if the exceptions of the new attempt would be more than
+// the threshold.
+func (bz *ByzCoin) restart(rt RoundType) error {
+	excluded := bz.excluded
+	for _, p := range bz.refusals(rt) {
+		if !isExcluded(excluded, p) {
+			excluded = append(excluded, p)
+		}
+	}
+	if len(excluded) == len(bz.excluded) {
+		return errors.New("Witnesses refused again after committing")
+	}
+	// the witnesses that didn't commit stay exceptions
+	exceptions := len(excluded)
+	for _, ex := range bz.exceptions(rt) {
+		if !isExcluded(excluded, ex.Public) {
+			exceptions++
+		}
+	}
+	if exceptions > bz.threshold {
+		return fmt.Errorf("More than 1/3 (%d/%d) refused to sign",
+			exceptions, len(bz.Tree().ListNodes()))
+	}
+	dbg.Lvl2(bz.Name(), "restarts the rounds without", len(excluded), "witnesses")
+	bz.newAttempt(bz.attempt+1, excluded)
+	return bz.Start()
+}
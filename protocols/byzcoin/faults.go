@@ -0,0 +1,202 @@
+package byzcoin
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dedis/cothority/lib/monitor"
+	"github.com/dedis/cothority/lib/network"
+	"github.com/dedis/cothority/lib/sda"
+	"github.com/dedis/cothority/protocols/byzcoin/blockchain"
+)
+
+// Faults describes the faults injected in the rounds of a simulation. It is
+// embedded in the simulation configs, so its fields can be set in the
+// runfile. The faulty witnesses are chosen in the tree of the simulation
+// and stay faulty across view changes.
+type Faults struct {
+	// Crashed witnesses at depth CrashDepth of the tree, 1 being the
+	// children of the root, never answer: their subtrees are cut off
+	Crashed    int
+	CrashDepth int
+	// Refusing witnesses refuse to sign every block
+	Refusing int
+	// Delayed witnesses wait DelayMs before sending each of their
+	// messages
+	Delayed int
+	DelayMs int
+	// Equivocate makes the leader propose another valid block to every
+	// second of its children and their subtrees
+	Equivocate bool
+	// GiveUpMs is how long the simulation waits for a round before
+	// counting it as failed, 0 waits forever
+	GiveUpMs int
+}
+
+// Fault is the behaviour of a node in a round
+type Fault int
+
+const (
+	FaultNone Fault = iota
+	FaultCrashed
+	FaultRefusing
+	FaultDelayed
+)
+
+// FaultPlan holds the faulty nodes of a simulation. Every node computes it
+// out of its own configuration and the tree of the simulation. The nodes
+// are kept by entity, so that they stay faulty in the trees of the view
+// changes.
+type FaultPlan struct {
+	Crashed  []*network.Entity
+	Refusing []*network.Entity
+	Delayed  []*network.Entity
+	DelayMs  int
+	// Equivocating is the leader proposing two blocks, if any
+	Equivocating *network.Entity
+}
+
+// faultsKey stores the FaultPlan of a host in its values
+const faultsKey = "byzcoin.faults"
+
+// Plan chooses the faulty nodes of tree: the crashed ones in the order of
+// the tree at CrashDepth, the refusing and then the delayed ones starting
+// from the last nodes that are not cut off by a crash. The root never
+// fails, but it can equivocate.
+func (f *Faults) Plan(tree *sda.Tree) (*FaultPlan, error) {
+	plan := &FaultPlan{DelayMs: f.DelayMs}
+	if f.Equivocate {
+		plan.Equivocating = tree.Root.Entity
+	}
+	depth := f.CrashDepth
+	if depth < 1 {
+		depth = 1
+	}
+	var alive []*sda.TreeNode
+	cut := make(map[string]bool)
+	tree.Root.Visit(0, func(d int, tn *sda.TreeNode) {
+		switch {
+		case d == 0:
+		case tn.Parent != nil && cut[string(tn.Parent.Id)]:
+			cut[string(tn.Id)] = true
+		case d == depth && len(plan.Crashed) < f.Crashed:
+			plan.Crashed = append(plan.Crashed, tn.Entity)
+			cut[string(tn.Id)] = true
+		default:
+			alive = append(alive, tn)
+		}
+	})
+	if len(plan.Crashed) < f.Crashed {
+		return nil, fmt.Errorf("Only %d witnesses at depth %d to crash", len(plan.Crashed), depth)
+	}
+	if len(alive) < f.Refusing+f.Delayed {
+		return nil, fmt.Errorf("Only %d witnesses left to refuse or delay", len(alive))
+	}
+	for i := 0; i < f.Refusing+f.Delayed; i++ {
+		e := alive[len(alive)-1-i].Entity
+		if i < f.Refusing {
+			plan.Refusing = append(plan.Refusing, e)
+		} else {
+			plan.Delayed = append(plan.Delayed, e)
+		}
+	}
+	return plan, nil
+}
+
+// RegisterFaults makes the ByzCoin and PBFT instances of host inject the
+// faults of plan.
+func RegisterFaults(host *sda.Host, plan *FaultPlan) {
+	host.SetValue(faultsKey, plan)
+}
+
+// FaultsOf returns the faults host injects, or nil if it has none.
+func FaultsOf(host *sda.Host) *FaultPlan {
+	plan, _ := host.Value(faultsKey, nil).(*FaultPlan)
+	return plan
+}
+
+// FaultOf returns the fault of entity e.
+func (p *FaultPlan) FaultOf(e *network.Entity) Fault {
+	if p == nil {
+		return FaultNone
+	}
+	for fault, list := range map[Fault][]*network.Entity{
+		FaultCrashed:  p.Crashed,
+		FaultRefusing: p.Refusing,
+		FaultDelayed:  p.Delayed,
+	} {
+		for _, faulty := range list {
+			if faulty.Equal(e) {
+				return fault
+			}
+		}
+	}
+	return FaultNone
+}
+
+// Delay returns how long a delayed node waits before sending
+func (p *FaultPlan) Delay() time.Duration {
+	return time.Duration(p.DelayMs) * time.Millisecond
+}
+
+// Equivocates returns whether e is the equivocating leader
+func (p *FaultPlan) Equivocates(e *network.Entity) bool {
+	return p != nil && p.Equivocating != nil && p.Equivocating.Equal(e)
+}
+
+// Equivocated returns whether the root of the tree of tn equivocates and
+// proposes another block to tn, which is the case for the subtrees of
+// every second child of the root.
+func (p *FaultPlan) Equivocated(tn *sda.TreeNode) bool {
+	if tn.Parent == nil {
+		return false
+	}
+	for tn.Parent.Parent != nil {
+		tn = tn.Parent
+	}
+	if !p.Equivocates(tn.Parent.Entity) {
+		return false
+	}
+	for i, child := range tn.Parent.Children {
+		if child.Id.Equal(tn.Id) {
+			return i%2 == 1
+		}
+	}
+	return false
+}
+
+// sendToParent sends msg up the tree, after waiting if we are delayed
+func (bz *ByzCoin) sendToParent(msg interface{}) error {
+	if bz.fault == FaultDelayed {
+		time.Sleep(bz.faults.Delay())
+	}
+	return bz.SendTo(bz.Parent(), msg)
+}
+
+// EquivocatingBlock returns another valid block on the same parents as
+// block: the one without its last transaction.
+func EquivocatingBlock(block *blockchain.TrBlock) *blockchain.TrBlock {
+	txs := block.Txs
+	if len(txs) > 0 {
+		txs = txs[:len(txs)-1]
+	}
+	trlist := blockchain.NewTransactionList(txs, len(txs))
+	header := blockchain.NewHeader(trlist, block.Parent, block.ParentKey)
+	return blockchain.NewTrBlock(trlist, header)
+}
+
+// WaitRound waits for the round to be done and returns what is sent on
+// done, or false if it isn't done after GiveUpMs, which is measured as name.
+func (f *Faults) WaitRound(done chan bool, name string) bool {
+	if f.GiveUpMs == 0 {
+		return <-done
+	}
+	failed := monitor.NewMeasure(name)
+	select {
+	case ok := <-done:
+		return ok
+	case <-time.After(time.Duration(f.GiveUpMs) * time.Millisecond):
+		failed.Measure()
+		return false
+	}
+}
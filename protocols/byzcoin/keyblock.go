@@ -0,0 +1,352 @@
+package byzcoin
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/dedis/cothority/lib/cliutils"
+	"github.com/dedis/cothority/lib/cosi"
+	"github.com/dedis/cothority/lib/dbg"
+	"github.com/dedis/cothority/lib/network"
+	"github.com/dedis/cothority/lib/sda"
+	"github.com/dedis/cothority/protocols/byzcoin/blockchain"
+	"github.com/dedis/crypto/abstract"
+)
+
+func init() {
+	sda.ProtocolRegisterName("ByzCoinKeyBlock", func(n *sda.Node) (sda.ProtocolInstance, error) {
+		return NewKeyBlockProtocol(n)
+	})
+}
+
+// KeyBlockRule decides who may produce the next key block. Every host must
+// use the same rule.
+var KeyBlockRule blockchain.LeaderRule = &blockchain.ProofOfWork{Difficulty: 12}
+
+// KeyBlockWindow is the window of the consensus group that has to accept a
+// new key block, see ConsensusGroup. Every host must use the same window.
+var KeyBlockWindow = 10
+
+// KeyBlockTimeout is how long the nodes of a KeyBlockProtocol wait for
+// each other before giving up on the key block.
+var KeyBlockTimeout = 10 * time.Second
+
+// KeyBlockAnnounce proposes the key block of the miner to the candidates.
+type KeyBlockAnnounce struct {
+	KeyBlock blockchain.KeyBlock
+}
+
+// KeyBlockReply holds the acceptance of the announced key block, or the
+// Error why it has been refused.
+type KeyBlockReply struct {
+	Acceptance blockchain.Acceptance
+	Error      string
+}
+
+// KeyBlockCommit holds the accepted key block to append, or the Error why
+// it has been refused.
+type KeyBlockCommit struct {
+	KeyBlock blockchain.KeyBlock
+	Error    string
+}
+
+type keyAnnounceChan struct {
+	*sda.TreeNode
+	KeyBlockAnnounce
+}
+
+type keyReplyChan struct {
+	*sda.TreeNode
+	KeyBlockReply
+}
+
+type keyCommitChan struct {
+	*sda.TreeNode
+	KeyBlockCommit
+}
+
+// KeyBlockProtocol publishes a key block from its miner, at the root, to
+// the candidates in its EntityList. Every node checks it and replies with
+// its acceptance. If enough of the consensus group preceding the key block
+// accepted it, the root sends it down again with the acceptances, and every
+// node appends it to the chain of its host, so that the following
+// microblocks point to it.
+type KeyBlockProtocol struct {
+	*sda.Node
+	keyBlock     *blockchain.KeyBlock
+	announceChan chan keyAnnounceChan
+	replyChan    chan keyReplyChan
+	commitChan   chan keyCommitChan
+	// published returns the outcome to the root
+	published chan error
+}
+
+// NewKeyBlockProtocol returns a node waiting for the key block.
+func NewKeyBlockProtocol(n *sda.Node) (*KeyBlockProtocol, error) {
+	kp := &KeyBlockProtocol{
+		Node:      n,
+		published: make(chan error, 1),
+	}
+	for _, c := range []interface{}{&kp.announceChan, &kp.replyChan, &kp.commitChan} {
+		if err := n.RegisterChannel(c); err != nil {
+			return nil, err
+		}
+	}
+	if !n.IsRoot() {
+		go kp.listen()
+	}
+	return kp, nil
+}
+
+// Start accepts the key block of the root and announces it to the
+// children. The outcome is sent to published.
+func (kp *KeyBlockProtocol) Start() error {
+	kb := kp.keyBlock
+	if kb == nil {
+		return errors.New("No key block to send")
+	}
+	acc, err := kp.accept(kb)
+	if err != nil {
+		return err
+	}
+	kb.Acceptances = []blockchain.Acceptance{*acc}
+	for _, c := range kp.Children() {
+		if err := kp.SendTo(c, &KeyBlockAnnounce{KeyBlock: *kb}); err != nil {
+			return err
+		}
+	}
+	go kp.collect()
+	return nil
+}
+
+// collect waits for the replies of the children and commits the key block
+// if it has been accepted.
+func (kp *KeyBlockProtocol) collect() {
+	kb := kp.keyBlock
+	timeout := time.After(KeyBlockTimeout)
+	for replies := 0; replies < len(kp.Children()); replies++ {
+		select {
+		case msg := <-kp.replyChan:
+			if msg.Error != "" {
+				dbg.Lvl2(kp.Name(), msg.Entity.First(), "refused key block:", msg.Error)
+				continue
+			}
+			kb.Acceptances = append(kb.Acceptances, msg.Acceptance)
+		case <-timeout:
+			dbg.Lvl2(kp.Name(), "Not all candidates replied in time")
+			replies = len(kp.Children())
+		}
+	}
+	err := kp.commit(kb)
+	reply := &KeyBlockCommit{KeyBlock: *kb}
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	for _, c := range kp.Children() {
+		if err := kp.SendTo(c, reply); err != nil {
+			dbg.Error(kp.Name(), "Couldn't send key block:", err)
+		}
+	}
+	kp.Done()
+	kp.published <- err
+}
+
+// listen replies to the announcement of the root and appends the key block
+// it commits. A refused key block is answered with the error.
+func (kp *KeyBlockProtocol) listen() {
+	defer kp.Done()
+	var kb blockchain.KeyBlock
+	select {
+	case msg := <-kp.announceChan:
+		kb = msg.KeyBlock
+	case <-time.After(KeyBlockTimeout):
+		dbg.Lvl2(kp.Name(), "No key block from the root")
+		return
+	}
+	reply := &KeyBlockReply{Acceptance: blockchain.Acceptance{Signature: []byte{}}}
+	acc, err := kp.accept(&kb)
+	if err != nil {
+		dbg.Lvl2(kp.Name(), "Refusing key block:", err)
+		reply.Error = err.Error()
+	} else {
+		reply.Acceptance = *acc
+	}
+	if err := kp.SendTo(kp.Parent(), reply); err != nil {
+		dbg.Error(kp.Name(), "Couldn't reply to the root:", err)
+		return
+	}
+	if reply.Error != "" {
+		return
+	}
+	select {
+	case msg := <-kp.commitChan:
+		if msg.Error != "" {
+			dbg.Lvl2(kp.Name(), "Key block has been refused:", msg.Error)
+			return
+		}
+		if err := kp.commit(&msg.KeyBlock); err != nil {
+			dbg.Error(kp.Name(), "Refused key block:", err)
+		}
+	case <-time.After(KeyBlockTimeout):
+		dbg.Lvl2(kp.Name(), "The root didn't commit the key block")
+	}
+}
+
+// accept checks kb without its acceptances and returns our acceptance.
+func (kp *KeyBlockProtocol) accept(kb *blockchain.KeyBlock) (*blockchain.Acceptance, error) {
+	if err := checkKeyBlock(kp.Suite(), chainOf(kp.Host()), kb); err != nil {
+		return nil, err
+	}
+	pub, err := cliutils.PubHex(kp.Suite(), kp.Public())
+	if err != nil {
+		return nil, err
+	}
+	return kb.Accept(kp.Suite(), kp.Private(), pub)
+}
+
+// commit appends kb to our chain if it has been accepted.
+func (kp *KeyBlockProtocol) commit(kb *blockchain.KeyBlock) error {
+	chain := chainOf(kp.Host())
+	if err := VerifyKeyBlock(kp.EntityList(), chain, KeyBlockWindow, kb); err != nil {
+		return err
+	}
+	if err := chain.AppendKey(kb); err != nil {
+		return err
+	}
+	dbg.Lvl3(kp.Name(), "Appended key block", kb.HeaderHash)
+	return nil
+}
+
+// VerifyKeyBlock checks that kb is sealed under KeyBlockRule, signed by its
+// miner and follows the last key block of store, and that the consensus
+// group of window out of candidates, as ConsensusGroup returns it for store,
+// accepted it.
+func VerifyKeyBlock(candidates *sda.EntityList, store *blockchain.Store, window int, kb *blockchain.KeyBlock) error {
+	suite := candidates.Suite()
+	if err := checkKeyBlock(suite, store, kb); err != nil {
+		return err
+	}
+	group, err := ConsensusGroup(candidates, store, window)
+	if err != nil {
+		return err
+	}
+	pubs := make([]string, len(group.List))
+	for i, e := range group.List {
+		if pubs[i], err = cliutils.PubHex(suite, e.Public); err != nil {
+			return err
+		}
+	}
+	return kb.VerifyAcceptances(suite, pubs, cosi.Threshold(len(pubs)))
+}
+
+// checkKeyBlock verifies everything of kb but the acceptances
+func checkKeyBlock(suite abstract.Suite, store *blockchain.Store, kb *blockchain.KeyBlock) error {
+	if kb.Header == nil || kb.HeaderHash != blockchain.HashHeader(kb.Header) {
+		return errors.New("Wrong hash of header")
+	}
+	if _, last := store.Last(); kb.ParentKey != last {
+		return fmt.Errorf("Key block %s doesn't follow %s", kb.HeaderHash, last)
+	}
+	if err := KeyBlockRule.Verify(kb); err != nil {
+		return err
+	}
+	return kb.VerifySignature(suite)
+}
+
+// MineKeyBlock returns a key block following the last key block of host,
+// sealed with KeyBlockRule and signed by host, that makes host the next
+// leader.
+func MineKeyBlock(host *sda.Host) (*blockchain.KeyBlock, error) {
+	pub, err := cliutils.PubHex(host.Suite(), host.Entity.Public)
+	if err != nil {
+		return nil, err
+	}
+	var ip net.IP
+	if addr, _, err := net.SplitHostPort(host.Entity.First()); err == nil {
+		ip = net.ParseIP(addr)
+	}
+	_, parentKey := chainOf(host).Last()
+	kb := blockchain.NewLeaderKeyBlock(parentKey, ip, pub)
+	if err := KeyBlockRule.Seal(kb); err != nil {
+		return nil, err
+	}
+	if err := kb.Sign(host.Suite(), host.Private()); err != nil {
+		return nil, err
+	}
+	return kb, nil
+}
+
+// PublishKeyBlock sends kb from host to all candidates, which must include
+// host, and returns once they appended it, or an error if it hasn't been
+// accepted.
+func PublishKeyBlock(host *sda.Host, candidates *sda.EntityList, kb *blockchain.KeyBlock) error {
+	var root *sda.TreeNode
+	var children []*sda.TreeNode
+	for _, e := range candidates.List {
+		if e.Equal(host.Entity) {
+			root = sda.NewTreeNode(e)
+		} else {
+			children = append(children, sda.NewTreeNode(e))
+		}
+	}
+	if root == nil {
+		return errors.New("Host is not a candidate")
+	}
+	// the miner is the root of a tree on the candidates as they are, so
+	// that everybody finds the same consensus group
+	for _, c := range children {
+		c.Parent = root
+		root.Children = append(root.Children, c)
+	}
+	tree := sda.NewTree(candidates, root)
+	host.AddEntityList(candidates)
+	host.AddTree(tree)
+	node, err := host.CreateNewNodeName("ByzCoinKeyBlock", tree)
+	if err != nil {
+		return err
+	}
+	kp := node.ProtocolInstance().(*KeyBlockProtocol)
+	kp.keyBlock = kb
+	if err := kp.Start(); err != nil {
+		return err
+	}
+	return <-kp.published
+}
+
+// ConsensusGroup returns the EntityList signing the next microblocks: the
+// miners of the last window key blocks, the leader first, filled up with
+// the other candidates up to window entities. Miners that are not
+// candidates are left out.
+func ConsensusGroup(candidates *sda.EntityList, store *blockchain.Store, window int) (*sda.EntityList, error) {
+	byKey := make(map[string]*network.Entity)
+	for _, e := range candidates.List {
+		pub, err := cliutils.PubHex(candidates.Suite(), e.Public)
+		if err != nil {
+			return nil, err
+		}
+		byKey[pub] = e
+	}
+	var list []*network.Entity
+	for _, pub := range store.Miners(window) {
+		if e, ok := byKey[pub]; ok {
+			list = append(list, e)
+			delete(byKey, pub)
+		}
+	}
+	for _, e := range candidates.List {
+		if len(list) >= window {
+			break
+		}
+		pub, _ := cliutils.PubHex(candidates.Suite(), e.Public)
+		if _, ok := byKey[pub]; ok {
+			list = append(list, e)
+			delete(byKey, pub)
+		}
+	}
+	if len(list) == 0 {
+		return nil, errors.New("Empty consensus group")
+	}
+	return sda.NewEntityListWithSuite(candidates.Suite(), list)
+}
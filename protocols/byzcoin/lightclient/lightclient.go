@@ -0,0 +1,161 @@
+// Package lightclient follows a ByzCoin chain knowing only its genesis
+// EntityList. It fetches the blocks with the hashes of their transactions,
+// checks their collective signatures against the consensus group derived
+// from the key blocks, and verifies that transactions are in a block with
+// Merkle proofs. A key block, which changes the consensus group, is only
+// followed if the current consensus group accepted it.
+package lightclient
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dedis/cothority/lib/cosi"
+	"github.com/dedis/cothority/lib/dbg"
+	"github.com/dedis/cothority/lib/network"
+	"github.com/dedis/cothority/lib/sda"
+	"github.com/dedis/cothority/protocols/byzcoin"
+	"github.com/dedis/cothority/protocols/byzcoin/blockchain"
+	"github.com/dedis/crypto/abstract"
+)
+
+// Client holds the headers of the blocks it verified.
+type Client struct {
+	candidates *sda.EntityList
+	window     int
+	// keys holds the verified key blocks
+	keys    *blockchain.Store
+	headers []*blockchain.Header
+	hashes  map[string]int
+}
+
+// NewClient returns a client for the chain whose consensus group is made of
+// the window last miners out of candidates, like byzcoin.ConsensusGroup.
+func NewClient(candidates *sda.EntityList, window int) *Client {
+	return &Client{
+		candidates: candidates,
+		window:     window,
+		keys:       blockchain.NewStore(candidates.Suite()),
+		hashes:     make(map[string]int),
+	}
+}
+
+// Height returns the number of verified blocks.
+func (c *Client) Height() int {
+	return len(c.headers)
+}
+
+// Header returns the verified header of the block with hash, or nil if it
+// is unknown.
+func (c *Client) Header(hash string) *blockchain.Header {
+	h, ok := c.hashes[hash]
+	if !ok {
+		return nil
+	}
+	return c.headers[h]
+}
+
+// Update fetches and verifies the blocks server has after the last
+// verified one.
+func (c *Client) Update(server *network.Entity) error {
+	status, err := byzcoin.FetchStatus(c.suite(), server)
+	if err != nil {
+		return err
+	}
+	for h := c.Height(); h < int(status.Height); h++ {
+		sig, err := byzcoin.FetchBlock(c.suite(), server, &byzcoin.BlockRequest{
+			Height:     int64(h),
+			HashesOnly: true,
+		})
+		if err != nil {
+			return err
+		}
+		if err := c.followKeyBlocks(server, sig.Block.ParentKey); err != nil {
+			return err
+		}
+		if err := c.Verify(sig); err != nil {
+			return fmt.Errorf("Block %d: %s", h, err)
+		}
+	}
+	return nil
+}
+
+// Verify checks that sig signs the block following the last verified one,
+// and adds it. The key block it points to has to be verified already.
+func (c *Client) Verify(sig *byzcoin.BlockSignature) error {
+	if sig == nil || sig.Sig == nil || sig.Block == nil || sig.Block.Header == nil {
+		return errors.New("Empty block signature")
+	}
+	block := sig.Block
+	if block.HeaderHash != blockchain.HashHeader(block.Header) {
+		return errors.New("Wrong hash of header")
+	}
+	if parent := c.lastHash(); block.Parent != parent {
+		return fmt.Errorf("Block %s doesn't follow %s", block.HeaderHash, parent)
+	}
+	if _, key := c.keys.Last(); block.ParentKey != key {
+		return fmt.Errorf("Block %s doesn't follow key block %s", block.HeaderHash, key)
+	}
+	group, err := byzcoin.ConsensusGroup(c.candidates, c.keys, c.window)
+	if err != nil {
+		return err
+	}
+	if err := byzcoin.CheckExceptions(group, sig.Exceptions); err != nil {
+		return err
+	}
+	if err := cosi.VerifyCosiSignatureWithException(c.suite(), group.Aggregate,
+		block.HashSum(), sig.Sig, sig.Exceptions); err != nil {
+		return err
+	}
+	dbg.Lvl3("Verified block", block.HeaderHash)
+	c.hashes[block.HeaderHash] = len(c.headers)
+	c.headers = append(c.headers, block.Header)
+	return nil
+}
+
+// VerifyTransaction fetches from server the Merkle proof that the
+// transaction tx is in the verified block with hash block, and checks it.
+func (c *Client) VerifyTransaction(server *network.Entity, block, tx string) error {
+	header := c.Header(block)
+	if header == nil {
+		return errors.New("Unknown block " + block)
+	}
+	proof, err := byzcoin.FetchProof(c.suite(), server, block, tx)
+	if err != nil {
+		return err
+	}
+	return header.CheckMerkleProof(tx, proof)
+}
+
+// followKeyBlocks fetches and verifies the key blocks of server up to the
+// one with hash key. Each of them has to be accepted by the consensus group
+// of the key blocks verified before.
+func (c *Client) followKeyBlocks(server *network.Entity, key string) error {
+	for {
+		if _, last := c.keys.Last(); last == key {
+			return nil
+		}
+		kb, err := byzcoin.FetchKeyBlock(c.suite(), server, c.keys.KeyHeight())
+		if err != nil {
+			return fmt.Errorf("Couldn't find key block %s: %s", key, err)
+		}
+		if err := byzcoin.VerifyKeyBlock(c.candidates, c.keys, c.window, kb); err != nil {
+			return fmt.Errorf("Key block %s: %s", kb.HeaderHash, err)
+		}
+		if err := c.keys.AppendKey(kb); err != nil {
+			return err
+		}
+		dbg.Lvl3("Verified key block", kb.HeaderHash)
+	}
+}
+
+func (c *Client) lastHash() string {
+	if len(c.headers) == 0 {
+		return ""
+	}
+	return blockchain.HashHeader(c.headers[len(c.headers)-1])
+}
+
+func (c *Client) suite() abstract.Suite {
+	return c.candidates.Suite()
+}
@@ -0,0 +1,200 @@
+package lightclient
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dedis/cothority/lib/cosi"
+	"github.com/dedis/cothority/lib/dbg"
+	"github.com/dedis/cothority/lib/sda"
+	"github.com/dedis/cothority/protocols/byzcoin"
+	"github.com/dedis/cothority/protocols/byzcoin/blockchain"
+	"github.com/dedis/cothority/protocols/byzcoin/blockchain/blkparser"
+	"github.com/dedis/crypto/random"
+)
+
+func TestClient(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	local := sda.NewLocalTest()
+	hosts, el, _ := local.GenTree(5, true, true, true)
+	defer local.CloseAll()
+	stores := make([]*blockchain.Store, len(hosts))
+	for i, h := range hosts {
+		stores[i] = blockchain.NewStore(el.Suite())
+		byzcoin.RegisterChain(h, stores[i])
+	}
+	window := 4
+
+	// the first block is signed by the first candidates
+	txs := blockchain.NewGenerator(&blockchain.TxConfig{Seed: 1}).Generate(4)
+	group, err := byzcoin.ConsensusGroup(el, stores[0], window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signBlock(t, local, hosts[0], group, stores[:4], txs)
+
+	// the last candidate catches up, mines a key block and leads the
+	// group signing the second block
+	miner := hosts[4]
+	sig, err := byzcoin.FetchBlock(el.Suite(), hosts[0].Entity, &byzcoin.BlockRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stores[4].Append(&blockchain.SignedBlock{
+		Block: sig.Block, Signature: sig.Sig, Exceptions: sig.Exceptions}); err != nil {
+		t.Fatal(err)
+	}
+	kb, err := byzcoin.MineKeyBlock(miner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := byzcoin.PublishKeyBlock(miner, el, kb); err != nil {
+		t.Fatal(err)
+	}
+	waitHeights(t, stores, func(s *blockchain.Store) int { return s.KeyHeight() }, 1)
+	group, err = byzcoin.ConsensusGroup(el, stores[4], window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !group.List[0].Equal(miner.Entity) {
+		t.Fatal("Miner doesn't lead the consensus group")
+	}
+	txs = blockchain.NewGenerator(&blockchain.TxConfig{Seed: 2}).Generate(3)
+	last := signBlock(t, local, miner, group, []*blockchain.Store{stores[0], stores[4]}, txs)
+
+	c := NewClient(el, window)
+	if err := c.Update(hosts[0].Entity); err != nil {
+		t.Fatal(err)
+	}
+	if c.Height() != 2 {
+		t.Fatal("Expected 2 blocks, got", c.Height())
+	}
+	if c.Header(last.Block.HeaderHash) == nil {
+		t.Fatal("Missing header of the last block")
+	}
+	if err := c.VerifyTransaction(hosts[0].Entity, last.Block.HeaderHash, txs[1].Hash); err != nil {
+		t.Fatal(err)
+	}
+	other := blockchain.NewGenerator(&blockchain.TxConfig{Seed: 3}).Generate(1)[0]
+	if c.VerifyTransaction(hosts[0].Entity, last.Block.HeaderHash, other.Hash) == nil {
+		t.Fatal("Verified a transaction that is not in the block")
+	}
+
+	// with another consensus group the signatures are wrong
+	if NewClient(el, len(hosts)).Update(hosts[0].Entity) == nil {
+		t.Fatal("Accepted blocks signed by the wrong group")
+	}
+
+	// a key block the consensus group didn't accept changes nothing
+	rogue, err := byzcoin.MineKeyBlock(hosts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stores[0].AppendKey(rogue); err != nil {
+		t.Fatal(err)
+	}
+	if c.followKeyBlocks(hosts[0].Entity, rogue.HeaderHash) == nil {
+		t.Fatal("Followed a key block without acceptances")
+	}
+	if _, key := c.keys.Last(); key != kb.HeaderHash {
+		t.Fatal("Appended a key block without acceptances")
+	}
+}
+
+// TestForgedException checks that a block signature can't be forged by
+// putting the missing part into the commitment of an exception.
+func TestForgedException(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	local := sda.NewLocalTest()
+	hosts, el, _ := local.GenTree(4, true, true, true)
+	defer local.CloseAll()
+	stores := make([]*blockchain.Store, len(hosts))
+	for i, h := range hosts {
+		stores[i] = blockchain.NewStore(el.Suite())
+		byzcoin.RegisterChain(h, stores[i])
+	}
+	window := len(hosts)
+	group, err := byzcoin.ConsensusGroup(el, stores[0], window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txs := blockchain.NewGenerator(&blockchain.TxConfig{Seed: 1}).Generate(2)
+	sig := signBlock(t, local, hosts[0], group, stores, txs)
+	if err := NewClient(el, window).Verify(sig); err != nil {
+		t.Fatal(err)
+	}
+
+	// without any private key, the commitment of the exception makes up
+	// for the signature of the others
+	suite := el.Suite()
+	response := suite.Secret().Pick(random.Stream)
+	commitment, _ := suite.Point().Pick(nil, random.Stream)
+	challenge, err := cosi.ComputeChallenge(suite, commitment, group.Aggregate, sig.Block.HashSum())
+	if err != nil {
+		t.Fatal(err)
+	}
+	excluded := group.List[len(group.List)-1].Public
+	subPublic := suite.Point().Sub(group.Aggregate, excluded)
+	exCommit := suite.Point().Sub(commitment, suite.Point().Mul(nil, response))
+	exCommit.Sub(exCommit, suite.Point().Mul(subPublic, challenge))
+	forged := &byzcoin.BlockSignature{
+		Sig:        &cosi.Signature{Challenge: challenge, Response: response},
+		Block:      sig.Block,
+		Exceptions: []cosi.Exception{{Public: excluded, Commitment: exCommit}},
+	}
+	if NewClient(el, window).Verify(forged) == nil {
+		t.Fatal("Accepted a forged exception commitment")
+	}
+	forged.Exceptions[0].Commitment = suite.Point().Null()
+	if NewClient(el, window).Verify(forged) == nil {
+		t.Fatal("Accepted a forged signature")
+	}
+}
+
+// signBlock runs ByzCoin on the group led by leader to sign txs, and waits
+// until stores have the block.
+func signBlock(t *testing.T, local *sda.LocalTest, leader *sda.Host, group *sda.EntityList,
+	stores []*blockchain.Store, txs []blkparser.Tx) *byzcoin.BlockSignature {
+	tree := group.GenerateBigNaryTree(2, len(group.List))
+	leader.AddEntityList(group)
+	leader.AddTree(tree)
+	height := stores[0].Height()
+	node, err := local.NewNodeEmptyName("ByzCoin", tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bz, err := byzcoin.NewByzCoinRootProtocol(node, txs, 500, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.SetProtocolInstance(bz)
+	sigChan := make(chan *byzcoin.BlockSignature, 1)
+	bz.RegisterOnSignatureDone(func(sig *byzcoin.BlockSignature) {
+		sigChan <- sig
+	})
+	go bz.Start()
+	var sig *byzcoin.BlockSignature
+	select {
+	case sig = <-sigChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("No signature")
+	}
+	waitHeights(t, stores, func(s *blockchain.Store) int { return s.Height() }, height+1)
+	return sig
+}
+
+// waitHeights waits until height returns h for all stores
+func waitHeights(t *testing.T, stores []*blockchain.Store, height func(*blockchain.Store) int, h int) {
+	for _, s := range stores {
+		for i := 0; height(s) != h; i++ {
+			if i == 100 {
+				t.Fatal("Store didn't reach height", h)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
@@ -9,7 +9,6 @@ import (
 	"github.com/dedis/cothority/lib/sda"
 	"github.com/dedis/cothority/protocols/byzcoin/blockchain"
 	"github.com/dedis/cothority/protocols/byzcoin/blockchain/blkparser"
-	"github.com/satori/go.uuid"
 )
 
 // Ntree is a basic implementation of a byzcoin consensus protocol using a tree
@@ -86,7 +85,7 @@ func NewNTreeRootProtocol(node *sda.Node, transactions []blkparser.Tx) (*Ntree,
 // Announce the new block to sign
 func (nt *Ntree) Start() error {
 	dbg.Lvl3(nt.Name(), "Start()")
-	go verifyBlock(nt.block, "", "", nt.verifyBlockChan)
+	go verifyBlock(nt.block, "", "", nil, nt.verifyBlockChan)
 	for _, tn := range nt.Children() {
 		nt.SendTo(tn, &BlockAnnounce{nt.block})
 	}
@@ -107,7 +106,7 @@ func (nt *Ntree) listen() {
 			dbg.Lvl3(nt.Name(), "Received Block announcement")
 			nt.block = msg.BlockAnnounce.Block
 			// verify the block
-			go verifyBlock(nt.block, "", "", nt.verifyBlockChan)
+			go verifyBlock(nt.block, "", "", nil, nt.verifyBlockChan)
 			if nt.IsLeaf() {
 				nt.startBlockSignature()
 				continue
@@ -312,7 +311,7 @@ type NaiveBlockSignature struct {
 // sign something. It justs passes its TreeNodeId inside. No need for public key
 // or whatever because each signatures is independant.
 type Exception struct {
-	Id uuid.UUID
+	Id crypto.HashId
 }
 
 // RoundSignatureRequest basically is the the block sisgnature broadcasting
@@ -5,7 +5,6 @@ import (
 	"github.com/dedis/cothority/lib/dbg"
 	"github.com/dedis/cothority/lib/monitor"
 	"github.com/dedis/cothority/lib/sda"
-	"github.com/dedis/cothority/protocols/byzcoin/blockchain"
 )
 
 func init() {
@@ -32,7 +31,7 @@ func NewNtreeSimulation(config string) (sda.Simulation, error) {
 
 // Setup implements sda.Simulation interface
 func (e *NtreeSimulation) Setup(dir string, hosts []string) (*sda.SimulationConfig, error) {
-	err := blockchain.EnsureBlockIsAvailable(dir)
+	err := e.Prepare(dir)
 	if err != nil {
 		dbg.Fatal("Couldn't get block:", err)
 	}
@@ -54,7 +53,7 @@ func (e *NtreeSimulation) Run(sdaConf *sda.SimulationConfig) error {
 	/*var rRespPrep monitorMut*/
 	for round := 0; round < e.Rounds; round++ {
 		client := NewClient(server)
-		err := client.StartClientSimulation(blockchain.GetBlockDir(), e.Blocksize)
+		err := client.StartClientSimulationConfig(&e.TxConfig, round, e.Blocksize)
 		if err != nil {
 			dbg.Error("ClientSimulation:", err)
 		}
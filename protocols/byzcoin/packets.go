@@ -1,9 +1,13 @@
 package byzcoin
 
 import (
+	"errors"
+
 	"github.com/dedis/cothority/lib/cosi"
+	"github.com/dedis/cothority/lib/crypto"
 	"github.com/dedis/cothority/lib/sda"
 	"github.com/dedis/cothority/protocols/byzcoin/blockchain"
+	"github.com/dedis/crypto/abstract"
 )
 
 // RoundType is a type to know if we are in the "prepare" round or the "commit"
@@ -24,12 +28,35 @@ type BlockSignature struct {
 	Exceptions []cosi.Exception
 }
 
+// CollectiveSignature returns the self-describing signature of the block,
+// signed by the witnesses in el.
+func (bs *BlockSignature) CollectiveSignature(suite abstract.Suite, el *sda.EntityList) (*cosi.CollectiveSignature, error) {
+	if bs.Sig == nil || bs.Block == nil {
+		return nil, errors.New("Empty block signature")
+	}
+	publics := make([]abstract.Point, len(el.List))
+	for i, e := range el.List {
+		publics[i] = e.Public
+	}
+	return cosi.NewCollectiveSignature(suite, bs.Block.HashSum(), el.Id, publics, bs.Sig, bs.Exceptions)
+}
+
 // ByzCoinAnnounce is the struct used during the announcement phase (of both
 // rounds)
 type ByzCoinAnnounce struct {
 	*cosi.Announcement
 	TYPE    RoundType
 	Timeout uint64
+	// View is the number of view changes that led to this round
+	View uint32
+	// ChildTimeout is how many milliseconds a node waits for the
+	// commitments of each level of its subtree, 0 waits for all
+	ChildTimeout uint64
+	// Attempt is the number of times the root restarted the rounds
+	Attempt uint32
+	// Excluded are the witnesses that refused after committing in an
+	// earlier attempt, they refuse to sign in this one
+	Excluded []abstract.Point
 }
 
 // announceChan is the type of the channel that will be used to catch
@@ -42,6 +69,9 @@ type announceChan struct {
 type ByzCoinCommitment struct {
 	TYPE RoundType
 	*cosi.Commitment
+	// Exceptions are the nodes of the subtree that didn't commit
+	Exceptions []cosi.Exception
+	Attempt    uint32
 }
 
 // commitChan is the type of the channel that will be used to catch commitment
@@ -56,7 +86,11 @@ type commitChan struct {
 type ByzCoinChallengePrepare struct {
 	TYPE RoundType
 	*cosi.Challenge
-	*blockchain.TrBlock
+	// Block is the binary encoding of the TrBlock, which is signed
+	Block []byte
+	// Compact is true if Block holds only the hashes of the transactions
+	Compact bool
+	Attempt uint32
 }
 
 // ByzCoinChallengeCommit  is the challenge used by ByzCoin during the "commit"
@@ -76,6 +110,7 @@ type ByzCoinChallengeCommit struct {
 	// verifying the signature. It can not be spoofed otherwise the signature
 	// would be wrong.
 	Exceptions []cosi.Exception
+	Attempt    uint32
 }
 
 // challengeChan is the type of the channel that will be used to dcatch the
@@ -91,11 +126,13 @@ type challengeCommitChan struct {
 }
 
 // ByzCoinResponse is the struct used by ByzCoin during the response. It
-// contains the response + the basic exception list.
+// contains the response + the witnesses of the subtree that refused after
+// committing, the root restarts the rounds without them.
 type ByzCoinResponse struct {
 	*cosi.Response
-	Exceptions []cosi.Exception
-	TYPE       RoundType
+	Refusals []abstract.Point
+	TYPE     RoundType
+	Attempt  uint32
 }
 
 // responseChan is the type of the channel used to catch the response messages.
@@ -103,3 +140,38 @@ type responseChan struct {
 	*sda.TreeNode
 	ByzCoinResponse
 }
+
+// committedChan is the type of the channel used to catch the final signature
+// sent down the tree.
+type committedChan struct {
+	*sda.TreeNode
+	BlockSignature
+}
+
+// ViewChange asks to go to View, whose leader is the entity following the
+// current leader by View - current view positions in the EntityList. It is
+// signed by the tree node sending it.
+type ViewChange struct {
+	View      uint32
+	Signature crypto.SchnorrSig
+}
+
+// viewChangeChan is the type of the channel used to catch the view changes.
+type viewChangeChan struct {
+	*sda.TreeNode
+	ViewChange
+}
+
+// NewViewSignature is sent by the leader of View to the root of the round
+// it replaced, once the block is signed.
+type NewViewSignature struct {
+	View uint32
+	BlockSignature
+}
+
+// newViewChan is the type of the channel used to catch the signature of the
+// new view.
+type newViewChan struct {
+	*sda.TreeNode
+	NewViewSignature
+}
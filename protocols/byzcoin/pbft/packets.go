@@ -27,6 +27,17 @@ type prepareChan struct {
 	Prepare
 }
 
+// Refusal is broadcast instead of Prepare by the nodes that refuse the
+// block with HeaderHash.
+type Refusal struct {
+	HeaderHash string
+}
+
+type refusalChan struct {
+	*sda.TreeNode
+	Refusal
+}
+
 type Commit struct {
 	HeaderHash string
 }
@@ -9,9 +9,9 @@ import (
 
 	"github.com/dedis/cothority/lib/dbg"
 	"github.com/dedis/cothority/lib/sda"
+	"github.com/dedis/cothority/protocols/byzcoin"
 	"github.com/dedis/cothority/protocols/byzcoin/blockchain"
 	"github.com/dedis/crypto/abstract"
-	"github.com/satori/go.uuid"
 )
 
 const (
@@ -39,16 +39,25 @@ type Protocol struct {
 
 	// we do not care for servers or clients (just store one block here)
 	trBlock *blockchain.TrBlock
+	// utxo checks the transactions of the block, if the host has a set
+	utxo *blockchain.UTXOSet
+	// faults are injected by the nodes of the simulation, fault is ours
+	faults *byzcoin.FaultPlan
+	fault  byzcoin.Fault
 
 	prepMsgCount   int
 	commitMsgCount int
+	refusalCount   int
 	threshold      int
 	// channels:
 	prePrepareChan chan prePrepareChan
 	prepareChan    chan prepareChan
+	refusalChan    chan refusalChan
 	commitChan     chan commitChan
 
 	onDoneCB func()
+	// onRefusedCB is called by the root if too many nodes refuse the block
+	onRefusedCB func()
 
 	state int
 
@@ -74,7 +83,7 @@ func NewProtocol(n *sda.Node) (*Protocol, error) {
 	pbft.nodeList = tree.ListNodes()
 	idx := NotFound
 	for i, tn := range pbft.nodeList {
-		if uuid.Equal(tn.Id, n.TreeNode().Id) {
+		if tn.Id.Equal(n.TreeNode().Id) {
 			idx = i
 		}
 	}
@@ -82,6 +91,9 @@ func NewProtocol(n *sda.Node) (*Protocol, error) {
 		panic(fmt.Sprintf("Could not find ourselves %+v in the list of nodes %+v", n, pbft.nodeList))
 	}
 	pbft.index = idx
+	pbft.utxo = byzcoin.UTXOSetOf(n.Host())
+	pbft.faults = byzcoin.FaultsOf(n.Host())
+	pbft.fault = pbft.faults.FaultOf(n.TreeNode().Entity)
 	// 2/3 * #participants == threshold FIXME the threshold is actually XXX
 	pbft.threshold = int(math.Ceil(float64(len(pbft.nodeList)) * 2.0 / 3.0))
 	pbft.prepMsgCount = 0
@@ -89,6 +101,7 @@ func NewProtocol(n *sda.Node) (*Protocol, error) {
 
 	n.RegisterChannel(&pbft.prePrepareChan)
 	n.RegisterChannel(&pbft.prepareChan)
+	n.RegisterChannel(&pbft.refusalChan)
 	n.RegisterChannel(&pbft.commitChan)
 	n.RegisterChannel(&pbft.finishChan)
 	return pbft, nil
@@ -102,6 +115,8 @@ func (p *Protocol) Dispatch() error {
 			p.handlePrePrepare(&msg.PrePrepare)
 		case msg := <-p.prepareChan:
 			p.handlePrepare(&msg.Prepare)
+		case msg := <-p.refusalChan:
+			p.handleRefusal(&msg.Refusal)
 		case msg := <-p.commitChan:
 			p.handleCommit(&msg.Commit)
 		case <-p.finishChan:
@@ -118,8 +133,14 @@ func (p *Protocol) PrePrepare() error {
 	var err error
 	dbg.Lvl2(p.Node.Name(), "Broadcast PrePrepare")
 	prep := &PrePrepare{p.trBlock}
+	// an equivocating root sends another block to some nodes
+	other := &PrePrepare{byzcoin.EquivocatingBlock(p.trBlock)}
 	p.broadcast(func(tn *sda.TreeNode) {
-		tempErr := p.Node.SendTo(tn, prep)
+		msg := prep
+		if p.faults.Equivocated(tn) {
+			msg = other
+		}
+		tempErr := p.Node.SendTo(tn, msg)
 		if tempErr != nil {
 			err = tempErr
 		}
@@ -136,11 +157,22 @@ func (p *Protocol) handlePrePrepare(prePre *PrePrepare) {
 		//dbg.Lvl3(p.Name(), "DROP preprepare packet : Already broadcasted prepare")
 		return
 	}
+	switch p.fault {
+	case byzcoin.FaultCrashed:
+		dbg.Lvl2(p.Name(), "Crashed, not answering")
+		return
+	case byzcoin.FaultRefusing:
+		dbg.Lvl2(p.Name(), "Refusing the block")
+		p.refuse(prePre.TrBlock)
+		return
+	}
 	// prepare: verify the structure of the block and broadcast
 	// prepare msg (with header hash of the block)
 	dbg.Lvl3(p.Name(), "handlePrePrepare() BROADCASTING PREPARE msg")
 	var err error
-	if verifyBlock(prePre.TrBlock, "", "") {
+	if verifyBlock(prePre.TrBlock, "", "", p.utxo) {
+		p.delay()
+		p.trBlock = prePre.TrBlock
 		// STATE TRANSITION PREPREPARE => PREPARE
 		p.state = STATE_PREPARE
 		prep := &Prepare{prePre.TrBlock.HeaderHash}
@@ -162,6 +194,7 @@ func (p *Protocol) handlePrePrepare(prePre *PrePrepare) {
 		dbg.Lvl3(p.Node.Name(), "handlePrePrepare() BROADCASTING PREPARE msgs DONE")
 	} else {
 		dbg.Lvl3(p.Name(), "Block couldn't be verified")
+		p.refuse(prePre.TrBlock)
 	}
 	if err != nil {
 		dbg.Error("Error while broadcasting Prepare msg", err)
@@ -174,6 +207,10 @@ func (p *Protocol) handlePrepare(pre *Prepare) {
 		p.tempPrepareMsg = append(p.tempPrepareMsg, pre)
 		return
 	}
+	if p.trBlock == nil || pre.HeaderHash != p.trBlock.HeaderHash {
+		dbg.Lvl3(p.Name(), "Ignoring prepare of another block")
+		return
+	}
 	p.prepMsgCount++
 	//dbg.Lvl3(p.Name(), "Handle Prepare", p.prepMsgCount,
 	//	"msgs and threshold is", p.threshold)
@@ -191,6 +228,7 @@ func (p *Protocol) handlePrepare(pre *Prepare) {
 		p.prepMsgCount = 0
 		var err error
 		com := &Commit{pre.HeaderHash}
+		p.delay()
 		p.broadcast(func(tn *sda.TreeNode) {
 			tempErr := p.Node.SendTo(tn, com)
 			if tempErr != nil {
@@ -212,6 +250,35 @@ func (p *Protocol) handlePrepare(pre *Prepare) {
 	}
 }
 
+// refuse tells everybody that we refuse block
+func (p *Protocol) refuse(block *blockchain.TrBlock) {
+	ref := &Refusal{block.HeaderHash}
+	p.broadcast(func(tn *sda.TreeNode) {
+		if err := p.Node.SendTo(tn, ref); err != nil {
+			dbg.Error(p.Name(), "Error broadcasting REFUSAL =>", err)
+		}
+	})
+}
+
+// handleRefusal counts the nodes refusing the block. Once the others can't
+// reach the threshold anymore, we stop waiting for them, and the root ends
+// the round.
+func (p *Protocol) handleRefusal(ref *Refusal) {
+	p.refusalCount++
+	dbg.Lvl3(p.Name(), "Got", p.refusalCount, "refusals of", ref.HeaderHash)
+	if p.state == STATE_FINISHED || len(p.nodeList)-p.refusalCount >= p.threshold {
+		return
+	}
+	dbg.Lvl2(p.Name(), "Too many refusals:", p.refusalCount, "of", len(p.nodeList))
+	p.state = STATE_FINISHED
+	if p.IsRoot() {
+		if p.onRefusedCB != nil {
+			p.onRefusedCB()
+		}
+		p.finish()
+	}
+}
+
 // handleCommit receives commit messages and signal the end if it received
 // enough of it.
 func (p *Protocol) handleCommit(com *Commit) {
@@ -220,6 +287,10 @@ func (p *Protocol) handleCommit(com *Commit) {
 		p.tempCommitMsg = append(p.tempCommitMsg, com)
 		return
 	}
+	if p.trBlock == nil || com.HeaderHash != p.trBlock.HeaderHash {
+		dbg.Lvl3(p.Name(), "Ignoring commit of another block")
+		return
+	}
 	// finish after threshold of Commit msgs
 	p.commitMsgCount++
 	dbg.Lvl4(p.Node.Name(), "----------------\nWe got", p.commitMsgCount,
@@ -232,6 +303,11 @@ func (p *Protocol) handleCommit(com *Commit) {
 		// reset counter
 		p.commitMsgCount = 0
 		dbg.Lvl3(p.Node.Name(), "Threshold reached: We are done... CONSENSUS")
+		if p.utxo != nil && p.trBlock != nil {
+			if err := p.utxo.Apply(p.trBlock.HeaderHash, p.trBlock.Txs); err != nil {
+				dbg.Error(p.Name(), "Couldn't apply block:", err)
+			}
+		}
 		if p.IsRoot() && p.onDoneCB != nil {
 			dbg.Lvl3(p.Node.Name(), "We are root and threshold reached: return to the simulation.")
 			p.onDoneCB()
@@ -250,6 +326,13 @@ func (p *Protocol) finish() {
 	go func() { p.finishChan <- finishChan{nil, Finish{}} }()
 }
 
+// delay waits before sending if we are a delayed node
+func (p *Protocol) delay() {
+	if p.fault == byzcoin.FaultDelayed {
+		time.Sleep(p.faults.Delay())
+	}
+}
+
 // sendCb should contain the real sendTo call and the msg to broadcast
 // example for sendCb:
 // func(tn *sda.TreeNode) { p.Node.SendTo(tn, &registerdMsg )}
@@ -262,9 +345,10 @@ func (p *Protocol) broadcast(sendCb func(*sda.TreeNode)) {
 	}
 }
 
-// verifyBlock is a simulation of a real block verification algorithm
+// verifyBlock simulates the cost of verifying the block, and checks its
+// header and, if utxo isn't nil, its transactions.
 // FIXME merge with Nicolas' code (public method in byzcoin)
-func verifyBlock(block *blockchain.TrBlock, lastBlock, lastKeyBlock string) bool {
+func verifyBlock(block *blockchain.TrBlock, lastBlock, lastKeyBlock string, utxo *blockchain.UTXOSet) bool {
 	//We measure the average block verification delays is 174ms for an average
 	//block of 500kB.
 	//To simulate the verification cost of bigger blocks we multiply 174ms
@@ -278,6 +362,11 @@ func verifyBlock(block *blockchain.TrBlock, lastBlock, lastKeyBlock string) bool
 	verified := block.Header.Parent == lastBlock && block.Header.ParentKey == lastKeyBlock
 	verified = verified && block.Header.MerkleRoot == blockchain.HashRootTransactions(block.TransactionList)
 	verified = verified && block.HeaderHash == blockchain.HashHeader(block.Header)
-
+	if verified && utxo != nil {
+		if err := utxo.Check(block.Txs); err != nil {
+			dbg.Lvl2("Refusing block:", err)
+			verified = false
+		}
+	}
 	return verified
 }
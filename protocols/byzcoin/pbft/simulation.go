@@ -5,7 +5,9 @@ import (
 	"github.com/dedis/cothority/lib/dbg"
 	"github.com/dedis/cothority/lib/monitor"
 	"github.com/dedis/cothority/lib/sda"
+	"github.com/dedis/cothority/protocols/byzcoin"
 	"github.com/dedis/cothority/protocols/byzcoin/blockchain"
+	"github.com/dedis/cothority/protocols/byzcoin/blockchain/blkparser"
 	"github.com/dedis/cothority/protocols/manage"
 )
 
@@ -24,6 +26,11 @@ type Simulation struct {
 	// pbft simulation specific fields:
 	// Blocksize is the number of transactions in one block:
 	Blocksize int
+	// Synthetic and the Tx-fields select generated transactions instead
+	// of Bitcoin blocks
+	blockchain.TxConfig
+	// Crashed, Refusing, Delayed and Equivocate inject faults
+	byzcoin.Faults
 }
 
 func NewSimulation(config string) (sda.Simulation, error) {
@@ -37,7 +44,7 @@ func NewSimulation(config string) (sda.Simulation, error) {
 
 // Setup implements sda.Simulation interface
 func (e *Simulation) Setup(dir string, hosts []string) (*sda.SimulationConfig, error) {
-	err := blockchain.EnsureBlockIsAvailable(dir)
+	err := e.Prepare(dir)
 	if err != nil {
 		dbg.Fatal("Couldn't get block:", err)
 	}
@@ -51,24 +58,24 @@ func (e *Simulation) Setup(dir string, hosts []string) (*sda.SimulationConfig, e
 	return sc, nil
 }
 
-func (e *Simulation) Run(sdaConf *sda.SimulationConfig) error {
-	doneChan := make(chan bool)
-	doneCB := func() {
-		doneChan <- true
+// Node implements sda.Simulation interface. It gives the host its faults.
+func (e *Simulation) Node(sc *sda.SimulationConfig) error {
+	if err := e.SimulationBFTree.Node(sc); err != nil {
+		return err
 	}
-	// FIXME use client instead
-	dir := blockchain.GetBlockDir()
-	parser, err := blockchain.NewParser(dir, magicNum)
+	plan, err := e.Plan(sc.Tree)
 	if err != nil {
-		dbg.Error("Error: Couldn't parse blocks in", dir)
 		return err
 	}
-	transactions, err := parser.Parse(0, e.Blocksize)
+	byzcoin.RegisterFaults(sc.Host, plan)
+	return nil
+}
+
+func (e *Simulation) Run(sdaConf *sda.SimulationConfig) error {
+	transactions, err := e.transactions()
 	if err != nil {
-		dbg.Error("Error while parsing transactions", err)
 		return err
 	}
-
 	// FIXME c&p from byzcoin.go
 	trlist := blockchain.NewTransactionList(transactions, len(transactions))
 	header := blockchain.NewHeader(trlist, "", "")
@@ -99,9 +106,18 @@ func (e *Simulation) Run(sdaConf *sda.SimulationConfig) error {
 		proto := node.ProtocolInstance().(*Protocol)
 
 		proto.trBlock = trblock
-		proto.onDoneCB = doneCB
-
 		r := monitor.NewMeasure("round_pbft")
+		refused := monitor.NewMeasure("round_pbft_refused")
+		// a round we gave up on may still finish
+		doneChan := make(chan bool, 1)
+		proto.onDoneCB = func() {
+			doneChan <- true
+		}
+		proto.onRefusedCB = func() {
+			refused.Measure()
+			doneChan <- false
+		}
+
 		err = proto.PrePrepare()
 		if err != nil {
 			dbg.Error("Couldn't start PrePrepare")
@@ -109,10 +125,33 @@ func (e *Simulation) Run(sdaConf *sda.SimulationConfig) error {
 		}
 
 		// wait for finishing pbft:
-		<-doneChan
+		if !e.WaitRound(doneChan, "round_pbft_failed") {
+			dbg.Error("Round", round, "has been refused or given up")
+			continue
+		}
 		r.Measure()
 
 		dbg.Lvl1("Finished round", round)
 	}
 	return nil
 }
+
+// transactions returns the transactions of the block signed every round
+func (e *Simulation) transactions() ([]blkparser.Tx, error) {
+	if e.Synthetic {
+		return blockchain.NewGenerator(&e.TxConfig).Generate(e.Blocksize), nil
+	}
+	// FIXME use client instead
+	dir := blockchain.GetBlockDir()
+	parser, err := blockchain.NewParser(dir, magicNum)
+	if err != nil {
+		dbg.Error("Error: Couldn't parse blocks in", dir)
+		return nil, err
+	}
+	transactions, err := parser.Parse(0, e.Blocksize)
+	if err != nil {
+		dbg.Error("Error while parsing transactions", err)
+		return nil, err
+	}
+	return transactions, nil
+}
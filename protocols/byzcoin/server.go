@@ -1,14 +1,45 @@
 package byzcoin
 
 import (
+	"errors"
 	"sync"
+	"time"
 
 	"github.com/dedis/cothority/lib/dbg"
+	"github.com/dedis/cothority/lib/network"
 	"github.com/dedis/cothority/lib/sda"
+	"github.com/dedis/cothority/protocols/byzcoin/blockchain"
 	"github.com/dedis/cothority/protocols/byzcoin/blockchain/blkparser"
 	"github.com/satori/go.uuid"
 )
 
+func init() {
+	network.RegisterMessageType(TransactionSubmit{})
+	network.RegisterMessageType(TransactionAck{})
+}
+
+// MempoolBlocks is how many blocks of transactions the mempool of a
+// ByzCoinServer holds at most.
+const MempoolBlocks = 10
+
+// PendingExpiry is how long a ByzCoinServer waits for a submitted
+// transaction to be acknowledged before refusing it.
+const PendingExpiry = 10 * time.Minute
+
+// TransactionSubmit asks a conode to include Tx in a block. Conodes that
+// don't lead the consensus group forward it to the leader.
+type TransactionSubmit struct {
+	Tx blkparser.Tx
+}
+
+// TransactionAck tells the submitter of the transaction with TxId Hash that
+// it is in the signed block Block, or why it has been refused in Error.
+type TransactionAck struct {
+	Hash  string
+	Block string
+	Error string
+}
+
 type BlockServer interface {
 	AddTransaction(blkparser.Tx)
 	Instantiate(n *sda.Node) (sda.ProtocolInstance, error)
@@ -20,63 +51,246 @@ type BlockServer interface {
 // only the root pariticipates to the creation of the block.
 type ByzCoinServer struct {
 	// transactions pool where all the incoming transactions are stored
-	transactions []blkparser.Tx
+	pool *mempool
 	// lock associated
 	transactionLock sync.Mutex
 	// how many transactions should we give to an instance
 	blockSize int
 	timeOutMs uint64
 	fail      uint
+	// Compact makes the instances send compact blocks
+	Compact bool
+	// ChildTimeoutMs is how long the nodes wait for each level of their
+	// subtree to commit, 0 waits for all of them
+	ChildTimeoutMs uint64
 	// all the protocols byzcoin he generated.Map from RoundID <-> ByzCoin
 	// protocol instance.
 	instances map[uuid.UUID]*ByzCoin
 	// blockSignatureChan is the channel used to pass out the signatures that
 	// ByzCoin's instances have made
 	blockSignatureChan chan BlockSignature
-	// enoughBlock signals the server we have enough
-	// no comments..
-	transactionChan chan blkparser.Tx
-	requestChan     chan bool
-	responseChan    chan []blkparser.Tx
+	// transactionChan signals that a transaction entered the pool
+	transactionChan chan bool
+
+	// host and candidates are set by ListenClientTransactions
+	host       *sda.Host
+	candidates *sda.EntityList
+	// pending maps the TxId of the submitted transactions to the entities
+	// waiting for the acknowledgement, it holds at most as many
+	// transactions as the mempool
+	pending     map[string]*pendingTx
+	maxPending  int
+	pendingLock sync.Mutex
+}
+
+// pendingTx is a submitted transaction waiting for its acknowledgement
+type pendingTx struct {
+	waiting []*network.Entity
+	// forwardedTo is the leader we forwarded the transaction to, the only
+	// one that can acknowledge it
+	forwardedTo *network.Entity
+	expires     time.Time
 }
 
 // NewByzCoinServer returns a new fresh ByzCoinServer. It must be given the blockSize in order
 // to efficiently give the transactions to the ByzCoin instances.
 func NewByzCoinServer(blockSize int, timeOutMs uint64, fail uint) *ByzCoinServer {
-	s := &ByzCoinServer{
+	return &ByzCoinServer{
+		pool:               newMempool(MempoolBlocks * blockSize),
 		blockSize:          blockSize,
 		timeOutMs:          timeOutMs,
 		fail:               fail,
 		instances:          make(map[uuid.UUID]*ByzCoin),
 		blockSignatureChan: make(chan BlockSignature),
-		transactionChan:    make(chan blkparser.Tx),
-		requestChan:        make(chan bool),
-		responseChan:       make(chan []blkparser.Tx),
+		transactionChan:    make(chan bool, 1),
+		pending:            make(map[string]*pendingTx),
+		maxPending:         MempoolBlocks * blockSize,
 	}
-	go s.listenEnoughBlocks()
-	return s
 }
 
+// AddTransaction puts tr in the mempool, unless it is full or already holds
+// tr.
 func (s *ByzCoinServer) AddTransaction(tr blkparser.Tx) {
-	s.transactionChan <- tr
+	if err := s.addTransaction(tr); err != nil {
+		dbg.Lvl4("Dropping transaction:", err)
+	}
 }
 
-// ListenClientTransactions will bind to a port a listen for incoming connection
-// from clients. These client will be able to pass the transactions to the
-// server.
-func (s *ByzCoinServer) ListenClientTransactions() {
-	panic("not implemented yet")
+func (s *ByzCoinServer) addTransaction(tr blkparser.Tx) error {
+	s.transactionLock.Lock()
+	err := s.pool.add(tr)
+	s.transactionLock.Unlock()
+	if err == nil {
+		select {
+		case s.transactionChan <- true:
+		default:
+		}
+	}
+	return err
+}
+
+// ListenClientTransactions makes host accept the TransactionSubmits of
+// clients. The leader of the consensus group out of candidates puts them in
+// its mempool, the other conodes forward them to the leader. Once a
+// transaction is in a block signed by an instance of this server, the
+// submitter gets a TransactionAck.
+func (s *ByzCoinServer) ListenClientTransactions(host *sda.Host, candidates *sda.EntityList) {
+	s.host = host
+	s.candidates = candidates
+	host.RegisterNetworkHandler(network.TypeFromData(TransactionSubmit{}), func(msg *network.NetworkMessage) {
+		go s.handleSubmit(msg.Entity, msg.Msg.(TransactionSubmit).Tx)
+	})
+	host.RegisterNetworkHandler(network.TypeFromData(TransactionAck{}), func(msg *network.NetworkMessage) {
+		ack := msg.Msg.(TransactionAck)
+		go s.acknowledgeForwarded(msg.Entity, &ack)
+	})
+}
+
+// handleSubmit adds tx to the mempool if we lead, else forwards it to the
+// leader. If too many transactions wait for their acknowledgement, tx is
+// refused.
+func (s *ByzCoinServer) handleSubmit(from *network.Entity, tx blkparser.Tx) {
+	id := blockchain.TxId(&tx)
+	s.pendingLock.Lock()
+	expired := s.prunePending()
+	p, forwarded := s.pending[id]
+	full := !forwarded && len(s.pending) >= s.maxPending
+	if !forwarded && !full {
+		p = &pendingTx{expires: time.Now().Add(PendingExpiry)}
+		s.pending[id] = p
+	}
+	if !full {
+		p.waiting = append(p.waiting, from)
+	}
+	s.pendingLock.Unlock()
+	for hash, p := range expired {
+		s.sendAck(p.waiting, &TransactionAck{Hash: hash, Error: "Transaction expired"})
+	}
+	if full {
+		s.sendAck([]*network.Entity{from}, &TransactionAck{Hash: id, Error: "Too many pending transactions"})
+		return
+	}
+	if forwarded {
+		return
+	}
+	AddKnownTransactions(s.host, tx)
+	group, err := ConsensusGroup(s.candidates, chainOf(s.host), 1)
+	if err == nil {
+		leader := group.List[0]
+		if leader.Equal(s.host.Entity) {
+			err = s.addTransaction(tx)
+		} else {
+			dbg.Lvl3(s.host.Entity.First(), "Forwarding transaction to", leader.First())
+			s.pendingLock.Lock()
+			p.forwardedTo = leader
+			s.pendingLock.Unlock()
+			err = s.host.SendRaw(leader, &TransactionSubmit{Tx: tx})
+		}
+	}
+	if err != nil {
+		s.acknowledge(&TransactionAck{Hash: id, Error: err.Error()})
+	}
+}
+
+// prunePending drops the pending transactions that expired and returns
+// them. The pendingLock has to be held.
+func (s *ByzCoinServer) prunePending() map[string]*pendingTx {
+	expired := make(map[string]*pendingTx)
+	now := time.Now()
+	for id, p := range s.pending {
+		if now.After(p.expires) {
+			expired[id] = p
+			delete(s.pending, id)
+		}
+	}
+	return expired
+}
+
+// acknowledge sends ack to everybody waiting for it.
+func (s *ByzCoinServer) acknowledge(ack *TransactionAck) {
+	s.pendingLock.Lock()
+	p := s.pending[ack.Hash]
+	delete(s.pending, ack.Hash)
+	s.pendingLock.Unlock()
+	if p != nil {
+		s.sendAck(p.waiting, ack)
+	}
+}
+
+// acknowledgeForwarded passes on ack if it comes from the leader we
+// forwarded the transaction to, and drops it else.
+func (s *ByzCoinServer) acknowledgeForwarded(from *network.Entity, ack *TransactionAck) {
+	s.pendingLock.Lock()
+	p := s.pending[ack.Hash]
+	if p == nil || p.forwardedTo == nil || !p.forwardedTo.Equal(from) {
+		s.pendingLock.Unlock()
+		dbg.Lvl2(s.host.Entity.First(), "Dropping acknowledgement from", from.First())
+		return
+	}
+	delete(s.pending, ack.Hash)
+	s.pendingLock.Unlock()
+	s.sendAck(p.waiting, ack)
+}
+
+// sendAck sends ack to the entities in waiting
+func (s *ByzCoinServer) sendAck(waiting []*network.Entity, ack *TransactionAck) {
+	for _, e := range waiting {
+		if err := s.host.SendRaw(e, ack); err != nil {
+			dbg.Error("Couldn't acknowledge transaction:", err)
+		}
+	}
+}
+
+// acknowledgeBlock acknowledges all transactions of the signed block, and
+// refuses the transactions of txs that didn't make it into the block, e.g.
+// because a new leader dropped them.
+func (s *ByzCoinServer) acknowledgeBlock(sig *BlockSignature, txs []blkparser.Tx) {
+	if s.host == nil {
+		return
+	}
+	signed := make(map[string]bool)
+	for i := range sig.Block.Txs {
+		id := blockchain.TxId(&sig.Block.Txs[i])
+		signed[id] = true
+		s.acknowledge(&TransactionAck{Hash: id, Block: sig.Block.HeaderHash})
+	}
+	for i := range txs {
+		if id := blockchain.TxId(&txs[i]); !signed[id] {
+			s.acknowledge(&TransactionAck{Hash: id, Error: "Transaction dropped from the block"})
+		}
+	}
+}
+
+// validTransactions drops the transactions that the UTXO set of host
+// refuses, and sends the errors to their submitters.
+func (s *ByzCoinServer) validTransactions(host *sda.Host, txs []blkparser.Tx) []blkparser.Tx {
+	utxo := UTXOSetOf(host)
+	if utxo == nil {
+		return txs
+	}
+	valid, refused := utxo.Filter(txs)
+	for id, err := range refused {
+		s.acknowledge(&TransactionAck{Hash: id, Error: err.Error()})
+	}
+	return valid
 }
 
 // Instantiate takes blockSize transactions and create the byzcoin instances.
 func (s *ByzCoinServer) Instantiate(node *sda.Node) (sda.ProtocolInstance, error) {
 	// wait until we have enough blocks
-	currTransactions := s.waitEnoughBlocks()
+	currTransactions := s.validTransactions(node.Host(), s.waitEnoughBlocks())
 	dbg.Lvl1("Instantiate ByzCoin Round with", len(currTransactions), " transactions")
 	pi, err := NewByzCoinRootProtocol(node, currTransactions, s.timeOutMs, s.fail)
+	if err != nil {
+		return nil, err
+	}
+	pi.compact = s.Compact
+	pi.childTimeout = s.ChildTimeoutMs
+	pi.RegisterOnSignatureDone(func(sig *BlockSignature) {
+		s.acknowledgeBlock(sig, currTransactions)
+	})
 	node.SetProtocolInstance(pi)
-
-	return pi, err
+	return pi, nil
 }
 
 // BlockSignature returns a channel that is given each new block signature as
@@ -89,39 +303,58 @@ func (s *ByzCoinServer) onDoneSign(blk BlockSignature) {
 	s.blockSignatureChan <- blk
 }
 
+// waitEnoughBlocks waits for blockSize transactions in the mempool and
+// takes them out.
 func (s *ByzCoinServer) waitEnoughBlocks() []blkparser.Tx {
-	s.requestChan <- true
-	transactions := <-s.responseChan
-	return transactions
-}
-
-func (s *ByzCoinServer) listenEnoughBlocks() {
-	// TODO the server should have a transaction pool instead:
-	var transactions []blkparser.Tx
-	var want bool
 	for {
-		select {
-		case tr := <-s.transactionChan:
-			// FIXME this will lead to a very large slice if the client sends many
-			if len(transactions) < s.blockSize {
-				transactions = append(transactions, tr)
-			}
-			if want {
-				if len(transactions) >= s.blockSize {
-					s.responseChan <- transactions[:s.blockSize]
-					transactions = transactions[s.blockSize:]
-					want = false
-				}
-			}
-		case <-s.requestChan:
-			want = true
-			if len(transactions) >= s.blockSize {
-				s.responseChan <- transactions[:s.blockSize]
-				transactions = transactions[s.blockSize:]
-				want = false
-			}
+		s.transactionLock.Lock()
+		if len(s.pool.txs) >= s.blockSize {
+			transactions := s.pool.take(s.blockSize)
+			s.transactionLock.Unlock()
+			return transactions
 		}
+		s.transactionLock.Unlock()
+		<-s.transactionChan
+	}
+}
+
+// mempool holds the transactions waiting for a block, in the order they
+// came, without duplicates.
+type mempool struct {
+	txs []blkparser.Tx
+	// TxIds of the transactions in txs
+	hashes map[string]bool
+	max    int
+}
+
+func newMempool(max int) *mempool {
+	return &mempool{
+		hashes: make(map[string]bool),
+		max:    max,
+	}
+}
+
+func (m *mempool) add(tx blkparser.Tx) error {
+	id := blockchain.TxId(&tx)
+	if m.hashes[id] {
+		return errors.New("Transaction already in mempool")
+	}
+	if len(m.txs) >= m.max {
+		return errors.New("Mempool is full")
+	}
+	m.hashes[id] = true
+	m.txs = append(m.txs, tx)
+	return nil
+}
+
+// take removes the first n transactions
+func (m *mempool) take(n int) []blkparser.Tx {
+	txs := m.txs[:n]
+	m.txs = m.txs[n:]
+	for i := range txs {
+		delete(m.hashes, blockchain.TxId(&txs[i]))
 	}
+	return txs
 }
 
 type NtreeServer struct {
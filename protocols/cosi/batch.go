@@ -0,0 +1,195 @@
+package cosi
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+
+	"github.com/dedis/cothority/lib/cosi"
+	"github.com/dedis/cothority/lib/crypto"
+	"github.com/dedis/cothority/lib/dbg"
+	"github.com/dedis/crypto/abstract"
+)
+
+// Batching lets the root sign many messages in one CoSi round: the hashes
+// of the messages are the leaves of a Merkle tree and only the root of the
+// tree is collectively signed. Every message gets its inclusion proof
+// together with the collective signature.
+
+// Batch holds the Merkle tree of a batch of messages
+type Batch struct {
+	// Root of the Merkle tree, which is the message signed by CoSi
+	Root   crypto.HashId
+	proofs []crypto.Proof
+}
+
+// NewBatch builds the Merkle tree of the hashes of msgs
+func NewBatch(suite abstract.Suite, msgs [][]byte) *Batch {
+	leaves := make([]crypto.HashId, len(msgs))
+	for i, m := range msgs {
+		leaves[i] = hashLeaf(suite, m)
+	}
+	root, proofs := crypto.ProofTree(suite.Hash, leaves)
+	return &Batch{
+		Root:   root,
+		proofs: proofs,
+	}
+}
+
+// Signatures returns the BatchSignature of every message of the batch,
+// given the collective signature on the root.
+func (b *Batch) Signatures(cs *cosi.CollectiveSignature) []*BatchSignature {
+	sigs := make([]*BatchSignature, len(b.proofs))
+	for i := range b.proofs {
+		sigs[i] = &BatchSignature{
+			Proof:     b.proofs[i],
+			Signature: cs,
+		}
+	}
+	return sigs
+}
+
+// BatchSignature is the signature of one message of a batch
+type BatchSignature struct {
+	// Proof that the message is in the Merkle tree of the batch
+	Proof crypto.Proof
+	// Signature on the root of the Merkle tree
+	Signature *cosi.CollectiveSignature
+}
+
+// Verify checks that msg is in the batch and that the batch has been
+// signed by the witnesses publics.
+func (bs *BatchSignature) Verify(suite abstract.Suite, msg []byte, publics []abstract.Point) error {
+	if bs.Signature == nil {
+		return errors.New("Missing collective signature")
+	}
+	root := bs.Proof.Calc(suite.Hash, hashLeaf(suite, msg))
+	if !bytes.Equal(root, bs.Signature.Hash) {
+		return errors.New("Message is not in the signed batch")
+	}
+	return bs.Signature.Verify(suite, publics)
+}
+
+// hashLeaf returns the leaf of the Merkle tree for msg
+func hashLeaf(suite abstract.Suite, msg []byte) crypto.HashId {
+	h := suite.Hash()
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+// RoundFunc returns a new root ProtocolCosi for the next round, which has
+// not been started yet.
+type RoundFunc func() (*ProtocolCosi, error)
+
+// Batcher collects the messages of clients and signs them in batches. Only
+// one round runs at a time, the messages coming in meanwhile are signed
+// in the next round.
+type Batcher struct {
+	// MaxBatch is the maximum number of messages per round, 0 for no limit
+	MaxBatch int
+	newRound RoundFunc
+	suite    abstract.Suite
+	sync.Mutex
+	queue   []*batchRequest
+	running bool
+}
+
+type batchRequest struct {
+	msg    []byte
+	result chan batchResult
+}
+
+type batchResult struct {
+	sig *BatchSignature
+	err error
+}
+
+// NewBatcher returns a Batcher that uses newRound to create every round
+func NewBatcher(suite abstract.Suite, newRound RoundFunc) *Batcher {
+	return &Batcher{
+		newRound: newRound,
+		suite:    suite,
+	}
+}
+
+// Sign adds msg to the next batch and returns its signature once the
+// batch has been signed.
+func (b *Batcher) Sign(msg []byte) (*BatchSignature, error) {
+	req := &batchRequest{msg, make(chan batchResult, 1)}
+	b.Lock()
+	b.queue = append(b.queue, req)
+	if !b.running {
+		b.running = true
+		go b.run()
+	}
+	b.Unlock()
+	res := <-req.result
+	return res.sig, res.err
+}
+
+// run signs the queued messages until the queue is empty
+func (b *Batcher) run() {
+	for {
+		b.Lock()
+		n := len(b.queue)
+		if n == 0 {
+			b.running = false
+			b.Unlock()
+			return
+		}
+		if b.MaxBatch > 0 && n > b.MaxBatch {
+			n = b.MaxBatch
+		}
+		reqs := b.queue[:n]
+		b.queue = b.queue[n:]
+		b.Unlock()
+
+		msgs := make([][]byte, n)
+		for i, r := range reqs {
+			msgs[i] = r.msg
+		}
+		sigs, err := b.SignBatch(msgs)
+		for i, r := range reqs {
+			if err != nil {
+				r.result <- batchResult{err: err}
+			} else {
+				r.result <- batchResult{sig: sigs[i]}
+			}
+		}
+	}
+}
+
+// SignBatch signs msgs in one CoSi round and returns their signatures, or
+// the error of the round if it fails.
+func (b *Batcher) SignBatch(msgs [][]byte) ([]*BatchSignature, error) {
+	if len(msgs) == 0 {
+		return nil, errors.New("No messages to sign")
+	}
+	batch := NewBatch(b.suite, msgs)
+	pc, err := b.newRound()
+	if err != nil {
+		return nil, err
+	}
+	dbg.Lvl3(pc.Name(), "signing batch of", len(msgs), "messages")
+	type roundResult struct {
+		cs  *cosi.CollectiveSignature
+		err error
+	}
+	done := make(chan roundResult, 1)
+	pc.SigningMessage(batch.Root)
+	pc.RegisterSignatureCallback(func(*cosi.Signature, []cosi.Exception) {
+		cs, err := pc.CollectiveSignature()
+		done <- roundResult{cs, err}
+	})
+	pc.RegisterErrorCallback(func(err error) {
+		done <- roundResult{err: err}
+	})
+	if err := pc.Start(); err != nil {
+		return nil, err
+	}
+	res := <-done
+	if res.err != nil {
+		return nil, res.err
+	}
+	return batch.Signatures(res.cs), nil
+}
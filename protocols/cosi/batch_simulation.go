@@ -0,0 +1,85 @@
+package cosi
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/dedis/cothority/lib/dbg"
+	"github.com/dedis/cothority/lib/monitor"
+	"github.com/dedis/cothority/lib/sda"
+	"github.com/dedis/crypto/abstract"
+)
+
+func init() {
+	sda.SimulationRegister("BatchCoSiSimulation", NewBatchCoSiSimulation)
+}
+
+// BatchCoSiSimulation signs BatchSize messages per round, so that the
+// throughput is BatchSize divided by the round-time.
+type BatchCoSiSimulation struct {
+	sda.SimulationBFTree
+	BatchSize int
+}
+
+func NewBatchCoSiSimulation(config string) (sda.Simulation, error) {
+	bs := new(BatchCoSiSimulation)
+	_, err := toml.Decode(config, bs)
+	if err != nil {
+		return nil, err
+	}
+	if bs.BatchSize <= 0 {
+		bs.BatchSize = 1
+	}
+	return bs, nil
+}
+
+func (bs *BatchCoSiSimulation) Setup(dir string, hosts []string) (*sda.SimulationConfig, error) {
+	sim := new(sda.SimulationConfig)
+	bs.CreateEntityList(sim, hosts, 2000)
+	err := bs.CreateTree(sim)
+	return sim, err
+}
+
+func (bs *BatchCoSiSimulation) Run(config *sda.SimulationConfig) error {
+	size := len(config.EntityList.List)
+	publics := make([]abstract.Point, size)
+	for i, e := range config.EntityList.List {
+		publics[i] = e.Public
+	}
+	batcher := NewBatcher(config.Host.Suite(), func() (*ProtocolCosi, error) {
+		node, err := config.Overlay.CreateNewNodeName("ProtocolCosi", config.Tree)
+		if err != nil {
+			return nil, err
+		}
+		return node.ProtocolInstance().(*ProtocolCosi), nil
+	})
+	dbg.Lvl1("Simulation starting with: Size=", size, ", Rounds=", bs.Rounds,
+		", BatchSize=", bs.BatchSize)
+	for round := 0; round < bs.Rounds; round++ {
+		dbg.Lvl1("Starting round", round)
+		msgs := make([][]byte, bs.BatchSize)
+		for i := range msgs {
+			msgs[i] = []byte("Batch message " + strconv.Itoa(round) + "-" + strconv.Itoa(i))
+		}
+		roundM := monitor.NewMeasure("round")
+		start := time.Now()
+		sigs, err := batcher.SignBatch(msgs)
+		if err != nil {
+			return err
+		}
+		roundM.Measure()
+		dbg.Lvl1("Round", round, "signed", bs.BatchSize, "messages at",
+			float64(bs.BatchSize)/time.Since(start).Seconds(), "messages/s")
+
+		verifyM := monitor.NewMeasure("verify")
+		if err := sigs[0].Verify(config.Host.Suite(), msgs[0], publics); err != nil {
+			dbg.Lvl1("Round", round, " => fail verification:", err)
+		} else {
+			dbg.Lvl1("Round", round, " => success")
+		}
+		verifyM.Measure()
+	}
+	dbg.Lvl1("Simulation finished")
+	return nil
+}
@@ -0,0 +1,118 @@
+package cosi
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dedis/cothority/lib/dbg"
+	"github.com/dedis/cothority/lib/sda"
+	"github.com/dedis/crypto/abstract"
+)
+
+// TestBatcher lets clients sign messages concurrently and checks every
+// signature.
+func TestBatcher(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	local := sda.NewLocalTest()
+	hosts, el, tree := local.GenBigTree(7, 7, 2, true, true)
+	defer local.CloseAll()
+	suite := hosts[0].Suite()
+	publics := make([]abstract.Point, len(el.List))
+	for i, e := range el.List {
+		publics[i] = e.Public
+	}
+
+	rounds := 0
+	batcher := NewBatcher(suite, func() (*ProtocolCosi, error) {
+		rounds++
+		node, err := hosts[0].CreateNewNodeName("ProtocolCosi", tree)
+		if err != nil {
+			return nil, err
+		}
+		return node.ProtocolInstance().(*ProtocolCosi), nil
+	})
+	batcher.MaxBatch = 8
+
+	nbrMsgs := 20
+	var wg sync.WaitGroup
+	for i := 0; i < nbrMsgs; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			msg := []byte("Message " + strconv.Itoa(i))
+			sig, err := batcher.Sign(msg)
+			if err != nil {
+				t.Error("Couldn't sign:", err)
+				return
+			}
+			if err := sig.Verify(suite, msg, publics); err != nil {
+				t.Error("Signature doesn't verify:", err)
+			}
+			if err := sig.Verify(suite, []byte("Other message"), publics); err == nil {
+				t.Error("Signature verifies another message")
+			}
+		}(i)
+	}
+	wg.Wait()
+	if rounds < (nbrMsgs+batcher.MaxBatch-1)/batcher.MaxBatch {
+		t.Fatal("Batches bigger than MaxBatch")
+	}
+}
+
+// TestBatcherRefused lets a witness refuse the batch, upon which the root
+// cancels the round: the clients get the error of the round.
+func TestBatcherRefused(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	local := sda.NewLocalTest()
+	hosts, _, tree := local.GenBigTree(7, 7, 2, true, true)
+	defer local.CloseAll()
+	refusing := string(tree.Root.Children[0].Id)
+
+	var root *ProtocolCosi
+	fn := func(node *sda.Node) (sda.ProtocolInstance, error) {
+		pc, err := NewProtocolCosi(node)
+		if err != nil {
+			return nil, err
+		}
+		if node.IsRoot() {
+			root = pc
+		} else if string(node.TreeNode().Id) == refusing {
+			pc.RegisterValidationHook(func([]byte) error {
+				root.Cancel()
+				return errors.New("Refusing the batch")
+			})
+		}
+		return pc, nil
+	}
+	sda.ProtocolRegisterName("ProtocolCosiBatchRefused", fn)
+	batcher := NewBatcher(hosts[0].Suite(), func() (*ProtocolCosi, error) {
+		node, err := hosts[0].CreateNewNodeName("ProtocolCosiBatchRefused", tree)
+		if err != nil {
+			return nil, err
+		}
+		return node.ProtocolInstance().(*ProtocolCosi), nil
+	})
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := batcher.Sign([]byte("Refused message"))
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Fatal("Signed a refused batch")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sign didn't return")
+	}
+	// the witnesses still send their commitments to the cancelled root
+	time.Sleep(500 * time.Millisecond)
+}
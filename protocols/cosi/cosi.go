@@ -2,13 +2,16 @@
 package cosi
 
 import (
+	"errors"
 	"fmt"
+	"sync"
+	"time"
+
 	"github.com/dedis/cothority/lib/cosi"
+	"github.com/dedis/cothority/lib/crypto"
 	"github.com/dedis/cothority/lib/dbg"
 	"github.com/dedis/cothority/lib/sda"
 	"github.com/dedis/crypto/abstract"
-	"github.com/satori/go.uuid"
-	"sync"
 )
 
 // This Cosi protocol is the simplest version, the "vanilla" version with the
@@ -17,14 +20,17 @@ import (
 //  - Commitment
 //  - Challenge
 //  - Response
-// It uses lib/cosi as the main structure for the protocol.
+// It uses lib/cosi as the main structure for the protocol. Witnesses that
+// refuse to sign or don't commit in time are recorded as exceptions, the
+// ones failing after their commitment make the round restart without them,
+// see exception.go.
 
 // ProtocolCosi is the main structure holding the round and the sda.Node.
 type ProtocolCosi struct {
 	// The node that represents us
 	*sda.Node
 	// TreeNodeId cached
-	treeNodeId uuid.UUID
+	treeNodeId crypto.HashId
 	// the cosi struct we use (since it is a cosi protocol)
 	// Public because we will need it from other protocols.
 	Cosi *cosi.Cosi
@@ -40,14 +46,32 @@ type ProtocolCosi struct {
 	response chan chanResponse
 	// the channel that indicates if we are finished or not
 	done chan bool
-	// temporary buffer of commitment messages
-	tempCommitment []*CosiCommitment
-	// lock associated
-	tempCommitLock *sync.Mutex
-	// temporary buffer of Response messages
-	tempResponse []*CosiResponse
-	// lock associated
-	tempResponseLock *sync.Mutex
+	// Timeout is how long we wait for one level of children
+	Timeout time.Duration
+	// timeout gets the phase in which the children didn't answer in time
+	timeout chan int
+	timer   *time.Timer
+	phase   int
+	// sendFailed gets the children we couldn't send a message to
+	sendFailed chan sendFailure
+	// mut serializes Start and the handling of the messages
+	mut sync.Mutex
+	// whether we're waiting for commitments or responses
+	waitCommit   bool
+	waitResponse bool
+	// children we couldn't send the announcement or challenge to
+	failed map[string]bool
+	// commitments and responses of the children, indexed by TreeNode-id
+	commitments map[string]*CosiCommitment
+	responses   map[string]*CosiResponse
+	// exceptions of our subtree, passed up with the commitment
+	commitExceptions []cosi.Exception
+	// refusals of our subtree, passed up with the response
+	refusals []abstract.Point
+	// witnesses excluded from this attempt of the round
+	excluded []abstract.Point
+	// next is the attempt the root restarted the round with
+	next *ProtocolCosi
 	// hooks related to the various phase of the protocol.
 	// XXX NOT DEPLOYED YET / NOT IN USE.
 	// announcement hook
@@ -55,6 +79,25 @@ type ProtocolCosi struct {
 	commitmentHook   CommitmentHook
 	challengeHook    ChallengeHook
 	DoneCallback     func(chal abstract.Secret, response abstract.Secret)
+	// validationHook is called by every witness with the message to sign
+	validationHook ValidationHook
+	// SignatureCallback is called by the root with the signature and the
+	// exceptions
+	SignatureCallback func(sig *cosi.Signature, exceptions []cosi.Exception)
+	// CommitmentDoneCallback is called by the root once it aggregated the
+	// commitments, before the challenge is sent
+	CommitmentDoneCallback func()
+	// PrecommitCallback is called by the root once a precommit round is done
+	PrecommitCallback func()
+	// ErrorCallback is called by the root instead of the SignatureCallback
+	// if the round fails or is cancelled
+	ErrorCallback func(err error)
+	// finished is set once the round is stopped
+	finished bool
+	// rounds to commit to in advance, see precommit.go
+	rounds []uint64
+	// round is the round committed to in advance we're signing in, or 0
+	round uint64
 }
 
 // NewProtocolCosi returns a ProtocolCosi with the node set with the right channels.
@@ -70,11 +113,15 @@ type ProtocolCosi struct {
 func NewProtocolCosi(node *sda.Node) (*ProtocolCosi, error) {
 	var err error
 	pc := &ProtocolCosi{
-		Cosi:             cosi.NewCosi(node.Suite(), node.Private()),
-		Node:             node,
-		done:             make(chan bool),
-		tempCommitLock:   new(sync.Mutex),
-		tempResponseLock: new(sync.Mutex),
+		Cosi:        cosi.NewCosi(node.Suite(), node.Private()),
+		Node:        node,
+		done:        make(chan bool),
+		Timeout:     DefaultTimeout,
+		timeout:     make(chan int),
+		sendFailed:  make(chan sendFailure),
+		failed:      make(map[string]bool),
+		commitments: make(map[string]*CosiCommitment),
+		responses:   make(map[string]*CosiResponse),
 	}
 	// Register the three channels we want to register and listens on
 	// By passing pointer = automatic instantiation
@@ -97,25 +144,50 @@ func NewRootProtocolCosi(msg []byte, node *sda.Node) (*ProtocolCosi, error) {
 // Start() will call the announcement function of its inner Round structure. It
 // will pass nil as *in* message.
 func (pc *ProtocolCosi) Start() error {
+	pc.mut.Lock()
+	defer pc.mut.Unlock()
+	if pc.finished {
+		return errors.New("Round already stopped")
+	}
+	if pc.round != 0 {
+		err := pc.startPrecommitted()
+		if err != nil {
+			pc.abort()
+		}
+		return err
+	}
 	return pc.StartAnnouncement()
 }
 
-// Dispatch will listen on the four channels we use (i.e. four steps)
+// Dispatch will listen on the four channels we use (i.e. four steps) and
+// on the timeout. The messages are handled one at a time and not
+// concurrently with Start.
 func (pc *ProtocolCosi) Dispatch() error {
 	for {
-		var err error
+		var handle func() error
 		select {
 		case packet := <-pc.announce:
-			err = pc.handleAnnouncement(&packet.CosiAnnouncement)
+			handle = func() error { return pc.handleAnnouncement(&packet.CosiAnnouncement) }
 		case packet := <-pc.commit:
-			err = pc.handleCommitment(&packet.CosiCommitment)
+			handle = func() error { return pc.handleCommitment(packet.TreeNode, &packet.CosiCommitment) }
 		case packet := <-pc.challenge:
-			err = pc.handleChallenge(&packet.CosiChallenge)
+			handle = func() error { return pc.handleChallenge(&packet.CosiChallenge) }
 		case packet := <-pc.response:
-			err = pc.handleResponse(&packet.CosiResponse)
+			handle = func() error { return pc.handleResponse(packet.TreeNode, &packet.CosiResponse) }
+		case phase := <-pc.timeout:
+			handle = func() error { return pc.handleTimeout(phase) }
+		case f := <-pc.sendFailed:
+			handle = func() error { return pc.handleSendFailure(f) }
 		case <-pc.done:
 			return nil
 		}
+		pc.mut.Lock()
+		err := handle()
+		if err != nil && pc.IsRoot() {
+			// the round can't finish anymore
+			pc.fail(err)
+		}
+		pc.mut.Unlock()
 		if err != nil {
 			dbg.Error("ProtocolCosi -> err treating incoming:", err)
 		}
@@ -131,10 +203,17 @@ func (pc *ProtocolCosi) StartAnnouncement() error {
 	}
 	// otherwise make the announcement  yourself
 	announcement := pc.Cosi.CreateAnnouncement()
+	pc.refuseExcluded()
+	if !pc.isPrecommitting() {
+		pc.validate()
+	}
 
 	out := &CosiAnnouncement{
 		From:         pc.treeNodeId,
 		Announcement: announcement,
+		Message:      pc.message,
+		Rounds:       pc.rounds,
+		Excluded:     pc.excluded,
 	}
 
 	return pc.sendAnnouncement(out)
@@ -154,6 +233,17 @@ func (pc *ProtocolCosi) handleAnnouncement(in *CosiAnnouncement) error {
 
 	// Otherwise, call announcement ourself
 	announcement := pc.Cosi.Announce(in.Announcement)
+	pc.message = in.Message
+	if pc.message == nil {
+		// an empty message gets decoded as nil
+		pc.message = []byte{}
+	}
+	pc.rounds = in.Rounds
+	pc.excluded = in.Excluded
+	pc.refuseExcluded()
+	if !pc.isPrecommitting() {
+		pc.validate()
+	}
 
 	// If we are leaf, we should go to commitment
 	if pc.IsLeaf() {
@@ -162,20 +252,38 @@ func (pc *ProtocolCosi) handleAnnouncement(in *CosiAnnouncement) error {
 	out := &CosiAnnouncement{
 		From:         pc.treeNodeId,
 		Announcement: announcement,
+		Message:      pc.message,
+		Rounds:       pc.rounds,
+		Excluded:     pc.excluded,
 	}
 
 	// send the output to children
 	return pc.sendAnnouncement(out)
 }
 
-// sendAnnouncement simply send the announcement to every children
-func (pc *ProtocolCosi) sendAnnouncement(ann *CosiAnnouncement) error {
-	var err error
-	for _, tn := range pc.Children() {
-		// still try to send to everyone
-		err = pc.SendTo(tn, ann)
+// ValidationHook is called by every witness with the message to sign. If it
+// returns an error, the witness refuses to sign and is an exception.
+type ValidationHook func(msg []byte) error
+
+// validate runs the validation hook on the message to sign and refuses to
+// sign if the message is rejected.
+func (pc *ProtocolCosi) validate() {
+	if pc.Cosi.Refused() || pc.validationHook == nil {
+		return
 	}
-	return err
+	if err := pc.validationHook(pc.message); err != nil {
+		dbg.Lvl2(pc.Name(), "refuses to sign:", err)
+		pc.Refuse()
+	}
+}
+
+// sendAnnouncement simply send the announcement to every children and
+// waits for their commitments. Children we can't reach are exceptions.
+func (pc *ProtocolCosi) sendAnnouncement(ann *CosiAnnouncement) error {
+	pc.waitCommit = true
+	pc.startTimer()
+	pc.sendChildren(pc.Children(), ann)
+	return pc.checkCommitments()
 }
 
 type CommitmentHook func(in []*CosiCommitment) error
@@ -187,52 +295,99 @@ func (pc *ProtocolCosi) StartCommitment() error {
 		return pc.commitmentHook(nil)
 	}
 	// otherwise make it yourself
+	pc.commitExceptions = pc.refuseException()
+	if pc.isPrecommitting() {
+		return pc.sendPrecommits()
+	}
 	commitment := pc.Cosi.CreateCommitment()
 	out := &CosiCommitment{
 		Commitment: commitment,
+		Exceptions: pc.commitExceptions,
 	}
 
 	dbg.Lvl3(pc.Node.Name(), "ProtocolCosi.StartCommitment() Send to", pc.Parent().Id)
 	return pc.SendTo(pc.Parent(), out)
 }
 
-// handleAllCommitment takes the full set of messages from the children and passes
-// it to the parent
-func (pc *ProtocolCosi) handleCommitment(in *CosiCommitment) error {
-	// add to temporary
-	pc.tempCommitLock.Lock()
-	pc.tempCommitment = append(pc.tempCommitment, in)
-	pc.tempCommitLock.Unlock()
-	// do we have enough ?
-	// TODO: exception mechanism will be put into another protocol
-	if len(pc.tempCommitment) < len(pc.Children()) {
+// handleCommitment stores the commitment of a child and goes on once all
+// children sent their commitment.
+func (pc *ProtocolCosi) handleCommitment(from *sda.TreeNode, in *CosiCommitment) error {
+	if !pc.waitCommit {
+		dbg.Lvl2(pc.Name(), "dropping late commitment from", from.Name())
+		return nil
+	}
+	pc.commitments[string(from.Id)] = in
+	return pc.checkCommitments()
+}
+
+// checkCommitments goes on once all children sent their commitment or
+// couldn't be reached.
+func (pc *ProtocolCosi) checkCommitments() error {
+	if len(pc.commitments)+len(pc.failed) < len(pc.Children()) {
+		return nil
+	}
+	return pc.finishCommitment()
+}
+
+// handleTimeout records the missing children as exceptions and goes on
+// with the protocol.
+func (pc *ProtocolCosi) handleTimeout(phase int) error {
+	if phase != pc.phase {
 		return nil
 	}
+	switch {
+	case pc.waitCommit:
+		dbg.Lvl2(pc.Name(), "timeout while waiting for commitments")
+		return pc.finishCommitment()
+	case pc.waitResponse:
+		dbg.Lvl2(pc.Name(), "timeout while waiting for responses")
+		return pc.finishResponse()
+	}
+	return nil
+}
+
+// finishCommitment aggregates the commitments of the children and passes
+// it to the parent. Children without commitment are added as exceptions.
+func (pc *ProtocolCosi) finishCommitment() error {
+	pc.waitCommit = false
+	pc.stopTimer()
 	dbg.Lvl3(pc.Node.Name(), "ProtocolCosi.HandleCommitment aggregated")
+	var inCommits []*CosiCommitment
+	var commits []*cosi.Commitment
+	for _, tn := range pc.Children() {
+		c, ok := pc.commitments[string(tn.Id)]
+		if !ok {
+			pc.commitExceptions = append(pc.commitExceptions,
+				SubtreeExceptions(pc.Suite(), tn)...)
+			continue
+		}
+		inCommits = append(inCommits, c)
+		commits = append(commits, c.Commitment)
+		pc.commitExceptions = append(pc.commitExceptions, c.Exceptions...)
+	}
 	// pass it to the hook
 	if pc.commitmentHook != nil {
-		return pc.commitmentHook(pc.tempCommitment)
+		return pc.commitmentHook(inCommits)
 	}
 
 	// or make continue the cosi protocol
-	commits := make([]*cosi.Commitment, len(pc.tempCommitment))
-	secretVar := pc.Node.Suite().Point().Null()
-	for i := range pc.tempCommitment {
-		secretVar.Add(secretVar, pc.tempCommitment[i].Commitment.Commitment)
-		commits[i] = pc.tempCommitment[i].Commitment
+	pc.commitExceptions = append(pc.commitExceptions, pc.refuseException()...)
+	if pc.isPrecommitting() {
+		return pc.sendPrecommits()
 	}
-
-	// go to Commit()
 	out := pc.Cosi.Commit(commits)
-	secretVar.Add(secretVar, pc.Cosi.GetCommitment())
 	// if we are the root, we need to start the Challenge
 	if pc.IsRoot() {
+		if pc.CommitmentDoneCallback != nil {
+			pc.CommitmentDoneCallback()
+		}
 		return pc.StartChallenge()
 	}
 
 	// otherwise send it to parent
 	outMsg := &CosiCommitment{
 		Commitment: out,
+		Exceptions: pc.commitExceptions,
 	}
 	return pc.SendTo(pc.Parent(), outMsg)
 }
@@ -249,24 +404,32 @@ func (pc *ProtocolCosi) StartChallenge() error {
 	if pc.message == nil {
 		return fmt.Errorf("%s StartChallenge() called without message (=%v)", pc.Node.Name(), pc.message)
 	}
-	challenge, err := pc.Cosi.CreateChallenge(pc.message)
+	challenge, err := pc.Cosi.CreateChallenge(pc.EntityList().Aggregate, pc.message)
 	if err != nil {
 		return err
 	}
-	out := &CosiChallenge{
-		Challenge: challenge,
-	}
 	dbg.Lvl3(pc.Node.Name(), "ProtocolCosi.StartChallenge() chal=", fmt.Sprintf("%+v", challenge))
-	return pc.sendChallenge(out)
+	return pc.sendChallenge(pc.newChallenge(challenge))
 
 }
 
 // handleChallenge dispatch the challenge to the round and then dispatch the
-// results down the tree.
+// results down the tree. A challenge that is not the one of the message we
+// validated is refused.
 func (pc *ProtocolCosi) handleChallenge(in *CosiChallenge) error {
 	// TODO check hook
 
 	dbg.Lvl3(pc.Node.Name(), "ProtocolCosi.HandleChallenge() chal=", fmt.Sprintf("%+v", in.Challenge))
+	if in.Round != 0 {
+		if err := pc.handlePrecommitted(in); err != nil {
+			pc.abort()
+			return err
+		}
+	}
+	if err := cosi.VerifyChallenge(pc.Suite(), pc.EntityList().Aggregate, pc.message, in.Challenge); err != nil {
+		dbg.Lvl2(pc.Name(), "refuses the challenge:", err)
+		pc.refuseCommitted()
+	}
 	// else dispatch it to cosi
 	challenge := pc.Cosi.Challenge(in.Challenge)
 
@@ -276,20 +439,37 @@ func (pc *ProtocolCosi) handleChallenge(in *CosiChallenge) error {
 	}
 
 	// otherwise send it to children
+	return pc.sendChallenge(pc.newChallenge(challenge))
+}
+
+// newChallenge returns the challenge for our children. The message is
+// only sent in rounds committed to in advance.
+func (pc *ProtocolCosi) newChallenge(challenge *cosi.Challenge) *CosiChallenge {
 	out := &CosiChallenge{
 		Challenge: challenge,
+		Message:   []byte{},
+	}
+	if pc.round != 0 {
+		out.Round = pc.round
+		out.Message = pc.message
 	}
-	return pc.sendChallenge(out)
+	return out
 }
 
-// sendChallenge sends the challenge down the tree.
+// sendChallenge sends the challenge down the tree to all children that
+// sent a commitment and waits for their responses.
 func (pc *ProtocolCosi) sendChallenge(out *CosiChallenge) error {
-	var err error
+	pc.failed = make(map[string]bool)
+	pc.waitResponse = true
+	pc.startTimer()
+	var committed []*sda.TreeNode
 	for _, tn := range pc.Children() {
-		err = pc.SendTo(tn, out)
+		if _, ok := pc.commitments[string(tn.Id)]; ok {
+			committed = append(committed, tn)
+		}
 	}
-	return err
-
+	pc.sendChildren(committed, out)
+	return pc.checkResponses()
 }
 
 func (pc *ProtocolCosi) StartResponse() error {
@@ -301,6 +481,7 @@ func (pc *ProtocolCosi) StartResponse() error {
 	}
 	out := &CosiResponse{
 		Response: resp,
+		Refusals: pc.refusals,
 	}
 	dbg.Lvl3(pc.Node.Name(), "ProtocolCosi().StartResponse()")
 	err = pc.SendTo(pc.Parent(), out)
@@ -308,58 +489,189 @@ func (pc *ProtocolCosi) StartResponse() error {
 	return err
 }
 
-// handleResponse brings up the response of each node in the tree to the root.
-func (pc *ProtocolCosi) handleResponse(in *CosiResponse) error {
-	// add to temporary
-	pc.tempResponseLock.Lock()
-	pc.tempResponse = append(pc.tempResponse, in)
-	pc.tempResponseLock.Unlock()
-	// do we have enough ?
-	dbg.Lvl3(pc.Node.Name(), "ProtocolCosi.HandleResponse() has", len(pc.tempResponse), "responses")
-	if len(pc.tempResponse) < len(pc.Children()) {
+// handleResponse stores the response of a child and goes on once all
+// children that committed sent their response.
+func (pc *ProtocolCosi) handleResponse(from *sda.TreeNode, in *CosiResponse) error {
+	if !pc.waitResponse {
+		dbg.Lvl2(pc.Name(), "dropping late response from", from.Name())
 		return nil
 	}
-	defer pc.Cleanup()
+	pc.responses[string(from.Id)] = in
+	dbg.Lvl3(pc.Node.Name(), "ProtocolCosi.HandleResponse() has", len(pc.responses), "responses")
+	return pc.checkResponses()
+}
+
+// checkResponses goes on once all children that committed sent their
+// response or couldn't be reached.
+func (pc *ProtocolCosi) checkResponses() error {
+	if len(pc.responses)+len(pc.failed) < len(pc.commitments) {
+		return nil
+	}
+	return pc.finishResponse()
+}
+
+// finishResponse brings up the response of each node in the tree to the
+// root. Children that committed but didn't respond are refusals. The
+// responses are only verified if there are no refusals, else the root
+// restarts the round.
+func (pc *ProtocolCosi) finishResponse() error {
+	pc.waitResponse = false
+	pc.stopTimer()
 
 	dbg.Lvl3(pc.Node.Name(), "ProtocolCosi.HandleResponse() aggregated")
 	// TODO check the hook
 
 	// else do it yourself
-	responses := make([]*cosi.Response, len(pc.tempResponse))
-	for i := range pc.tempResponse {
-		responses[i] = pc.tempResponse[i].Response
+	var responses []*cosi.Response
+	for _, tn := range pc.Children() {
+		if _, ok := pc.commitments[string(tn.Id)]; !ok {
+			continue
+		}
+		r, ok := pc.responses[string(tn.Id)]
+		if !ok {
+			pc.refusals = append(pc.refusals, tn.Entity.Public)
+			continue
+		}
+		responses = append(responses, r.Response)
+		pc.refusals = append(pc.refusals, r.Refusals...)
 	}
 	outResponse, err := pc.Cosi.Response(responses)
+	if err == nil && len(pc.refusals) == 0 {
+		// verify the responses at each level with the aggregate public key
+		// of this subtree.
+		err = pc.Cosi.VerifyResponsesWithException(pc.TreeNode().PublicAggregateSubTree,
+			pc.Exceptions())
+		if err != nil {
+			err = fmt.Errorf("%s Verifcation of responses failed:%s", pc.Name(), err)
+		}
+	}
 	if err != nil {
+		if pc.IsRoot() {
+			// there is no signature
+			pc.fail(err)
+		} else {
+			pc.Cleanup()
+		}
 		return err
 	}
 
-	// verify the responses at each level with the aggregate public key of this
-	// subtree.
-	if err := pc.Cosi.VerifyResponses(pc.TreeNode().PublicAggregateSubTree); err != nil {
-		return fmt.Errorf("%s Verifcation of responses failed:%s", pc.Name(), err)
+	if pc.IsRoot() {
+		if len(pc.refusals) > 0 {
+			return pc.restart()
+		}
+		pc.Cleanup()
+		return nil
 	}
-
+	// send it back to parent
+	defer pc.Cleanup()
 	out := &CosiResponse{
 		Response: outResponse,
+		Refusals: pc.refusals,
 	}
-	// send it back to parent
+	return pc.SendTo(pc.Parent(), out)
+}
+
+// Exceptions returns the exceptions of our subtree. For the root, these
+// are the exceptions needed to verify the signature.
+func (pc *ProtocolCosi) Exceptions() []cosi.Exception {
+	return append([]cosi.Exception{}, pc.commitExceptions...)
+}
+
+// CollectiveSignature returns the self-describing signature of the round,
+// with the EntityList as roster. Only the root has the signature, and only
+// once the round is done.
+func (pc *ProtocolCosi) CollectiveSignature() (*cosi.CollectiveSignature, error) {
 	if !pc.IsRoot() {
-		return pc.SendTo(pc.Parent(), out)
+		return nil, errors.New("Only the root has the collective signature")
 	}
-	return nil
+	el := pc.EntityList()
+	publics := make([]abstract.Point, len(el.List))
+	for i, e := range el.List {
+		publics[i] = e.Public
+	}
+	return cosi.NewCollectiveSignature(pc.Suite(), pc.message, el.Id, publics,
+		pc.Cosi.Signature(), pc.Exceptions())
+}
+
+// Refuse makes this node refuse to sign. It will still pass on the
+// commitments and responses of its children. It has to be called before
+// the commitment phase.
+func (pc *ProtocolCosi) Refuse() {
+	pc.Cosi.Refuse()
 }
 
 // Closes the protocol
 func (pc *ProtocolCosi) Cleanup() {
+	if pc.finished {
+		return
+	}
 	dbg.Lvl3(pc.Entity().First(), "Cleaning up")
+	if pc.isPrecommitting() {
+		if pc.IsRoot() && pc.PrecommitCallback != nil {
+			pc.PrecommitCallback()
+		}
+		pc.abort()
+		return
+	}
 	// if callback when finished
 	if pc.DoneCallback != nil {
 		pc.DoneCallback(pc.Cosi.GetChallenge(), pc.Cosi.GetAggregateResponse())
 	}
-	close(pc.done)
+	if pc.IsRoot() && pc.SignatureCallback != nil {
+		pc.SignatureCallback(pc.Cosi.Signature(), pc.Exceptions())
+	}
+	pc.abort()
+}
+
+// abort stops the protocol without calling the callbacks
+func (pc *ProtocolCosi) abort() {
+	if pc.finished {
+		return
+	}
+	pc.stop()
 	pc.Node.Done()
+}
 
+// stop makes Dispatch return
+func (pc *ProtocolCosi) stop() {
+	if !pc.finished {
+		pc.finished = true
+		close(pc.done)
+	}
+}
+
+// fail stops the round because of err, the root reports it to the
+// ErrorCallback.
+func (pc *ProtocolCosi) fail(err error) {
+	if pc.finished {
+		return
+	}
+	if pc.IsRoot() && pc.ErrorCallback != nil {
+		pc.ErrorCallback(err)
+	}
+	pc.abort()
+}
+
+// Cancel stops the round, the root calls the ErrorCallback.
+func (pc *ProtocolCosi) Cancel() {
+	pc.mut.Lock()
+	next := pc.next
+	if next == nil {
+		pc.fail(errors.New("Round cancelled"))
+	}
+	pc.mut.Unlock()
+	if next != nil {
+		// the restarted attempt reports to us
+		next.Cancel()
+	}
+}
+
+// Shutdown stops the round when the host closes
+func (pc *ProtocolCosi) Shutdown() error {
+	pc.mut.Lock()
+	defer pc.mut.Unlock()
+	pc.stop()
+	return nil
 }
 
 // SigningMessage simply set the message to sign for this round
@@ -381,6 +693,30 @@ func (pc *ProtocolCosi) RegisterChallengeHook(fn ChallengeHook) {
 	pc.challengeHook = fn
 }
 
+// RegisterCommitmentDoneCallback registers a function that is called by
+// the root once the commitments are aggregated. It must not block.
+func (pc *ProtocolCosi) RegisterCommitmentDoneCallback(fn func()) {
+	pc.CommitmentDoneCallback = fn
+}
+
+// RegisterValidationHook registers the function every witness uses to
+// validate the message before signing it.
+func (pc *ProtocolCosi) RegisterValidationHook(fn ValidationHook) {
+	pc.validationHook = fn
+}
+
 func (pc *ProtocolCosi) RegisterDoneCallback(fn func(chal, resp abstract.Secret)) {
 	pc.DoneCallback = fn
 }
+
+// RegisterErrorCallback registers a function that is called by the root if
+// the round fails or is cancelled, instead of the SignatureCallback.
+func (pc *ProtocolCosi) RegisterErrorCallback(fn func(err error)) {
+	pc.ErrorCallback = fn
+}
+
+// RegisterSignatureCallback registers a function that is called by the root
+// with the final signature and the exceptions needed to verify it.
+func (pc *ProtocolCosi) RegisterSignatureCallback(fn func(sig *cosi.Signature, exceptions []cosi.Exception)) {
+	pc.SignatureCallback = fn
+}
@@ -1,10 +1,14 @@
 package cosi
 
 import (
+	"bytes"
+	"errors"
 	"github.com/dedis/cothority/lib/cosi"
 	"github.com/dedis/cothority/lib/dbg"
+	"github.com/dedis/cothority/lib/network"
 	"github.com/dedis/cothority/lib/sda"
 	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/nist"
 	"testing"
 	"time"
 )
@@ -62,3 +66,285 @@ func TestCosi(t *testing.T) {
 		t.Fatal("Could not get signature verification done in time")
 	}
 }
+
+// TestCosiSuite runs a round on hosts using P-256 instead of the default
+// suite.
+func TestCosiSuite(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	local := sda.NewLocalTest()
+	local.Suite = nist.NewAES128SHA256P256()
+	hosts, el, tree := local.GenBigTree(5, 5, 2, true, true)
+	defer local.CloseAll()
+	suite := el.Suite()
+	if suite.String() != local.Suite.String() {
+		t.Fatal("EntityList should use", local.Suite, "but uses", suite)
+	}
+
+	node, err := hosts[0].CreateNewNodeName("ProtocolCosi", tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc := node.ProtocolInstance().(*ProtocolCosi)
+	msg := []byte("Hello World Cosi on P-256")
+	pc.SigningMessage(msg)
+	done := make(chan bool, 1)
+	pc.RegisterSignatureCallback(func(sig *cosi.Signature, exceptions []cosi.Exception) {
+		if err := cosi.VerifyCosiSignatureWithException(suite, el.Aggregate, msg, sig, exceptions); err != nil {
+			t.Error("Signature doesn't verify:", err)
+		}
+		if cosi.VerifyCosiSignatureWithException(network.Suite, el.Aggregate, msg, sig, exceptions) == nil {
+			t.Error("Signature shouldn't verify with the default suite")
+		}
+		done <- true
+	})
+	if err := pc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second * 2):
+		t.Fatal("Round didn't finish in time")
+	}
+}
+
+// TestCosiException muzzles nodes by making them refuse to sign and kills
+// nodes at different depths, before the round or once they committed. The
+// root must still create a signature that verifies with the exceptions.
+func TestCosiException(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	// paths of the TreeNodes as index of the children, starting at the root
+	tests := []struct {
+		refuse [][]int
+		kill   [][]int
+		// killed once the root aggregated the commitments
+		killCommitted [][]int
+	}{
+		{refuse: [][]int{{0}, {1, 1, 0}}},
+		{kill: [][]int{{0, 1}, {1, 0, 1}}},
+		{refuse: [][]int{{}, {0, 0, 0}}, kill: [][]int{{1}}},
+		{killCommitted: [][]int{{0, 1, 0}}},
+		{refuse: [][]int{{0}}, killCommitted: [][]int{{1}}},
+	}
+	for i, test := range tests {
+		dbg.Lvl2("Running test", i)
+		testCosiException(t, test.refuse, test.kill, test.killCommitted)
+	}
+}
+
+func testCosiException(t *testing.T, refuse, kill, killCommitted [][]int) {
+	local := sda.NewLocalTest()
+	hosts, el, tree := local.GenBigTree(15, 15, 2, true, true)
+	defer local.CloseAll()
+	msg := []byte("Hello World Cosi with exceptions")
+
+	getTreeNode := func(path []int) *sda.TreeNode {
+		tn := tree.Root
+		for _, i := range path {
+			tn = tn.Children[i]
+		}
+		return tn
+	}
+	refused := make(map[string]bool)
+	nbrExceptions := 0
+	for _, p := range refuse {
+		refused[string(getTreeNode(p).Id)] = true
+		nbrExceptions++
+	}
+	killHosts := func(paths [][]int) {
+		for _, p := range paths {
+			tn := getTreeNode(p)
+			for _, h := range hosts {
+				if h.Entity.Equal(tn.Entity) {
+					h.Close()
+					delete(local.Hosts, string(h.Entity.Id))
+				}
+			}
+		}
+	}
+	for _, p := range append(kill, killCommitted...) {
+		getTreeNode(p).Visit(0, func(int, *sda.TreeNode) { nbrExceptions++ })
+	}
+	killHosts(kill)
+
+	done := make(chan bool)
+	var root *ProtocolCosi
+	sigCallback := func(sig *cosi.Signature, exceptions []cosi.Exception) {
+		suite := hosts[0].Suite()
+		aggPublic := tree.Root.PublicAggregateSubTree
+		if len(exceptions) != nbrExceptions {
+			t.Fatal("Expected", nbrExceptions, "exceptions, got", len(exceptions))
+		}
+		if err := cosi.VerifyCosiSignatureWithException(suite, aggPublic, msg, sig, exceptions); err != nil {
+			t.Fatal("Error verifying signature with exceptions:", err)
+		}
+		if err := cosi.VerifySignature(suite, msg, aggPublic, sig.Challenge, sig.Response); err == nil {
+			t.Fatal("Signature shouldn't verify without exceptions")
+		}
+		cs, err := root.CollectiveSignature()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cs.Participants() != len(el.List)-nbrExceptions {
+			t.Fatal("Wrong number of participants:", cs.Participants())
+		}
+		publics := make([]abstract.Point, len(el.List))
+		for i, e := range el.List {
+			publics[i] = e.Public
+		}
+		if err := cs.Verify(suite, publics); err != nil {
+			t.Fatal("Error verifying collective signature:", err)
+		}
+		done <- true
+	}
+	fn := func(node *sda.Node) (sda.ProtocolInstance, error) {
+		pc, err := NewProtocolCosi(node)
+		if err != nil {
+			return nil, err
+		}
+		pc.Timeout = 100 * time.Millisecond
+		if refused[string(node.TreeNode().Id)] {
+			pc.Refuse()
+		}
+		if node.IsRoot() {
+			root = pc
+			pc.SigningMessage(msg)
+			pc.RegisterSignatureCallback(sigCallback)
+			// the round restarts without the nodes that committed and
+			// didn't respond, where they didn't commit anymore
+			pc.RegisterCommitmentDoneCallback(func() {
+				killHosts(killCommitted)
+			})
+		}
+		return pc, nil
+	}
+	sda.ProtocolRegisterName("ProtocolCosiException", fn)
+	_, err := local.StartNewNodeName("ProtocolCosiException", tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Could not get signature verification done in time")
+	}
+	if len(kill)+len(killCommitted) > 0 {
+		// wait for the connection-attempts to the killed hosts to fail
+		time.Sleep(2 * network.MaxRetry * network.WaitRetry)
+	}
+}
+
+// TestCosiValidation lets some witnesses reject the message, which makes
+// them exceptions.
+func TestCosiValidation(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	local := sda.NewLocalTest()
+	_, el, tree := local.GenBigTree(7, 7, 2, true, true)
+	defer local.CloseAll()
+	msg := []byte("Hello World Cosi with validation")
+	reject := map[string]bool{
+		string(tree.Root.Children[0].Id):             true,
+		string(tree.Root.Children[1].Children[1].Id): true,
+	}
+
+	done := make(chan bool)
+	var root *ProtocolCosi
+	sigCallback := func(sig *cosi.Signature, exceptions []cosi.Exception) {
+		if len(exceptions) != len(reject) {
+			t.Fatal("Expected", len(reject), "exceptions, got", len(exceptions))
+		}
+		cs, err := root.CollectiveSignature()
+		if err != nil {
+			t.Fatal(err)
+		}
+		publics := make([]abstract.Point, len(el.List))
+		for i, e := range el.List {
+			publics[i] = e.Public
+		}
+		if err := cs.Verify(root.Suite(), publics); err != nil {
+			t.Fatal("Error verifying collective signature:", err)
+		}
+		done <- true
+	}
+	fn := func(node *sda.Node) (sda.ProtocolInstance, error) {
+		pc, err := NewProtocolCosi(node)
+		if err != nil {
+			return nil, err
+		}
+		id := string(node.TreeNode().Id)
+		pc.RegisterValidationHook(func(m []byte) error {
+			if !bytes.Equal(m, msg) {
+				t.Fatal("Witness got wrong message", m)
+			}
+			if reject[id] {
+				return errors.New("Rejected")
+			}
+			return nil
+		})
+		if node.IsRoot() {
+			root = pc
+			pc.SigningMessage(msg)
+			pc.RegisterSignatureCallback(sigCallback)
+		}
+		return pc, nil
+	}
+	sda.ProtocolRegisterName("ProtocolCosiValidation", fn)
+	if _, err := local.StartNewNodeName("ProtocolCosiValidation", tree); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Could not get signature verification done in time")
+	}
+}
+
+// TestCosiSwappedMessage lets the root announce one message and create the
+// challenge for another one: all witnesses must refuse the challenge, so
+// that the round restarts without any of them.
+func TestCosiSwappedMessage(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	local := sda.NewLocalTest()
+	_, el, tree := local.GenBigTree(7, 7, 2, true, true)
+	defer local.CloseAll()
+	msg := []byte("Hello World Cosi")
+	other := []byte("Hello Other World")
+
+	done := make(chan bool)
+	sigCallback := func(sig *cosi.Signature, exceptions []cosi.Exception) {
+		if len(exceptions) != len(el.List)-1 {
+			t.Fatal("All witnesses should refuse, got", len(exceptions), "exceptions")
+		}
+		done <- true
+	}
+	fn := func(node *sda.Node) (sda.ProtocolInstance, error) {
+		pc, err := NewProtocolCosi(node)
+		if err != nil {
+			return nil, err
+		}
+		if node.IsRoot() {
+			pc.SigningMessage(msg)
+			pc.RegisterCommitmentDoneCallback(func() {
+				pc.SigningMessage(other)
+			})
+			pc.RegisterSignatureCallback(sigCallback)
+		}
+		return pc, nil
+	}
+	sda.ProtocolRegisterName("ProtocolCosiSwapped", fn)
+	if _, err := local.StartNewNodeName("ProtocolCosiSwapped", tree); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Could not get signature in time")
+	}
+}
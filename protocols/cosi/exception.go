@@ -1,27 +1,222 @@
 package cosi
 
 import (
+	"errors"
+	"time"
+
+	"github.com/dedis/cothority/lib/cosi"
+	"github.com/dedis/cothority/lib/dbg"
 	"github.com/dedis/cothority/lib/sda"
+	"github.com/dedis/crypto/abstract"
 )
 
-// ExceptionProtocol handles the exception mechanisms.
-type ProtocolException struct {
-	*sda.Node
-	cosi *ProtocolCosi
+// This file holds the exception mechanism of CoSi. A witness that refuses
+// to sign or that doesn't commit in time is recorded as a cosi.Exception
+// with the null commitment:
+//  - a witness refusing to sign passes up an exception with its own public
+//    key, but still aggregates its children
+//  - if a child doesn't send its commitment, every node of its subtree is
+//    an exception
+// The exceptions travel up the tree with the commitments, so that the root
+// can output the signature together with all exceptions.
+// A witness that fails once its commitment is aggregated can't be an
+// exception, as nothing proves which commitment it contributed:
+//  - a witness refusing the challenge, because it is not the one of the
+//    message it validated, passes up a refusal
+//  - if a child committed but doesn't send its response, the child is a
+//    refusal
+// The refusals travel up the tree with the responses and the root restarts
+// the round without them, see restart.
+
+// DefaultTimeout is how long a node waits for one level of children
+// before recording them as exceptions.
+const DefaultTimeout = 2 * time.Second
+
+// WaitTime returns how long tn waits for the commitments or responses of
+// its subtree: timeout per level below it.
+func WaitTime(tn *sda.TreeNode, timeout time.Duration) time.Duration {
+	height := 0
+	tn.Visit(0, func(d int, n *sda.TreeNode) {
+		if d > height {
+			height = d
+		}
+	})
+	return timeout * time.Duration(height)
+}
+
+// waitTime returns how long we wait for the commitments or responses of
+// our subtree.
+func (pc *ProtocolCosi) waitTime() time.Duration {
+	return WaitTime(pc.TreeNode(), pc.Timeout)
 }
 
-func NewProtocolException(node *sda.Node) (*ProtocolException, error) {
-	pe := &ProtocolException{
-		Node: node,
+// SubtreeExceptions returns an exception for every node in the subtree of
+// tn, all with the null commitment.
+func SubtreeExceptions(suite abstract.Suite, tn *sda.TreeNode) []cosi.Exception {
+	var exs []cosi.Exception
+	tn.Visit(0, func(d int, n *sda.TreeNode) {
+		exs = append(exs, cosi.Exception{
+			Public:     n.Entity.Public,
+			Commitment: suite.Point().Null(),
+		})
+	})
+	return exs
+}
+
+// refuseException returns our own exception if we refused to sign
+func (pc *ProtocolCosi) refuseException() []cosi.Exception {
+	if !pc.Cosi.Refused() {
+		return nil
 	}
-	cosi, err := NewProtocolCosi(node)
-	pe.cosi = cosi
-	return pe, err
+	return []cosi.Exception{{
+		Public:     pc.Public(),
+		Commitment: pc.Suite().Point().Null(),
+	}}
 }
 
-func (pe *ProtocolException) listen() {
+// refuseCommitted makes us refuse to sign once our commitment is
+// aggregated: we pass up a refusal so that the root restarts the round
+// without us.
+func (pc *ProtocolCosi) refuseCommitted() {
+	if pc.Cosi.Refused() {
+		return
+	}
+	pc.Refuse()
+	pc.refusals = append(pc.refusals, pc.Public())
 }
 
-func (pe *ProtocolException) announcementMiddleware(announce AnnouncementHook) {
+// excludedPublic returns whether public is in excluded
+func excludedPublic(excluded []abstract.Point, public abstract.Point) bool {
+	for _, p := range excluded {
+		if p.Equal(public) {
+			return true
+		}
+	}
+	return false
+}
+
+// refuseExcluded makes us refuse to sign if we refused after committing
+// in an earlier attempt of the round.
+func (pc *ProtocolCosi) refuseExcluded() {
+	if excludedPublic(pc.excluded, pc.Public()) {
+		dbg.Lvl2(pc.Name(), "is excluded from this attempt")
+		pc.Refuse()
+	}
+}
 
+// restart starts a new attempt of the round, with a new protocol-instance
+// on the same tree, without the witnesses that refused after committing.
+// It fails if none of them is new, as the attempt would fail the same way.
+// The new attempt reports to the callbacks of this round, except for the
+// CommitmentDoneCallback that is only called once.
+func (pc *ProtocolCosi) restart() error {
+	excluded := pc.excluded
+	for _, p := range pc.refusals {
+		if !excludedPublic(excluded, p) {
+			excluded = append(excluded, p)
+		}
+	}
+	if len(excluded) == len(pc.excluded) {
+		return errors.New("Witnesses refused again after committing")
+	}
+	dbg.Lvl2(pc.Name(), "restarts the round without", len(excluded), "witnesses")
+	node, err := pc.Host().CreateNewNode(pc.Token().ProtocolID, pc.Tree())
+	if err != nil {
+		return err
+	}
+	next, ok := node.ProtocolInstance().(*ProtocolCosi)
+	if !ok {
+		return errors.New("Protocol of the round is not CoSi")
+	}
+	next.message = pc.message
+	next.excluded = excluded
+	next.Timeout = pc.Timeout
+	next.CommitmentDoneCallback = nil
+	next.DoneCallback = nil
+	next.SignatureCallback = func(*cosi.Signature, []cosi.Exception) {
+		pc.mut.Lock()
+		defer pc.mut.Unlock()
+		pc.Cosi = next.Cosi
+		pc.commitExceptions = next.commitExceptions
+		pc.Cleanup()
+	}
+	next.ErrorCallback = func(err error) {
+		pc.mut.Lock()
+		defer pc.mut.Unlock()
+		pc.fail(err)
+	}
+	pc.next = next
+	// the callbacks of next lock us, so it can't be started while we're
+	// locked
+	go func() {
+		if err := next.Start(); err != nil {
+			next.mut.Lock()
+			next.fail(err)
+			next.mut.Unlock()
+		}
+	}()
+	return nil
+}
+
+// startTimer starts a new phase of waiting for the children. If they don't
+// answer within waitTime, the phase is sent to the timeout-channel.
+func (pc *ProtocolCosi) startTimer() {
+	pc.stopTimer()
+	pc.phase++
+	phase := pc.phase
+	pc.timer = time.AfterFunc(pc.waitTime(), func() {
+		select {
+		case pc.timeout <- phase:
+		case <-pc.done:
+		}
+	})
+}
+
+// stopTimer stops the timer of the current phase
+func (pc *ProtocolCosi) stopTimer() {
+	if pc.timer != nil {
+		pc.timer.Stop()
+		pc.timer = nil
+	}
+}
+
+// sendFailure holds a child we couldn't send a message to in a phase
+type sendFailure struct {
+	phase int
+	tn    *sda.TreeNode
+}
+
+// sendChildren sends msg to the children without blocking the protocol,
+// as connecting to a dead child can take longer than the timeout.
+// Children that can't be reached are reported to Dispatch.
+func (pc *ProtocolCosi) sendChildren(children []*sda.TreeNode, msg interface{}) {
+	phase := pc.phase
+	for _, tn := range children {
+		go func(tn *sda.TreeNode) {
+			err := pc.SendTo(tn, msg)
+			if err == nil {
+				return
+			}
+			dbg.Lvl2(pc.Name(), "couldn't send to", tn.Name(), err)
+			select {
+			case pc.sendFailed <- sendFailure{phase, tn}:
+			case <-pc.done:
+			}
+		}(tn)
+	}
+}
+
+// handleSendFailure records a child we couldn't send to
+func (pc *ProtocolCosi) handleSendFailure(f sendFailure) error {
+	if f.phase != pc.phase {
+		return nil
+	}
+	pc.failed[string(f.tn.Id)] = true
+	switch {
+	case pc.waitCommit:
+		return pc.checkCommitments()
+	case pc.waitResponse:
+		return pc.checkResponses()
+	}
+	return nil
 }
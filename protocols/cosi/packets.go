@@ -2,8 +2,9 @@ package cosi
 
 import (
 	"github.com/dedis/cothority/lib/cosi"
+	"github.com/dedis/cothority/lib/crypto"
 	"github.com/dedis/cothority/lib/sda"
-	"github.com/satori/go.uuid"
+	"github.com/dedis/crypto/abstract"
 )
 
 // This files defines the structure we use for registering to the channels by
@@ -14,14 +15,26 @@ import (
 // Broadcasted message initiated and signed by proposer
 type CosiAnnouncement struct {
 	// From = TreeNodeId in the Tree
-	From uuid.UUID
+	From crypto.HashId
 	*cosi.Announcement
+	// Message to be signed, so that every witness can validate it
+	Message []byte
+	// Rounds to commit to in advance instead of signing a message
+	Rounds []uint64
+	// Excluded are the witnesses that refused after committing in an
+	// earlier attempt of the round, they refuse to sign in this one
+	Excluded []abstract.Point
 }
 
 // Commitment of all nodes together with the data they want
 // to have signed
 type CosiCommitment struct {
 	*cosi.Commitment
+	// Exceptions of the subtree: witnesses that refused or didn't commit
+	Exceptions []cosi.Exception
+	// Precommits holds one commitment per round of the announcement when
+	// committing in advance
+	Precommits []*cosi.Commitment
 }
 
 /* Message []byte*/
@@ -41,6 +54,11 @@ type CosiCommitment struct {
 // The challenge calculated by the root-node
 type CosiChallenge struct {
 	*cosi.Challenge
+	// Round is the round committed to in advance, or 0
+	Round uint64
+	// Message is only sent in rounds committed in advance, as there was
+	// no announcement
+	Message []byte
 }
 
 /* Message []byte*/
@@ -51,10 +69,13 @@ type CosiChallenge struct {
 //Proof  proof.Proof   // Merkle Path of Proofs from root to us
 //}
 
-// Every node replies with eventual exceptions if they
-// are not OK
+// Every node replies with the witnesses that failed after the commitment
 type CosiResponse struct {
 	*cosi.Response
+	// Refusals of the subtree: witnesses that refused after committing or
+	// didn't send their response. The root restarts the round without
+	// them.
+	Refusals []abstract.Point
 }
 
 /* Message []byte*/
@@ -0,0 +1,100 @@
+package cosi
+
+import (
+	"sync"
+
+	"github.com/dedis/cothority/lib/cosi"
+)
+
+// Pipelining runs CoSi rounds over the same tree so that they overlap: the
+// next round is started as soon as the root of the current round
+// aggregated all commitments. Its announcement and commitment then run
+// while the current round does its challenge and response.
+
+// RunPipelined runs one round per message, round i signing msgs[i], with
+// every round created by newRound. done is called with the signature of
+// every round, in the order the rounds finish. It returns once all rounds
+// are done, or with the first error.
+func RunPipelined(newRound RoundFunc, msgs [][]byte,
+	done func(round int, sig *cosi.Signature, exceptions []cosi.Exception)) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	var wg sync.WaitGroup
+	var mut sync.Mutex
+	var firstErr error
+	// the rounds started and not yet finished
+	running := make(map[int]*ProtocolCosi)
+	// fail records the first error and cancels the rounds in flight
+	fail := func(round int, err error) {
+		mut.Lock()
+		delete(running, round)
+		if firstErr != nil {
+			mut.Unlock()
+			return
+		}
+		firstErr = err
+		var cancel []*ProtocolCosi
+		for _, pc := range running {
+			cancel = append(cancel, pc)
+		}
+		mut.Unlock()
+		for _, pc := range cancel {
+			go pc.Cancel()
+		}
+	}
+	var start func(round int)
+	start = func(round int) {
+		// a round is finished either by its signature or by an error
+		var finished sync.Once
+		mut.Lock()
+		failed := firstErr != nil
+		mut.Unlock()
+		if failed {
+			finished.Do(wg.Done)
+			return
+		}
+		pc, err := newRound()
+		if err != nil {
+			fail(round, err)
+			finished.Do(wg.Done)
+			return
+		}
+		pc.SigningMessage(msgs[round])
+		pc.RegisterCommitmentDoneCallback(func() {
+			if round+1 < len(msgs) {
+				wg.Add(1)
+				go start(round + 1)
+			}
+		})
+		pc.RegisterSignatureCallback(func(sig *cosi.Signature, exceptions []cosi.Exception) {
+			mut.Lock()
+			delete(running, round)
+			mut.Unlock()
+			done(round, sig, exceptions)
+			finished.Do(wg.Done)
+		})
+		pc.RegisterErrorCallback(func(err error) {
+			fail(round, err)
+			finished.Do(wg.Done)
+		})
+		mut.Lock()
+		if firstErr != nil {
+			// another round failed while we created this one
+			mut.Unlock()
+			pc.Cancel()
+			finished.Do(wg.Done)
+			return
+		}
+		running[round] = pc
+		mut.Unlock()
+		if err := pc.Start(); err != nil {
+			fail(round, err)
+			finished.Do(wg.Done)
+		}
+	}
+	wg.Add(1)
+	start(0)
+	wg.Wait()
+	return firstErr
+}
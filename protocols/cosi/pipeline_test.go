@@ -0,0 +1,112 @@
+package cosi
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/dedis/cothority/lib/cosi"
+	"github.com/dedis/cothority/lib/dbg"
+	"github.com/dedis/cothority/lib/sda"
+)
+
+// TestRunPipelined runs overlapping rounds and checks that every round
+// signed its own message.
+func TestRunPipelined(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	local := sda.NewLocalTest()
+	hosts, el, tree := local.GenBigTree(7, 7, 2, true, true)
+	defer local.CloseAll()
+	suite := hosts[0].Suite()
+	aggPublic := suite.Point().Null()
+	for _, e := range el.List {
+		aggPublic.Add(aggPublic, e.Public)
+	}
+
+	var mut sync.Mutex
+	running, overlaps := 0, 0
+	newRound := func() (*ProtocolCosi, error) {
+		mut.Lock()
+		running++
+		if running > 1 {
+			overlaps++
+		}
+		mut.Unlock()
+		node, err := hosts[0].CreateNewNodeName("ProtocolCosi", tree)
+		if err != nil {
+			return nil, err
+		}
+		return node.ProtocolInstance().(*ProtocolCosi), nil
+	}
+	msgs := make([][]byte, 5)
+	for i := range msgs {
+		msgs[i] = []byte("Pipelined message " + strconv.Itoa(i))
+	}
+	signed := make([]bool, len(msgs))
+	done := func(round int, sig *cosi.Signature, exceptions []cosi.Exception) {
+		mut.Lock()
+		running--
+		signed[round] = true
+		mut.Unlock()
+		if err := cosi.VerifyCosiSignatureWithException(suite, aggPublic, msgs[round], sig, exceptions); err != nil {
+			t.Error("Round", round, "doesn't verify:", err)
+		}
+	}
+	if err := RunPipelined(newRound, msgs, done); err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range signed {
+		if !s {
+			t.Fatal("Round", i, "didn't finish")
+		}
+	}
+	if overlaps == 0 {
+		t.Fatal("No rounds overlapped")
+	}
+}
+
+// TestRunPipelinedError checks that a failing round stops the pipeline
+// and that RunPipelined returns its error.
+func TestRunPipelinedError(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	local := sda.NewLocalTest()
+	hosts, _, tree := local.GenBigTree(7, 7, 2, true, true)
+	defer local.CloseAll()
+
+	var mut sync.Mutex
+	created := 0
+	newRound := func() (*ProtocolCosi, error) {
+		node, err := hosts[0].CreateNewNodeName("ProtocolCosi", tree)
+		if err != nil {
+			return nil, err
+		}
+		pc := node.ProtocolInstance().(*ProtocolCosi)
+		mut.Lock()
+		created++
+		if created == 3 {
+			pc.Cancel()
+		}
+		mut.Unlock()
+		return pc, nil
+	}
+	msgs := make([][]byte, 10)
+	for i := range msgs {
+		msgs[i] = []byte("Pipelined message " + strconv.Itoa(i))
+	}
+	signed := 0
+	done := func(round int, sig *cosi.Signature, exceptions []cosi.Exception) {
+		mut.Lock()
+		signed++
+		mut.Unlock()
+	}
+	if err := RunPipelined(newRound, msgs, done); err == nil {
+		t.Fatal("A cancelled round should return an error")
+	}
+	if signed == len(msgs) {
+		t.Fatal("The pipeline didn't stop")
+	}
+}
@@ -0,0 +1,251 @@
+package cosi
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dedis/cothority/lib/cosi"
+	"github.com/dedis/cothority/lib/dbg"
+	"github.com/dedis/crypto/abstract"
+)
+
+// This file holds the precommitment mode of CoSi. A precommit round only
+// runs the announcement and the commitment phase for a list of future
+// round-numbers: every node generates one commitment per round, aggregates
+// the ones of its children and keeps everything it needs for that round.
+// A later round using one of these round-numbers starts directly with the
+// challenge, which removes two traversals of the tree from signing.
+// The secrets are kept in a cosi.Precommits, so that no commitment is ever
+// used for two challenges. They are stored in the Host and dropped when it
+// closes, or after PrecommitExpiry if the round is never used.
+
+// PrecommitExpiry is how long a node keeps a round committed to in advance
+const PrecommitExpiry = 10 * time.Minute
+
+// precommitted is what a node keeps of a round it committed to in advance
+type precommitted struct {
+	refused bool
+	// commitments of the children for this round, indexed by TreeNode-id
+	commitments map[string]*CosiCommitment
+	// exceptions of the commitment phase
+	exceptions []cosi.Exception
+	// expires is when the round is dropped if it is not used
+	expires time.Time
+}
+
+// precommitStore holds the rounds a TreeNode committed to in advance
+type precommitStore struct {
+	secrets *cosi.Precommits
+	sync.Mutex
+	rounds map[uint64]*precommitted
+}
+
+// prune drops the rounds that expired. The store has to be locked.
+func (ps *precommitStore) prune() {
+	now := time.Now()
+	for round, state := range ps.rounds {
+		if now.After(state.expires) {
+			delete(ps.rounds, round)
+			// the secret is never used
+			ps.secrets.Take(round)
+		}
+	}
+}
+
+// precommitStores holds the store of every TreeNode of a Host, indexed by
+// the ids of the Tree and the TreeNode, as they outlive the
+// protocol-instances.
+type precommitStores struct {
+	sync.Mutex
+	stores map[string]*precommitStore
+}
+
+// getPrecommitStore returns the store of the TreeNode of pc. The stores
+// without any rounds left are dropped.
+func (pc *ProtocolCosi) getPrecommitStore() *precommitStore {
+	pss := pc.Host().Value("cosi.precommit", func() interface{} {
+		return &precommitStores{stores: make(map[string]*precommitStore)}
+	}).(*precommitStores)
+	key := string(pc.Tree().Id) + string(pc.TreeNode().Id)
+	pss.Lock()
+	defer pss.Unlock()
+	for k, ps := range pss.stores {
+		ps.Lock()
+		ps.prune()
+		empty := len(ps.rounds) == 0
+		ps.Unlock()
+		if empty && k != key {
+			delete(pss.stores, k)
+		}
+	}
+	ps, ok := pss.stores[key]
+	if !ok {
+		ps = &precommitStore{
+			secrets: cosi.NewPrecommits(pc.Suite()),
+			rounds:  make(map[uint64]*precommitted),
+		}
+		pss.stores[key] = ps
+	}
+	return ps
+}
+
+// Precommit makes this round commit in advance to rounds instead of
+// signing a message. It has to be called by the root before Start.
+func (pc *ProtocolCosi) Precommit(rounds []uint64) {
+	pc.rounds = rounds
+	// there is no message in a precommit round
+	pc.message = []byte{}
+}
+
+// UsePrecommit makes this round use the commitments of round, made by an
+// earlier precommit round, and start directly with the challenge. It has
+// to be called by the root before Start.
+func (pc *ProtocolCosi) UsePrecommit(round uint64) {
+	pc.round = round
+}
+
+// RegisterPrecommitCallback registers a function that is called by the
+// root once a precommit round is done.
+func (pc *ProtocolCosi) RegisterPrecommitCallback(fn func()) {
+	pc.PrecommitCallback = fn
+}
+
+// precommit generates our commitments for the rounds of the announcement,
+// aggregates them with the ones of the children and stores everything we
+// need for these rounds. It returns the commitments to send up.
+func (pc *ProtocolCosi) precommit() ([]*cosi.Commitment, error) {
+	ps := pc.getPrecommitStore()
+	ps.Lock()
+	defer ps.Unlock()
+	refused := pc.Cosi.Refused()
+	out := make([]*cosi.Commitment, len(pc.rounds))
+	for i, round := range pc.rounds {
+		state := &precommitted{
+			refused:     refused,
+			commitments: make(map[string]*CosiCommitment),
+			exceptions:  pc.commitExceptions,
+			expires:     time.Now().Add(PrecommitExpiry),
+		}
+		var commits []*cosi.Commitment
+		for id, c := range pc.commitments {
+			if i >= len(c.Precommits) {
+				return nil, errors.New("Child sent too few precommitments")
+			}
+			state.commitments[id] = &CosiCommitment{
+				Commitment: c.Precommits[i],
+				Exceptions: c.Exceptions,
+			}
+			commits = append(commits, c.Precommits[i])
+		}
+		var commitment abstract.Point
+		if refused {
+			commitment = pc.Suite().Point().Null()
+		} else {
+			var err error
+			commitment, err = ps.secrets.Generate(round)
+			if err != nil {
+				return nil, err
+			}
+		}
+		out[i] = &cosi.Commitment{
+			Commitment:     commitment,
+			ChildrenCommit: cosi.AggregateCommitments(pc.Suite(), commits),
+		}
+		ps.rounds[round] = state
+	}
+	dbg.Lvl3(pc.Name(), "precommitted to", len(pc.rounds), "rounds")
+	return out, nil
+}
+
+// usePrecommit restores the commitment phase of round, so that the
+// challenge can be handled. The round can be used only once.
+func (pc *ProtocolCosi) usePrecommit(round uint64) error {
+	ps := pc.getPrecommitStore()
+	ps.Lock()
+	state, ok := ps.rounds[round]
+	delete(ps.rounds, round)
+	ps.Unlock()
+	if !ok {
+		return errors.New("No precommitment for this round or already used")
+	}
+	if state.refused {
+		pc.Cosi.Refuse()
+	} else {
+		random, err := ps.secrets.Take(round)
+		if err != nil {
+			return err
+		}
+		pc.Cosi.SetRandom(random)
+	}
+	pc.round = round
+	pc.commitments = state.commitments
+	pc.commitExceptions = state.exceptions
+	var commits []*cosi.Commitment
+	for _, c := range pc.commitments {
+		commits = append(commits, c.Commitment)
+	}
+	pc.Cosi.Commit(commits)
+	return nil
+}
+
+// validatePrecommitted validates the message of a round committed to in
+// advance. As our commitment is already aggregated, refusing to sign makes
+// the root restart the round without us, see refuseCommitted.
+func (pc *ProtocolCosi) validatePrecommitted() {
+	if pc.Cosi.Refused() || pc.validationHook == nil {
+		return
+	}
+	if err := pc.validationHook(pc.message); err != nil {
+		dbg.Lvl2(pc.Name(), "refuses to sign:", err)
+		pc.refuseCommitted()
+	}
+}
+
+// startPrecommitted starts a round committed to in advance with the
+// challenge.
+func (pc *ProtocolCosi) startPrecommitted() error {
+	if err := pc.usePrecommit(pc.round); err != nil {
+		return err
+	}
+	pc.validatePrecommitted()
+	return pc.StartChallenge()
+}
+
+// handlePrecommitted restores the round of a challenge that has been
+// committed to in advance.
+func (pc *ProtocolCosi) handlePrecommitted(in *CosiChallenge) error {
+	pc.message = in.Message
+	if pc.message == nil {
+		pc.message = []byte{}
+	}
+	if err := pc.usePrecommit(in.Round); err != nil {
+		return err
+	}
+	pc.validatePrecommitted()
+	return nil
+}
+
+// isPrecommitting returns whether this round commits in advance
+func (pc *ProtocolCosi) isPrecommitting() bool {
+	return len(pc.rounds) > 0
+}
+
+// sendPrecommits sends our precommitments up the tree, which ends the
+// precommit round for us.
+func (pc *ProtocolCosi) sendPrecommits() error {
+	defer pc.Cleanup()
+	precommits, err := pc.precommit()
+	if err != nil {
+		return err
+	}
+	if pc.IsRoot() {
+		return nil
+	}
+	return pc.SendTo(pc.Parent(), &CosiCommitment{
+		// only the Precommits are used
+		Commitment: &cosi.Commitment{},
+		Exceptions: pc.commitExceptions,
+		Precommits: precommits,
+	})
+}
@@ -0,0 +1,109 @@
+package cosi
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dedis/cothority/lib/cosi"
+	"github.com/dedis/cothority/lib/dbg"
+	"github.com/dedis/cothority/lib/sda"
+)
+
+// TestCosiPrecommit commits in advance to some rounds, signs in these rounds
+// without commitment phase and checks that no round can be used twice.
+func TestCosiPrecommit(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	local := sda.NewLocalTest()
+	hosts, el, tree := local.GenBigTree(7, 7, 2, true, true)
+	defer local.CloseAll()
+	suite := hosts[0].Suite()
+	aggPublic := suite.Point().Null()
+	for _, e := range el.List {
+		aggPublic.Add(aggPublic, e.Public)
+	}
+	// this witness refuses to sign the rejected message
+	rejecting := string(tree.Root.Children[1].Id)
+	rejected := []byte("Rejected message")
+	sda.ProtocolRegisterName("ProtocolCosiPrecommit", func(node *sda.Node) (sda.ProtocolInstance, error) {
+		pc, err := NewProtocolCosi(node)
+		if err != nil {
+			return nil, err
+		}
+		id := string(node.TreeNode().Id)
+		pc.RegisterValidationHook(func(msg []byte) error {
+			if id == rejecting && bytes.Equal(msg, rejected) {
+				return errors.New("Rejected")
+			}
+			return nil
+		})
+		return pc, nil
+	})
+	newRound := func() *ProtocolCosi {
+		node, err := hosts[0].CreateNewNodeName("ProtocolCosiPrecommit", tree)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return node.ProtocolInstance().(*ProtocolCosi)
+	}
+
+	pre := newRound()
+	pre.Precommit([]uint64{1, 2, 3})
+	preDone := make(chan bool, 1)
+	pre.RegisterPrecommitCallback(func() { preDone <- true })
+	if err := pre.Start(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-preDone:
+	case <-time.After(time.Second * 2):
+		t.Fatal("Precommit round didn't finish")
+	}
+
+	sign := func(round uint64, msg []byte) []cosi.Exception {
+		pc := newRound()
+		pc.UsePrecommit(round)
+		pc.SigningMessage(msg)
+		done := make(chan []cosi.Exception, 1)
+		pc.RegisterSignatureCallback(func(sig *cosi.Signature, exceptions []cosi.Exception) {
+			if err := cosi.VerifyCosiSignatureWithException(suite, aggPublic, msg, sig, exceptions); err != nil {
+				t.Error("Round", round, "doesn't verify:", err)
+			}
+			done <- exceptions
+		})
+		if err := pc.Start(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case exceptions := <-done:
+			return exceptions
+		case <-time.After(time.Second * 2):
+			t.Fatal("Round", round, "didn't finish")
+		}
+		return nil
+	}
+	if exs := sign(2, []byte("Hello precommitted round")); len(exs) != 0 {
+		t.Fatal("Round 2 shouldn't have exceptions")
+	}
+	// the witness already committed, so the round restarts without it
+	exs := sign(1, rejected)
+	if len(exs) != 1 {
+		t.Fatal("Round 1 should have one exception, got", len(exs))
+	}
+	if !exs[0].Public.Equal(tree.Root.Children[1].Entity.Public) ||
+		!exs[0].Commitment.Equal(suite.Point().Null()) {
+		t.Fatal("The rejecting witness should be an exception without commitment")
+	}
+
+	for _, round := range []uint64{2, 4} {
+		pc := newRound()
+		pc.UsePrecommit(round)
+		pc.SigningMessage([]byte("Hello again"))
+		if err := pc.Start(); err == nil {
+			t.Fatal("Round", round, "shouldn't be usable")
+		}
+	}
+}
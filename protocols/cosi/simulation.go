@@ -5,7 +5,6 @@ import (
 	"github.com/dedis/cothority/lib/cosi"
 	"github.com/dedis/cothority/lib/dbg"
 	"github.com/dedis/cothority/lib/monitor"
-	"github.com/dedis/cothority/lib/network"
 	"github.com/dedis/cothority/lib/sda"
 	"github.com/dedis/crypto/abstract"
 )
@@ -19,6 +18,8 @@ func init() {
 
 type CoSiSimulation struct {
 	sda.SimulationBFTree
+	// Pipeline overlaps the rounds if it is not 0, see RunPipelined
+	Pipeline int
 }
 
 func NewCoSiSimulation(config string) (sda.Simulation, error) {
@@ -41,43 +42,79 @@ func (cs *CoSiSimulation) Run(config *sda.SimulationConfig) error {
 	size := len(config.EntityList.List)
 	msg := []byte("Hello World Cosi Simulation")
 	aggPublic := computeAggregatedPublic(config.EntityList)
-	dbg.Lvl1("Simulation starting with: Size=", size, ", Rounds=", cs.Rounds)
-	for round := 0; round < cs.Rounds; round++ {
-		dbg.Lvl1("Starting round", round)
-		roundM := monitor.NewMeasure("round")
+	dbg.Lvl1("Simulation starting with: Size=", size, ", Rounds=", cs.Rounds,
+		", Pipeline=", cs.Pipeline)
+	newRound := func() (*ProtocolCosi, error) {
 		// create the node with the protocol, but do NOT start it yet.
 		node, err := config.Overlay.CreateNewNodeName("ProtocolCosi", config.Tree)
 		if err != nil {
+			return nil, err
+		}
+		return node.ProtocolInstance().(*ProtocolCosi), nil
+	}
+	// the measures of the rounds, so that pipelined rounds are measured
+	// from their own start
+	roundMs := make([]*monitor.Measure, cs.Rounds)
+	verify := func(round int, sig *cosi.Signature, exceptions []cosi.Exception) {
+		roundMs[round].Measure()
+		if err := cosi.VerifyCosiSignatureWithException(config.Host.Suite(), aggPublic, msg, sig, exceptions); err != nil {
+			dbg.Lvl1("Round", round, " => fail verification")
+		} else {
+			dbg.Lvl1("Round", round, " => success with", len(exceptions), "exceptions")
+		}
+	}
+	throughputM := monitor.NewMeasure("throughput")
+	if cs.Pipeline != 0 {
+		msgs := make([][]byte, cs.Rounds)
+		for round := range msgs {
+			msgs[round] = msg
+		}
+		// the rounds are created one after the other
+		next := 0
+		newPipelined := func() (*ProtocolCosi, error) {
+			dbg.Lvl1("Starting round", next)
+			roundMs[next] = monitor.NewMeasure("round")
+			next++
+			return newRound()
+		}
+		if err := RunPipelined(newPipelined, msgs, verify); err != nil {
 			return err
 		}
-		// the protocol itself
-		proto := node.ProtocolInstance().(*ProtocolCosi)
-		// give the message to sign
-		proto.SigningMessage(msg)
-		// tell us when it is done
-		done := make(chan bool)
-		fn := func(chal, resp abstract.Secret) {
-			roundM.Measure()
-			if err := proto.Cosi.VerifyResponses(aggPublic); err != nil {
-				dbg.Lvl1("Round", round, " has failed responses")
+	} else {
+		for round := 0; round < cs.Rounds; round++ {
+			dbg.Lvl1("Starting round", round)
+			roundMs[round] = monitor.NewMeasure("round")
+			proto, err := newRound()
+			if err != nil {
+				return err
+			}
+			// give the message to sign
+			proto.SigningMessage(msg)
+			// tell us when it is done or failed
+			done := make(chan error, 1)
+			proto.RegisterSignatureCallback(func(sig *cosi.Signature, exceptions []cosi.Exception) {
+				verify(round, sig, exceptions)
+				done <- nil
+			})
+			proto.RegisterErrorCallback(func(err error) {
+				done <- err
+			})
+			if err := proto.Start(); err != nil {
+				return err
 			}
-			if err := cosi.VerifySignature(network.Suite, msg, aggPublic, chal, resp); err != nil {
-				dbg.Lvl1("Round", round, " => fail verification")
-			} else {
-				dbg.Lvl1("Round", round, " => success")
+			if err := <-done; err != nil {
+				return err
 			}
-			done <- true
 		}
-		proto.RegisterDoneCallback(fn)
-		proto.Start()
-		<-done
 	}
+	// the wall-time of all rounds, the throughput is Rounds divided by it
+	throughputM.Measure()
 	dbg.Lvl1("Simulation finished")
 	return nil
 }
 
 func computeAggregatedPublic(el *sda.EntityList) abstract.Point {
-	suite := network.Suite
+	suite := el.Suite()
 	agg := suite.Point().Null()
 	for _, e := range el.List {
 		agg = agg.Add(agg, e.Public)
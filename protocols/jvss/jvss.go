@@ -10,7 +10,6 @@ import (
 	"github.com/dedis/crypto/abstract"
 	"github.com/dedis/crypto/config"
 	"github.com/dedis/crypto/poly"
-	"github.com/satori/go.uuid"
 	"hash"
 	"sync"
 )
@@ -96,7 +95,7 @@ func NewJVSSProtocol(n *sda.Node) (*JVSSProtocol, error) {
 	nodes := tree.ListNodes()
 	pubs := make([]abstract.Point, len(nodes))
 	for i, tn := range nodes {
-		if uuid.Equal(tn.Id, n.TreeNode().Id) {
+		if tn.Id.Equal(n.TreeNode().Id) {
 			idx = i
 		}
 		pubs[i] = tn.Entity.Public
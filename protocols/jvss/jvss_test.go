@@ -45,7 +45,10 @@ func TestJVSSLongterm(t *testing.T) {
 	}
 	sda.ProtocolRegister(CustomJVSSProtocolID, fn)
 	// Create the entityList  + tree
-	el := sda.NewEntityList([]*network.Entity{h1.Entity, h2.Entity})
+	el, err := sda.NewEntityList([]*network.Entity{h1.Entity, h2.Entity})
+	if err != nil {
+		t.Fatal(err)
+	}
 	h1.AddEntityList(el)
 	tree := el.GenerateBinaryTree()
 	h1.AddTree(tree)
@@ -103,7 +106,10 @@ func TestJVSSSign(t *testing.T) {
 	}
 	sda.ProtocolRegister(CustomJVSSProtocolID, fn)
 	// Create the entityList  + tree
-	el := sda.NewEntityList([]*network.Entity{h1.Entity, h2.Entity})
+	el, err := sda.NewEntityList([]*network.Entity{h1.Entity, h2.Entity})
+	if err != nil {
+		t.Fatal(err)
+	}
 	h1.AddEntityList(el)
 	tree := el.GenerateBinaryTree()
 	h1.AddTree(tree)
@@ -121,7 +127,6 @@ func TestJVSSSign(t *testing.T) {
 	msg := []byte("Hello World\n")
 	doneSig := make(chan bool)
 	var schnorrSig *poly.SchnorrSig
-	var err error
 	go func() {
 		schnorrSig, err = p1.Sign(msg)
 		doneSig <- true
@@ -4,7 +4,6 @@ package manage
 import (
 	"github.com/dedis/cothority/lib/dbg"
 	"github.com/dedis/cothority/lib/sda"
-	"github.com/satori/go.uuid"
 )
 
 // Broadcast will just simply broadcast
@@ -27,7 +26,7 @@ type Broadcast struct {
 	}
 
 	// map for all the nodes => state
-	listNode map[uuid.UUID]*sda.TreeNode
+	listNode map[string]*sda.TreeNode
 	// how many peers are connected with me
 	ackdNode int
 	done     chan bool
@@ -50,14 +49,14 @@ func (b *Broadcast) init(n *sda.Node) *Broadcast {
 	b.RegisterChannel(&b.okChan)
 
 	lists := b.Tree().ListNodes()
-	b.listNode = make(map[uuid.UUID]*sda.TreeNode)
+	b.listNode = make(map[string]*sda.TreeNode)
 	b.ackdNode = 0
 	b.done = make(chan bool, 1)
 	for _, tn := range lists {
-		if uuid.Equal(tn.Id, n.TreeNode().Id) {
+		if tn.Id.Equal(n.TreeNode().Id) {
 			continue
 		}
-		b.listNode[tn.Id] = tn
+		b.listNode[string(tn.Id)] = tn
 	}
 	go b.listen()
 	return b
@@ -101,7 +100,7 @@ func (b *Broadcast) handleAnnounce(tn *sda.TreeNode) {
 // It checks if we have sent an Announce to this treenode (hopefully yes^^)
 // if yes it checks if everyone has been ACK'd, if yes, it finishes.
 func (b *Broadcast) handleACK(tn *sda.TreeNode) {
-	if _, ok := b.listNode[tn.Id]; !ok {
+	if _, ok := b.listNode[string(tn.Id)]; !ok {
 		dbg.Error(b.Name(), "Broadcast Received ACK from unknown treenode")
 	}
 
@@ -115,7 +114,7 @@ func (b *Broadcast) handleACK(tn *sda.TreeNode) {
 }
 
 func (b *Broadcast) handleOk(tn *sda.TreeNode) {
-	if _, ok := b.listNode[tn.Id]; !ok {
+	if _, ok := b.listNode[string(tn.Id)]; !ok {
 		dbg.Error(b.Name(), "Broadcast Received ACK from unknown treenode")
 	}
 
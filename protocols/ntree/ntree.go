@@ -56,7 +56,7 @@ func (p *Protocol) Start() error {
 func (p *Protocol) HandleSignRequest(msg structMessage) error {
 	var err error
 	p.message = msg.Msg
-	p.signature, err = crypto.SignSchnorr(network.Suite, p.Private(), p.message)
+	p.signature, err = crypto.SignSchnorr(p.Suite(), p.Private(), p.message)
 	if err != nil {
 		return err
 	}
@@ -88,7 +88,7 @@ func (p *Protocol) HandleSignReply(reply []structSignatureReply) error {
 		for _, sigs := range reply {
 			childPub := sigs.Entity.Public
 			childSig := sigs.Signatures[0]
-			if err := crypto.VerifySchnorr(network.Suite, childPub, p.message, childSig); err != nil {
+			if err := crypto.VerifySchnorr(p.Suite(), childPub, p.message, childSig); err != nil {
 				dbg.Error(err)
 			}
 			for _, sig := range sigs.Signatures {
@@ -36,4 +36,5 @@ import (
 	_ "github.com/dedis/cothority/protocols/jvss"
 	_ "github.com/dedis/cothority/protocols/manage"
 	_ "github.com/dedis/cothority/protocols/ntree"
+	_ "github.com/dedis/cothority/protocols/timestamp"
 )
@@ -0,0 +1,39 @@
+package timestamp
+
+import (
+	"errors"
+
+	"github.com/dedis/cothority/lib/dbg"
+	"github.com/dedis/cothority/lib/network"
+	"github.com/dedis/cothority/lib/sda"
+	"github.com/dedis/crypto/abstract"
+)
+
+// Client requests timestamps from the root of a timestamping tree
+type Client struct {
+	suite abstract.Suite
+}
+
+// NewClient returns a client using suite, which has to be the suite of the
+// server.
+func NewClient(suite abstract.Suite) *Client {
+	return &Client{suite: suite}
+}
+
+// Stamp sends hash to the server at root and waits for the timestamp. It
+// doesn't verify it, which is up to the caller using StampReply.Verify.
+func (c *Client) Stamp(root *network.Entity, hash []byte) (*StampReply, error) {
+	msg, err := sda.Request(c.suite, root, &StampRequest{Hash: hash}, 0)
+	if err != nil {
+		return nil, err
+	}
+	switch reply := msg.(type) {
+	case StampReply:
+		dbg.Lvl3("Got timestamp for time", reply.Time)
+		return &reply, nil
+	case StampError:
+		return nil, errors.New(reply.Error)
+	default:
+		return nil, errors.New("Unexpected reply from server")
+	}
+}
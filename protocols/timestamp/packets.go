@@ -0,0 +1,36 @@
+package timestamp
+
+import (
+	"github.com/dedis/cothority/lib/cosi"
+	"github.com/dedis/cothority/lib/crypto"
+	"github.com/dedis/cothority/lib/network"
+)
+
+func init() {
+	network.RegisterMessageType(StampRequest{})
+	network.RegisterMessageType(StampReply{})
+	network.RegisterMessageType(StampError{})
+}
+
+// StampRequest is sent by a client to get a timestamp on Hash
+type StampRequest struct {
+	Hash []byte
+}
+
+// StampReply is the timestamp of a hash: the collective signature on the
+// root of the Merkle tree of an epoch together with the time, and the proof
+// that the hash is in the tree.
+type StampReply struct {
+	// Time of the epoch in seconds since 1970, UTC
+	Time int64
+	// Proof that the hash is in the Merkle tree
+	Proof crypto.Proof
+	// Signature on the message returned by StampMessage
+	Signature *cosi.CollectiveSignature
+}
+
+// StampError is sent instead of a StampReply if the epoch couldn't be
+// signed.
+type StampError struct {
+	Error string
+}
@@ -0,0 +1,89 @@
+package timestamp
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/dedis/cothority/lib/dbg"
+	"github.com/dedis/cothority/lib/monitor"
+	"github.com/dedis/cothority/lib/sda"
+)
+
+func init() {
+	sda.SimulationRegister("TimestampSimulation", NewTimestampSimulation)
+}
+
+// TimestampSimulation runs a timestamp server on the root. In every round,
+// Clients clients send a hash over the network and verify their timestamp.
+type TimestampSimulation struct {
+	sda.SimulationBFTree
+	// Epoch is the time between two signed epochs in milliseconds
+	Epoch int
+	// Clients is the number of clients per round
+	Clients int
+}
+
+// NewTimestampSimulation returns the simulation configured by config
+func NewTimestampSimulation(config string) (sda.Simulation, error) {
+	ts := new(TimestampSimulation)
+	_, err := toml.Decode(config, ts)
+	if err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// Setup implements sda.Simulation
+func (ts *TimestampSimulation) Setup(dir string, hosts []string) (*sda.SimulationConfig, error) {
+	sim := new(sda.SimulationConfig)
+	ts.CreateEntityList(sim, hosts, 2000)
+	err := ts.CreateTree(sim)
+	return sim, err
+}
+
+// Run implements sda.Simulation
+func (ts *TimestampSimulation) Run(config *sda.SimulationConfig) error {
+	suite := config.Host.Suite()
+	epoch := time.Duration(ts.Epoch) * time.Millisecond
+	if epoch == 0 {
+		epoch = time.Second
+	}
+	clients := ts.Clients
+	if clients == 0 {
+		clients = 1
+	}
+	dbg.Lvl1("Simulation starting with: Size=", len(config.EntityList.List), ", Rounds=", ts.Rounds,
+		", Epoch=", epoch, ", Clients=", clients)
+	server := NewServer(config.Host, config.Tree, epoch)
+	defer server.Close()
+	client := NewClient(suite)
+	for round := 0; round < ts.Rounds; round++ {
+		dbg.Lvl1("Starting round", round)
+		roundM := monitor.NewMeasure("round")
+		var wg sync.WaitGroup
+		for c := 0; c < clients; c++ {
+			wg.Add(1)
+			go func(c int) {
+				defer wg.Done()
+				h := suite.Hash()
+				h.Write([]byte("Document " + strconv.Itoa(round) + "-" + strconv.Itoa(c)))
+				hash := h.Sum(nil)
+				reply, err := client.Stamp(config.Host.Entity, hash)
+				if err != nil {
+					dbg.Lvl1("Round", round, "client", c, "failed:", err)
+					return
+				}
+				if err := reply.Verify(suite, hash, config.EntityList); err != nil {
+					dbg.Lvl1("Round", round, "client", c, " => fail verification:", err)
+				}
+			}(c)
+		}
+		wg.Wait()
+		roundM.Measure()
+		dbg.Lvl1("Round", round, "done")
+	}
+	dbg.Lvl1("Simulation finished")
+	return nil
+}
@@ -0,0 +1,237 @@
+/*
+Package timestamp is a timestamping service cosigned by witnesses. Clients
+send hashes to the root of a tree. Every epoch, the root builds the Merkle
+tree of the hashes it got and a CoSi round signs the root of the Merkle tree
+together with the time. The witnesses refuse to sign if the time is too far
+from their own clock. Every client gets back the collective signature and
+the proof that its hash is in the Merkle tree.
+*/
+package timestamp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dedis/cothority/lib/cosi"
+	"github.com/dedis/cothority/lib/crypto"
+	"github.com/dedis/cothority/lib/dbg"
+	"github.com/dedis/cothority/lib/network"
+	"github.com/dedis/cothority/lib/sda"
+	pcosi "github.com/dedis/cothority/protocols/cosi"
+	"github.com/dedis/crypto/abstract"
+)
+
+// ProtocolName is the name of the CoSi protocol signing the epochs
+const ProtocolName = "CoSiTimestamp"
+
+// MaxDrift is how far the time of an epoch may be from the clock of a
+// witness for it to sign.
+var MaxDrift = 10 * time.Second
+
+func init() {
+	sda.ProtocolRegisterName(ProtocolName, func(n *sda.Node) (sda.ProtocolInstance, error) {
+		pc, err := pcosi.NewProtocolCosi(n)
+		if err != nil {
+			return nil, err
+		}
+		pc.RegisterValidationHook(func(msg []byte) error {
+			return checkTime(msg, time.Now())
+		})
+		return pc, nil
+	})
+}
+
+// StampMessage returns the message signed for an epoch: the root of the
+// Merkle tree followed by the time in big-endian.
+func StampMessage(root []byte, t int64) []byte {
+	buf := make([]byte, len(root)+8)
+	copy(buf, root)
+	binary.BigEndian.PutUint64(buf[len(root):], uint64(t))
+	return buf
+}
+
+// checkTime returns an error if the time in msg is more than MaxDrift from
+// now.
+func checkTime(msg []byte, now time.Time) error {
+	if len(msg) < 8 {
+		return errors.New("Message too short")
+	}
+	t := int64(binary.BigEndian.Uint64(msg[len(msg)-8:]))
+	drift := now.Sub(time.Unix(t, 0))
+	if drift > MaxDrift || drift < -MaxDrift {
+		return fmt.Errorf("Time of epoch is off by %s", drift)
+	}
+	return nil
+}
+
+// Verify checks that hash has been timestamped by el, the trusted list of
+// witnesses. More than two thirds of them have to sign, see
+// cosi.Threshold.
+func (sr *StampReply) Verify(suite abstract.Suite, hash []byte, el *sda.EntityList) error {
+	if sr.Signature == nil {
+		return errors.New("Missing collective signature")
+	}
+	root := sr.Proof.Calc(suite.Hash, hash)
+	if !bytes.Equal(StampMessage(root, sr.Time), sr.Signature.Hash) {
+		return errors.New("Hash or time is not in the signed epoch")
+	}
+	publics := make([]abstract.Point, len(el.List))
+	for i, e := range el.List {
+		publics[i] = e.Public
+	}
+	return sr.Signature.VerifyRoster(suite, el.Id, publics, cosi.Threshold(len(publics)))
+}
+
+// Server collects the hashes sent by clients and timestamps them every
+// epoch. It has to run on the host of the root of the tree.
+type Server struct {
+	host  *sda.Host
+	tree  *sda.Tree
+	epoch time.Duration
+	sync.Mutex
+	queue   []*stampRequest
+	closing chan bool
+	closed  sync.WaitGroup
+}
+
+type stampRequest struct {
+	hash  []byte
+	reply func(*StampReply, error)
+}
+
+// NewServer starts a Server timestamping every epoch with the witnesses of
+// tree, and registers it with host for the requests of clients.
+func NewServer(host *sda.Host, tree *sda.Tree, epoch time.Duration) *Server {
+	s := &Server{
+		host:    host,
+		tree:    tree,
+		epoch:   epoch,
+		closing: make(chan bool),
+	}
+	host.RegisterNetworkHandler(network.TypeFromData(StampRequest{}), s.handleRequest)
+	s.closed.Add(1)
+	go s.run()
+	return s
+}
+
+// Stamp adds hash to the next epoch and returns its timestamp once the epoch
+// is signed.
+func (s *Server) Stamp(hash []byte) (*StampReply, error) {
+	type result struct {
+		reply *StampReply
+		err   error
+	}
+	done := make(chan result, 1)
+	s.add(hash, func(sr *StampReply, err error) {
+		done <- result{sr, err}
+	})
+	res := <-done
+	return res.reply, res.err
+}
+
+// Close stops the epochs. The requests of the current epoch fail.
+func (s *Server) Close() {
+	close(s.closing)
+	s.closed.Wait()
+	s.Lock()
+	defer s.Unlock()
+	for _, r := range s.queue {
+		r.reply(nil, errors.New("Server closed"))
+	}
+	s.queue = nil
+}
+
+// handleRequest queues the request of a client, which gets the answer at
+// the end of the epoch.
+func (s *Server) handleRequest(msg *network.NetworkMessage) {
+	req := msg.Msg.(StampRequest)
+	client := msg.Entity
+	s.add(req.Hash, func(sr *StampReply, err error) {
+		var reply network.ProtocolMessage = sr
+		if err != nil {
+			reply = &StampError{Error: err.Error()}
+		}
+		if err := s.host.SendRaw(client, reply); err != nil {
+			dbg.Error("Couldn't send timestamp:", err)
+		}
+	})
+}
+
+func (s *Server) add(hash []byte, reply func(*StampReply, error)) {
+	s.Lock()
+	defer s.Unlock()
+	s.queue = append(s.queue, &stampRequest{hash, reply})
+}
+
+// run signs the queued hashes every epoch
+func (s *Server) run() {
+	defer s.closed.Done()
+	ticker := time.NewTicker(s.epoch)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-ticker.C:
+		}
+		s.Lock()
+		reqs := s.queue
+		s.queue = nil
+		s.Unlock()
+		if len(reqs) == 0 {
+			continue
+		}
+		hashes := make([]crypto.HashId, len(reqs))
+		for i, r := range reqs {
+			hashes[i] = r.hash
+		}
+		t, root, proofs, cs, err := s.signEpoch(hashes)
+		for i, r := range reqs {
+			if err != nil {
+				r.reply(nil, err)
+				continue
+			}
+			r.reply(&StampReply{
+				Time:      t,
+				Proof:     proofs[i],
+				Signature: cs,
+			}, nil)
+		}
+		dbg.Lvl3("Epoch of", len(reqs), "hashes with root", root, "done:", err)
+	}
+}
+
+// signEpoch builds the Merkle tree of hashes and signs its root with the
+// current time.
+func (s *Server) signEpoch(hashes []crypto.HashId) (int64, crypto.HashId, []crypto.Proof, *cosi.CollectiveSignature, error) {
+	root, proofs := crypto.ProofTree(s.host.Suite().Hash, hashes)
+	t := time.Now().Unix()
+	node, err := s.host.CreateNewNodeName(ProtocolName, s.tree)
+	if err != nil {
+		return 0, nil, nil, nil, err
+	}
+	pc := node.ProtocolInstance().(*pcosi.ProtocolCosi)
+	type roundResult struct {
+		cs  *cosi.CollectiveSignature
+		err error
+	}
+	done := make(chan roundResult, 1)
+	pc.SigningMessage(StampMessage(root, t))
+	pc.RegisterSignatureCallback(func(*cosi.Signature, []cosi.Exception) {
+		cs, err := pc.CollectiveSignature()
+		done <- roundResult{cs, err}
+	})
+	if err := pc.Start(); err != nil {
+		return 0, nil, nil, nil, err
+	}
+	select {
+	case res := <-done:
+		return t, root, proofs, res.cs, res.err
+	case <-s.closing:
+		return 0, nil, nil, nil, errors.New("Server closed")
+	}
+}
@@ -0,0 +1,139 @@
+package timestamp
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dedis/cothority/lib/cosi"
+	"github.com/dedis/cothority/lib/dbg"
+	"github.com/dedis/cothority/lib/sda"
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/random"
+)
+
+// TestServer timestamps the hashes of clients over the network and of a
+// local caller in the same epoch.
+func TestServer(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	local := sda.NewLocalTest()
+	hosts, el, tree := local.GenBigTree(5, 5, 2, true, true)
+	defer local.CloseAll()
+	suite := hosts[0].Suite()
+	server := NewServer(hosts[0], tree, 200*time.Millisecond)
+	defer server.Close()
+
+	hashes := make([][]byte, 4)
+	replies := make([]*StampReply, len(hashes))
+	var wg sync.WaitGroup
+	for i := range hashes {
+		h := suite.Hash()
+		h.Write([]byte("Document " + strconv.Itoa(i)))
+		hashes[i] = h.Sum(nil)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			if i == 0 {
+				replies[i], err = server.Stamp(hashes[i])
+			} else {
+				replies[i], err = NewClient(suite).Stamp(hosts[0].Entity, hashes[i])
+			}
+			if err != nil {
+				t.Error("Stamp", i, "failed:", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, r := range replies {
+		if r == nil {
+			t.Fatal("No timestamp for", i)
+		}
+		if err := r.Verify(suite, hashes[i], el); err != nil {
+			t.Fatal("Timestamp", i, "doesn't verify:", err)
+		}
+		if r.Verify(suite, hashes[(i+1)%len(hashes)], el) == nil {
+			t.Fatal("Timestamp", i, "shouldn't verify another hash")
+		}
+		if d := time.Since(time.Unix(r.Time, 0)); d > time.Minute || d < -time.Minute {
+			t.Fatal("Wrong time of timestamp", i)
+		}
+	}
+	other := local.GenEntityListFromHost(hosts[1:]...)
+	if replies[0].Verify(suite, hashes[0], other) == nil {
+		t.Fatal("Timestamp shouldn't verify with another roster")
+	}
+}
+
+// TestForgedReply forges the signature of a timestamp without any private
+// key, putting the difference into the commitment of a missing witness. It
+// must not verify.
+func TestForgedReply(t *testing.T) {
+	defer dbg.AfterTest(t)
+	dbg.TestOutput(testing.Verbose(), 4)
+
+	local := sda.NewLocalTest()
+	_, el, _ := local.GenTree(4, false, false, false)
+	defer local.CloseAll()
+	suite := el.Suite()
+	h := suite.Hash()
+	h.Write([]byte("Forged document"))
+	hash := h.Sum(nil)
+	now := time.Now().Unix()
+	msg := StampMessage(hash, now)
+
+	publics := make([]abstract.Point, len(el.List))
+	for i, e := range el.List {
+		publics[i] = e.Public
+	}
+	response := suite.Secret().Pick(random.Stream)
+	commitment, _ := suite.Point().Pick(nil, random.Stream)
+	challenge, err := cosi.ComputeChallenge(suite, commitment, el.Aggregate, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the commitment of the first witness makes up for the missing
+	// private keys
+	subPublic := suite.Point().Sub(el.Aggregate, publics[0])
+	exCommit := suite.Point().Sub(commitment, suite.Point().Mul(nil, response))
+	exCommit.Sub(exCommit, suite.Point().Mul(subPublic, challenge))
+	sig := &cosi.Signature{Challenge: challenge, Response: response}
+	exceptions := []cosi.Exception{{Public: publics[0], Commitment: exCommit}}
+	if _, err := cosi.NewCollectiveSignature(suite, msg, el.Id, publics, sig, exceptions); err == nil {
+		t.Fatal("Exception with a commitment should be refused")
+	}
+
+	exceptions[0].Commitment = suite.Point().Null()
+	cs, err := cosi.NewCollectiveSignature(suite, msg, el.Id, publics, sig, exceptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := &StampReply{Time: now, Signature: cs}
+	if reply.Verify(suite, hash, el) == nil {
+		t.Fatal("Forged timestamp shouldn't verify")
+	}
+}
+
+// TestCheckTime checks that witnesses refuse times too far from their clock
+func TestCheckTime(t *testing.T) {
+	now := time.Now()
+	root := []byte("root")
+	for _, test := range []struct {
+		drift time.Duration
+		ok    bool
+	}{
+		{0, true},
+		{MaxDrift / 2, true},
+		{-MaxDrift / 2, true},
+		{2 * MaxDrift, false},
+		{-2 * MaxDrift, false},
+	} {
+		msg := StampMessage(root, now.Add(test.drift).Unix())
+		if err := checkTime(msg, now); (err == nil) != test.ok {
+			t.Fatal("Drift", test.drift, "gave", err)
+		}
+	}
+}
@@ -72,7 +72,7 @@ func main() {
 			dbg.Fatal(err)
 		}
 		sims[i] = sim
-		if host.Entity.Id == sc.Tree.Root.Entity.Id {
+		if host.Entity.Id.Equal(sc.Tree.Root.Entity.Id) {
 			dbg.Lvl2(hostAddress, "is root-node, will start protocol")
 			rootSim = sim
 			rootSC = sc